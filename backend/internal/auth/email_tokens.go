@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	EmailVerificationTTL = 48 * time.Hour
+	PasswordResetTTL     = time.Hour
+)
+
+var ErrInvalidEmailToken = errors.New("invalid or expired token")
+
+// IssueEmailToken creates a single-use token for purpose sent to the user's
+// current email address. Unused tokens issued earlier for the same purpose
+// stop working.
+func IssueEmailToken(db *gorm.DB, user *models.User, purpose models.EmailTokenPurpose, ttl time.Duration) (string, error) {
+	rawToken, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&models.EmailToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).
+			Update("used_at", &now).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&models.EmailToken{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			Email:     user.Email,
+			TokenHash: hashToken(rawToken),
+			ExpiresAt: now.Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return rawToken, nil
+}
+
+// ConsumeEmailToken uses up a token issued for purpose and returns it. It must
+// run inside the transaction that acts on the token, so the token is only
+// spent if the action succeeds.
+func ConsumeEmailToken(tx *gorm.DB, rawToken string, purpose models.EmailTokenPurpose) (*models.EmailToken, error) {
+	var token models.EmailToken
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token_hash = ? AND purpose = ?", hashToken(rawToken), purpose).
+		First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidEmailToken
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.UsedAt != nil || !token.ExpiresAt.After(now) {
+		return nil, ErrInvalidEmailToken
+	}
+
+	if err := tx.Model(&token).Update("used_at", &now).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// consume uses up rawToken in its own transaction
+func consume(db *gorm.DB, rawToken string, purpose models.EmailTokenPurpose) (*models.EmailToken, error) {
+	var token *models.EmailToken
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		token, err = ConsumeEmailToken(tx, rawToken, purpose)
+		return err
+	})
+	return token, err
+}
+
+func TestConsumeEmailToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		purpose models.EmailTokenPurpose // Purpose presented, issued for verify_email
+		want    error
+	}{
+		{name: "valid", ttl: time.Hour, purpose: models.EmailTokenVerifyEmail},
+		{name: "expired", ttl: -time.Second, purpose: models.EmailTokenVerifyEmail, want: ErrInvalidEmailToken},
+		{name: "issued for another purpose", ttl: time.Hour, purpose: models.EmailTokenResetPassword, want: ErrInvalidEmailToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t, &models.EmailToken{})
+			user := &models.User{ID: 1, Email: "reader@example.com"}
+
+			rawToken, err := IssueEmailToken(db, user, models.EmailTokenVerifyEmail, tt.ttl)
+			if err != nil {
+				t.Fatalf("IssueEmailToken: %v", err)
+			}
+
+			token, err := consume(db, rawToken, tt.purpose)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if token.UserID != 1 || token.Email != "reader@example.com" {
+				t.Errorf("got token for user %d at %s", token.UserID, token.Email)
+			}
+		})
+	}
+}
+
+func TestEmailTokensAreSingleUse(t *testing.T) {
+	db := dbtest.Open(t, &models.EmailToken{})
+	user := &models.User{ID: 1, Email: "reader@example.com"}
+
+	rawToken, err := IssueEmailToken(db, user, models.EmailTokenResetPassword, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueEmailToken: %v", err)
+	}
+
+	// A token spent in a transaction that fails stays usable
+	failed := errors.New("action failed")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := ConsumeEmailToken(tx, rawToken, models.EmailTokenResetPassword); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got error %v, want %v", err, failed)
+	}
+
+	if _, err := consume(db, rawToken, models.EmailTokenResetPassword); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := consume(db, rawToken, models.EmailTokenResetPassword); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Fatalf("second use: got error %v, want %v", err, ErrInvalidEmailToken)
+	}
+	if _, err := consume(db, "not-a-token", models.EmailTokenResetPassword); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Fatalf("unknown token: got error %v, want %v", err, ErrInvalidEmailToken)
+	}
+}
+
+func TestIssueEmailTokenReplacesEarlierTokens(t *testing.T) {
+	db := dbtest.Open(t, &models.EmailToken{})
+	user := &models.User{ID: 1, Email: "reader@example.com"}
+
+	first, err := IssueEmailToken(db, user, models.EmailTokenResetPassword, time.Hour)
+	if err != nil {
+		t.Fatalf("first IssueEmailToken: %v", err)
+	}
+	verify, err := IssueEmailToken(db, user, models.EmailTokenVerifyEmail, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueEmailToken for verification: %v", err)
+	}
+	second, err := IssueEmailToken(db, user, models.EmailTokenResetPassword, time.Hour)
+	if err != nil {
+		t.Fatalf("second IssueEmailToken: %v", err)
+	}
+
+	if _, err := consume(db, first, models.EmailTokenResetPassword); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Errorf("earlier token: got error %v, want %v", err, ErrInvalidEmailToken)
+	}
+	if _, err := consume(db, second, models.EmailTokenResetPassword); err != nil {
+		t.Errorf("latest token: %v", err)
+	}
+	// Tokens for other purposes are left alone
+	if _, err := consume(db, verify, models.EmailTokenVerifyEmail); err != nil {
+		t.Errorf("verification token: %v", err)
+	}
+
+	var stored models.EmailToken
+	db.Where("purpose = ?", models.EmailTokenVerifyEmail).First(&stored)
+	if stored.TokenHash == verify {
+		t.Error("the raw token is stored")
+	}
+}
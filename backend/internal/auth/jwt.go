@@ -13,11 +13,19 @@ import (
 
 var jwtSecret []byte
 
+// AccessTokenTTL is how long an access token is valid. Access tokens are
+// short-lived; clients get new ones from their refresh token.
+const AccessTokenTTL = 15 * time.Minute
+
 // Claims represents the JWT claims
 type Claims struct {
-	UserID   uint           `json:"user_id"`
-	Username string         `json:"username"`
-	Role     models.UserRole `json:"role"`
+	UserID       uint            `json:"user_id"`
+	Username     string          `json:"username"`
+	Role         models.UserRole `json:"role"`
+	SessionID    uint            `json:"sid"`
+	TokenVersion int             `json:"ver"`           // Must match the user's TokenVersion
+	MFA          bool            `json:"mfa,omitempty"` // Session signed in with a second factor
+	Purpose      string          `json:"typ,omitempty"` // Empty for access tokens
 	jwt.RegisteredClaims
 }
 
@@ -31,14 +39,17 @@ func InitJWT() error {
 	return nil
 }
 
-// GenerateToken creates a new JWT token for a user
-func GenerateToken(user *models.User) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // 24 hours
+// GenerateToken creates a new access token for a user's session
+func GenerateToken(user *models.User, sessionID uint, mfa bool) (string, error) {
+	expirationTime := time.Now().Add(AccessTokenTTL)
 
 	claims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Role:     user.Role,
+		UserID:       user.ID,
+		Username:     user.Username,
+		Role:         user.Role,
+		SessionID:    sessionID,
+		TokenVersion: user.TokenVersion,
+		MFA:          mfa,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -65,7 +76,9 @@ func ValidateToken(tokenString string) (*Claims, error) {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	// Tokens issued for another purpose, such as MFA challenges, are not
+	// access tokens
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.Purpose == "" {
 		return claims, nil
 	}
 
@@ -83,19 +96,3 @@ func CheckPassword(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
-
-// RefreshToken creates a new token with extended expiration
-func RefreshToken(tokenString string) (string, error) {
-	claims, err := ValidateToken(tokenString)
-	if err != nil {
-		return "", err
-	}
-
-	// Create a new token with extended expiration
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims.ExpiresAt = jwt.NewNumericDate(expirationTime)
-	claims.IssuedAt = jwt.NewNumericDate(time.Now())
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
-} 
\ No newline at end of file
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"fdip/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MFAChallengeTTL is how long a user has to enter their code after the
+// password step of a two-step login
+const MFAChallengeTTL = 5 * time.Minute
+
+// RecoveryCodeCount is how many recovery codes are issued at a time
+const RecoveryCodeCount = 10
+
+const mfaChallengePurpose = "mfa"
+
+var ErrInvalidSecondFactor = errors.New("invalid two-factor code")
+
+// GenerateMFAChallenge creates the token returned after a correct password
+// when the user has two-factor authentication enabled. It cannot be used as
+// an access token.
+func GenerateMFAChallenge(user *models.User) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:       user.ID,
+		Username:     user.Username,
+		Role:         user.Role,
+		TokenVersion: user.TokenVersion,
+		Purpose:      mfaChallengePurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(MFAChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "fdip",
+			Subject:   fmt.Sprintf("%d", user.ID),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+// ValidateMFAChallenge validates a challenge token and returns its claims
+func ValidateMFAChallenge(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.Purpose == mfaChallengePurpose {
+		return claims, nil
+	}
+	return nil, errors.New("invalid challenge token")
+}
+
+// VerifySecondFactor checks a TOTP code or, failing that, an unused recovery
+// code for a user with two-factor authentication enabled. Accepted TOTP codes
+// and recovery codes cannot be used again.
+func VerifySecondFactor(db *gorm.DB, userID uint, code string) error {
+	code = strings.TrimSpace(code)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+		if user.TOTPSecret == nil {
+			return ErrInvalidSecondFactor
+		}
+
+		if step, ok := ValidateTOTP(*user.TOTPSecret, code, time.Now()); ok {
+			if step <= user.TOTPLastStep {
+				return ErrInvalidSecondFactor
+			}
+			return tx.Model(&user).Update("totp_last_step", step).Error
+		}
+
+		if !user.TwoFactorEnabled() {
+			return ErrInvalidSecondFactor
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(normalizeRecoveryCode(code))).
+			Update("used_at", &now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidSecondFactor
+		}
+		return nil
+	})
+}
+
+// ReplaceRecoveryCodes discards a user's recovery codes and issues new ones.
+// The plain codes are returned once and never stored.
+func ReplaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	rows := make([]models.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: hashToken(normalizeRecoveryCode(code))}
+	}
+
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns a code like "k7qm-2xwp-9dfa"
+func newRecoveryCode() (string, error) {
+	// Crockford's base32 alphabet, which leaves out the easily confused i, l,
+	// o and u
+	const alphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	for i := range b {
+		b[i] = alphabet[b[i]&31]
+	}
+	return string(b[0:4]) + "-" + string(b[4:8]) + "-" + string(b[8:12]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
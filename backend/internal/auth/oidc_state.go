@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OIDCLoginTTL is how long a user has to complete a sign-in at an external
+// provider
+const OIDCLoginTTL = 10 * time.Minute
+
+var ErrInvalidOIDCState = errors.New("invalid or expired sign-in state")
+
+// BeginOIDCLogin records a sign-in with provider and returns the state
+// parameter that identifies it, together with the stored attempt holding the
+// nonce and PKCE code verifier. linkUserID is set when a signed-in user is
+// linking the provider to their account.
+func BeginOIDCLogin(db *gorm.DB, provider string, linkUserID *uint) (string, *models.OIDCLoginState, error) {
+	rawState, err := newOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := newOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+	codeVerifier, err := newOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	login := models.OIDCLoginState{
+		StateHash:    hashToken(rawState),
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(OIDCLoginTTL),
+	}
+	if err := db.Create(&login).Error; err != nil {
+		return "", nil, err
+	}
+	return rawState, &login, nil
+}
+
+// OIDCStateBinding returns the value kept in the browser that started a
+// sign-in, so the sign-in can only be completed from that browser
+func OIDCStateBinding(rawState string) string {
+	return hashToken(rawState)
+}
+
+// ConsumeOIDCLoginState uses up the sign-in identified by a state parameter
+// and returns it. binding is the value OIDCStateBinding returned for the
+// state, as sent back by the browser completing the sign-in. A state can only
+// be used once, even if the sign-in fails afterwards.
+func ConsumeOIDCLoginState(db *gorm.DB, rawState, binding string) (*models.OIDCLoginState, error) {
+	if binding == "" || subtle.ConstantTimeCompare([]byte(binding), []byte(hashToken(rawState))) != 1 {
+		return nil, ErrInvalidOIDCState
+	}
+
+	var login models.OIDCLoginState
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("state_hash = ?", hashToken(rawState)).
+			First(&login).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidOIDCState
+			}
+			return err
+		}
+
+		now := time.Now()
+		if login.UsedAt != nil || !login.ExpiresAt.After(now) {
+			return ErrInvalidOIDCState
+		}
+		return tx.Model(&login).Update("used_at", &now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
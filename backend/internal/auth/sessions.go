@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RefreshTokenTTL is how long a session stays signed in without activity.
+// Every refresh extends it.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused means a refresh token was presented after it had
+	// already been exchanged, so it has probably been stolen. The session
+	// it belongs to is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+	ErrSessionRevoked     = errors.New("session has been revoked")
+)
+
+// TokenPair is what a client receives when signing in or refreshing
+type TokenPair struct {
+	AccessToken      string    `json:"token"`
+	RefreshToken     string    `json:"refresh_token"`
+	ExpiresIn        int       `json:"expires_in"` // Seconds until the access token expires
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+	SessionID        uint      `json:"session_id"`
+}
+
+// StartSession signs a user in on a new device. mfa records whether the user
+// passed a second factor.
+func StartSession(db *gorm.DB, user *models.User, userAgent, ipAddress string, mfa bool) (*TokenPair, error) {
+	var pair *TokenPair
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		session := models.Session{
+			UserID:      user.ID,
+			UserAgent:   truncate(userAgent, 255),
+			IPAddress:   ipAddress,
+			MFAVerified: mfa,
+			ExpiresAt:   now.Add(RefreshTokenTTL),
+			LastUsedAt:  now,
+		}
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+
+		var err error
+		pair, err = issueTokens(tx, user, &session)
+		return err
+	})
+	return pair, err
+}
+
+// Refresh exchanges a refresh token for a new token pair. The presented token
+// is used up; presenting it again revokes the session.
+func Refresh(db *gorm.DB, rawToken string) (*TokenPair, error) {
+	var pair *TokenPair
+	var reused bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var token models.RefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashToken(rawToken)).
+			First(&token).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return err
+		}
+
+		var session models.Session
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&session, token.SessionID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if token.UsedAt != nil {
+			reused = true
+			return revokeSession(tx, &session, "refresh token reused")
+		}
+		if !session.IsActive(now) || !token.ExpiresAt.After(now) {
+			return ErrInvalidRefreshToken
+		}
+
+		if err := tx.Model(&token).Update("used_at", &now).Error; err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.First(&user, session.UserID).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&session).Updates(map[string]interface{}{
+			"last_used_at": now,
+			"expires_at":   now.Add(RefreshTokenTTL),
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		pair, err = issueTokens(tx, &user, &session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, ErrRefreshTokenReused
+	}
+	return pair, nil
+}
+
+// EndSession revokes a single session, signing that device out
+func EndSession(db *gorm.DB, userID, sessionID uint, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var session models.Session
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ?", sessionID, userID).
+			First(&session).Error; err != nil {
+			return err
+		}
+		return revokeSession(tx, &session, reason)
+	})
+}
+
+// EndAllSessions revokes every session of a user and invalidates all of
+// their access tokens
+func EndAllSessions(db *gorm.DB, userID uint, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&models.Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Updates(map[string]interface{}{
+				"revoked_at":     &now,
+				"revoked_reason": reason,
+			}).Error; err != nil {
+			return err
+		}
+		return InvalidateAccessTokens(tx, userID)
+	})
+}
+
+// EndOtherSessions revokes every session of a user except keepSessionID and
+// invalidates all of their access tokens, e.g. after a security setting
+// changed. The kept session stays signed in but needs a new access token.
+func EndOtherSessions(db *gorm.DB, userID, keepSessionID uint, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&models.Session{}).
+			Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepSessionID).
+			Updates(map[string]interface{}{
+				"revoked_at":     &now,
+				"revoked_reason": reason,
+			}).Error; err != nil {
+			return err
+		}
+		return InvalidateAccessTokens(tx, userID)
+	})
+}
+
+// InvalidateAccessTokens makes every access token issued to a user so far
+// invalid, e.g. after their role changed. Sessions stay signed in and pick up
+// the change on their next refresh.
+func InvalidateAccessTokens(db *gorm.DB, userID uint) error {
+	return db.Model(&models.User{}).
+		Where("id = ?", userID).
+		Update("token_version", gorm.Expr("token_version + 1")).Error
+}
+
+// CheckSession returns ErrSessionRevoked unless the session is active
+func CheckSession(db *gorm.DB, sessionID uint) error {
+	var session models.Session
+	if err := db.First(&session, sessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionRevoked
+		}
+		return err
+	}
+	if !session.IsActive(time.Now()) {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// issueTokens creates a refresh token in the session and an access token
+// bound to it
+func issueTokens(tx *gorm.DB, user *models.User, session *models.Session) (*TokenPair, error) {
+	rawToken, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(RefreshTokenTTL)
+	if err := tx.Create(&models.RefreshToken{
+		SessionID: session.ID,
+		TokenHash: hashToken(rawToken),
+		ExpiresAt: expiresAt,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	accessToken, err := GenerateToken(user, session.ID, session.MFAVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     rawToken,
+		ExpiresIn:        int(AccessTokenTTL.Seconds()),
+		RefreshExpiresAt: expiresAt,
+		SessionID:        session.ID,
+	}, nil
+}
+
+func revokeSession(tx *gorm.DB, session *models.Session, reason string) error {
+	if session.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	return tx.Model(session).Updates(map[string]interface{}{
+		"revoked_at":     &now,
+		"revoked_reason": reason,
+	}).Error
+}
+
+// newOpaqueToken returns a random URL-safe token
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(rawToken string) string {
+	sum := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
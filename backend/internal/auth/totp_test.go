@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+)
+
+// rfcSecret is the RFC 6238 SHA1 test key "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC 6238 test vectors, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := TOTPCode(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("TOTPCode: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("at %d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		ok     bool
+	}{
+		{name: "current step", ok: true},
+		{name: "previous step", offset: -totpPeriod * time.Second, ok: true},
+		{name: "next step", offset: totpPeriod * time.Second, ok: true},
+		{name: "two steps ago", offset: -2 * totpPeriod * time.Second},
+		{name: "two steps ahead", offset: 2 * totpPeriod * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codeTime := now.Add(tt.offset)
+			code, err := TOTPCode(rfcSecret, codeTime)
+			if err != nil {
+				t.Fatalf("TOTPCode: %v", err)
+			}
+
+			got, ok := ValidateTOTP(rfcSecret, code, now)
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+			if ok && got != step+int64(tt.offset/(totpPeriod*time.Second)) {
+				t.Errorf("got step %d, want the step of the code", got)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPRejectsMalformedInput(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	tests := []struct {
+		name, secret, code string
+	}{
+		{name: "wrong code", secret: rfcSecret, code: "000000"},
+		{name: "too short", secret: rfcSecret, code: "05924"},
+		{name: "too long", secret: rfcSecret, code: "0005924"},
+		{name: "invalid secret", secret: "not base32!", code: "005924"},
+	}
+
+	for _, tt := range tests {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, now); ok {
+			t.Errorf("%s: accepted %q", tt.name, tt.code)
+		}
+	}
+}
+
+func TestVerifySecondFactorRejectsReplay(t *testing.T) {
+	db := dbtest.Open(t, &models.User{}, &models.RecoveryCode{})
+
+	secret := rfcSecret
+	enabledAt := time.Now()
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x", TOTPSecret: &secret, TOTPEnabledAt: &enabledAt}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	code, err := TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("TOTPCode: %v", err)
+	}
+	if err := VerifySecondFactor(db, user.ID, code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := VerifySecondFactor(db, user.ID, code); !errors.Is(err, ErrInvalidSecondFactor) {
+		t.Fatalf("replay: got error %v, want %v", err, ErrInvalidSecondFactor)
+	}
+
+	// Nor is a code from an earlier step inside the skew window accepted
+	earlier, err := TOTPCode(secret, time.Now().Add(-totpPeriod*time.Second))
+	if err != nil {
+		t.Fatalf("TOTPCode: %v", err)
+	}
+	if err := VerifySecondFactor(db, user.ID, earlier); !errors.Is(err, ErrInvalidSecondFactor) {
+		t.Fatalf("earlier step: got error %v, want %v", err, ErrInvalidSecondFactor)
+	}
+}
+
+func TestVerifySecondFactorRecoveryCodes(t *testing.T) {
+	db := dbtest.Open(t, &models.User{}, &models.RecoveryCode{})
+
+	secret := rfcSecret
+	enabledAt := time.Now()
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x", TOTPSecret: &secret, TOTPEnabledAt: &enabledAt}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	codes, err := ReplaceRecoveryCodes(db, user.ID)
+	if err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), RecoveryCodeCount)
+	}
+
+	// Recovery codes are accepted without dashes and in upper case, once
+	if err := VerifySecondFactor(db, user.ID, " "+codes[0]+" "); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := VerifySecondFactor(db, user.ID, codes[0]); !errors.Is(err, ErrInvalidSecondFactor) {
+		t.Fatalf("reuse: got error %v, want %v", err, ErrInvalidSecondFactor)
+	}
+	if err := VerifySecondFactor(db, user.ID, strings.ToUpper(normalizeRecoveryCode(codes[1]))); err != nil {
+		t.Fatalf("normalized code: %v", err)
+	}
+}
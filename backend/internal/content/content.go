@@ -0,0 +1,221 @@
+// Package content turns the Markdown or HTML authors write into the
+// sanitized HTML readers are served, and derives the plain text, word count
+// and reading time from it.
+package content
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Version identifies the rendering pipeline. Bump it when the output
+// changes so stored renders are refreshed.
+const Version = 1
+
+// WordsPerMinute is the reading speed used for reading times
+const WordsPerMinute = 238
+
+type Format string
+
+const (
+	Markdown Format = "markdown"
+	HTML     Format = "html"
+)
+
+// Rendered is content ready to serve
+type Rendered struct {
+	HTML           string
+	Text           string
+	WordCount      int
+	ReadingMinutes int
+}
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Footnote),
+	// Raw HTML is kept so the sanitizer, not the parser, decides what stays
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+var policy = newPolicy()
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.RequireNoFollowOnLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	// Footnotes
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(footnotes|footnote-ref|footnote-backref)$`)).Globally()
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-(endnotes|noteref|backlink)$`)).Globally()
+	return p
+}
+
+// Render parses raw in the given format and returns the sanitized HTML with
+// its text statistics. Unknown formats are treated as HTML.
+func Render(raw string, format Format) (*Rendered, error) {
+	source := raw
+	if format == Markdown {
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(raw), &buf); err != nil {
+			return nil, err
+		}
+		source = buf.String()
+	}
+
+	safe := policy.Sanitize(source)
+	text := PlainText(safe)
+	words := CountWords(text)
+	return &Rendered{
+		HTML:           safe,
+		Text:           text,
+		WordCount:      words,
+		ReadingMinutes: ReadingMinutes(words),
+	}, nil
+}
+
+// blockElements end a run of text when they open or close
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "figcaption": true, "figure": true,
+	"footer": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// PlainText returns the text of an HTML fragment with block elements on
+// lines of their own. Footnote markers and back-links are left out.
+func PlainText(fragment string) string {
+	var b strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(fragment))
+	skip := 0
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return strings.TrimSpace(collapseBlankLines(b.String()))
+		case xhtml.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			if tag == "a" && hasAttr && isFootnoteLink(z) {
+				skip++
+			} else if skip > 0 && tag == "a" {
+				skip++
+			}
+			if blockElements[tag] {
+				b.WriteString("\n")
+			}
+		case xhtml.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if tag == "a" && skip > 0 {
+				skip--
+			}
+			if blockElements[tag] {
+				b.WriteString("\n")
+			}
+		}
+	}
+}
+
+func isFootnoteLink(z *xhtml.Tokenizer) bool {
+	for {
+		key, val, more := z.TagAttr()
+		if string(key) == "class" && (string(val) == "footnote-ref" || string(val) == "footnote-backref") {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+var blankLines = regexp.MustCompile(`[ \t]*\n[ \t\n]*\n`)
+
+func collapseBlankLines(s string) string {
+	return blankLines.ReplaceAllString(s, "\n\n")
+}
+
+// CountWords counts the words in text. A word is a run of letters, digits,
+// apostrophes or hyphens containing at least one letter or digit; each Han,
+// Hiragana or Katakana character counts as a word of its own.
+func CountWords(text string) int {
+	count := 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+			count++
+			inWord = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			if !inWord {
+				count++
+				inWord = true
+			}
+		case inWord && (r == '\'' || r == '’' || r == '-'):
+			// Joins contractions and hyphenated words
+		default:
+			inWord = false
+		}
+	}
+	return count
+}
+
+// ReadingMinutes estimates how long words take to read, rounded up to whole
+// minutes
+func ReadingMinutes(words int) int {
+	if words == 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(words) / WordsPerMinute))
+}
+
+// Teaser returns the opening of an HTML fragment: whole top-level blocks up
+// to about words words. A first block longer than that is cut to plain
+// text, so a chapter written as one long paragraph is not given away.
+func Teaser(fragment string, words int) string {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(fragment), &xhtml.Node{
+		Type:     xhtml.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	used := 0
+	for _, node := range nodes {
+		var block bytes.Buffer
+		if err := xhtml.Render(&block, node); err != nil {
+			return b.String()
+		}
+		text := PlainText(block.String())
+		n := CountWords(text)
+		if used+n <= words {
+			b.Write(block.Bytes())
+			used += n
+			continue
+		}
+		if used == 0 {
+			fields := strings.Fields(text)
+			if len(fields) > words {
+				fields = fields[:words]
+			}
+			b.WriteString("<p>" + xhtml.EscapeString(strings.Join(fields, " ")) + "…</p>")
+		}
+		break
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package content
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderSanitizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		format  Format
+		want    string
+		without []string
+	}{
+		{name: "script", raw: `<p>Hi</p><script>alert(1)</script>`, format: HTML, want: "<p>Hi</p>", without: []string{"script", "alert"}},
+		{name: "script in Markdown", raw: "<script>alert(1)</script>\n\nText", format: Markdown, want: "<p>Text</p>", without: []string{"script", "alert"}},
+		{name: "javascript: link", raw: `<a href="javascript:alert(1)">x</a>`, format: HTML, want: "x", without: []string{"href", "javascript"}},
+		{name: "javascript: link in mixed case", raw: `<a href="JaVaScRiPt:alert(1)">x</a>`, format: HTML, want: "x", without: []string{"href", "alert"}},
+		{name: "javascript: link with an entity", raw: `<a href="java&#x09;script:alert(1)">x</a>`, format: HTML, want: "x", without: []string{"href", "alert"}},
+		{name: "javascript: link in Markdown", raw: "[x](javascript:alert(1))", format: Markdown, want: "<p>x</p>", without: []string{"href", "javascript"}},
+		{name: "event handler", raw: `<img src="x" onerror="alert(1)">`, format: HTML, want: `<img src="x">`, without: []string{"onerror"}},
+		{name: "inline style", raw: `<p style="color:red" onclick="x()">t</p>`, format: HTML, want: "<p>t</p>", without: []string{"style", "onclick"}},
+		{name: "iframe", raw: `<iframe src="https://evil.example"></iframe><p>ok</p>`, format: HTML, want: "<p>ok</p>", without: []string{"iframe"}},
+		{name: "data: URL", raw: `<img src="data:text/html;base64,PHNjcmlwdD4=">`, format: HTML, without: []string{"data:"}},
+		{name: "external link", raw: `<a href="https://example.com">x</a>`, format: HTML, want: `<a href="https://example.com" rel="nofollow noreferrer noopener" target="_blank">x</a>`},
+		{name: "relative link", raw: `<a href="/books/1">x</a>`, format: HTML, want: `<a href="/books/1" rel="nofollow noreferrer">x</a>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := Render(tt.raw, tt.format)
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			got := strings.TrimSpace(rendered.HTML)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for _, s := range tt.without {
+				if strings.Contains(strings.ToLower(got), s) {
+					t.Errorf("%q still contains %q", got, s)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderKeepsFootnotes(t *testing.T) {
+	rendered, err := Render("Hello[^1]\n\n[^1]: Note", Markdown)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+
+	for _, s := range []string{`class="footnote-ref"`, `class="footnotes"`, `role="doc-backlink"`} {
+		if !strings.Contains(rendered.HTML, s) {
+			t.Errorf("footnote markup %q was removed from %q", s, rendered.HTML)
+		}
+	}
+	// The markers are not part of the text
+	if rendered.Text != "Hello\n\nNote" || rendered.WordCount != 2 {
+		t.Errorf("got text %q of %d words, want %q of 2", rendered.Text, rendered.WordCount, "Hello\n\nNote")
+	}
+}
+
+func TestCountWords(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: "  one   two\nthree ", want: 3},
+		{text: "don't stop", want: 2},
+		{text: "don’t stop", want: 2},
+		{text: "well-known fact", want: 2},
+		{text: "- a list -- of -- items", want: 4},
+		{text: "route 66", want: 2},
+		{text: "café naïve", want: 2},
+		{text: "日本語です", want: 5},
+		{text: "...", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := CountWords(tt.text); got != tt.want {
+			t.Errorf("%q: got %d words, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestReadingMinutes(t *testing.T) {
+	tests := []struct {
+		words int
+		want  int
+	}{
+		{words: 0, want: 0},
+		{words: 1, want: 1},
+		{words: WordsPerMinute, want: 1},
+		{words: WordsPerMinute + 1, want: 2},
+	}
+
+	for _, tt := range tests {
+		if got := ReadingMinutes(tt.words); got != tt.want {
+			t.Errorf("%d words: got %d minutes, want %d", tt.words, got, tt.want)
+		}
+	}
+}
+
+func TestTeaser(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment string
+		words    int
+		want     string
+	}{
+		{name: "whole blocks", fragment: "<p>one two</p><p>three four five</p>", words: 3, want: "<p>one two</p>"},
+		{name: "everything", fragment: "<p>one two</p><p>three four five</p>", words: 5, want: "<p>one two</p><p>three four five</p>"},
+		{name: "long first block", fragment: "<p>one <em>two</em> three four</p><p>five</p>", words: 2, want: "<p>one two…</p>"},
+		{name: "escaped text", fragment: "<p>a &lt;b&gt; c d</p>", words: 2, want: "<p>a &lt;b&gt;…</p>"},
+	}
+
+	for _, tt := range tests {
+		if got := Teaser(tt.fragment, tt.words); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -79,15 +79,75 @@ func Connect(config *Config) error {
 
 // AutoMigrate runs database migrations
 func AutoMigrate() error {
-	return DB.AutoMigrate(
+	// Accounts created before email verification existed are trusted as
+	// they are, so they keep access to the flows that now require it
+	grandfatherEmails := DB.Migrator().HasTable(&models.User{}) &&
+		!DB.Migrator().HasColumn(&models.User{}, "EmailVerifiedAt")
+
+	if err := DB.AutoMigrate(
 		&models.User{},
 		&models.Book{},
 		&models.Chapter{},
 		&models.ChapterVersion{},
+		&models.ChapterDraft{},
 		&models.TokenTransaction{},
 		&models.UserTokenBalance{},
 		&models.UserFollow{},
-	)
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.Posting{},
+		&models.TokenBucket{},
+		&models.WebhookEvent{},
+		&models.PaymentDispute{},
+		&models.RiskAssessment{},
+		&models.CashoutReview{},
+		&models.PayoutRuleSet{},
+		&models.PayoutTier{},
+		&models.PayoutRateOverride{},
+		&models.Session{},
+		&models.RefreshToken{},
+		&models.EmailToken{},
+		&models.RecoveryCode{},
+		&models.UserIdentity{},
+		&models.OIDCLoginState{},
+		&models.Role{},
+		&models.RolePermission{},
+		&models.PermissionSeed{},
+		&models.PermissionAudit{},
+		&models.BookMember{},
+		&models.BookInvitation{},
+		&models.JobLease{},
+		&models.BookExport{},
+		&models.ManuscriptImport{},
+		&models.Media{},
+		&models.ChapterUnlock{},
+		&models.SubscriptionTier{},
+		&models.Subscription{},
+		&models.TokenBundle{},
+		&models.Promotion{},
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+	); err != nil {
+		return err
+	}
+
+	// Subscriptions that predate keeping their own price renew at what
+	// their tier costs now
+	tierPrice := DB.Model(&models.SubscriptionTier{}).Select("price_tokens").Where("subscription_tiers.id = subscriptions.tier_id")
+	if err := DB.Model(&models.Subscription{}).Where("price_tokens = 0").Update("price_tokens", tierPrice).Error; err != nil {
+		return err
+	}
+
+	if grandfatherEmails {
+		if err := DB.Model(&models.User{}).Where("email_verified_at IS NULL").
+			Update("email_verified_at", gorm.Expr("created_at")).Error; err != nil {
+			return err
+		}
+	}
+
+	// AutoMigrate leaves existing ENUM columns alone, so widen the ones that
+	// have gained values
+	return DB.Migrator().AlterColumn(&models.TokenTransaction{}, "TransactionType")
 }
 
 // CreateIndexes creates additional indexes for performance
@@ -106,12 +166,14 @@ func SeedData() error {
 	
 	if adminCount == 0 {
 		// Create default admin user
+		now := time.Now()
 		adminUser := models.User{
 			Username:     "admin",
 			Email:        "admin@fdip.com",
 			PasswordHash: "$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi", // admin123
 			Role:         models.RoleAdmin,
 			DisplayName:  "System Administrator",
+			EmailVerifiedAt: &now,
 		}
 		
 		if err := DB.Create(&adminUser).Error; err != nil {
@@ -0,0 +1,62 @@
+// Package dbtest opens in-memory SQLite databases for tests. MySQL ENUM
+// columns are stored as text, as SQLite has no ENUM type.
+package dbtest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// Open returns an in-memory SQLite database holding tables, closed when the
+// test ends
+func Open(t testing.TB, tables ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		Logger:                                   logger.Default.LogMode(logger.Silent),
+		DisableForeignKeyConstraintWhenMigrating: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql.DB: %v", err)
+	}
+	// Every connection to :memory: is its own database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	for _, table := range tables {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(table); err != nil {
+			t.Fatalf("failed to parse %T: %v", table, err)
+		}
+		dropEnums(stmt.Schema, map[*schema.Schema]bool{})
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return db
+}
+
+// dropEnums turns the ENUM columns of s and the models it refers to into text
+func dropEnums(s *schema.Schema, seen map[*schema.Schema]bool) {
+	if seen[s] {
+		return
+	}
+	seen[s] = true
+	for _, field := range s.Fields {
+		if strings.HasPrefix(strings.ToUpper(string(field.DataType)), "ENUM") {
+			field.DataType = "text"
+		}
+	}
+	for _, rel := range s.Relationships.Relations {
+		dropEnums(rel.FieldSchema, seen)
+	}
+}
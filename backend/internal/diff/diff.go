@@ -0,0 +1,185 @@
+// Package diff compares two texts line by line or word by word using the
+// Myers algorithm.
+package diff
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxEdits bounds the work done on texts that share little. Past it the
+// whole of one text is reported as replaced by the other.
+const maxEdits = 2000
+
+type OpType string
+
+const (
+	Equal  OpType = "equal"
+	Insert OpType = "insert"
+	Delete OpType = "delete"
+)
+
+// Op is a run of text that is unchanged, inserted or deleted. Joining the
+// equal and deleted runs gives the old text; joining the equal and inserted
+// runs gives the new one.
+type Op struct {
+	Type OpType `json:"type"`
+	Text string `json:"text"`
+}
+
+// Lines compares a and b line by line
+func Lines(a, b string) []Op {
+	return compare(splitLines(a), splitLines(b))
+}
+
+// Words compares a and b word by word. Runs of whitespace are compared as
+// words of their own.
+func Words(a, b string) []Op {
+	return compare(splitWords(a), splitWords(b))
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func splitWords(s string) []string {
+	var tokens []string
+	start, space := 0, false
+	for i, r := range s {
+		if i > start && unicode.IsSpace(r) != space {
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+func compare(a, b []string) []Op {
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []Op
+	ops = appendRun(ops, Equal, a[:prefix])
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	ops = appendRun(ops, Equal, a[len(a)-suffix:])
+	return merge(ops)
+}
+
+// myers returns the shortest edit script turning a into b, one op per token
+func myers(a, b []string) []Op {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return appendRun(appendRun(nil, Delete, a), Insert, b)
+	}
+
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] holds v[-d..d] as it stood before step d
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxEdits {
+			return appendRun(appendRun(nil, Delete, a), Insert, b)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(a, b []string, trace [][]int) []Op {
+	var ops []Op
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, Op{Equal, a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, Op{Insert, b[y-1]})
+		} else {
+			ops = append(ops, Op{Delete, a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, Op{Equal, a[x-1]})
+		x--
+		y--
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func appendRun(ops []Op, t OpType, tokens []string) []Op {
+	for _, token := range tokens {
+		ops = append(ops, Op{t, token})
+	}
+	return ops
+}
+
+// merge joins neighbouring ops of the same type
+func merge(ops []Op) []Op {
+	merged := []Op{}
+	for i := 0; i < len(ops); {
+		j := i + 1
+		for j < len(ops) && ops[j].Type == ops[i].Type {
+			j++
+		}
+
+		var text strings.Builder
+		for _, op := range ops[i:j] {
+			text.WriteString(op.Text)
+		}
+		merged = append(merged, Op{ops[i].Type, text.String()})
+		i = j
+	}
+	return merged
+}
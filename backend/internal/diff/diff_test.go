@@ -0,0 +1,120 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Op
+	}{
+		{name: "identical", a: "a\nb\n", b: "a\nb\n", want: []Op{{Equal, "a\nb\n"}}},
+		{name: "both empty", want: []Op{}},
+		{name: "added text", b: "a\nb\n", want: []Op{{Insert, "a\nb\n"}}},
+		{name: "removed text", a: "a\nb\n", want: []Op{{Delete, "a\nb\n"}}},
+		{name: "changed line", a: "a\nb\nc\n", b: "a\nx\nc\n", want: []Op{{Equal, "a\n"}, {Delete, "b\n"}, {Insert, "x\n"}, {Equal, "c\n"}}},
+		{name: "added line", a: "a\nc\n", b: "a\nb\nc\n", want: []Op{{Equal, "a\n"}, {Insert, "b\n"}, {Equal, "c\n"}}},
+		{name: "final newline", a: "a\nb", b: "a\nb\n", want: []Op{{Equal, "a\n"}, {Delete, "b"}, {Insert, "b\n"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertOps(t, Lines(tt.a, tt.b), tt.want)
+		})
+	}
+}
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Op
+	}{
+		{name: "changed word", a: "the quick fox", b: "the slow fox", want: []Op{{Equal, "the "}, {Delete, "quick"}, {Insert, "slow"}, {Equal, " fox"}}},
+		{name: "added word", a: "the fox", b: "the red fox", want: []Op{{Equal, "the "}, {Insert, "red "}, {Equal, "fox"}}},
+		{name: "changed whitespace", a: "a b", b: "a  b", want: []Op{{Equal, "a"}, {Delete, " "}, {Insert, "  "}, {Equal, "b"}}},
+		{name: "line break", a: "one two", b: "one\ntwo", want: []Op{{Equal, "one"}, {Delete, " "}, {Insert, "\n"}, {Equal, "two"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertOps(t, Words(tt.a, tt.b), tt.want)
+		})
+	}
+}
+
+func TestOpsRebuildBothTexts(t *testing.T) {
+	pairs := []struct{ a, b string }{
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n"},
+		{"one\ntwo\nthree\n", "zero\none\nthree\nfour\n"},
+		{"x\n", "y\n"},
+		{strings.Repeat("same\n", 50) + "end\n", "start\n" + strings.Repeat("same\n", 49)},
+		{"", "only new\n"},
+	}
+
+	for _, p := range pairs {
+		for name, ops := range map[string][]Op{"Lines": Lines(p.a, p.b), "Words": Words(p.a, p.b)} {
+			var oldText, newText strings.Builder
+			for i, op := range ops {
+				if i > 0 && ops[i-1].Type == op.Type {
+					t.Errorf("%s(%q, %q): neighbouring %s ops were not merged", name, p.a, p.b, op.Type)
+				}
+				if op.Type != Insert {
+					oldText.WriteString(op.Text)
+				}
+				if op.Type != Delete {
+					newText.WriteString(op.Text)
+				}
+			}
+			if oldText.String() != p.a || newText.String() != p.b {
+				t.Errorf("%s(%q, %q): ops rebuild %q and %q", name, p.a, p.b, oldText.String(), newText.String())
+			}
+		}
+	}
+}
+
+func TestLinesFindsShortestEdit(t *testing.T) {
+	// The example from Myers' paper, which takes five edits
+	a := "a\nb\nc\na\nb\nb\na\n"
+	b := "c\nb\na\nb\na\nc\n"
+
+	edits := 0
+	for _, op := range Lines(a, b) {
+		if op.Type != Equal {
+			edits += strings.Count(op.Text, "\n")
+		}
+	}
+	if edits != 5 {
+		t.Errorf("got %d edits, want 5", edits)
+	}
+}
+
+func TestLinesGivesUpPastMaxEdits(t *testing.T) {
+	// The shortest edit keeps the shared line, but finding it takes more
+	// than maxEdits steps
+	var olds, news strings.Builder
+	for i := 0; i < maxEdits; i++ {
+		olds.WriteString("old\n")
+		news.WriteString("new\n")
+	}
+	a := "shared\n" + olds.String() + "old end\n"
+	b := news.String() + "shared\n" + "new end\n"
+
+	assertOps(t, Lines(a, b), []Op{{Delete, a}, {Insert, b}})
+}
+
+func assertOps(t *testing.T, got, want []Op) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
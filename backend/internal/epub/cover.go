@@ -0,0 +1,80 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// MaxCoverSize is the largest cover image included in a package
+const MaxCoverSize = 5 << 20
+
+var errPrivateAddress = errors.New("cover image host is not public")
+
+// coverClient fetches cover images. Cover URLs are chosen by authors, so it
+// refuses to connect to loopback, private and link-local addresses.
+var coverClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+					ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// FetchCover downloads a cover image over HTTP(S)
+func FetchCover(ctx context.Context, rawURL string) (*Image, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid cover image URL %q", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := coverClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cover image returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxCoverSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxCoverSize {
+		return nil, fmt.Errorf("cover image is larger than %d bytes", MaxCoverSize)
+	}
+
+	// The type comes from the bytes, not the server's Content-Type header
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if _, ok := extensions[mediaType]; !ok {
+		return nil, fmt.Errorf("unsupported cover image type %q", mediaType)
+	}
+
+	return &Image{MediaType: mediaType, Data: data}, nil
+}
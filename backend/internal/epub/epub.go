@@ -0,0 +1,302 @@
+// Package epub builds EPUB 3 packages of published books for offline
+// reading.
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"fdip/internal/models"
+)
+
+// MediaType is the MIME type of an EPUB file
+const MediaType = "application/epub+zip"
+
+// Language is the language declared for every book until books record their
+// own
+const Language = "en"
+
+// Image is an image to include in a package
+type Image struct {
+	MediaType string
+	Data      []byte
+}
+
+// extensions maps the cover image types EPUB readers must support to file
+// extensions. SVG is left out since it can carry scripts.
+var extensions = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+type chapterFile struct {
+	ID     string
+	Href   string
+	Title  string
+	Body   string
+	Number uint
+}
+
+type packageData struct {
+	Identifier string
+	Title      string
+	Author     string
+	Language   string
+	Subjects   []string
+	Modified   string
+	Cover      string
+	CoverType  string
+	Chapters   []chapterFile
+}
+
+// Build packages a book and the given chapters, in chapter number order.
+// chapters must hold their rendered HTML. cover may be nil.
+func Build(book *models.Book, chapters []models.Chapter, cover *Image, modified time.Time) ([]byte, error) {
+	sorted := append([]models.Chapter(nil), chapters...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ChapterNumber < sorted[j].ChapterNumber })
+
+	data := packageData{
+		Identifier: fmt.Sprintf("urn:fdip:book:%d", book.ID),
+		Title:      book.Title,
+		Author:     book.Author.DisplayName,
+		Language:   Language,
+		Subjects:   book.GetGenres(),
+		Modified:   modified.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	if cover != nil {
+		ext, ok := extensions[cover.MediaType]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cover type %q", cover.MediaType)
+		}
+		data.Cover = "cover." + ext
+		data.CoverType = cover.MediaType
+	}
+
+	for i, chapter := range sorted {
+		body, err := toXHTML(chapter.RenderedHTML)
+		if err != nil {
+			return nil, fmt.Errorf("chapter %d: %w", chapter.ID, err)
+		}
+		data.Chapters = append(data.Chapters, chapterFile{
+			ID:     fmt.Sprintf("chapter-%d", i+1),
+			Href:   fmt.Sprintf("chapter-%d.xhtml", i+1),
+			Title:  chapter.GetDisplayTitle(),
+			Body:   body,
+			Number: chapter.ChapterNumber,
+		})
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	// The mimetype file must come first, uncompressed and without a data
+	// descriptor, so readers can identify the file from its first bytes
+	mimetype := []byte(MediaType)
+	header := &zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(mimetype),
+		CompressedSize64:   uint64(len(mimetype)),
+		UncompressedSize64: uint64(len(mimetype)),
+	}
+	mw, err := w.CreateRaw(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mw.Write(mimetype); err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name string
+		tmpl *template.Template
+		data interface{}
+	}{
+		{"META-INF/container.xml", containerTemplate, nil},
+		{"OEBPS/content.opf", packageTemplate, data},
+		{"OEBPS/nav.xhtml", navTemplate, data},
+		{"OEBPS/style.css", styleTemplate, nil},
+	}
+	if cover != nil {
+		files = append(files, struct {
+			name string
+			tmpl *template.Template
+			data interface{}
+		}{"OEBPS/cover.xhtml", coverTemplate, data})
+	}
+	for _, f := range files {
+		fw, err := w.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.tmpl.Execute(fw, f.data); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", f.name, err)
+		}
+	}
+
+	for _, chapter := range data.Chapters {
+		fw, err := w.Create("OEBPS/" + chapter.Href)
+		if err != nil {
+			return nil, err
+		}
+		if err := chapterTemplate.Execute(fw, struct {
+			chapterFile
+			Language string
+		}{chapter, data.Language}); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", chapter.Href, err)
+		}
+	}
+
+	if cover != nil {
+		fw, err := w.Create("OEBPS/" + data.Cover)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(cover.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Filename returns a download file name for a book
+func Filename(book *models.Book) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(book.Title) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "-")
+	if name == "" {
+		name = fmt.Sprintf("book-%d", book.ID)
+	}
+	return name + ".epub"
+}
+
+var funcs = template.FuncMap{"xml": html.EscapeString}
+
+var containerTemplate = template.Must(template.New("container").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`))
+
+var packageTemplate = template.Must(template.New("package").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="{{.Language}}">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{xml .Identifier}}</dc:identifier>
+    <dc:title>{{xml .Title}}</dc:title>
+    <dc:creator id="author">{{xml .Author}}</dc:creator>
+    <meta refines="#author" property="role" scheme="marc:relators">aut</meta>
+    <dc:language>{{.Language}}</dc:language>
+{{- range .Subjects}}
+    <dc:subject>{{xml .}}</dc:subject>
+{{- end}}
+    <meta property="dcterms:modified">{{.Modified}}</meta>
+{{- if .Cover}}
+    <meta name="cover" content="cover-image"/>
+{{- end}}
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+{{- if .Cover}}
+    <item id="cover-image" href="{{.Cover}}" media-type="{{.CoverType}}" properties="cover-image"/>
+    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>
+{{- end}}
+{{- range .Chapters}}
+    <item id="{{.ID}}" href="{{.Href}}" media-type="application/xhtml+xml"/>
+{{- end}}
+  </manifest>
+  <spine>
+{{- if .Cover}}
+    <itemref idref="cover" linear="no"/>
+{{- end}}
+    <itemref idref="nav"/>
+{{- range .Chapters}}
+    <itemref idref="{{.ID}}"/>
+{{- end}}
+  </spine>
+</package>
+`))
+
+var navTemplate = template.Must(template.New("nav").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{.Language}}" lang="{{.Language}}">
+<head>
+  <title>{{xml .Title}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+  <h1>{{xml .Title}}</h1>
+  <p class="author">{{xml .Author}}</p>
+  <nav epub:type="toc" id="toc">
+    <h2>Contents</h2>
+    <ol>
+{{- range .Chapters}}
+      <li><a href="{{.Href}}">{{xml .Title}}</a></li>
+{{- end}}
+    </ol>
+  </nav>
+</body>
+</html>
+`))
+
+var coverTemplate = template.Must(template.New("cover").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{.Language}}" lang="{{.Language}}">
+<head>
+  <title>{{xml .Title}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body epub:type="cover">
+  <div class="cover"><img src="{{.Cover}}" alt="{{xml .Title}}"/></div>
+</body>
+</html>
+`))
+
+var chapterTemplate = template.Must(template.New("chapter").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{.Language}}" lang="{{.Language}}">
+<head>
+  <title>{{xml .Title}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+  <section epub:type="chapter">
+    <h1>{{xml .Title}}</h1>
+    {{.Body}}
+  </section>
+</body>
+</html>
+`))
+
+var styleTemplate = template.Must(template.New("style").Parse(`body { font-family: serif; line-height: 1.5; margin: 0 5%; }
+h1 { text-align: center; margin: 2em 0 1em; }
+.author { text-align: center; font-style: italic; }
+.cover { text-align: center; }
+.cover img { max-width: 100%; max-height: 100%; }
+.footnotes { font-size: 0.9em; }
+`))
@@ -0,0 +1,182 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"fdip/internal/content"
+	"fdip/internal/models"
+)
+
+// render gives a chapter the HTML the content pipeline would store for it
+func render(t *testing.T, number uint, title, markdown string) models.Chapter {
+	t.Helper()
+	rendered, err := content.Render(markdown, content.Markdown)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	return models.Chapter{ChapterNumber: number, Title: title, RenderedHTML: rendered.HTML}
+}
+
+// readEntries returns the files of a package by name
+func readEntries(t *testing.T, data []byte) ([]*zip.File, map[string]string) {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to read package: %v", err)
+	}
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", f.Name, err)
+		}
+		body, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", f.Name, err)
+		}
+		files[f.Name] = string(body)
+	}
+	return r.File, files
+}
+
+func TestBuild(t *testing.T) {
+	book := &models.Book{
+		ID:     7,
+		Title:  `Salt & "Smoke" <i>`,
+		Genres: `["Fantasy"]`,
+		Author: models.User{DisplayName: "Ada <Writer>"},
+	}
+	// Out of order, to check chapters are sorted by number
+	chapters := []models.Chapter{
+		render(t, 2, "Dawn & after", "It came back.\n\n<script>alert(1)</script>\n\n![map](https://example.com/map.png)"),
+		render(t, 1, "<b>Dusk</b>", "The sun went **down**.\n\n<a id=\"note:1\" href=\"javascript:alert(1)\" onclick=\"x()\">note</a>"),
+	}
+
+	data, err := Build(book, chapters, &Image{MediaType: "image/png", Data: []byte("png")}, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	// The mimetype entry comes first, stored, so its name and contents sit
+	// at fixed offsets at the start of the file
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) || string(data[30:38]) != "mimetype" || string(data[38:58]) != MediaType {
+		t.Errorf("package does not start with the mimetype entry: %q", data[:58])
+	}
+	if method := binary.LittleEndian.Uint16(data[8:]); method != zip.Store {
+		t.Errorf("got mimetype compression method %d, want stored", method)
+	}
+	entries, files := readEntries(t, data)
+	if entries[0].Name != "mimetype" || entries[0].Method != zip.Store || entries[0].Flags&0x8 != 0 {
+		t.Errorf("got first entry %s method %d flags %#x, want mimetype stored without a data descriptor", entries[0].Name, entries[0].Method, entries[0].Flags)
+	}
+
+	// Every XML file must be well-formed for readers to open it
+	for name, body := range files {
+		if !strings.HasSuffix(name, ".xml") && !strings.HasSuffix(name, ".opf") && !strings.HasSuffix(name, ".xhtml") {
+			continue
+		}
+		d := xml.NewDecoder(strings.NewReader(body))
+		d.Strict = true
+		d.Entity = xml.HTMLEntity
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%s is not well-formed: %v", name, err)
+				break
+			}
+		}
+	}
+
+	var pkg struct {
+		Title    string   `xml:"metadata>title"`
+		Creator  string   `xml:"metadata>creator"`
+		Subjects []string `xml:"metadata>subject"`
+		Items    []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"manifest>item"`
+		Itemrefs []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := xml.Unmarshal([]byte(files["OEBPS/content.opf"]), &pkg); err != nil {
+		t.Fatalf("failed to read package document: %v", err)
+	}
+	if pkg.Title != book.Title || pkg.Creator != "Ada <Writer>" || strings.Join(pkg.Subjects, ",") != "Fantasy" {
+		t.Errorf("got title %q by %q in %q", pkg.Title, pkg.Creator, pkg.Subjects)
+	}
+
+	var manifest []string
+	for _, item := range pkg.Items {
+		manifest = append(manifest, item.ID+"="+item.Href)
+		if _, ok := files["OEBPS/"+item.Href]; !ok {
+			t.Errorf("manifest item %s is not in the package", item.Href)
+		}
+	}
+	if got, want := strings.Join(manifest, " "), "nav=nav.xhtml style=style.css cover-image=cover.png cover=cover.xhtml chapter-1=chapter-1.xhtml chapter-2=chapter-2.xhtml"; got != want {
+		t.Errorf("got manifest %s, want %s", got, want)
+	}
+	var spine []string
+	for _, ref := range pkg.Itemrefs {
+		spine = append(spine, ref.IDRef+":"+ref.Linear)
+	}
+	if got, want := strings.Join(spine, " "), "cover:no nav: chapter-1: chapter-2:"; got != want {
+		t.Errorf("got spine %s, want %s", got, want)
+	}
+
+	first, second := files["OEBPS/chapter-1.xhtml"], files["OEBPS/chapter-2.xhtml"]
+	if !strings.Contains(first, "<title>Chapter 1: &lt;b&gt;Dusk&lt;/b&gt;</title>") {
+		t.Errorf("chapter title not escaped:\n%s", first)
+	}
+	if !strings.Contains(first, "<strong>down</strong>") || !strings.Contains(first, `id="note-1"`) {
+		t.Errorf("chapter body not kept:\n%s", first)
+	}
+	if !strings.Contains(second, "Dawn &amp; after") {
+		t.Errorf("chapter title not escaped:\n%s", second)
+	}
+	for name, body := range map[string]string{"chapter-1": first, "chapter-2": second} {
+		for _, unsafe := range []string{"<script", "javascript:", "onclick", "<img"} {
+			if strings.Contains(body, unsafe) {
+				t.Errorf("%s contains %s:\n%s", name, unsafe, body)
+			}
+		}
+	}
+	if !strings.Contains(second, "map") {
+		t.Errorf("image not replaced by its alt text:\n%s", second)
+	}
+}
+
+func TestBuildRejectsUnsupportedCover(t *testing.T) {
+	_, err := Build(&models.Book{Title: "Book"}, nil, &Image{MediaType: "image/svg+xml", Data: []byte("<svg/>")}, time.Now())
+	if err == nil {
+		t.Fatal("accepted an SVG cover")
+	}
+}
+
+func TestFilename(t *testing.T) {
+	tests := []struct {
+		book models.Book
+		want string
+	}{
+		{book: models.Book{Title: "The Long Night"}, want: "the-long-night.epub"},
+		{book: models.Book{Title: "  Salt & Smoke!  "}, want: "salt-smoke.epub"},
+		{book: models.Book{ID: 7, Title: "夜"}, want: "book-7.epub"},
+	}
+	for _, tt := range tests {
+		if got := Filename(&tt.book); got != tt.want {
+			t.Errorf("Filename(%q) = %q, want %q", tt.book.Title, got, tt.want)
+		}
+	}
+}
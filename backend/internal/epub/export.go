@@ -0,0 +1,135 @@
+package epub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"fdip/internal/content"
+	"fdip/internal/media"
+	"fdip/internal/models"
+	"fdip/internal/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// formatVersion identifies the package layout. Bump it when Build's output
+// changes so cached exports are rebuilt.
+const formatVersion = 1
+
+// exportFormat is the BookExport format of EPUB files
+const exportFormat = "epub"
+
+// Chapters returns the chapters of a book an export holds at now: the
+// visible ones open to every reader
+func Chapters(book *models.Book, now time.Time) []models.Chapter {
+	var chapters []models.Chapter
+	for _, chapter := range book.GetPublishedChapters() {
+		if chapter.IsOpen(now) {
+			chapters = append(chapters, chapter)
+		}
+	}
+	return chapters
+}
+
+// Revision identifies the state of a book an export is built from: the
+// book, its author, the chapters it holds and the rendering pipeline. book
+// must have its Author and Chapters loaded; chapter bodies are not needed.
+func Revision(book *models.Book) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "epub:%d content:%d\n", formatVersion, content.Version)
+	fmt.Fprintf(h, "book:%d:%d author:%d:%d\n", book.ID, book.UpdatedAt.UnixNano(), book.Author.ID, book.Author.UpdatedAt.UnixNano())
+	for _, chapter := range Chapters(book, time.Now()) {
+		fmt.Fprintf(h, "chapter:%d:%d:%d\n", chapter.ID, chapter.ChapterNumber, chapter.UpdatedAt.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Export returns the EPUB of a book's free chapters, reusing the cached
+// copy if the book has not changed since it was built. book must have its
+// Author and Chapters loaded, as for Revision.
+func Export(ctx context.Context, db *gorm.DB, book *models.Book) ([]byte, error) {
+	revision := Revision(book)
+
+	var cached models.BookExport
+	err := db.Where("book_id = ? AND format = ? AND revision = ?", book.ID, exportFormat, revision).First(&cached).Error
+	if err == nil {
+		return cached.Data, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	var chapters []models.Chapter
+	if err := db.Where("book_id = ?", book.ID).Order("chapter_number").Find(&chapters).Error; err != nil {
+		return nil, err
+	}
+	full := *book
+	full.Chapters = chapters
+	visible := Chapters(&full, time.Now())
+
+	modified := book.UpdatedAt
+	for i := range visible {
+		chapter := &visible[i]
+		// The background job may not have caught up with a pipeline change
+		if chapter.RenderVersion < content.Version {
+			if err := chapter.Render(); err != nil {
+				return nil, err
+			}
+		}
+		if chapter.UpdatedAt.After(modified) {
+			modified = chapter.UpdatedAt
+		}
+	}
+
+	var cover *Image
+	if book.CoverImageURL != nil && *book.CoverImageURL != "" {
+		fetchCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		cover, err = loadCover(fetchCtx, db, *book.CoverImageURL)
+		cancel()
+		if err != nil {
+			// A book without its cover is still worth reading
+			log.Printf("[EPUB] Leaving out cover of book %d: %v", book.ID, err)
+			cover = nil
+		}
+	}
+
+	data, err := Build(book, visible, cover, modified)
+	if err != nil {
+		return nil, err
+	}
+
+	export := models.BookExport{
+		BookID:   book.ID,
+		Format:   exportFormat,
+		Revision: revision,
+		Data:     data,
+		Size:     len(data),
+	}
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "book_id"}, {Name: "format"}},
+		DoUpdates: clause.AssignmentColumns([]string{"revision", "data", "size", "updated_at"}),
+	}).Create(&export).Error; err != nil {
+		// The file is good even if it could not be cached
+		log.Printf("[EPUB] Failed to cache export of book %d: %v", book.ID, err)
+	}
+
+	return data, nil
+}
+
+// loadCover reads an uploaded cover from storage, or downloads one the
+// authors linked to
+func loadCover(ctx context.Context, db *gorm.DB, rawURL string) (*Image, error) {
+	if _, _, ok := media.Parse(rawURL); !ok {
+		return FetchCover(ctx, rawURL)
+	}
+	data, mediaType, err := media.Read(ctx, db, storage.Default, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{MediaType: mediaType, Data: data}, nil
+}
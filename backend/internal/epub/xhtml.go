@@ -0,0 +1,81 @@
+package epub
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// toXHTML rewrites a sanitized HTML fragment as well-formed XHTML. Images
+// are replaced by their alt text, since EPUB readers do not load remote
+// images, and colons are taken out of fragment identifiers, which XML does
+// not allow in IDs.
+func toXHTML(fragment string) (string, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), body)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		node = rewrite(node)
+		if node == nil {
+			continue
+		}
+		if err := html.Render(&buf, node); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// rewrite fixes up n and its descendants, returning the node to use in its
+// place or nil to drop it
+func rewrite(n *html.Node) *html.Node {
+	if n.Type != html.ElementNode {
+		return n
+	}
+
+	if n.DataAtom == atom.Img {
+		for _, attr := range n.Attr {
+			if attr.Key == "alt" && attr.Val != "" {
+				return &html.Node{Type: html.TextNode, Data: attr.Val}
+			}
+		}
+		return nil
+	}
+
+	attrs := n.Attr[:0]
+	for _, attr := range n.Attr {
+		switch {
+		case attr.Namespace != "":
+			continue
+		case attr.Key == "id":
+			attr.Val = xmlID(attr.Val)
+		case attr.Key == "href" && strings.HasPrefix(attr.Val, "#"):
+			attr.Val = "#" + xmlID(attr.Val[1:])
+		}
+		attrs = append(attrs, attr)
+	}
+	n.Attr = attrs
+
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		replacement := rewrite(child)
+		if replacement != child {
+			if replacement != nil {
+				n.InsertBefore(replacement, child)
+			}
+			n.RemoveChild(child)
+		}
+		child = next
+	}
+	return n
+}
+
+func xmlID(id string) string {
+	return strings.ReplaceAll(id, ":", "-")
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"fdip/internal/auth"
+	"fdip/internal/database"
+	"fdip/internal/mailer"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// VerifyEmailRequest represents the email verification request
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ForgotPasswordRequest represents the password reset request
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPasswordRequest represents the new password for a reset
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// VerifyEmail marks the email address a verification token was sent to as
+// verified
+func VerifyEmail(c *gin.Context) {
+	var req VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		token, err := auth.ConsumeEmailToken(tx, req.Token, models.EmailTokenVerifyEmail)
+		if err != nil {
+			return err
+		}
+
+		// The address must not have changed since the token was sent
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND email = ?", token.UserID, token.Email).
+			Update("email_verified_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return auth.ErrInvalidEmailToken
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidEmailToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ResendVerification sends the current user a new verification email
+func ResendVerification(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	if currentUser.IsEmailVerified() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(currentUser); err != nil {
+		log.Printf("[MAIL] Failed to send verification email to user %d: %v", currentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// ForgotPassword emails a password reset link. It responds the same way
+// whether or not the address belongs to an account.
+func ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	err := database.DB.Where("email = ?", req.Email).First(&user).Error
+	if err == nil {
+		if err := sendPasswordResetEmail(&user); err != nil {
+			log.Printf("[MAIL] Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If an account exists for that email, a reset link has been sent"})
+}
+
+// ResetPassword sets a new password using a reset token and signs the user
+// out everywhere
+func ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	var userID uint
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		token, err := auth.ConsumeEmailToken(tx, req.Token, models.EmailTokenResetPassword)
+		if err != nil {
+			return err
+		}
+		userID = token.UserID
+
+		updates := map[string]interface{}{"password_hash": hashedPassword}
+		var user models.User
+		if err := tx.First(&user, token.UserID).Error; err != nil {
+			return err
+		}
+		// Receiving the reset link proves the address belongs to the user
+		if user.Email == token.Email && !user.IsEmailVerified() {
+			updates["email_verified_at"] = time.Now()
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return auth.EndAllSessions(tx, user.ID, "password reset")
+	})
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidEmailToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+			return
+		}
+		log.Printf("[AUTH] Password reset failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	log.Printf("[AUTH] Password reset for user %d", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully; please sign in again"})
+}
+
+// sendVerificationEmail emails the user a link to verify their address
+func sendVerificationEmail(user *models.User) error {
+	token, err := auth.IssueEmailToken(database.DB, user, models.EmailTokenVerifyEmail, auth.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := frontendURL() + "/verify-email?token=" + url.QueryEscape(token)
+	return mailer.Default.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %d hours. If you did not create an account, you can ignore this email.\n",
+			user.DisplayName, link, int(auth.EmailVerificationTTL.Hours())),
+	})
+}
+
+// sendPasswordResetEmail emails the user a link to choose a new password
+func sendPasswordResetEmail(user *models.User) error {
+	token, err := auth.IssueEmailToken(database.DB, user, models.EmailTokenResetPassword, auth.PasswordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := frontendURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return mailer.Default.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. To choose a new password, open this link:\n\n%s\n\n"+
+			"The link expires in %d minutes. If you did not ask for a reset, you can ignore this email.\n",
+			user.DisplayName, link, int(auth.PasswordResetTTL.Minutes())),
+	})
+}
+
+// frontendURL returns the base URL of the web app used in links sent to users
+func frontendURL() string {
+	if u := os.Getenv("FRONTEND_URL"); u != "" {
+		return u
+	}
+	return "http://localhost:3000"
+}
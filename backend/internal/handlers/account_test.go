@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"fdip/internal/auth"
+	"fdip/internal/database"
+	"fdip/internal/mailer"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupAccountTest prepares the tables the account and token handlers use
+// and a mailer that keeps the messages it sends
+func setupAccountTest(t *testing.T) *mailer.LogMailer {
+	t.Helper()
+
+	setupTestDB(t,
+		&models.User{},
+		&models.EmailToken{},
+		&models.Session{},
+		&models.RefreshToken{},
+		&models.TokenTransaction{},
+		&models.TokenBundle{},
+		&models.Promotion{},
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+	)
+	useFakeProvider(t)
+
+	sent := mailer.NewLogMailer(t.TempDir(), "FDIP <no-reply@fdip.local>")
+	prev := mailer.Default
+	mailer.Default = sent
+	t.Cleanup(func() { mailer.Default = prev })
+	return sent
+}
+
+// newAccountRouter serves the account handlers, and the token handlers as
+// the user named by the X-Test-User header
+func newAccountRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/auth/verify-email", VerifyEmail)
+	router.POST("/auth/forgot-password", ForgotPassword)
+	router.POST("/auth/reset-password", ResetPassword)
+
+	signedIn := router.Group("/", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.GetHeader("X-Test-User"), 10, 64)
+		var user models.User
+		if err := database.DB.First(&user, id).Error; err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("user", &user)
+		c.Set("user_id", user.ID)
+	})
+	signedIn.POST("/tokens/purchase", PurchaseTokens)
+	signedIn.POST("/tokens/cashout", CashoutTokens)
+	return router
+}
+
+func postJSON(router *gin.Engine, path string, userID uint, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if userID != 0 {
+		req.Header.Set("X-Test-User", strconv.FormatUint(uint64(userID), 10))
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+var emailLink = regexp.MustCompile(`token=(\S+)`)
+
+// lastToken returns the token in the link of the last email sent
+func lastToken(t *testing.T, sent *mailer.LogMailer) string {
+	t.Helper()
+
+	msg, ok := sent.Last()
+	if !ok {
+		t.Fatal("no email was sent")
+	}
+	m := emailLink.FindStringSubmatch(msg.Body)
+	if m == nil {
+		t.Fatalf("no link in email %q", msg.Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatalf("bad token in link: %v", err)
+	}
+	return token
+}
+
+func createAccountTestUser(t *testing.T, verified bool) models.User {
+	t.Helper()
+
+	hash, err := auth.HashPassword("old-password")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: hash, DisplayName: "Reader"}
+	if verified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
+
+func TestVerifyEmailUnblocksPurchasesAndCashouts(t *testing.T) {
+	sent := setupAccountTest(t)
+	router := newAccountRouter()
+	user := createAccountTestUser(t, false)
+
+	purchase := map[string]interface{}{"amount": 10}
+	cashout := map[string]interface{}{"amount": 100}
+	if w := postJSON(router, "/tokens/purchase", user.ID, purchase); w.Code != http.StatusForbidden {
+		t.Errorf("unverified purchase: got status %d, want 403", w.Code)
+	}
+	if w := postJSON(router, "/tokens/cashout", user.ID, cashout); w.Code != http.StatusForbidden {
+		t.Errorf("unverified cashout: got status %d, want 403", w.Code)
+	}
+
+	if err := sendVerificationEmail(&user); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	token := lastToken(t, sent)
+	if w := postJSON(router, "/auth/verify-email", 0, gin.H{"token": token}); w.Code != http.StatusOK {
+		t.Fatalf("verify: got status %d, body %s", w.Code, w.Body.String())
+	}
+	if w := postJSON(router, "/auth/verify-email", 0, gin.H{"token": token}); w.Code != http.StatusBadRequest {
+		t.Errorf("second verify: got status %d, want 400", w.Code)
+	}
+
+	if w := postJSON(router, "/tokens/purchase", user.ID, purchase); w.Code != http.StatusOK {
+		t.Errorf("verified purchase: got status %d, body %s", w.Code, w.Body.String())
+	}
+	// The cashout now stops at payout onboarding instead
+	if w := postJSON(router, "/tokens/cashout", user.ID, cashout); w.Code != http.StatusBadRequest {
+		t.Errorf("verified cashout: got status %d, want 400, body %s", w.Code, w.Body.String())
+	}
+}
+
+func TestVerifyEmailRejectsInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		issue func(user *models.User) error
+		alter func(t *testing.T, user *models.User) // Runs after the token was sent
+	}{
+		{name: "password reset token", issue: sendPasswordResetEmail},
+		{name: "expired", issue: sendVerificationEmail, alter: func(t *testing.T, user *models.User) {
+			database.DB.Model(&models.EmailToken{}).Where("user_id = ?", user.ID).Update("expires_at", time.Now().Add(-time.Minute))
+		}},
+		{name: "address changed since", issue: sendVerificationEmail, alter: func(t *testing.T, user *models.User) {
+			database.DB.Model(user).Update("email", "new@example.com")
+		}},
+		{name: "replaced by a newer token", issue: sendVerificationEmail, alter: func(t *testing.T, user *models.User) {
+			if _, err := auth.IssueEmailToken(database.DB, user, models.EmailTokenVerifyEmail, auth.EmailVerificationTTL); err != nil {
+				t.Fatalf("IssueEmailToken: %v", err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := setupAccountTest(t)
+			router := newAccountRouter()
+			user := createAccountTestUser(t, false)
+
+			if err := tt.issue(&user); err != nil {
+				t.Fatalf("failed to send token: %v", err)
+			}
+			token := lastToken(t, sent)
+			if tt.alter != nil {
+				tt.alter(t, &user)
+			}
+
+			if w := postJSON(router, "/auth/verify-email", 0, gin.H{"token": token}); w.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want 400", w.Code)
+			}
+			var reloaded models.User
+			database.DB.First(&reloaded, user.ID)
+			if reloaded.IsEmailVerified() {
+				t.Error("email was marked verified")
+			}
+		})
+	}
+}
+
+func TestResetPasswordEndsAllSessions(t *testing.T) {
+	sent := setupAccountTest(t)
+	router := newAccountRouter()
+	user := createAccountTestUser(t, true)
+
+	for i := 0; i < 2; i++ {
+		session := models.Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour), LastUsedAt: time.Now()}
+		if err := database.DB.Create(&session).Error; err != nil {
+			t.Fatalf("failed to create session: %v", err)
+		}
+	}
+
+	// Unknown addresses get the same answer, and no email
+	if w := postJSON(router, "/auth/forgot-password", 0, gin.H{"email": "nobody@example.com"}); w.Code != http.StatusOK {
+		t.Fatalf("unknown address: got status %d", w.Code)
+	}
+	if _, ok := sent.Last(); ok {
+		t.Fatal("an email was sent to an unknown address")
+	}
+	if w := postJSON(router, "/auth/forgot-password", 0, gin.H{"email": user.Email}); w.Code != http.StatusOK {
+		t.Fatalf("forgot password: got status %d", w.Code)
+	}
+	token := lastToken(t, sent)
+
+	// A verification token cannot reset the password
+	if err := sendVerificationEmail(&user); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	if w := postJSON(router, "/auth/reset-password", 0, gin.H{"token": lastToken(t, sent), "password": "new-password"}); w.Code != http.StatusBadRequest {
+		t.Errorf("verification token: got status %d, want 400", w.Code)
+	}
+
+	if w := postJSON(router, "/auth/reset-password", 0, gin.H{"token": token, "password": "new-password"}); w.Code != http.StatusOK {
+		t.Fatalf("reset: got status %d, body %s", w.Code, w.Body.String())
+	}
+	if w := postJSON(router, "/auth/reset-password", 0, gin.H{"token": token, "password": "other-password"}); w.Code != http.StatusBadRequest {
+		t.Errorf("second reset: got status %d, want 400", w.Code)
+	}
+
+	var reloaded models.User
+	database.DB.First(&reloaded, user.ID)
+	if !auth.CheckPassword("new-password", reloaded.PasswordHash) {
+		t.Error("password was not changed to the one from the first reset")
+	}
+	if reloaded.TokenVersion != user.TokenVersion+1 {
+		t.Errorf("got token version %d, want %d", reloaded.TokenVersion, user.TokenVersion+1)
+	}
+	var active int64
+	database.DB.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", user.ID).Count(&active)
+	if active != 0 {
+		t.Errorf("%d sessions are still active", active)
+	}
+}
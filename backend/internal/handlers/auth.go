@@ -1,12 +1,18 @@
 package handlers
 
 import (
+	"errors"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"fdip/internal/auth"
 	"fdip/internal/database"
+	"fdip/internal/middleware"
 	"fdip/internal/models"
+	"fdip/internal/permissions"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -27,6 +33,11 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// RefreshRequest represents the token refresh request
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
 // Register handles user registration
 func Register(c *gin.Context) {
 	var req RegisterRequest
@@ -86,16 +97,24 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := auth.GenerateToken(&user)
+	// Ask the user to confirm their address; they can resend it later
+	if err := sendVerificationEmail(&user); err != nil {
+		log.Printf("[MAIL] Failed to send verification email to user %d: %v", user.ID, err)
+	}
+
+	// Sign the user in on this device
+	tokens, err := auth.StartSession(database.DB, &user, c.Request.UserAgent(), c.ClientIP(), false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message": "User registered successfully",
-		"token":   token,
+		"message":            "User registered successfully",
+		"token":              tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
 		"user": gin.H{
 			"id":           user.ID,
 			"username":     user.Username,
@@ -114,11 +133,17 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// Refuse attempts while this username is locked out from this address
+	if wait := middleware.Logins.Check(req.Username, c.ClientIP()); wait > 0 {
+		loginLockedOut(c, wait)
+		return
+	}
+
 	// Find user by username
 	var user models.User
 	if err := database.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			loginFailed(c, req.Username, "Invalid credentials")
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -127,20 +152,42 @@ func Login(c *gin.Context) {
 
 	// Check password
 	if !auth.CheckPassword(req.Password, user.PasswordHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		loginFailed(c, req.Username, "Invalid credentials")
 		return
 	}
 
-	// Generate JWT token
-	token, err := auth.GenerateToken(&user)
+	// With two-factor authentication the password only earns a challenge
+	// token, which is exchanged for a session at /auth/login/2fa
+	if user.TwoFactorEnabled() {
+		challenge, err := auth.GenerateMFAChallenge(&user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Two-factor code required",
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"expires_in":   int(auth.MFAChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	// Sign the user in on this device
+	tokens, err := auth.StartSession(database.DB, &user, c.Request.UserAgent(), c.ClientIP(), false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	middleware.Logins.Succeed(req.Username, c.ClientIP())
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"token":   token,
+		"message":            "Login successful",
+		"token":              tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
 		"user": gin.H{
 			"id":           user.ID,
 			"username":     user.Username,
@@ -151,6 +198,60 @@ func Login(c *gin.Context) {
 	})
 }
 
+// RefreshSession exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token can be used once.
+func RefreshSession(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := auth.Refresh(database.DB, req.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrRefreshTokenReused):
+			log.Printf("[AUTH] Refresh token reuse detected from %s; session revoked", c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used; please sign in again"})
+		case errors.Is(err, auth.ErrInvalidRefreshToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Logout signs the current device out by revoking its session
+func Logout(c *gin.Context) {
+	userID, _ := middleware.GetCurrentUserID(c)
+	sessionID := middleware.GetCurrentSessionID(c)
+	if err := auth.EndSession(database.DB, userID, sessionID, "logout"); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// LogoutAll signs the current user out on every device
+func LogoutAll(c *gin.Context) {
+	userID, exists := middleware.GetCurrentUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	if err := auth.EndAllSessions(database.DB, userID, "logout all"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all devices successfully"})
+}
+
 // GetProfile returns the current user's profile
 func GetProfile(c *gin.Context) {
 	user, exists := c.Get("user")
@@ -179,6 +280,12 @@ func GetProfile(c *gin.Context) {
 		}
 	}
 
+	perms, err := permissions.For(database.DB, currentUser.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get permissions"})
+		return
+	}
+
 	// Get follower and following counts
 	followerCount, _ := models.GetFollowerCount(database.DB, currentUser.ID)
 	followingCount, _ := models.GetFollowingCount(database.DB, currentUser.ID)
@@ -188,10 +295,13 @@ func GetProfile(c *gin.Context) {
 			"id":              currentUser.ID,
 			"username":        currentUser.Username,
 			"email":           currentUser.Email,
+			"email_verified":  currentUser.IsEmailVerified(),
+			"two_factor":      currentUser.TwoFactorEnabled(),
 			"display_name":    currentUser.DisplayName,
 			"bio":             currentUser.Bio,
 			"avatar_url":      currentUser.AvatarURL,
 			"role":            currentUser.Role,
+			"permissions":     perms.List(),
 			"created_at":      currentUser.CreatedAt,
 			"token_balance":   balance.Balance,
 			"total_earned":    balance.TotalEarned,
@@ -241,6 +351,12 @@ func UpdateProfile(c *gin.Context) {
 		return
 	}
 
+	perms, err := permissions.For(database.DB, currentUser.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get permissions"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Profile updated successfully",
 		"user": gin.H{
@@ -251,6 +367,7 @@ func UpdateProfile(c *gin.Context) {
 			"bio":          currentUser.Bio,
 			"avatar_url":   currentUser.AvatarURL,
 			"role":         currentUser.Role,
+			"permissions":  perms.List(),
 		},
 	})
 }
@@ -279,7 +396,16 @@ func PromoteToAuthor(c *gin.Context) {
 		return
 	}
 
-	if err := database.DB.Model(&user).Update("role", models.RoleAuthor).Error; err != nil {
+	// Staff roles are changed through role assignment instead
+	if user.Role != models.RoleReader {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only readers can be promoted to author"})
+		return
+	}
+
+	// Tokens carrying the old role stop working; the user's sessions pick
+	// up the new role on their next refresh
+	actorID, _ := middleware.GetCurrentUserID(c)
+	if _, err := permissions.Assign(database.DB, actorID, user.ID, models.RoleAuthor, ""); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to promote user"})
 		return
 	}
@@ -305,14 +431,14 @@ func SelfPromoteToAuthor(c *gin.Context) {
 
 	user := currentUser.(*models.User)
 
-	// Check if user is already an author
-	if user.Role == models.RoleAuthor || user.Role == models.RoleAdmin {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User is already an author or admin"})
+	// Only readers can promote themselves; other roles are assigned by staff
+	if user.Role != models.RoleReader {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User is already an author or staff member"})
 		return
 	}
 
 	// Update user role to author
-	if err := database.DB.Model(&user).Update("role", models.RoleAuthor).Error; err != nil {
+	if _, err := permissions.Assign(database.DB, user.ID, user.ID, models.RoleAuthor, ""); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to promote user"})
 		return
 	}
@@ -324,7 +450,7 @@ func SelfPromoteToAuthor(c *gin.Context) {
 	}
 
 	// Generate new JWT token with updated role
-	newToken, err := auth.GenerateToken(user)
+	newToken, err := auth.GenerateToken(user, middleware.GetCurrentSessionID(c), middleware.IsMFAVerified(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate new token"})
 		return
@@ -341,3 +467,23 @@ func SelfPromoteToAuthor(c *gin.Context) {
 		},
 	})
 }
+
+// loginFailed records a failed sign-in attempt for username and responds with
+// message, or with a lockout if the attempt triggered one
+func loginFailed(c *gin.Context, username, message string) {
+	if wait := middleware.Logins.Fail(username, c.ClientIP()); wait > 0 {
+		loginLockedOut(c, wait)
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// loginLockedOut responds to a sign-in attempt during a lockout
+func loginLockedOut(c *gin.Context, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many failed sign-in attempts, try again later",
+		"retry_after": retryAfter,
+	})
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"fdip/internal/database"
+	"fdip/internal/mailer"
+	"fdip/internal/membership"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// InviteMemberRequest represents an invitation to work on a book
+type InviteMemberRequest struct {
+	Username     string          `json:"username" binding:"required"`
+	Role         models.BookRole `json:"role" binding:"required"`
+	RevenueShare int             `json:"revenue_share" binding:"min=0,max=100"`
+}
+
+// UpdateMemberRequest represents a member's new role on a book
+type UpdateMemberRequest struct {
+	Role models.BookRole `json:"role" binding:"required"`
+}
+
+// RevenueShare is one member's percentage of a book's tips
+type RevenueShare struct {
+	UserID uint `json:"user_id" binding:"required"`
+	Share  int  `json:"share" binding:"min=0,max=100"`
+}
+
+// UpdateRevenueSharesRequest represents the new revenue split of a book
+type UpdateRevenueSharesRequest struct {
+	Shares []RevenueShare `json:"shares" binding:"required,min=1,dive"`
+}
+
+// GetBookMembers lists the members of a book and its pending invitations
+func GetBookMembers(c *gin.Context) {
+	book, _, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var members []models.BookMember
+	if err := database.DB.Preload("User").Where("book_id = ?", book.ID).Order("id").Find(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+
+	var invitations []models.BookInvitation
+	if err := database.DB.Preload("Invitee").
+		Where("book_id = ? AND status = ?", book.ID, models.BookInvitationPending).
+		Order("id").Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"members":     members,
+		"invitations": invitations,
+	})
+}
+
+// InviteBookMember invites a user to a book by username
+func InviteBookMember(c *gin.Context) {
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can invite members"})
+		return
+	}
+
+	var req InviteMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var invitee models.User
+	if err := database.DB.Where("username = ?", req.Username).First(&invitee).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	inviterID, _ := middleware.GetCurrentUserID(c)
+	invitation, err := membership.Invite(database.DB, book.ID, inviterID, invitee.ID, req.Role, req.RevenueShare)
+	if err != nil {
+		respondMembershipError(c, err, "Failed to send invitation")
+		return
+	}
+
+	if err := sendInvitationEmail(book, &invitee, invitation); err != nil {
+		log.Printf("[BOOKS] Failed to email invitation %d: %v", invitation.ID, err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Invitation sent",
+		"invitation": invitation,
+	})
+}
+
+// RevokeBookInvitation withdraws a pending invitation to a book
+func RevokeBookInvitation(c *gin.Context) {
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can revoke invitations"})
+		return
+	}
+
+	invitationID, err := strconv.ParseUint(c.Param("invitationId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	if err := membership.Revoke(database.DB, book.ID, uint(invitationID)); err != nil {
+		respondMembershipError(c, err, "Failed to revoke invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+// UpdateBookMember changes a member's role on a book
+func UpdateBookMember(c *gin.Context) {
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can change members"})
+		return
+	}
+
+	userID, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req UpdateMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := membership.ChangeRole(database.DB, book.ID, uint(userID), req.Role); err != nil {
+		respondMembershipError(c, err, "Failed to update member")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member updated"})
+}
+
+// RemoveBookMember takes a member off a book. Members may also remove
+// themselves.
+func RemoveBookMember(c *gin.Context) {
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+	if !role.CanManageMembers() && uint(userID) != currentUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can remove members"})
+		return
+	}
+
+	if err := membership.Remove(database.DB, book.ID, uint(userID)); err != nil {
+		respondMembershipError(c, err, "Failed to remove member")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// UpdateRevenueShares sets how a book's tips are split between the owner
+// and co-authors
+func UpdateRevenueShares(c *gin.Context) {
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can change revenue shares"})
+		return
+	}
+
+	var req UpdateRevenueSharesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	shares := make(map[uint]int, len(req.Shares))
+	for _, s := range req.Shares {
+		if _, dup := shares[s.UserID]; dup {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Each member can only appear once"})
+			return
+		}
+		shares[s.UserID] = s.Share
+	}
+
+	if err := membership.SetShares(database.DB, book.ID, shares); err != nil {
+		respondMembershipError(c, err, "Failed to update revenue shares")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Revenue shares updated"})
+}
+
+// GetMyInvitations lists the pending invitations sent to the current user
+func GetMyInvitations(c *gin.Context) {
+	userID, _ := middleware.GetCurrentUserID(c)
+
+	var invitations []models.BookInvitation
+	if err := database.DB.Preload("Book").Preload("Inviter").
+		Where("invitee_id = ? AND status = ?", userID, models.BookInvitationPending).
+		Order("id DESC").Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// AcceptBookInvitation joins the book the current user was invited to
+func AcceptBookInvitation(c *gin.Context) {
+	invitationID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	userID, _ := middleware.GetCurrentUserID(c)
+	member, err := membership.Accept(database.DB, uint(invitationID), userID)
+	if err != nil {
+		respondMembershipError(c, err, "Failed to accept invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Invitation accepted",
+		"member":  member,
+	})
+}
+
+// DeclineBookInvitation turns down an invitation sent to the current user
+func DeclineBookInvitation(c *gin.Context) {
+	invitationID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	userID, _ := middleware.GetCurrentUserID(c)
+	if err := membership.Decline(database.DB, uint(invitationID), userID); err != nil {
+		respondMembershipError(c, err, "Failed to decline invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation declined"})
+}
+
+// findBookAs loads a book and the role the current user holds on it. It
+// responds with 404 when the book does not exist or the user is not a
+// member. Users who moderate content act as the owner of every book.
+func findBookAs(c *gin.Context, id string) (*models.Book, models.BookRole, bool) {
+	bookID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+		return nil, "", false
+	}
+
+	currentUserID, exists := middleware.GetCurrentUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return nil, "", false
+	}
+
+	var book models.Book
+	if err := database.DB.First(&book, bookID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return nil, "", false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+		return nil, "", false
+	}
+
+	role, ok := bookRoleOf(c, book.ID, currentUserID, "Book not found")
+	if !ok {
+		return nil, "", false
+	}
+	return &book, role, true
+}
+
+// bookRoleOf returns the role the current user holds on a book, responding
+// with 404 and notFound when they are not a member
+func bookRoleOf(c *gin.Context, bookID, userID uint, notFound string) (models.BookRole, bool) {
+	role, err := membership.RoleOf(database.DB, bookID, userID)
+	switch {
+	case err == nil:
+		return role, true
+	case errors.Is(err, membership.ErrNotMember) && middleware.HasPermission(c, models.PermContentModerate):
+		return models.BookRoleOwner, true
+	case errors.Is(err, membership.ErrNotMember):
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+	}
+	return "", false
+}
+
+// sendInvitationEmail tells a user they have been invited to a book
+func sendInvitationEmail(book *models.Book, invitee *models.User, invitation *models.BookInvitation) error {
+	return mailer.Default.Send(mailer.Message{
+		To:      invitee.Email,
+		Subject: fmt.Sprintf("You have been invited to work on %s", book.Title),
+		Body: fmt.Sprintf("Hi %s,\n\nYou have been invited to join %q as %s. To accept or decline, open:\n\n%s\n",
+			invitee.DisplayName, book.Title, invitation.Role, frontendURL()+"/invitations"),
+	})
+}
+
+func respondMembershipError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, membership.ErrNotMember):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+	case errors.Is(err, membership.ErrInvitationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+	case errors.Is(err, membership.ErrInvalidRole), errors.Is(err, membership.ErrInvalidShare), errors.Is(err, membership.ErrSharesTotal):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, membership.ErrAlreadyMember), errors.Is(err, membership.ErrAlreadyInvited),
+		errors.Is(err, membership.ErrInvitationClosed), errors.Is(err, membership.ErrOwner),
+		errors.Is(err, membership.ErrShareUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
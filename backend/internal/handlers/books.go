@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 	"strconv"
 
 	"fdip/internal/database"
+	"fdip/internal/media"
+	"fdip/internal/membership"
 	"fdip/internal/middleware"
 	"fdip/internal/models"
+	"fdip/internal/storage"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -22,14 +26,17 @@ type CreateBookRequest struct {
 
 // UpdateBookRequest represents the book update request
 type UpdateBookRequest struct {
-	Title         string   `json:"title" binding:"required,min=1,max=255"`
-	Description   string   `json:"description"`
-	CoverImageURL string   `json:"cover_image_url"`
-	Genres        []string `json:"genres"`
-	IsPublished   *bool    `json:"is_published"`
+	Title          string   `json:"title" binding:"required,min=1,max=255"`
+	Description    string   `json:"description"`
+	CoverImageURL  string   `json:"cover_image_url"`
+	Genres         []string `json:"genres"`
+	IsPublished    *bool    `json:"is_published"`
+	AllowDownloads *bool    `json:"allow_downloads"`
+	IsCompleted    *bool    `json:"is_completed"`
 }
 
-// GetBooks returns all books for the authenticated user
+// GetBooks returns the books the authenticated user is a member of, with
+// the role they hold on each
 func GetBooks(c *gin.Context) {
 	currentUser, exists := middleware.GetCurrentUser(c)
 	if !exists {
@@ -40,23 +47,36 @@ func GetBooks(c *gin.Context) {
 	var books []models.Book
 	query := database.DB.Preload("Author").Preload("Chapters")
 
-	// If user is not admin, only show their own books
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Where("author_id = ?", currentUser.ID)
+	// Unless the user moderates content, only show the books they work on
+	if !middleware.HasPermission(c, models.PermContentModerate) {
+		query = query.Where("id IN (?)", membership.BookIDs(database.DB, currentUser.ID))
 	}
 
 	if err := query.Find(&books).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch books"})
 		return
 	}
+	for i := range books {
+		signChapterImages(books[i].Chapters)
+	}
 
-	c.JSON(http.StatusOK, gin.H{"books": books})
+	var members []models.BookMember
+	if err := database.DB.Where("user_id = ?", currentUser.ID).Find(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch books"})
+		return
+	}
+	roles := make(map[uint]models.BookRole, len(members))
+	for _, member := range members {
+		roles[member.BookID] = member.Role
+	}
+
+	c.JSON(http.StatusOK, gin.H{"books": books, "roles": roles})
 }
 
 // GetPublicBooks returns published books for public viewing
 func GetPublicBooks(c *gin.Context) {
 	var books []models.Book
-	query := database.DB.Preload("Author").Preload("Chapters")
+	query := database.DB.Preload("Author").Preload("Chapters", withoutChapterBodies)
 
 	// Only show published books
 	query = query.Where("is_published = ?", true)
@@ -71,9 +91,7 @@ func GetPublicBooks(c *gin.Context) {
 	}
 
 	// Pagination
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
-	offset := (page - 1) * limit
+	page, limit, offset := paginate(c, 20)
 
 	query = query.Offset(offset).Limit(limit).Order("created_at DESC")
 
@@ -81,6 +99,9 @@ func GetPublicBooks(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch books"})
 		return
 	}
+	for i := range books {
+		signChapterImages(books[i].Chapters)
+	}
 
 	// Get total count for pagination
 	var total int64
@@ -131,7 +152,13 @@ func CreateBook(c *gin.Context) {
 		book.CoverImageURL = &req.CoverImageURL
 	}
 
-	if err := database.DB.Create(&book).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&book).Error; err != nil {
+			return err
+		}
+		return membership.AddOwner(tx, &book)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to create book",
 			"details": err.Error(),
@@ -145,40 +172,20 @@ func CreateBook(c *gin.Context) {
 	})
 }
 
-// GetBook returns a specific book
+// GetBook returns a specific book with the role the user holds on it
 func GetBook(c *gin.Context) {
-	bookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
-		return
-	}
-
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
 		return
 	}
 
-	var book models.Book
-	query := database.DB.Preload("Author").Preload("Chapters")
-
-	// If user is not admin, only allow access to their own books
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Where("id = ? AND author_id = ?", bookID, currentUser.ID)
-	} else {
-		query = query.Where("id = ?", bookID)
-	}
-
-	if err := query.First(&book).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
-			return
-		}
+	if err := database.DB.Preload("Author").Preload("Chapters").First(book, book.ID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
 		return
 	}
+	signChapterImages(book.Chapters)
 
-	c.JSON(http.StatusOK, gin.H{"book": book})
+	c.JSON(http.StatusOK, gin.H{"book": book, "role": role})
 }
 
 // GetPublicBook returns a published book for public viewing
@@ -190,7 +197,7 @@ func GetPublicBook(c *gin.Context) {
 	}
 
 	var book models.Book
-	if err := database.DB.Preload("Author").Preload("Chapters").
+	if err := database.DB.Preload("Author").Preload("Chapters", withoutChapterBodies).
 		Where("id = ? AND is_published = ?", bookID, true).
 		First(&book).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -204,45 +211,31 @@ func GetPublicBook(c *gin.Context) {
 	// Filter out private chapters
 	publishedChapters := book.GetPublishedChapters()
 	book.Chapters = publishedChapters
+	signChapterImages(book.Chapters)
 
 	c.JSON(http.StatusOK, gin.H{"book": book})
 }
 
-// UpdateBook updates a book
+// UpdateBook updates a book. The owner and co-authors can edit it;
+// publishing also needs the books.publish permission.
 func UpdateBook(c *gin.Context) {
-	bookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
-		return
-	}
-
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
-		return
-	}
-
 	var req UpdateBookRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get the book
-	var book models.Book
-	query := database.DB.Where("id = ?", bookID)
-
-	// If user is not admin, only allow updates to their own books
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Where("author_id = ?", currentUser.ID)
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanWrite() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can edit this book"})
+		return
 	}
 
-	if err := query.First(&book).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+	if req.IsPublished != nil && *req.IsPublished && !book.IsPublished && !middleware.HasPermission(c, models.PermBooksPublish) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to publish books"})
 		return
 	}
 
@@ -267,9 +260,21 @@ func UpdateBook(c *gin.Context) {
 
 	if req.IsPublished != nil {
 		updates["is_published"] = *req.IsPublished
+		// Publishing by hand replaces any schedule
+		if *req.IsPublished {
+			updates["publish_at"] = nil
+		}
+	}
+
+	if req.AllowDownloads != nil {
+		updates["allow_downloads"] = *req.AllowDownloads
+	}
+
+	if req.IsCompleted != nil {
+		updates["is_completed"] = *req.IsCompleted
 	}
 
-	if err := database.DB.Model(&book).Updates(updates).Error; err != nil {
+	if err := database.DB.Model(book).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
 		return
 	}
@@ -280,43 +285,43 @@ func UpdateBook(c *gin.Context) {
 	})
 }
 
-// DeleteBook deletes a book
+// DeleteBook deletes a book. Only the owner can delete it.
 func DeleteBook(c *gin.Context) {
-	bookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
-		return
-	}
-
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
 		return
 	}
-
-	// Get the book
-	var book models.Book
-	query := database.DB.Where("id = ?", bookID)
-
-	// If user is not admin, only allow deletion of their own books
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Where("author_id = ?", currentUser.ID)
-	}
-
-	if err := query.First(&book).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+	if !role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can delete this book"})
 		return
 	}
 
 	// Delete book (this will cascade to chapters due to foreign key constraint)
-	if err := database.DB.Delete(&book).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("book_id = ?", book.ID).Delete(&models.BookInvitation{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("book_id = ?", book.ID).Delete(&models.BookMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("book_id = ?", book.ID).Delete(&models.BookExport{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(book).Error
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
 		return
 	}
+	if err := media.DeleteFor(c.Request.Context(), database.DB, storage.Default, media.KindCover, book.ID); err != nil {
+		log.Printf("[MEDIA] Failed to delete cover of book %d: %v", book.ID, err)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Book deleted successfully"})
 }
+
+// withoutChapterBodies leaves the content of preloaded chapters out of public
+// book listings; readers fetch each chapter's sanitized HTML on its own
+func withoutChapterBodies(db *gorm.DB) *gorm.DB {
+	return db.Omit("content", "rendered_html")
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"fdip/internal/database"
+	"fdip/internal/diff"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/versions"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SaveDraftRequest represents an autosaved edit of a chapter
+type SaveDraftRequest struct {
+	Title       string             `json:"title" binding:"max=255"`
+	Content     string             `json:"content"`
+	ContentType models.ContentType `json:"content_type" binding:"omitempty,oneof=markdown html"`
+}
+
+// GetChapterVersions lists the versions of a chapter, newest first, without
+// their content
+func GetChapterVersions(c *gin.Context) {
+	chapter, _, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var list []models.ChapterVersion
+	if err := database.DB.Preload("Author").
+		Omit("content").
+		Where("chapter_id = ?", chapter.ID).
+		Order("version_number DESC").
+		Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"versions": list})
+}
+
+// GetChapterVersion returns a version of a chapter by its number
+func GetChapterVersion(c *gin.Context) {
+	chapter, _, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	version, ok := findVersion(c, chapter.ID, c.Param("version"))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"version": version})
+}
+
+// DiffChapterVersions compares two versions of a chapter. from and to are
+// version numbers, "current" for the chapter as saved or "draft" for the
+// user's autosaved draft; to defaults to "current". mode is "line" (the
+// default) or "word".
+func DiffChapterVersions(c *gin.Context) {
+	chapter, _, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	mode := c.DefaultQuery("mode", "line")
+	if mode != "line" && mode != "word" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be line or word"})
+		return
+	}
+
+	from, ok := versionText(c, chapter, c.Query("from"))
+	if !ok {
+		return
+	}
+	to, ok := versionText(c, chapter, c.DefaultQuery("to", "current"))
+	if !ok {
+		return
+	}
+
+	ops := diff.Lines(from, to)
+	if mode == "word" {
+		ops = diff.Words(from, to)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from": c.Query("from"),
+		"to":   c.DefaultQuery("to", "current"),
+		"mode": mode,
+		"ops":  ops,
+	})
+}
+
+// RestoreChapterVersion copies an old version back into the chapter
+func RestoreChapterVersion(c *gin.Context) {
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanEditChapters() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot edit chapters of this book"})
+		return
+	}
+
+	version, ok := findVersion(c, chapter.ID, c.Param("version"))
+	if !ok {
+		return
+	}
+
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+	if err := versions.Restore(database.DB, chapter, version, currentUserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Version restored",
+		"chapter": chapter,
+	})
+}
+
+// GetChapterDraft returns the current user's autosaved draft of a chapter.
+// stale is set when the chapter has been saved since the draft was.
+func GetChapterDraft(c *gin.Context) {
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanEditChapters() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot edit chapters of this book"})
+		return
+	}
+
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+	var draft models.ChapterDraft
+	if err := database.DB.Where("chapter_id = ? AND user_id = ?", chapter.ID, currentUserID).First(&draft).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No draft saved"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch draft"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"draft": draft,
+		"stale": chapter.UpdatedAt.After(draft.UpdatedAt),
+	})
+}
+
+// SaveChapterDraft autosaves the current user's edit of a chapter without
+// changing what readers see
+func SaveChapterDraft(c *gin.Context) {
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanEditChapters() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot edit chapters of this book"})
+		return
+	}
+
+	var req SaveDraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+	draft := models.ChapterDraft{
+		ChapterID:   chapter.ID,
+		UserID:      currentUserID,
+		Title:       req.Title,
+		Content:     req.Content,
+		ContentType: req.ContentType,
+	}
+	if draft.Title == "" {
+		draft.Title = chapter.Title
+	}
+	if draft.ContentType == "" {
+		draft.ContentType = chapter.ContentType
+	}
+
+	if err := versions.SaveDraft(database.DB, &draft); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save draft"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Draft saved",
+		"saved_at": draft.UpdatedAt,
+	})
+}
+
+// DeleteChapterDraft discards the current user's draft of a chapter
+func DeleteChapterDraft(c *gin.Context) {
+	chapter, _, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+	if err := versions.DiscardDraft(database.DB, chapter.ID, currentUserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to discard draft"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Draft discarded"})
+}
+
+// findVersion loads a version of a chapter by its number
+func findVersion(c *gin.Context, chapterID uint, number string) (*models.ChapterVersion, bool) {
+	versionNumber, err := strconv.ParseUint(number, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version number"})
+		return nil, false
+	}
+
+	var version models.ChapterVersion
+	if err := database.DB.Preload("Author").
+		Where("chapter_id = ? AND version_number = ?", chapterID, versionNumber).
+		First(&version).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch version"})
+		return nil, false
+	}
+	return &version, true
+}
+
+// versionText returns the content named by ref: a version number, "current"
+// or "draft"
+func versionText(c *gin.Context, chapter *models.Chapter, ref string) (string, bool) {
+	switch ref {
+	case "current":
+		return chapter.Content, true
+	case "draft":
+		currentUserID, _ := middleware.GetCurrentUserID(c)
+		var draft models.ChapterDraft
+		if err := database.DB.Where("chapter_id = ? AND user_id = ?", chapter.ID, currentUserID).First(&draft).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "No draft saved"})
+				return "", false
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch draft"})
+			return "", false
+		}
+		return draft.Content, true
+	}
+
+	version, ok := findVersion(c, chapter.ID, ref)
+	if !ok {
+		return "", false
+	}
+	return version.Content, true
+}
@@ -1,155 +1,170 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
+	"fdip/internal/content"
 	"fdip/internal/database"
+	"fdip/internal/media"
 	"fdip/internal/middleware"
 	"fdip/internal/models"
+	"fdip/internal/paywall"
+	"fdip/internal/publishing"
+	"fdip/internal/storage"
+	"fdip/internal/versions"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 // CreateChapterRequest represents the chapter creation request
 type CreateChapterRequest struct {
-	Title         string                `json:"title" binding:"required,min=1,max=255"`
-	Content       string                `json:"content" binding:"required"`
-	ContentType   models.ContentType    `json:"content_type" binding:"required"`
-	ImageURL      string                `json:"image_url"`
-	ChapterNumber uint                  `json:"chapter_number" binding:"required"`
-	IsPublished   bool                  `json:"is_published"`
-	IsPrivate     bool                  `json:"is_private"`
+	Title            string             `json:"title" binding:"required,min=1,max=255"`
+	Content          string             `json:"content" binding:"required"`
+	ContentType      models.ContentType `json:"content_type" binding:"required"`
+	ImageURL         string             `json:"image_url"`
+	ChapterNumber    uint               `json:"chapter_number" binding:"required"`
+	IsPublished      bool               `json:"is_published"`
+	IsPrivate        bool               `json:"is_private"`
+	PublishAt        *time.Time         `json:"publish_at"` // Schedule an unpublished chapter
+	IsPremium        bool               `json:"is_premium"`
+	PriceTokens      int                `json:"price_tokens"`
+	FreeAfterDays    *int               `json:"free_after_days"`
+	SubscribersOnly  bool               `json:"subscribers_only"`
+	EarlyAccessUntil *time.Time         `json:"early_access_until"` // Subscribers with early access read the chapter first
 }
 
 // UpdateChapterRequest represents the chapter update request
 type UpdateChapterRequest struct {
-	Title         string                `json:"title" binding:"required,min=1,max=255"`
-	Content       string                `json:"content" binding:"required"`
-	ContentType   models.ContentType    `json:"content_type" binding:"required"`
-	ImageURL      string                `json:"image_url"`
-	ChapterNumber uint                  `json:"chapter_number" binding:"required"`
-	IsPublished   bool                  `json:"is_published"`
-	IsPrivate     bool                  `json:"is_private"`
+	Title            string             `json:"title" binding:"required,min=1,max=255"`
+	Content          string             `json:"content" binding:"required"`
+	ContentType      models.ContentType `json:"content_type" binding:"required"`
+	ImageURL         string             `json:"image_url"`
+	ChapterNumber    uint               `json:"chapter_number" binding:"required"`
+	IsPublished      bool               `json:"is_published"`
+	IsPrivate        bool               `json:"is_private"`
+	IsPremium        bool               `json:"is_premium"`
+	PriceTokens      int                `json:"price_tokens"`
+	FreeAfterDays    *int               `json:"free_after_days"`
+	SubscribersOnly  bool               `json:"subscribers_only"`
+	EarlyAccessUntil *time.Time         `json:"early_access_until"` // Subscribers with early access read the chapter first
 }
 
 // GetChapters returns all chapters for a book
 func GetChapters(c *gin.Context) {
-	bookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
-		return
-	}
-
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
-		return
-	}
-
-	// Check if user has access to this book
-	var book models.Book
-	query := database.DB.Where("id = ?", bookID)
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Where("author_id = ?", currentUser.ID)
-	}
-
-	if err := query.First(&book).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+	book, _, ok := findBookAs(c, c.Param("id"))
+	if !ok {
 		return
 	}
 
 	var chapters []models.Chapter
-	if err := database.DB.Where("book_id = ?", bookID).
+	if err := database.DB.Where("book_id = ?", book.ID).
 		Order("chapter_number ASC").
 		Find(&chapters).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chapters"})
 		return
 	}
+	signChapterImages(chapters)
 
 	c.JSON(http.StatusOK, gin.H{"chapters": chapters})
 }
 
-// CreateChapter creates a new chapter
+// CreateChapter creates a new chapter. The owner and co-authors can add
+// chapters.
 func CreateChapter(c *gin.Context) {
-	bookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+	var req CreateChapterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
 		return
 	}
-
-	var req CreateChapterRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !role.CanWrite() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can add chapters"})
 		return
 	}
+	currentUserID, _ := middleware.GetCurrentUserID(c)
 
-	// Check if user has access to this book
-	var book models.Book
-	query := database.DB.Where("id = ?", bookID)
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Where("author_id = ?", currentUser.ID)
+	if (req.IsPublished || req.PublishAt != nil) && !middleware.HasPermission(c, models.PermBooksPublish) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to publish chapters"})
+		return
 	}
 
-	if err := query.First(&book).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+	if req.PublishAt != nil {
+		if req.IsPublished {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only unpublished chapters can be scheduled"})
+			return
+		}
+		if err := publishing.ValidateSchedule(*req.PublishAt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+	}
+
+	if err := paywall.Validate(req.IsPremium, req.PriceTokens, req.FreeAfterDays); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Check if chapter number already exists
 	var existingChapter models.Chapter
-	if err := database.DB.Where("book_id = ? AND chapter_number = ?", bookID, req.ChapterNumber).
+	if err := database.DB.Where("book_id = ? AND chapter_number = ?", book.ID, req.ChapterNumber).
 		First(&existingChapter).Error; err == nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "Chapter number already exists"})
 		return
 	}
 
 	chapter := models.Chapter{
-		BookID:       uint(bookID),
-		Title:        req.Title,
-		Content:      req.Content,
-		ContentType:  req.ContentType,
-		ChapterNumber: req.ChapterNumber,
-		IsPublished:  req.IsPublished,
-		IsPrivate:    req.IsPrivate,
+		BookID:           book.ID,
+		Title:            req.Title,
+		Content:          req.Content,
+		ContentType:      req.ContentType,
+		ChapterNumber:    req.ChapterNumber,
+		IsPublished:      req.IsPublished,
+		IsPrivate:        req.IsPrivate,
+		PublishAt:        req.PublishAt,
+		IsPremium:        req.IsPremium,
+		PriceTokens:      req.PriceTokens,
+		FreeAfterDays:    req.FreeAfterDays,
+		SubscribersOnly:  req.SubscribersOnly,
+		EarlyAccessUntil: req.EarlyAccessUntil,
+	}
+	if chapter.IsPublished {
+		now := time.Now()
+		chapter.PublishedAt = &now
 	}
 
 	if req.ImageURL != "" {
 		chapter.ImageURL = &req.ImageURL
 	}
 
-	// Calculate word count
-	chapter.CalculateWordCount()
-
-	if err := database.DB.Create(&chapter).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chapter"})
+	// Render the content and calculate word count
+	if err := chapter.Render(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to render chapter content"})
 		return
 	}
 
-	// Create initial version if chapter is published
-	if chapter.IsPublished {
-		version := models.ChapterVersion{
-			ChapterID:     chapter.ID,
-			Content:       chapter.Content,
-			ContentType:   chapter.ContentType,
-			VersionNumber: 1,
+	// Create the chapter, with its first version if it is published
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chapter).Error; err != nil {
+			return err
 		}
-		database.DB.Create(&version)
+		if !chapter.IsPublished {
+			return nil
+		}
+		_, err := versions.Record(tx, &chapter, &currentUserID, models.VersionSourcePublish, nil)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chapter"})
+		return
 	}
+	signChapterImage(&chapter)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Chapter created successfully",
@@ -157,42 +172,20 @@ func CreateChapter(c *gin.Context) {
 	})
 }
 
-// GetChapter returns a specific chapter
+// GetChapter returns a specific chapter to any member of its book, including
+// unpublished chapters for beta readers
 func GetChapter(c *gin.Context) {
-	chapterID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chapter ID"})
-		return
-	}
-
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
-		return
-	}
-
-	var chapter models.Chapter
-	query := database.DB.Preload("Book").Preload("Book.Author").Where("id = ?", chapterID)
-
-	// If user is not admin, check if they own the book
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Joins("JOIN books ON chapters.book_id = books.id").
-			Where("books.author_id = ?", currentUser.ID)
-	}
-
-	if err := query.First(&chapter).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Chapter not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chapter"})
+	chapter, _, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
 		return
 	}
+	signChapterImage(chapter)
 
 	c.JSON(http.StatusOK, gin.H{"chapter": chapter})
 }
 
-// GetPublicChapter returns a published chapter for public viewing
+// GetPublicChapter returns a published chapter for public viewing. Readers
+// get the sanitized HTML rather than the raw content.
 func GetPublicChapter(c *gin.Context) {
 	chapterID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
@@ -212,103 +205,159 @@ func GetPublicChapter(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"chapter": chapter})
-}
+	// Chapters saved before the current rendering pipeline are rendered on
+	// the fly until the background job catches up
+	if chapter.RenderVersion != content.Version {
+		if err := chapter.Render(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render chapter"})
+			return
+		}
+	}
+	chapter.Content = ""
 
-// UpdateChapter updates a chapter
-func UpdateChapter(c *gin.Context) {
-	chapterID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	// Readers who have not unlocked a premium chapter get its opening only
+	lock, canRead, err := chapterLock(c, &chapter)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chapter ID"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chapter"})
 		return
 	}
-
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
-		return
+	if !canRead {
+		chapter.RenderedHTML = content.Teaser(chapter.RenderedHTML, teaserWords)
 	}
+	signChapterImage(&chapter)
+
+	c.JSON(http.StatusOK, gin.H{"chapter": chapter, "lock": lock})
+}
 
+// UpdateChapter updates a chapter. Editors can revise chapters; only the
+// owner and co-authors can publish, unpublish or renumber them.
+func UpdateChapter(c *gin.Context) {
 	var req UpdateChapterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get the chapter
-	var chapter models.Chapter
-	query := database.DB.Preload("Book").Where("id = ?", chapterID)
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanEditChapters() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot edit chapters of this book"})
+		return
+	}
+	if !role.CanWrite() && (req.IsPublished != chapter.IsPublished || req.IsPrivate != chapter.IsPrivate || req.ChapterNumber != chapter.ChapterNumber) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can publish or renumber chapters"})
+		return
+	}
 
-	// If user is not admin, check if they own the book
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Joins("JOIN books ON chapters.book_id = books.id").
-			Where("books.author_id = ?", currentUser.ID)
+	if !role.CanWrite() && (req.IsPremium != chapter.IsPremium || req.PriceTokens != chapter.PriceTokens || !sameDays(req.FreeAfterDays, chapter.FreeAfterDays) ||
+		req.SubscribersOnly != chapter.SubscribersOnly || !sameTime(req.EarlyAccessUntil, chapter.EarlyAccessUntil)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can change who may read chapters"})
+		return
+	}
+	if err := paywall.Validate(req.IsPremium, req.PriceTokens, req.FreeAfterDays); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	if err := query.First(&chapter).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Chapter not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chapter"})
+	if req.IsPublished && !chapter.IsPublished && !middleware.HasPermission(c, models.PermBooksPublish) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to publish chapters"})
 		return
 	}
 
 	// Check if new chapter number conflicts with existing chapter
 	if req.ChapterNumber != chapter.ChapterNumber {
 		var existingChapter models.Chapter
-		if err := database.DB.Where("book_id = ? AND chapter_number = ? AND id != ?", 
-			chapter.BookID, req.ChapterNumber, chapterID).First(&existingChapter).Error; err == nil {
+		if err := database.DB.Where("book_id = ? AND chapter_number = ? AND id != ?",
+			chapter.BookID, req.ChapterNumber, chapter.ID).First(&existingChapter).Error; err == nil {
 			c.JSON(http.StatusConflict, gin.H{"error": "Chapter number already exists"})
 			return
 		}
 	}
 
-	// Create version if chapter is being published and wasn't published before
-	wasPublished := chapter.IsPublished
-	if req.IsPublished && !wasPublished {
-		// Get the latest version number
-		var maxVersion uint
-		database.DB.Model(&models.ChapterVersion{}).
-			Where("chapter_id = ?", chapter.ID).
-			Select("COALESCE(MAX(version_number), 0)").
-			Scan(&maxVersion)
-
-		version := models.ChapterVersion{
-			ChapterID:     chapter.ID,
-			Content:       req.Content,
-			ContentType:   req.ContentType,
-			VersionNumber: maxVersion + 1,
-		}
-		database.DB.Create(&version)
-	}
-
 	// Update chapter
 	updates := map[string]interface{}{
-		"title":          req.Title,
-		"content":        req.Content,
-		"content_type":   req.ContentType,
-		"chapter_number": req.ChapterNumber,
-		"is_published":   req.IsPublished,
-		"is_private":     req.IsPrivate,
+		"title":              req.Title,
+		"content":            req.Content,
+		"content_type":       req.ContentType,
+		"chapter_number":     req.ChapterNumber,
+		"is_published":       req.IsPublished,
+		"is_private":         req.IsPrivate,
+		"is_premium":         req.IsPremium,
+		"price_tokens":       req.PriceTokens,
+		"free_after_days":    req.FreeAfterDays,
+		"subscribers_only":   req.SubscribersOnly,
+		"early_access_until": req.EarlyAccessUntil,
 	}
 
 	if req.ImageURL != "" {
 		updates["image_url"] = req.ImageURL
 	}
 
-	// Calculate word count
-	tempChapter := models.Chapter{
+	// Publishing by hand replaces any schedule
+	if req.IsPublished {
+		updates["publish_at"] = nil
+		if chapter.PublishedAt == nil {
+			now := time.Now()
+			updates["published_at"] = now
+			chapter.PublishedAt = &now
+		}
+	}
+
+	// Render the content and calculate word count
+	rendered := models.Chapter{
 		Content:     req.Content,
 		ContentType: req.ContentType,
 	}
-	tempChapter.CalculateWordCount()
-	updates["word_count"] = tempChapter.WordCount
+	if err := rendered.Render(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to render chapter content"})
+		return
+	}
+	for column, value := range rendered.RenderedColumns() {
+		updates[column] = value
+	}
 
-	if err := database.DB.Model(&chapter).Updates(updates).Error; err != nil {
+	// Save the chapter and, if it is published, a version of it. Saving
+	// replaces the editor's autosaved draft.
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+	wasPublished := chapter.IsPublished
+	chapter.Title = req.Title
+	chapter.Content = req.Content
+	chapter.ContentType = req.ContentType
+	chapter.IsPublished = req.IsPublished
+	chapter.IsPremium = req.IsPremium
+	chapter.PriceTokens = req.PriceTokens
+	chapter.FreeAfterDays = req.FreeAfterDays
+	chapter.SubscribersOnly = req.SubscribersOnly
+	chapter.EarlyAccessUntil = req.EarlyAccessUntil
+	chapter.RenderedHTML = rendered.RenderedHTML
+	chapter.WordCount = rendered.WordCount
+	chapter.ReadingMinutes = rendered.ReadingMinutes
+	chapter.RenderVersion = rendered.RenderVersion
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(chapter).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := versions.DiscardDraft(tx, chapter.ID, currentUserID); err != nil {
+			return err
+		}
+		if !chapter.IsPublished {
+			return nil
+		}
+
+		source := models.VersionSourceSave
+		if !wasPublished {
+			source = models.VersionSourcePublish
+		}
+		_, err := versions.Record(tx, chapter, &currentUserID, source, nil)
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chapter"})
 		return
 	}
+	signChapterImage(chapter)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Chapter updated successfully",
@@ -316,44 +365,70 @@ func UpdateChapter(c *gin.Context) {
 	})
 }
 
-// DeleteChapter deletes a chapter
+// DeleteChapter deletes a chapter. The owner and co-authors can delete
+// chapters.
 func DeleteChapter(c *gin.Context) {
-	chapterID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chapter ID"})
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanWrite() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can delete chapters"})
 		return
 	}
 
-	currentUser, exists := middleware.GetCurrentUser(c)
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+	// Delete chapter with its history and drafts
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("chapter_id = ?", chapter.ID).Delete(&models.ChapterVersion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("chapter_id = ?", chapter.ID).Delete(&models.ChapterDraft{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("chapter_id = ?", chapter.ID).Delete(&models.ChapterUnlock{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(chapter).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chapter"})
 		return
 	}
+	if err := media.DeleteFor(c.Request.Context(), database.DB, storage.Default, media.KindChapterImage, chapter.ID); err != nil {
+		log.Printf("[MEDIA] Failed to delete images of chapter %d: %v", chapter.ID, err)
+	}
 
-	// Get the chapter
-	var chapter models.Chapter
-	query := database.DB.Preload("Book").Where("id = ?", chapterID)
+	c.JSON(http.StatusOK, gin.H{"message": "Chapter deleted successfully"})
+}
 
-	// If user is not admin, check if they own the book
-	if currentUser.Role != models.RoleAdmin {
-		query = query.Joins("JOIN books ON chapters.book_id = books.id").
-			Where("books.author_id = ?", currentUser.ID)
+// findChapterAs loads a chapter with its book and the role the current user
+// holds on the book, responding with 404 when the user is not a member
+func findChapterAs(c *gin.Context, id string) (*models.Chapter, models.BookRole, bool) {
+	chapterID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chapter ID"})
+		return nil, "", false
+	}
+
+	currentUserID, exists := middleware.GetCurrentUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return nil, "", false
 	}
 
-	if err := query.First(&chapter).Error; err != nil {
+	var chapter models.Chapter
+	if err := database.DB.Preload("Book").Preload("Book.Author").First(&chapter, chapterID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Chapter not found"})
-			return
+			return nil, "", false
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chapter"})
-		return
+		return nil, "", false
 	}
 
-	// Delete chapter (this will cascade to versions due to foreign key constraint)
-	if err := database.DB.Delete(&chapter).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chapter"})
-		return
+	role, ok := bookRoleOf(c, chapter.BookID, currentUserID, "Chapter not found")
+	if !ok {
+		return nil, "", false
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Chapter deleted successfully"})
-} 
\ No newline at end of file
+	return &chapter, role, true
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+
+	"fdip/internal/content"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PreviewRequest represents content to render without saving it
+type PreviewRequest struct {
+	Content     string             `json:"content"`
+	ContentType models.ContentType `json:"content_type" binding:"required,oneof=markdown html"`
+}
+
+// PreviewContent renders Markdown or HTML the way readers will see it
+func PreviewContent(c *gin.Context) {
+	var req PreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rendered, err := content.Render(req.Content, content.Format(req.ContentType))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to render content"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"html":            rendered.HTML,
+		"text":            rendered.Text,
+		"word_count":      rendered.WordCount,
+		"reading_minutes": rendered.ReadingMinutes,
+	})
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/epub"
+	"fdip/internal/membership"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// DownloadBookEPUB returns a published book's free chapters as an EPUB.
+// Members of the book can download it even when the authors have turned
+// downloads off.
+func DownloadBookEPUB(c *gin.Context) {
+	bookID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+		return
+	}
+
+	var book models.Book
+	if err := database.DB.Preload("Author").Preload("Chapters", withoutChapterBodies).
+		Where("id = ? AND is_published = ?", bookID, true).
+		First(&book).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+		return
+	}
+
+	if !book.AllowDownloads && !isBookMember(c, book.ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The authors have turned off downloads for this book"})
+		return
+	}
+	if len(epub.Chapters(&book, time.Now())) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Book has no free chapters to download"})
+		return
+	}
+
+	etag := fmt.Sprintf("%q", epub.Revision(&book))
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	data, err := epub.Export(c.Request.Context(), database.DB, &book)
+	if err != nil {
+		log.Printf("[EPUB] Failed to export book %d: %v", book.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate EPUB"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", epub.Filename(&book)))
+	c.Data(http.StatusOK, epub.MediaType, data)
+}
+
+// isBookMember reports whether the current user, if any, is a member of the
+// book
+func isBookMember(c *gin.Context, bookID uint) bool {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return false
+	}
+	_, err := membership.RoleOf(database.DB, bookID, userID)
+	return err == nil
+}
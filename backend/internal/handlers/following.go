@@ -20,9 +20,7 @@ func GetFollowing(c *gin.Context) {
 	}
 
 	// Get pagination parameters
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
-	offset := (page - 1) * limit
+	page, limit, offset := paginate(c, 20)
 
 	following, err := models.GetFollowing(database.DB, currentUser.ID, limit, offset)
 	if err != nil {
@@ -150,9 +148,7 @@ func UnfollowAuthor(c *gin.Context) {
 // GetAuthors returns a list of authors for public viewing
 func GetAuthors(c *gin.Context) {
 	// Get pagination parameters
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
-	offset := (page - 1) * limit
+	page, limit, offset := paginate(c, 20)
 
 	var authors []models.User
 	query := database.DB.Where("role IN (?, ?)", models.RoleAuthor, models.RoleAdmin)
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"fdip/internal/database"
+	"fdip/internal/manuscript"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CommitImportRequest represents the author's choices when turning an
+// import into a book
+type CommitImportRequest struct {
+	Title       string   `json:"title" binding:"max=255"`
+	Description string   `json:"description"`
+	Genres      []string `json:"genres"`
+	Chapters    []int    `json:"chapters"` // Preview numbers of the chapters to keep; all when empty
+}
+
+// ImportManuscript parses an uploaded EPUB, DOCX, Markdown file or zip of
+// Markdown files and returns a preview of the chapters found. Nothing is
+// created until the import is committed.
+func ImportManuscript(c *gin.Context) {
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, manuscript.MaxUploadSize+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload the manuscript as the \"file\" field, up to 20 MB"})
+		return
+	}
+	if header.Size > manuscript.MaxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Manuscripts can be up to 20 MB"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, manuscript.MaxUploadSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+
+	parsed, err := manuscript.Parse(header.Filename, data)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	imp, err := manuscript.Save(database.DB, currentUserID, header.Filename, parsed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save import"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"import": importReport(imp, parsed)})
+}
+
+// GetManuscriptImport returns the preview of one of the user's imports
+func GetManuscriptImport(c *gin.Context) {
+	imp, ok := findImport(c)
+	if !ok {
+		return
+	}
+
+	parsed, err := manuscript.Load(imp)
+	if err != nil {
+		log.Printf("[IMPORT] %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load import"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"import": importReport(imp, parsed)})
+}
+
+// CommitManuscriptImport creates a draft book from an import, with its
+// chapters unpublished and numbered in order
+func CommitManuscriptImport(c *gin.Context) {
+	var req CommitImportRequest
+	// The body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	imp, ok := findImport(c)
+	if !ok {
+		return
+	}
+
+	book, err := manuscript.Commit(database.DB, imp, manuscript.CommitOptions{
+		Title:       req.Title,
+		Description: req.Description,
+		Genres:      req.Genres,
+		Chapters:    req.Chapters,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, manuscript.ErrImportClosed):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, manuscript.ErrNoSelection), errors.Is(err, manuscript.ErrBadSelection):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			log.Printf("[IMPORT] Failed to commit import %d: %v", imp.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book"})
+		}
+		return
+	}
+
+	if err := database.DB.Preload("Chapters", withoutChapterBodies).First(book, book.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Book imported successfully",
+		"book":    book,
+	})
+}
+
+// DiscardManuscriptImport deletes an import without creating a book
+func DiscardManuscriptImport(c *gin.Context) {
+	imp, ok := findImport(c)
+	if !ok {
+		return
+	}
+
+	if err := manuscript.Discard(database.DB, imp); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to discard import"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Import discarded"})
+}
+
+// findImport loads the current user's import named in the URL, writing the
+// error response if it cannot
+func findImport(c *gin.Context) (*models.ManuscriptImport, bool) {
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import ID"})
+		return nil, false
+	}
+
+	imp, err := manuscript.Find(database.DB, uint(id), currentUserID)
+	if err != nil {
+		if errors.Is(err, manuscript.ErrImportNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Import not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch import"})
+		return nil, false
+	}
+	return imp, true
+}
+
+// importReport describes an import and the chapters found in it, without
+// their full text
+func importReport(imp *models.ManuscriptImport, m *manuscript.Manuscript) gin.H {
+	chapters := make([]gin.H, len(m.Chapters))
+	totalWords := 0
+	for i, chapter := range m.Chapters {
+		chapters[i] = gin.H{
+			"number":     i + 1,
+			"title":      chapter.Title,
+			"word_count": chapter.WordCount,
+			"excerpt":    chapter.Excerpt,
+		}
+		totalWords += chapter.WordCount
+	}
+
+	return gin.H{
+		"id":          imp.ID,
+		"filename":    imp.Filename,
+		"format":      imp.Format,
+		"title":       imp.Title,
+		"author":      imp.Author,
+		"status":      imp.Status,
+		"book_id":     imp.BookID,
+		"expires_at":  imp.ExpiresAt,
+		"chapters":    chapters,
+		"total_words": totalWords,
+		"warnings":    m.Warnings,
+	}
+}
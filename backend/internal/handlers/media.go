@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"fdip/internal/database"
+	"fdip/internal/media"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UploadBookCover replaces a book's cover image. The owner and co-authors
+// can change it.
+func UploadBookCover(c *gin.Context) {
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanWrite() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can change the cover"})
+		return
+	}
+
+	m, ok := saveUpload(c, media.KindCover, book.ID)
+	if !ok {
+		return
+	}
+	url := media.URL(m.ID, "large")
+	if err := database.DB.Model(book).Update("cover_image_url", url).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Cover updated successfully",
+		"book":    book,
+		"media":   mediaResponse(m),
+	})
+}
+
+// UploadAvatar replaces the current user's avatar
+func UploadAvatar(c *gin.Context) {
+	user, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	m, ok := saveUpload(c, media.KindAvatar, user.ID)
+	if !ok {
+		return
+	}
+	url := media.URL(m.ID, "large")
+	if err := database.DB.Model(user).Update("avatar_url", url).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Avatar updated successfully",
+		"avatar_url": url,
+		"media":      mediaResponse(m),
+	})
+}
+
+// UploadChapterImage replaces a chapter's image. Chapter images are
+// private: they are only served through signed URLs handed out with the
+// chapter.
+func UploadChapterImage(c *gin.Context) {
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanEditChapters() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot edit chapters of this book"})
+		return
+	}
+
+	m, ok := saveUpload(c, media.KindChapterImage, chapter.ID)
+	if !ok {
+		return
+	}
+	if err := database.DB.Model(chapter).Update("image_url", media.URL(m.ID, "large")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chapter"})
+		return
+	}
+	signChapterImage(chapter)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Chapter image updated successfully",
+		"chapter": chapter,
+		"media":   mediaResponse(m),
+	})
+}
+
+// ServeMedia streams a size of an uploaded image. Private images need a
+// valid signature.
+func ServeMedia(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	variant := c.Param("variant")
+
+	var m models.Media
+	if err := database.DB.First(&m, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if m.Private && !media.Verify(m.ID, variant, c.Request.URL.Query()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Image link has expired or is invalid"})
+		return
+	}
+
+	r, err := media.Open(c.Request.Context(), storage.Default, &m, variant)
+	if err != nil {
+		if errors.Is(err, media.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+			return
+		}
+		log.Printf("[MEDIA] Failed to open media %d/%s: %v", m.ID, variant, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load image"})
+		return
+	}
+	defer r.Close()
+
+	// Objects never change once stored; a new upload gets a new ID
+	if m.Private {
+		c.Header("Cache-Control", "private, max-age=3600")
+	} else {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Type", m.ContentType)
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, r)
+}
+
+// saveUpload reads the "file" field of a multipart upload and stores it as
+// media of the given kind, writing the error response on failure
+func saveUpload(c *gin.Context, kind media.Kind, subjectID uint) (*models.Media, bool) {
+	userID, _ := middleware.GetCurrentUserID(c)
+	limit := media.MaxBytes(kind)
+
+	// Allow some room for the multipart framing around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+64<<10)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": media.ErrTooLarge.Error()})
+			return nil, false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload an image in the \"file\" field"})
+		return nil, false
+	}
+	if header.Size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": media.ErrTooLarge.Error()})
+		return nil, false
+	}
+
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return nil, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return nil, false
+	}
+
+	m, err := media.Save(c.Request.Context(), database.DB, storage.Default, userID, kind, subjectID, data)
+	switch {
+	case err == nil:
+		return m, true
+	case errors.Is(err, media.ErrTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, media.ErrUnsupportedType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, media.ErrInvalidImage), errors.Is(err, media.ErrTooManyPixels):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		log.Printf("[MEDIA] Failed to save %s for %d: %v", kind, subjectID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+	}
+	return nil, false
+}
+
+// mediaResponse describes stored media with the URL of each size
+func mediaResponse(m *models.Media) gin.H {
+	variants := gin.H{}
+	for _, v := range m.GetVariants() {
+		url := media.URL(m.ID, v.Name)
+		if m.Private {
+			url = media.Sign(url)
+		}
+		variants[v.Name] = gin.H{"url": url, "width": v.Width, "height": v.Height}
+	}
+	return gin.H{
+		"id":           m.ID,
+		"kind":         m.Kind,
+		"content_type": m.ContentType,
+		"variants":     variants,
+	}
+}
+
+// signChapterImage swaps a chapter's private image URL for a signed one.
+// The chapter must not be saved afterwards.
+func signChapterImage(chapter *models.Chapter) {
+	if chapter.ImageURL != nil {
+		signed := media.Sign(*chapter.ImageURL)
+		chapter.ImageURL = &signed
+	}
+}
+
+// signChapterImages signs the image URLs of a list of chapters
+func signChapterImages(chapters []models.Chapter) {
+	for i := range chapters {
+		signChapterImage(&chapters[i])
+	}
+}
@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"fdip/internal/auth"
+	"fdip/internal/database"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/oidc"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CompleteOIDCLoginRequest carries the provider's redirect parameters, which
+// the frontend callback page forwards
+type CompleteOIDCLoginRequest struct {
+	State string `json:"state" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+}
+
+var (
+	errOIDCEmailInUse      = errors.New("an account with this email already exists")
+	errOIDCNoEmail         = errors.New("provider did not share an email address")
+	errOIDCLinkedElsewhere = errors.New("identity is linked to another account")
+	errOIDCProviderLinked  = errors.New("provider is already linked")
+)
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// oidcStateCookie binds a sign-in to the browser that started it, so a link
+// to the provider started by someone else cannot be completed by the victim
+const oidcStateCookie = "oidc_state"
+
+// GetOIDCProviders lists the external providers users can sign in with
+func GetOIDCProviders(c *gin.Context) {
+	providers := []gin.H{}
+	for _, p := range oidc.List() {
+		providers = append(providers, gin.H{
+			"name":         p.Name,
+			"display_name": p.DisplayName,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
+
+// StartOIDCLogin begins a sign-in with an external provider and returns the
+// URL to send the user to
+func StartOIDCLogin(c *gin.Context) {
+	startOIDC(c, nil)
+}
+
+// StartOIDCLink begins linking an external provider to the current user's
+// account. The provider redirects back to the same callback as a sign-in.
+func StartOIDCLink(c *gin.Context) {
+	userID, exists := middleware.GetCurrentUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	startOIDC(c, &userID)
+}
+
+func startOIDC(c *gin.Context, linkUserID *uint) {
+	provider, err := oidc.Get(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown sign-in provider"})
+		return
+	}
+
+	state, login, err := auth.BeginOIDCLogin(database.DB, provider.Name, linkUserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(c.Request.Context(), state, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		log.Printf("[OIDC] Failed to build authorization URL for %s: %v", provider.Name, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Sign-in provider is unavailable"})
+		return
+	}
+
+	setOIDCStateCookie(c, auth.OIDCStateBinding(state), int(auth.OIDCLoginTTL.Seconds()))
+	c.JSON(http.StatusOK, gin.H{
+		"authorization_url": authURL,
+		"expires_in":        int(auth.OIDCLoginTTL.Seconds()),
+	})
+}
+
+// CompleteOIDCLogin finishes a sign-in or account link with an external
+// provider. It must be called from the browser that started it, and links
+// by the user who started them. Sign-ins use the account linked to the
+// provider identity, link to an existing account with the same verified
+// email, or create a new one.
+func CompleteOIDCLogin(c *gin.Context) {
+	var req CompleteOIDCLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	binding, _ := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1)
+
+	login, err := auth.ConsumeOIDCLoginState(database.DB, req.State, binding)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidOIDCState) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in, please try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete sign-in"})
+		return
+	}
+
+	if login.LinkUserID != nil {
+		if userID, ok := middleware.GetCurrentUserID(c); !ok || userID != *login.LinkUserID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Sign in to the account that started linking"})
+			return
+		}
+	}
+
+	provider, err := oidc.Get(login.Provider)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown sign-in provider"})
+		return
+	}
+
+	identity, err := provider.Exchange(c.Request.Context(), req.Code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		log.Printf("[OIDC] Sign-in with %s failed: %v", provider.Name, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign-in with " + provider.DisplayName + " failed"})
+		return
+	}
+
+	if login.LinkUserID != nil {
+		completeOIDCLink(c, provider, identity, *login.LinkUserID)
+		return
+	}
+
+	var user models.User
+	created := false
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		created, err = resolveOIDCUser(tx, identity, &user)
+		return err
+	})
+	switch {
+	case errors.Is(err, errOIDCEmailInUse):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("An account with this email already exists. Sign in with your password and link %s from your profile.", provider.DisplayName),
+		})
+		return
+	case errors.Is(err, errOIDCNoEmail):
+		c.JSON(http.StatusBadRequest, gin.H{"error": provider.DisplayName + " did not share an email address"})
+		return
+	case err != nil:
+		log.Printf("[OIDC] Failed to resolve %s identity: %v", provider.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete sign-in"})
+		return
+	}
+
+	if created && !user.IsEmailVerified() {
+		if err := sendVerificationEmail(&user); err != nil {
+			log.Printf("[MAIL] Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}
+
+	// Two-factor authentication still applies to external sign-ins
+	if user.TwoFactorEnabled() {
+		challenge, err := auth.GenerateMFAChallenge(&user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Two-factor code required",
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"expires_in":   int(auth.MFAChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	tokens, err := auth.StartSession(database.DB, &user, c.Request.UserAgent(), c.ClientIP(), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{
+		"message":            "Login successful",
+		"created":            created,
+		"token":              tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+		"user": gin.H{
+			"id":           user.ID,
+			"username":     user.Username,
+			"email":        user.Email,
+			"display_name": user.DisplayName,
+			"role":         user.Role,
+		},
+	})
+}
+
+// GetIdentities lists the external providers linked to the current user
+func GetIdentities(c *gin.Context) {
+	userID, exists := middleware.GetCurrentUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var identities []models.UserIdentity
+	if err := database.DB.Where("user_id = ?", userID).Order("created_at").Find(&identities).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch linked accounts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"identities": identities})
+}
+
+// UnlinkIdentity removes a linked provider from the current user's account.
+// The last way to sign in cannot be removed.
+func UnlinkIdentity(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	identityID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity ID"})
+		return
+	}
+
+	var identity models.UserIdentity
+	if err := database.DB.Where("id = ? AND user_id = ?", identityID, currentUser.ID).First(&identity).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Linked account not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if currentUser.PasswordHash == "" {
+		var others int64
+		if err := database.DB.Model(&models.UserIdentity{}).
+			Where("user_id = ? AND id <> ?", currentUser.ID, identity.ID).
+			Count(&others).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if others == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Set a password before unlinking your last sign-in method"})
+			return
+		}
+	}
+
+	if err := database.DB.Delete(&identity).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink account"})
+		return
+	}
+
+	log.Printf("[OIDC] User %d unlinked %s", currentUser.ID, identity.Provider)
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlinked"})
+}
+
+// setOIDCStateCookie stores the binding of a sign-in in the browser for
+// maxAge seconds, or removes it when maxAge is negative
+func setOIDCStateCookie(c *gin.Context, binding string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, binding, maxAge, "/", "", os.Getenv("ENV") == "production", true)
+}
+
+// completeOIDCLink links a verified provider identity to the user who
+// started the link
+func completeOIDCLink(c *gin.Context, provider *oidc.Provider, identity *oidc.Identity, userID uint) {
+	var link models.UserIdentity
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&link).Error
+		if err == nil {
+			if link.UserID != userID {
+				return errOIDCLinkedElsewhere
+			}
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.UserIdentity{}).
+			Where("user_id = ? AND provider = ?", userID, identity.Provider).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errOIDCProviderLinked
+		}
+
+		link = models.UserIdentity{UserID: userID, Provider: identity.Provider, Subject: identity.Subject, Email: identity.Email}
+		return tx.Create(&link).Error
+	})
+	switch {
+	case errors.Is(err, errOIDCLinkedElsewhere):
+		c.JSON(http.StatusConflict, gin.H{"error": "This " + provider.DisplayName + " account is linked to another user"})
+		return
+	case errors.Is(err, errOIDCProviderLinked):
+		c.JSON(http.StatusConflict, gin.H{"error": "Another " + provider.DisplayName + " account is already linked"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link account"})
+		return
+	}
+
+	log.Printf("[OIDC] User %d linked %s", userID, identity.Provider)
+	c.JSON(http.StatusOK, gin.H{
+		"message":  provider.DisplayName + " account linked",
+		"identity": link,
+	})
+}
+
+// resolveOIDCUser loads the user a provider identity signs in as into user,
+// linking or creating an account when the identity is new. It reports whether
+// an account was created.
+func resolveOIDCUser(tx *gorm.DB, identity *oidc.Identity, user *models.User) (bool, error) {
+	now := time.Now()
+
+	var link models.UserIdentity
+	err := tx.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&link).Error
+	if err == nil {
+		if err := tx.Model(&link).Update("last_login_at", &now).Error; err != nil {
+			return false, err
+		}
+		return false, tx.First(user, link.UserID).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+
+	if identity.Email == "" {
+		return false, errOIDCNoEmail
+	}
+
+	link = models.UserIdentity{Provider: identity.Provider, Subject: identity.Subject, Email: identity.Email, LastLoginAt: &now}
+
+	// Link to an existing account only when both sides have verified the
+	// address, so nobody can claim an account by registering its email first
+	err = tx.Where("email = ?", identity.Email).First(user).Error
+	if err == nil {
+		if !identity.EmailVerified || !user.IsEmailVerified() {
+			return false, errOIDCEmailInUse
+		}
+		link.UserID = user.ID
+		return false, tx.Create(&link).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+
+	username, err := uniqueUsername(tx, identity)
+	if err != nil {
+		return false, err
+	}
+
+	*user = models.User{
+		Username:    username,
+		Email:       identity.Email,
+		DisplayName: identity.Name,
+		Role:        models.RoleReader,
+	}
+	if user.DisplayName == "" {
+		user.DisplayName = username
+	} else if len(user.DisplayName) > 100 {
+		user.DisplayName = user.DisplayName[:100]
+	}
+	if identity.EmailVerified {
+		user.EmailVerifiedAt = &now
+	}
+	if identity.Picture != "" && len(identity.Picture) <= 500 {
+		user.AvatarURL = &identity.Picture
+	}
+	if err := tx.Create(user).Error; err != nil {
+		return false, err
+	}
+
+	if err := tx.Create(&models.UserTokenBalance{UserID: user.ID}).Error; err != nil {
+		return false, err
+	}
+
+	link.UserID = user.ID
+	if err := tx.Create(&link).Error; err != nil {
+		return false, err
+	}
+
+	log.Printf("[OIDC] Created user %d from %s sign-in", user.ID, identity.Provider)
+	return true, nil
+}
+
+// uniqueUsername derives an unused username from a provider identity
+func uniqueUsername(tx *gorm.DB, identity *oidc.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = usernameUnsafe.ReplaceAllString(base, "")
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	if len(base) < 3 {
+		base = "reader" + base
+	}
+
+	candidate := base
+	for i := 2; ; i++ {
+		var count int64
+		if err := tx.Model(&models.User{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s%d", base, i)
+	}
+}
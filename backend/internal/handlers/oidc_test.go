@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fdip/internal/auth"
+	"fdip/internal/database"
+	"fdip/internal/models"
+	"fdip/internal/oidc"
+	"fdip/internal/oidc/oidctest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// setupOIDCTest configures a single "test" provider backed by an in-process
+// issuer on top of an in-memory database
+func setupOIDCTest(t *testing.T) *oidctest.Issuer {
+	t.Helper()
+
+	setupTestDB(t,
+		&models.User{},
+		&models.UserTokenBalance{},
+		&models.UserIdentity{},
+		&models.OIDCLoginState{},
+		&models.Session{},
+		&models.RefreshToken{},
+	)
+
+	t.Setenv("JWT_SECRET", "test-secret")
+	if err := auth.InitJWT(); err != nil {
+		t.Fatalf("failed to init JWT: %v", err)
+	}
+
+	issuer, err := oidctest.NewIssuer("fdip-client", "fdip-secret")
+	if err != nil {
+		t.Fatalf("failed to start issuer: %v", err)
+	}
+	t.Cleanup(issuer.Close)
+
+	prev := oidc.Providers
+	oidc.Providers = map[string]*oidc.Provider{
+		"test": {
+			Name:         "test",
+			DisplayName:  "Test",
+			Issuer:       issuer.URL,
+			ClientID:     issuer.ClientID,
+			ClientSecret: issuer.ClientSecret,
+			RedirectURL:  "http://localhost:3000/auth/callback",
+			Scopes:       []string{"openid", "email", "profile"},
+		},
+	}
+	t.Cleanup(func() { oidc.Providers = prev })
+
+	return issuer
+}
+
+// signInWithOIDC starts a sign-in, approves it at the issuer with claims and
+// completes it, returning the response to the completion
+func signInWithOIDC(t *testing.T, issuer *oidctest.Issuer, claims jwt.MapClaims) *httptest.ResponseRecorder {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/auth/oidc/:provider", StartOIDCLogin)
+	router.POST("/auth/oidc/callback", CompleteOIDCLogin)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/test", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("start sign-in: got status %d, body %s", w.Code, w.Body.String())
+	}
+	var started struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+		t.Fatalf("failed to parse start response: %v", err)
+	}
+
+	code, state, err := issuer.Authorize(started.AuthorizationURL, claims)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	body, _ := json.Marshal(CompleteOIDCLoginRequest{State: state, Code: code})
+	req := httptest.NewRequest(http.MethodPost, "/auth/oidc/callback", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// createOIDCTestUser creates a password account, with a verified email if
+// verified is set
+func createOIDCTestUser(t *testing.T, email string, verified bool) models.User {
+	t.Helper()
+
+	user := models.User{Username: "existing", Email: email, PasswordHash: "x", DisplayName: "Existing", Role: models.RoleReader}
+	if verified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
+
+func TestCompleteOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	issuer := setupOIDCTest(t)
+	user := createOIDCTestUser(t, "reader@example.com", true)
+
+	w := signInWithOIDC(t, issuer, jwt.MapClaims{
+		"sub":            "subject-1",
+		"email":          "reader@example.com",
+		"email_verified": true,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Created bool `json:"created"`
+		User    struct {
+			ID uint `json:"id"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if resp.Created || resp.User.ID != user.ID {
+		t.Errorf("signed in as user %d (created %v), want existing user %d", resp.User.ID, resp.Created, user.ID)
+	}
+
+	var link models.UserIdentity
+	if err := database.DB.Where("provider = ? AND subject = ?", "test", "subject-1").First(&link).Error; err != nil {
+		t.Fatalf("identity was not linked: %v", err)
+	}
+	if link.UserID != user.ID {
+		t.Errorf("identity linked to user %d, want %d", link.UserID, user.ID)
+	}
+
+	// The next sign-in finds the account through the link alone
+	w = signInWithOIDC(t, issuer, jwt.MapClaims{"sub": "subject-1", "email": "changed@example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("second sign-in: got status %d, body %s", w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if resp.User.ID != user.ID {
+		t.Errorf("second sign-in as user %d, want %d", resp.User.ID, user.ID)
+	}
+}
+
+func TestCompleteOIDCLoginRefusesUnverifiedEmail(t *testing.T) {
+	tests := []struct {
+		name             string
+		accountVerified  bool
+		providerVerified bool
+	}{
+		{name: "provider has not verified the email", accountVerified: true},
+		{name: "account has not verified the email", providerVerified: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := setupOIDCTest(t)
+			createOIDCTestUser(t, "reader@example.com", tt.accountVerified)
+
+			w := signInWithOIDC(t, issuer, jwt.MapClaims{
+				"sub":            "subject-1",
+				"email":          "reader@example.com",
+				"email_verified": tt.providerVerified,
+			})
+			if w.Code != http.StatusConflict {
+				t.Fatalf("got status %d, want 409, body %s", w.Code, w.Body.String())
+			}
+
+			var links int64
+			database.DB.Model(&models.UserIdentity{}).Count(&links)
+			if links != 0 {
+				t.Errorf("linked %d identities to an account with an unproven email", links)
+			}
+		})
+	}
+}
+
+func TestCompleteOIDCLoginCreatesAccount(t *testing.T) {
+	issuer := setupOIDCTest(t)
+
+	w := signInWithOIDC(t, issuer, jwt.MapClaims{
+		"sub":                "subject-1",
+		"email":              "new@example.com",
+		"email_verified":     true,
+		"preferred_username": "newreader",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %s", w.Code, w.Body.String())
+	}
+
+	var user models.User
+	if err := database.DB.Where("email = ?", "new@example.com").First(&user).Error; err != nil {
+		t.Fatalf("account was not created: %v", err)
+	}
+	if user.Username != "newreader" || !user.IsEmailVerified() {
+		t.Errorf("unexpected account: username %q, verified %v", user.Username, user.IsEmailVerified())
+	}
+}
+
+func TestCompleteOIDCLoginRejectsReusedState(t *testing.T) {
+	issuer := setupOIDCTest(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/auth/oidc/callback", CompleteOIDCLogin)
+
+	state, login, err := auth.BeginOIDCLogin(database.DB, "test", nil)
+	if err != nil {
+		t.Fatalf("BeginOIDCLogin: %v", err)
+	}
+	authURL, err := oidc.Providers["test"].AuthCodeURL(context.Background(), state, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+
+	complete := func() int {
+		code, returnedState, err := issuer.Authorize(authURL, jwt.MapClaims{"sub": "subject-1", "email": "new@example.com", "email_verified": true})
+		if err != nil {
+			t.Fatalf("Authorize: %v", err)
+		}
+		body, _ := json.Marshal(CompleteOIDCLoginRequest{State: returnedState, Code: code})
+		req := httptest.NewRequest(http.MethodPost, "/auth/oidc/callback", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: auth.OIDCStateBinding(state)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if status := complete(); status != http.StatusCreated {
+		t.Fatalf("first completion: got status %d", status)
+	}
+	if status := complete(); status != http.StatusBadRequest {
+		t.Fatalf("replayed state: got status %d, want 400", status)
+	}
+}
+
+func TestCompleteOIDCLoginRejectsStateFromAnotherBrowser(t *testing.T) {
+	issuer := setupOIDCTest(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/auth/oidc/:provider/start", StartOIDCLogin)
+	router.POST("/auth/oidc/callback", CompleteOIDCLogin)
+
+	// The attacker starts a sign-in and sends the URL to the victim, whose
+	// browser does not hold the attacker's cookie
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/oidc/test/start", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("start sign-in: got status %d, body %s", w.Code, w.Body.String())
+	}
+	var started struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+		t.Fatalf("failed to parse start response: %v", err)
+	}
+	code, state, err := issuer.Authorize(started.AuthorizationURL, jwt.MapClaims{"sub": "attacker", "email": "attacker@example.com", "email_verified": true})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	body, _ := json.Marshal(CompleteOIDCLoginRequest{State: state, Code: code})
+	req := httptest.NewRequest(http.MethodPost, "/auth/oidc/callback", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400, body %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCompleteOIDCLinkRejectsOtherCaller(t *testing.T) {
+	tests := []struct {
+		name     string
+		cookie   bool   // Whether the caller holds the cookie set when the link started
+		caller   string // Who is signed in when completing the link
+		wantCode int
+	}{
+		{name: "victim's browser", caller: "victim", wantCode: http.StatusBadRequest},
+		{name: "victim signed in with the starter's cookie", cookie: true, caller: "victim", wantCode: http.StatusForbidden},
+		{name: "signed out with the starter's cookie", cookie: true, wantCode: http.StatusForbidden},
+		{name: "the user who started it", cookie: true, caller: "attacker", wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := setupOIDCTest(t)
+
+			users := map[string]uint{}
+			for _, name := range []string{"attacker", "victim"} {
+				user := models.User{Username: name, Email: name + "@example.com", PasswordHash: "x", DisplayName: name, Role: models.RoleReader}
+				if err := database.DB.Create(&user).Error; err != nil {
+					t.Fatalf("failed to create user: %v", err)
+				}
+				users[name] = user.ID
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				if userID, ok := users[c.GetHeader("X-Test-User")]; ok {
+					c.Set("user_id", userID)
+				}
+			})
+			router.POST("/profile/identities/:provider", StartOIDCLink)
+			router.POST("/auth/oidc/callback", CompleteOIDCLogin)
+
+			// User A starts linking and gets the victim to sign in at the
+			// provider with the returned URL
+			req := httptest.NewRequest(http.MethodPost, "/profile/identities/test", nil)
+			req.Header.Set("X-Test-User", "attacker")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("start link: got status %d, body %s", w.Code, w.Body.String())
+			}
+			var started struct {
+				AuthorizationURL string `json:"authorization_url"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+				t.Fatalf("failed to parse start response: %v", err)
+			}
+			code, state, err := issuer.Authorize(started.AuthorizationURL, jwt.MapClaims{"sub": "victim-subject", "email": "victim@example.com", "email_verified": true})
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+
+			body, _ := json.Marshal(CompleteOIDCLoginRequest{State: state, Code: code})
+			req = httptest.NewRequest(http.MethodPost, "/auth/oidc/callback", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Test-User", tt.caller)
+			if tt.cookie {
+				for _, cookie := range w.Result().Cookies() {
+					req.AddCookie(cookie)
+				}
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d, body %s", w.Code, tt.wantCode, w.Body.String())
+			}
+
+			var links int64
+			database.DB.Model(&models.UserIdentity{}).Where("subject = ?", "victim-subject").Count(&links)
+			if tt.wantCode != http.StatusOK && links != 0 {
+				t.Errorf("linked the victim's identity %d times", links)
+			}
+			if tt.wantCode == http.StatusOK && links != 1 {
+				t.Errorf("linked the identity %d times, want 1", links)
+			}
+		})
+	}
+}
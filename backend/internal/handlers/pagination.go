@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPageSize caps the limit query parameter of list endpoints
+const maxPageSize = 100
+
+// paginate reads the page and limit query parameters, falling back to page 1
+// and defaultLimit and capping the limit at maxPageSize
+func paginate(c *gin.Context, defaultLimit int) (page, limit, offset int) {
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err = strconv.Atoi(c.Query("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultLimit
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return page, limit, (page - 1) * limit
+}
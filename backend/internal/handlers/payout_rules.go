@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/payout"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type PayoutTierRequest struct {
+	Name              string  `json:"name" binding:"required,max=50"`
+	Rate              float64 `json:"rate" binding:"required"`
+	MinEarnings90d    int     `json:"min_earnings_90d"`
+	MinFollowers      int     `json:"min_followers"`
+	MinAccountAgeDays int     `json:"min_account_age_days"`
+}
+
+type CreatePayoutRulesRequest struct {
+	Tiers    []PayoutTierRequest `json:"tiers" binding:"required,dive"`
+	Notes    string              `json:"notes"`
+	Activate bool                `json:"activate"`
+}
+
+type PayoutOverrideRequest struct {
+	Rate      float64    `json:"rate" binding:"required"`
+	Reason    string     `json:"reason" binding:"required,max=255"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// GetPayoutTier returns the current user's payout tier, the rate they would
+// cash out at, and what they still need to reach the next tier
+func GetPayoutTier(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	quote, err := payout.QuoteFor(database.DB, currentUser)
+	if err != nil {
+		log.Printf("[PAYOUTS] Failed to quote payout tier for user %d: %v", currentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to determine payout tier"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
+
+// GetPayoutRules lists every payout rule set version, newest first
+func GetPayoutRules(c *gin.Context) {
+	var rules []models.PayoutRuleSet
+	if err := database.DB.Preload("Tiers").Order("version DESC").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payout rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rule_sets": rules})
+}
+
+// CreatePayoutRules publishes a new version of the payout tiers
+func CreatePayoutRules(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req CreatePayoutRulesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tiers := make([]models.PayoutTier, 0, len(req.Tiers))
+	for _, t := range req.Tiers {
+		tiers = append(tiers, models.PayoutTier{
+			Name:              t.Name,
+			Rate:              t.Rate,
+			MinEarnings90d:    t.MinEarnings90d,
+			MinFollowers:      t.MinFollowers,
+			MinAccountAgeDays: t.MinAccountAgeDays,
+		})
+	}
+	if err := payout.ValidateTiers(tiers); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rules *models.PayoutRuleSet
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		rules, err = payout.Publish(tx, tiers, req.Notes, &currentUser.ID, req.Activate)
+		return err
+	})
+	if err != nil {
+		log.Printf("[PAYOUTS] Failed to publish payout rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payout rules"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rules)
+}
+
+// ActivatePayoutRules switches cashouts to another payout rule set version
+func ActivatePayoutRules(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		return payout.Activate(tx, version)
+	})
+	if err != nil {
+		if errors.Is(err, payout.ErrRuleSetNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payout rule set not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate payout rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Payout rules activated successfully",
+		"version": version,
+	})
+}
+
+// GetPayoutOverrides lists the current and past rate overrides of an author
+func GetPayoutOverrides(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var overrides []models.PayoutRateOverride
+	if err := database.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&overrides).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payout overrides"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"overrides": overrides})
+}
+
+// SetPayoutOverride pins an author's payout rate, replacing any active override
+func SetPayoutOverride(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req PayoutOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := payout.ValidateRate(req.Rate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	override := models.PayoutRateOverride{
+		UserID:      user.ID,
+		Rate:        req.Rate,
+		Reason:      req.Reason,
+		CreatedByID: &currentUser.ID,
+		ExpiresAt:   req.ExpiresAt,
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := revokePayoutOverrides(tx, user.ID); err != nil {
+			return err
+		}
+		return tx.Create(&override).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set payout override"})
+		return
+	}
+
+	c.JSON(http.StatusOK, override)
+}
+
+// RemovePayoutOverride returns an author to the rate of their tier
+func RemovePayoutOverride(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := revokePayoutOverrides(database.DB, uint(userID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove payout override"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Payout override removed successfully"})
+}
+
+// revokePayoutOverrides marks every unrevoked override of a user as revoked
+func revokePayoutOverrides(tx *gorm.DB, userID uint) error {
+	return tx.Model(&models.PayoutRateOverride{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
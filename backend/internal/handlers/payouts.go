@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/payments"
+	"fdip/internal/risk"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errCashoutNotPending   = errors.New("cashout is not pending")
+	errEmailNotVerified    = errors.New("email address is not verified")
+	errAccountFlagged      = errors.New("account is under review")
+	errPayoutsNotOnboarded = errors.New("payout onboarding is not complete")
+	errCashoutHeld         = errors.New("cashout is held for review")
+	// errLegacyCashout is returned for cashouts replayed from before the
+	// ledger, which have no payout amount and may already have been paid
+	errLegacyCashout = errors.New("cashout predates payout amounts and must be settled by hand")
+)
+
+// StartPayoutOnboarding creates the author's Stripe Connect Express account if
+// needed and returns a link to Stripe's hosted onboarding flow
+func StartPayoutOnboarding(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	if currentUser.StripeAccountID == nil {
+		acct, err := payments.Default.CreateConnectedAccount(payments.ConnectedAccountParams{
+			Email: currentUser.Email,
+			Metadata: map[string]string{
+				"user_id": strconv.FormatUint(uint64(currentUser.ID), 10),
+			},
+			IdempotencyKey: fmt.Sprintf("connect-account-%d", currentUser.ID),
+		})
+		if err != nil {
+			log.Printf("[PAYOUTS] Failed to create Connect account for user %d: %v", currentUser.ID, err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create payout account"})
+			return
+		}
+
+		if err := database.DB.Model(currentUser).Update("stripe_account_id", acct.ID).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save payout account"})
+			return
+		}
+		currentUser.StripeAccountID = &acct.ID
+	}
+
+	link, err := payments.Default.CreateAccountLink(payments.AccountLinkParams{
+		AccountID:  *currentUser.StripeAccountID,
+		RefreshURL: frontendURL() + "/payouts/onboarding?refresh=1",
+		ReturnURL:  frontendURL() + "/payouts/onboarding?complete=1",
+	})
+	if err != nil {
+		log.Printf("[PAYOUTS] Failed to create account link for user %d: %v", currentUser.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create onboarding link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"url":        link.URL,
+		"expires_at": link.ExpiresAt,
+	})
+}
+
+// GetPayoutAccount returns the current user's payout onboarding status
+func GetPayoutAccount(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"has_account":     currentUser.StripeAccountID != nil,
+		"payouts_enabled": currentUser.StripePayoutsEnabled,
+		"can_cash_out":    currentUser.CanReceivePayouts(),
+	})
+}
+
+// RetryPayout re-attempts the Stripe transfer of a cashout that is still
+// pending, e.g. because the server stopped before the transfer was made
+func RetryPayout(c *gin.Context) {
+	transactionID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return
+	}
+
+	// The cashout and its author are re-checked under lock, as the author
+	// may have been flagged since the cashout was requested
+	var transaction *models.TokenTransaction
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		transaction, err = lockCashout(tx, "id = ?", transactionID)
+		if err != nil {
+			return err
+		}
+		if transaction.Status != models.TransactionStatusPending {
+			return errCashoutNotPending
+		}
+		if transaction.PayoutAmountCents == nil {
+			return errLegacyCashout
+		}
+
+		held, err := risk.Held(tx, transaction.ID)
+		if err != nil {
+			return err
+		}
+		if held {
+			return errCashoutHeld
+		}
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&transaction.User, transaction.UserID).Error; err != nil {
+			return err
+		}
+		return cashoutBlocked(&transaction.User)
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cashout not found"})
+		return
+	case errors.Is(err, errCashoutNotPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "Cashout is not pending"})
+		return
+	case errors.Is(err, errCashoutHeld):
+		c.JSON(http.StatusConflict, gin.H{"error": "Cashout is held for review"})
+		return
+	case errors.Is(err, errLegacyCashout):
+		c.JSON(http.StatusConflict, gin.H{"error": "Cashout predates payout amounts and must be settled by hand"})
+		return
+	case errors.Is(err, errEmailNotVerified), errors.Is(err, errAccountFlagged), errors.Is(err, errPayoutsNotOnboarded):
+		c.JSON(http.StatusConflict, gin.H{"error": "Author cannot be paid out: " + err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cashout"})
+		return
+	}
+
+	if err := executePayout(transaction, &transaction.User); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":   "Payout transfer failed",
+			"details": err.Error(),
+			"status":  transaction.Status,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":            "Payout completed successfully",
+		"stripe_transfer_id": transaction.StripeTransferID,
+	})
+}
+
+// cashoutBlocked returns why user may not be paid out, or nil if they may
+func cashoutBlocked(user *models.User) error {
+	switch {
+	case !user.IsEmailVerified():
+		return errEmailNotVerified
+	case user.IsFlagged:
+		return errAccountFlagged
+	case !user.CanReceivePayouts():
+		return errPayoutsNotOnboarded
+	}
+	return nil
+}
+
+// executePayout creates the Stripe transfer for a pending cashout and settles
+// the cashout accordingly. The idempotency key is derived from the cashout so
+// retries can never pay twice.
+func executePayout(transaction *models.TokenTransaction, user *models.User) error {
+	// Failing a legacy cashout would credit back tokens that may already
+	// have been paid out
+	if transaction.PayoutAmountCents == nil {
+		return errLegacyCashout
+	}
+	if user.StripeAccountID == nil {
+		err := errors.New("cashout has no payout destination")
+		failPayout(transaction.ID, err.Error())
+		transaction.Status = models.TransactionStatusFailed
+		return err
+	}
+
+	tr, err := payments.Default.CreateTransfer(payments.TransferParams{
+		AmountCents:          *transaction.PayoutAmountCents,
+		Currency:             "usd",
+		DestinationAccountID: *user.StripeAccountID,
+		TransferGroup:        fmt.Sprintf("cashout-%d", transaction.ID),
+		Metadata: map[string]string{
+			"transaction_id": strconv.FormatUint(uint64(transaction.ID), 10),
+			"user_id":        strconv.FormatUint(uint64(transaction.UserID), 10),
+		},
+		IdempotencyKey: fmt.Sprintf("cashout-%d", transaction.ID),
+	})
+	if err != nil {
+		log.Printf("[PAYOUTS] Transfer for cashout %d failed: %v", transaction.ID, err)
+
+		// Only a rejection proves the transfer was not made; on network
+		// errors the cashout stays pending so it can be retried
+		if errors.Is(err, payments.ErrRejected) {
+			failPayout(transaction.ID, err.Error())
+			transaction.Status = models.TransactionStatusFailed
+		}
+		return err
+	}
+
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		return completePayout(tx, transaction.ID, tr.ID)
+	}); err != nil {
+		// The money has left, so leave the cashout pending for an admin
+		// rather than returning the tokens
+		log.Printf("[PAYOUTS] Transfer %s succeeded but cashout %d could not be settled: %v", tr.ID, transaction.ID, err)
+		return err
+	}
+
+	transaction.StripeTransferID = &tr.ID
+	transaction.Status = models.TransactionStatusCompleted
+	return nil
+}
+
+// lockCashout loads a cashout transaction with a row lock
+func lockCashout(tx *gorm.DB, query string, args ...interface{}) (*models.TokenTransaction, error) {
+	var transaction models.TokenTransaction
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("transaction_type = ?", models.TransactionTypeCashout).
+		Where(query, args...).
+		First(&transaction).Error; err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// completePayout records the transfer on a pending cashout and moves its
+// tokens from the payouts account to the paid out account
+func completePayout(tx *gorm.DB, transactionID uint, transferID string) error {
+	transaction, err := lockCashout(tx, "id = ?", transactionID)
+	if err != nil {
+		return err
+	}
+
+	if transaction.Status != models.TransactionStatusPending {
+		return nil
+	}
+
+	entry := ledger.Transfer(models.JournalKindCashout, ledger.Payouts, ledger.PaidOut, -transaction.Amount, &transaction.ID)
+	if _, err := ledger.Post(tx, entry); err != nil {
+		return err
+	}
+
+	return tx.Model(transaction).Updates(map[string]interface{}{
+		"stripe_transfer_id": transferID,
+		"status":             models.TransactionStatusCompleted,
+	}).Error
+}
+
+// failPayout marks a pending cashout as failed and re-credits its tokens
+func failPayout(transactionID uint, reason string) {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		transaction, err := lockCashout(tx, "id = ?", transactionID)
+		if err != nil {
+			return err
+		}
+
+		if transaction.Status != models.TransactionStatusPending {
+			return nil
+		}
+
+		return reverseCashout(tx, transaction, ledger.Payouts, reason)
+	})
+	if err != nil {
+		log.Printf("[PAYOUTS] Failed to return tokens for cashout %d: %v", transactionID, err)
+	}
+}
+
+// reverseCashout returns the tokens of a cashout to the author from the
+// account currently holding them and marks the cashout as failed
+func reverseCashout(tx *gorm.DB, transaction *models.TokenTransaction, from ledger.AccountRef, reason string) error {
+	if err := returnCashoutTokens(tx, transaction, from, -transaction.Amount); err != nil {
+		return err
+	}
+
+	return tx.Model(transaction).Updates(map[string]interface{}{
+		"status":         models.TransactionStatusFailed,
+		"failure_reason": reason,
+	}).Error
+}
+
+// returnCashoutTokens gives tokens of a cashout back to the author from the
+// account currently holding them, into the buckets the cashout took them from
+func returnCashoutTokens(tx *gorm.DB, transaction *models.TokenTransaction, from ledger.AccountRef, tokens int) error {
+	wallet := ledger.User(transaction.UserID)
+	prefer, err := ledger.DebitsOf(tx, transaction.ID, wallet)
+	if err != nil {
+		return err
+	}
+	entry := ledger.Transfer(models.JournalKindCashoutReversal, from, wallet, tokens, &transaction.ID)
+	entry.Lines[1].Prefer = prefer
+	entry.Memo = "Cashout reversal"
+	_, err = ledger.Post(tx, entry)
+	return err
+}
+
+// reversedTokens returns the tokens of a cashout covered by cents of its
+// transfer
+func reversedTokens(transaction *models.TokenTransaction, cents int64) int {
+	if transaction.PayoutAmountCents == nil || *transaction.PayoutAmountCents <= 0 {
+		return 0
+	}
+	tokens := int64(-transaction.Amount)
+	return int(math.Round(float64(tokens*cents) / float64(*transaction.PayoutAmountCents)))
+}
+
+// reversePayoutTransfer handles a transfer that Stripe reversed after the
+// cashout was completed by returning the reversed part of its tokens to the
+// author. Stripe reports the cumulative amount reversed, so only the part not
+// returned by earlier events is credited, and applying the same total twice
+// is a no-op. The cashout fails once the whole transfer is reversed.
+func reversePayoutTransfer(tx *gorm.DB, tr *stripe.Transfer) error {
+	transaction, err := lockCashout(tx, "stripe_transfer_id = ?", tr.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("no cashout for transfer %s", tr.ID)
+		}
+		return err
+	}
+
+	if transaction.Status != models.TransactionStatusCompleted || tr.AmountReversed <= transaction.ReversedCents {
+		return nil
+	}
+
+	tokens := reversedTokens(transaction, tr.AmountReversed) - reversedTokens(transaction, transaction.ReversedCents)
+	if tokens > 0 {
+		if err := returnCashoutTokens(tx, transaction, ledger.PaidOut, tokens); err != nil {
+			return err
+		}
+	}
+
+	updates := map[string]interface{}{"reversed_cents": tr.AmountReversed}
+	if tr.Reversed {
+		updates["status"] = models.TransactionStatusFailed
+		updates["failure_reason"] = "Transfer reversed"
+	}
+	return tx.Model(transaction).Updates(updates).Error
+}
+
+// syncConnectedAccount updates the payout status of the user owning a Stripe
+// Connect account
+func syncConnectedAccount(tx *gorm.DB, acct *stripe.Account) error {
+	enabled := acct.PayoutsEnabled && acct.DetailsSubmitted
+	return tx.Model(&models.User{}).
+		Where("stripe_account_id = ?", acct.ID).
+		Update("stripe_payouts_enabled", enabled).Error
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestRetryPayoutRechecksAuthor(t *testing.T) {
+	setupTestDB(t,
+		&models.User{},
+		&models.TokenTransaction{},
+		&models.UserTokenBalance{},
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.Posting{},
+		&models.TokenBucket{},
+		&models.WebhookEvent{},
+		&models.CashoutReview{},
+	)
+	provider := useFakeProvider(t)
+
+	accountID := "acct_author"
+	now := time.Now()
+	author := models.User{Username: "author", Email: "author@example.com", PasswordHash: "x", StripeAccountID: &accountID, StripePayoutsEnabled: true, EmailVerifiedAt: &now}
+	if err := database.DB.Create(&author).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	purchase := createPurchase(t, provider, author.ID, 100, 0, 1000)
+	mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+
+	// A cashout left pending, as when the server stops before the transfer
+	cents := int64(600)
+	cashout := models.TokenTransaction{
+		UserID:            author.ID,
+		TransactionType:   models.TransactionTypeCashout,
+		Amount:            -100,
+		PayoutAmountCents: &cents,
+		Status:            models.TransactionStatusPending,
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&cashout).Error; err != nil {
+			return err
+		}
+		_, err := ledger.Post(tx, ledger.Transfer(models.JournalKindCashout, ledger.User(author.ID), ledger.Payouts, 100, &cashout.ID))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to create cashout: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/payouts/:id/retry", RetryPayout)
+	retry := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/payouts/%d/retry", cashout.ID), nil))
+		return w
+	}
+
+	// The author is flagged before the retry
+	database.DB.Model(&author).Update("is_flagged", true)
+	if w := retry(); w.Code != http.StatusConflict {
+		t.Fatalf("flagged author: got status %d, want 409, body %s", w.Code, w.Body.String())
+	}
+	if err := database.DB.First(&cashout, cashout.ID).Error; err != nil {
+		t.Fatalf("failed to reload cashout: %v", err)
+	}
+	if cashout.Status != models.TransactionStatusPending || cashout.StripeTransferID != nil {
+		t.Errorf("cashout: got status %s, want pending and not transferred", cashout.Status)
+	}
+
+	// Once cleared, the retry pays the cashout out
+	database.DB.Model(&author).Update("is_flagged", false)
+	if w := retry(); w.Code != http.StatusOK {
+		t.Fatalf("cleared author: got status %d, want 200, body %s", w.Code, w.Body.String())
+	}
+	if err := database.DB.First(&cashout, cashout.ID).Error; err != nil {
+		t.Fatalf("failed to reload cashout: %v", err)
+	}
+	if cashout.Status != models.TransactionStatusCompleted || cashout.StripeTransferID == nil {
+		t.Errorf("cashout: got status %s, want completed and transferred", cashout.Status)
+	}
+}
+
+func TestRetryPayoutRefusesLegacyCashout(t *testing.T) {
+	setupTestDB(t,
+		&models.User{},
+		&models.TokenTransaction{},
+		&models.UserTokenBalance{},
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.Posting{},
+		&models.TokenBucket{},
+		&models.WebhookEvent{},
+		&models.CashoutReview{},
+	)
+	provider := useFakeProvider(t)
+
+	accountID := "acct_author"
+	now := time.Now()
+	author := models.User{Username: "author", Email: "author@example.com", PasswordHash: "x", StripeAccountID: &accountID, StripePayoutsEnabled: true, EmailVerifiedAt: &now}
+	if err := database.DB.Create(&author).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	purchase := createPurchase(t, provider, author.ID, 100, 0, 1000)
+	mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+
+	// A pending cashout from before payout amounts were recorded
+	cashout := models.TokenTransaction{
+		UserID:          author.ID,
+		TransactionType: models.TransactionTypeCashout,
+		Amount:          -100,
+		Status:          models.TransactionStatusPending,
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&cashout).Error; err != nil {
+			return err
+		}
+		_, err := ledger.Post(tx, ledger.Transfer(models.JournalKindCashout, ledger.User(author.ID), ledger.Payouts, 100, &cashout.ID))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to create cashout: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/payouts/:id/retry", RetryPayout)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/payouts/%d/retry", cashout.ID), nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want 409, body %s", w.Code, w.Body.String())
+	}
+
+	// The cashout is left for an admin to settle, and the tokens stay paid out
+	if err := database.DB.First(&cashout, cashout.ID).Error; err != nil {
+		t.Fatalf("failed to reload cashout: %v", err)
+	}
+	if cashout.Status != models.TransactionStatusPending || cashout.StripeTransferID != nil {
+		t.Errorf("cashout: got status %s, want pending and not transferred", cashout.Status)
+	}
+	if len(provider.Transfers) != 0 {
+		t.Errorf("got %d transfers, want none", len(provider.Transfers))
+	}
+	if balance := walletBalance(t, author.ID); balance != 0 {
+		t.Errorf("got balance %d, want 0", balance)
+	}
+}
@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/pricing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// TokenBundleRequest represents a bundle creation or update request
+type TokenBundleRequest struct {
+	Name       string `json:"name" binding:"required,max=100"`
+	PriceCents int64  `json:"price_cents" binding:"required,min=1"`
+	Tokens     int    `json:"tokens" binding:"required,min=1"`
+	SortOrder  int    `json:"sort_order"`
+	IsActive   *bool  `json:"is_active"`
+}
+
+// PromotionRequest represents a promotion creation or update request
+type PromotionRequest struct {
+	Name              string     `json:"name" binding:"required,max=100"`
+	BonusPercent      int        `json:"bonus_percent" binding:"required,min=1"`
+	BundleID          *uint      `json:"bundle_id"`
+	FirstPurchaseOnly bool       `json:"first_purchase_only"`
+	StartsAt          time.Time  `json:"starts_at" binding:"required"`
+	EndsAt            *time.Time `json:"ends_at"`
+	IsActive          *bool      `json:"is_active"`
+}
+
+// PromoCodeRequest represents a promo code creation or update request
+type PromoCodeRequest struct {
+	Code           string     `json:"code" binding:"required,max=50"`
+	BonusPercent   int        `json:"bonus_percent" binding:"min=0"`
+	BonusTokens    int        `json:"bonus_tokens" binding:"min=0"`
+	BundleID       *uint      `json:"bundle_id"`
+	MaxRedemptions *int       `json:"max_redemptions" binding:"omitempty,min=1"`
+	MaxPerUser     *int       `json:"max_per_user" binding:"omitempty,min=0"` // Defaults to 1; 0 for no limit
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	IsActive       *bool      `json:"is_active"`
+}
+
+// GetTokenBundles returns the bundles on sale, each priced for the current
+// user with any running promotion
+func GetTokenBundles(c *gin.Context) {
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	var bundles []models.TokenBundle
+	if err := database.DB.Where("is_active = ?", true).Order("sort_order, price_cents").Find(&bundles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch token bundles"})
+		return
+	}
+
+	now := time.Now()
+	results := make([]gin.H, 0, len(bundles))
+	for _, bundle := range bundles {
+		quote, err := pricing.Price(database.DB, currentUserID, pricing.Request{BundleID: bundle.ID}, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price token bundles"})
+			return
+		}
+		results = append(results, gin.H{"bundle": bundle, "quote": quote})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bundles":           results,
+		"tokens_per_dollar": models.TokensPerDollar,
+		"min_amount_cents":  pricing.MinCustomCents,
+	})
+}
+
+// QuotePurchase prices a purchase for the current user without starting it
+func QuotePurchase(c *gin.Context) {
+	var req PurchaseTokensRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	quote, err := pricing.Price(database.DB, currentUserID, purchaseRequest(req), time.Now())
+	if err != nil {
+		respondPricingError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quote": quote})
+}
+
+// GetAdminTokenBundles lists every bundle, retired ones included
+func GetAdminTokenBundles(c *gin.Context) {
+	var bundles []models.TokenBundle
+	if err := database.DB.Order("sort_order, price_cents").Find(&bundles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch token bundles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"bundles": bundles})
+}
+
+// CreateTokenBundle adds a bundle to the catalog
+func CreateTokenBundle(c *gin.Context) {
+	var req TokenBundleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	bundle := models.TokenBundle{
+		Name:       req.Name,
+		PriceCents: req.PriceCents,
+		Tokens:     req.Tokens,
+		SortOrder:  req.SortOrder,
+		IsActive:   req.IsActive == nil || *req.IsActive,
+	}
+	if err := database.DB.Create(&bundle).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token bundle"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Token bundle created successfully",
+		"bundle":  bundle,
+	})
+}
+
+// UpdateTokenBundle updates a bundle. Purchases already started keep the
+// price and tokens they were quoted.
+func UpdateTokenBundle(c *gin.Context) {
+	var req TokenBundleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var bundle models.TokenBundle
+	if !findPricingRecord(c, &bundle, "Token bundle") {
+		return
+	}
+	updates := map[string]interface{}{
+		"name":        req.Name,
+		"price_cents": req.PriceCents,
+		"tokens":      req.Tokens,
+		"sort_order":  req.SortOrder,
+	}
+	if req.IsActive != nil {
+		updates["is_active"] = *req.IsActive
+	}
+	if err := database.DB.Model(&bundle).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update token bundle"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Token bundle updated successfully",
+		"bundle":  bundle,
+	})
+}
+
+// GetPromotions lists every promotion, newest first
+func GetPromotions(c *gin.Context) {
+	var promotions []models.Promotion
+	if err := database.DB.Order("starts_at DESC").Find(&promotions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promotions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"promotions": promotions})
+}
+
+// CreatePromotion schedules a bonus promotion
+func CreatePromotion(c *gin.Context) {
+	var req PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validatePromotion(c, req.BonusPercent, req.BundleID, &req.StartsAt, req.EndsAt) {
+		return
+	}
+
+	promotion := models.Promotion{
+		Name:              req.Name,
+		BonusPercent:      req.BonusPercent,
+		BundleID:          req.BundleID,
+		FirstPurchaseOnly: req.FirstPurchaseOnly,
+		StartsAt:          req.StartsAt,
+		EndsAt:            req.EndsAt,
+		IsActive:          req.IsActive == nil || *req.IsActive,
+	}
+	if err := database.DB.Create(&promotion).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create promotion"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":   "Promotion created successfully",
+		"promotion": promotion,
+	})
+}
+
+// UpdatePromotion updates a promotion
+func UpdatePromotion(c *gin.Context) {
+	var req PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validatePromotion(c, req.BonusPercent, req.BundleID, &req.StartsAt, req.EndsAt) {
+		return
+	}
+
+	var promotion models.Promotion
+	if !findPricingRecord(c, &promotion, "Promotion") {
+		return
+	}
+	updates := map[string]interface{}{
+		"name":                req.Name,
+		"bonus_percent":       req.BonusPercent,
+		"bundle_id":           req.BundleID,
+		"first_purchase_only": req.FirstPurchaseOnly,
+		"starts_at":           req.StartsAt,
+		"ends_at":             req.EndsAt,
+	}
+	if req.IsActive != nil {
+		updates["is_active"] = *req.IsActive
+	}
+	if err := database.DB.Model(&promotion).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update promotion"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Promotion updated successfully",
+		"promotion": promotion,
+	})
+}
+
+// GetPromoCodes lists every promo code with its paid redemptions
+func GetPromoCodes(c *gin.Context) {
+	var codes []models.PromoCode
+	if err := database.DB.Order("created_at DESC").Find(&codes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promo codes"})
+		return
+	}
+
+	var counts []struct {
+		PromoCodeID uint
+		Count       int64
+	}
+	if err := database.DB.Model(&models.PromoRedemption{}).
+		Select("promo_code_id, COUNT(*) AS count").
+		Where("status = ?", models.PromoRedemptionCompleted).
+		Group("promo_code_id").
+		Scan(&counts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promo codes"})
+		return
+	}
+	redemptions := make(map[uint]int64, len(counts))
+	for _, count := range counts {
+		redemptions[count.PromoCodeID] = count.Count
+	}
+
+	results := make([]gin.H, 0, len(codes))
+	for _, code := range codes {
+		results = append(results, gin.H{"promo_code": code, "redemptions": redemptions[code.ID]})
+	}
+	c.JSON(http.StatusOK, gin.H{"promo_codes": results})
+}
+
+// CreatePromoCode adds a promo code
+func CreatePromoCode(c *gin.Context) {
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := pricing.NormalizeCode(req.Code)
+	if !validatePromoCode(c, code, req) {
+		return
+	}
+
+	promo := models.PromoCode{
+		Code:           code,
+		BonusPercent:   req.BonusPercent,
+		BonusTokens:    req.BonusTokens,
+		BundleID:       req.BundleID,
+		MaxRedemptions: req.MaxRedemptions,
+		MaxPerUser:     maxPerUser(req),
+		StartsAt:       req.StartsAt,
+		EndsAt:         req.EndsAt,
+		IsActive:       req.IsActive == nil || *req.IsActive,
+	}
+	var existing int64
+	database.DB.Model(&models.PromoCode{}).Where("code = ?", code).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Promo code already exists"})
+		return
+	}
+	if err := database.DB.Create(&promo).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create promo code"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Promo code created successfully",
+		"promo_code": promo,
+	})
+}
+
+// UpdatePromoCode updates a promo code. Its redemptions so far still count
+// towards the new limits.
+func UpdatePromoCode(c *gin.Context) {
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := pricing.NormalizeCode(req.Code)
+	if !validatePromoCode(c, code, req) {
+		return
+	}
+
+	var promo models.PromoCode
+	if !findPricingRecord(c, &promo, "Promo code") {
+		return
+	}
+	var existing int64
+	database.DB.Model(&models.PromoCode{}).Where("code = ? AND id <> ?", code, promo.ID).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Promo code already exists"})
+		return
+	}
+	updates := map[string]interface{}{
+		"code":            code,
+		"bonus_percent":   req.BonusPercent,
+		"bonus_tokens":    req.BonusTokens,
+		"bundle_id":       req.BundleID,
+		"max_redemptions": req.MaxRedemptions,
+		"max_per_user":    maxPerUser(req),
+		"starts_at":       req.StartsAt,
+		"ends_at":         req.EndsAt,
+	}
+	if req.IsActive != nil {
+		updates["is_active"] = *req.IsActive
+	}
+	if err := database.DB.Model(&promo).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update promo code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Promo code updated successfully",
+		"promo_code": promo,
+	})
+}
+
+// purchaseRequest converts a purchase or quote request for pricing
+func purchaseRequest(req PurchaseTokensRequest) pricing.Request {
+	return pricing.Request{
+		BundleID:    req.BundleID,
+		AmountCents: int64(math.Round(req.Amount * 100)),
+		Code:        req.PromoCode,
+	}
+}
+
+// isPricingError reports whether err is a pricing error about the request
+func isPricingError(err error) bool {
+	for _, target := range []error{
+		pricing.ErrBundleNotFound, pricing.ErrInvalidAmount, pricing.ErrBundleAndAmount,
+		pricing.ErrCodeNotFound, pricing.ErrCodeNotApplicable, pricing.ErrCodeUsedUp, pricing.ErrCodeUserLimit,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// respondPricingError responds to a failed pricing of a purchase
+func respondPricingError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, pricing.ErrBundleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token bundle not found"})
+	case errors.Is(err, pricing.ErrCodeUsedUp), errors.Is(err, pricing.ErrCodeUserLimit):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case isPricingError(err):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price purchase"})
+	}
+}
+
+// validatePromotion checks a promotion's bonus, bundle and dates,
+// responding with 400 if they are invalid
+func validatePromotion(c *gin.Context, bonusPercent int, bundleID *uint, startsAt, endsAt *time.Time) bool {
+	if bonusPercent < 0 || bonusPercent > pricing.MaxBonusPercent {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bonus percent must be between 0 and 500"})
+		return false
+	}
+	if startsAt != nil && endsAt != nil && !endsAt.After(*startsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "End must be after start"})
+		return false
+	}
+	if bundleID != nil {
+		var count int64
+		database.DB.Model(&models.TokenBundle{}).Where("id = ?", *bundleID).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Token bundle not found"})
+			return false
+		}
+	}
+	return true
+}
+
+// validatePromoCode checks a promo code request, responding with 400 if it
+// is invalid
+func validatePromoCode(c *gin.Context, code string, req PromoCodeRequest) bool {
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return false
+	}
+	if req.BonusPercent == 0 && req.BonusTokens == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Promo code must give bonus tokens"})
+		return false
+	}
+	return validatePromotion(c, req.BonusPercent, req.BundleID, req.StartsAt, req.EndsAt)
+}
+
+// maxPerUser returns a promo code request's limit per user, one use if it
+// has none
+func maxPerUser(req PromoCodeRequest) int {
+	if req.MaxPerUser == nil {
+		return 1
+	}
+	return *req.MaxPerUser
+}
+
+// findPricingRecord loads a bundle, promotion or promo code from the :id
+// parameter into dest, responding with 404 if there is none
+func findPricingRecord(c *gin.Context, dest interface{}, name string) bool {
+	if err := database.DB.Where("id = ?", c.Param("id")).First(dest).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": name + " not found"})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch " + strings.ToLower(name)})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+	"fdip/internal/payments"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RefundRequest struct {
+	AmountCents int64  `json:"amount_cents" binding:"min=0"` // 0 refunds the remaining amount
+	Reason      string `json:"reason"`
+}
+
+// RefundPurchase issues a Stripe refund for all or part of a token purchase
+// and claws back the matching tokens. Tokens the buyer already spent cannot
+// be taken back; that shortfall is written off to the losses account and
+// recorded on the refund transaction, and tips already sent are left with
+// their authors.
+func RefundPurchase(c *gin.Context) {
+	transactionID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return
+	}
+
+	var req RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var purchase models.TokenTransaction
+	if err := database.DB.
+		Where("id = ? AND transaction_type = ?", transactionID, models.TransactionTypePurchase).
+		First(&purchase).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purchase"})
+		return
+	}
+
+	if purchase.Status != models.TransactionStatusCompleted || purchase.StripePaymentIntentID == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only completed purchases can be refunded"})
+		return
+	}
+
+	refundedCents, err := refundedPurchaseCents(database.DB, purchase.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch previous refunds"})
+		return
+	}
+
+	remaining := purchaseCents(&purchase) - refundedCents
+	if remaining <= 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Purchase is already fully refunded"})
+		return
+	}
+	amount := req.AmountCents
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refund exceeds the remaining purchase amount"})
+		return
+	}
+
+	// The key is tied to what has been refunded so far, so retrying after a
+	// timeout cannot refund the same share twice
+	r, err := payments.Default.CreateRefund(payments.RefundParams{
+		PaymentIntentID: *purchase.StripePaymentIntentID,
+		AmountCents:     amount,
+		Reason:          string(stripe.RefundReasonRequestedByCustomer),
+		Metadata: map[string]string{
+			"transaction_id": strconv.FormatUint(uint64(purchase.ID), 10),
+			"reason":         req.Reason,
+		},
+		IdempotencyKey: fmt.Sprintf("refund-%d-%d", purchase.ID, refundedCents),
+	})
+	if err != nil {
+		log.Printf("[REFUNDS] Refund of purchase %d failed: %v", purchase.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Stripe refund failed"})
+		return
+	}
+
+	var refund *models.TokenTransaction
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockPurchase(tx, *purchase.StripePaymentIntentID)
+		if err != nil {
+			return err
+		}
+		refund, err = applyRefund(tx, locked, refundedCents+r.AmountCents, &r.ID)
+		return err
+	})
+	if err != nil {
+		// The charge.refunded webhook applies the refund if this fails
+		log.Printf("[REFUNDS] Stripe refund %s succeeded but purchase %d could not be updated: %v", r.ID, purchase.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Refund issued but tokens could not be clawed back"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "Refund issued successfully",
+		"stripe_refund_id": r.ID,
+		"refund":           refund,
+	})
+}
+
+// GetDisputes lists payment disputes for admins, optionally filtered by status
+func GetDisputes(c *gin.Context) {
+	page, limit, offset := paginate(c, 50)
+
+	query := database.DB.Model(&models.PaymentDispute{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var disputes []models.PaymentDispute
+	if err := query.Preload("User").Order("created_at DESC").Offset(offset).Limit(limit).Find(&disputes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch disputes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"disputes": disputes,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// UnflagUser clears the review flag set on an account by a payment dispute
+func UnflagUser(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	result := database.DB.Model(&models.User{}).
+		Where("id = ?", userID).
+		Updates(map[string]interface{}{
+			"is_flagged":     false,
+			"flagged_reason": nil,
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unflag user"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unflagged successfully"})
+}
+
+// purchaseCents returns what the buyer paid for a purchase. Purchases made
+// before the amount was recorded are valued at the purchase rate.
+func purchaseCents(purchase *models.TokenTransaction) int64 {
+	if purchase.AmountCents != nil {
+		return *purchase.AmountCents
+	}
+	return int64(math.Round(models.CalculateUSDValue(purchase.Amount) * 100))
+}
+
+// purchaseTokens returns the tokens bought with the first cents of a purchase
+func purchaseTokens(purchase *models.TokenTransaction, cents int64) int {
+	total := purchaseCents(purchase)
+	if total <= 0 {
+		return 0
+	}
+	return int(int64(purchase.Amount) * cents / total)
+}
+
+// refundedPurchaseCents sums the refunds and lost disputes recorded against a
+// purchase
+func refundedPurchaseCents(tx *gorm.DB, purchaseID uint) (int64, error) {
+	var cents int64
+	err := tx.Model(&models.TokenTransaction{}).
+		Where("related_transaction_id = ? AND transaction_type = ?", purchaseID, models.TransactionTypeRefund).
+		Select("COALESCE(SUM(amount_cents), 0)").
+		Scan(&cents).Error
+	return cents, err
+}
+
+// applyRefund brings the tokens of a locked purchase in line with the total
+// amount refunded so far. Stripe reports cumulative refunds, so only the part
+// not covered by earlier refund transactions is clawed back, and applying the
+// same total twice is a no-op.
+func applyRefund(tx *gorm.DB, purchase *models.TokenTransaction, totalRefundedCents int64, stripeRefundID *string) (*models.TokenTransaction, error) {
+	recorded, err := refundedPurchaseCents(tx, purchase.ID)
+	if err != nil {
+		return nil, err
+	}
+	if totalRefundedCents <= recorded {
+		return nil, nil
+	}
+
+	tokens := purchaseTokens(purchase, totalRefundedCents) - purchaseTokens(purchase, recorded)
+	return retireTokens(tx, purchase, ledger.User(purchase.UserID), tokens, totalRefundedCents-recorded, stripeRefundID)
+}
+
+// retireTokens returns up to tokens from the given account to Stripe and
+// records a refund transaction for cents of the purchase. Whatever the
+// account no longer holds is written off to the losses account.
+func retireTokens(tx *gorm.DB, purchase *models.TokenTransaction, from ledger.AccountRef, tokens int, cents int64, stripeRefundID *string) (*models.TokenTransaction, error) {
+	balance, err := ledger.Balance(tx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	clawed := tokens
+	if clawed > balance {
+		clawed = balance
+	}
+	if clawed < 0 {
+		clawed = 0
+	}
+	shortfall := tokens - clawed
+
+	refund := models.TokenTransaction{
+		UserID:                purchase.UserID,
+		TransactionType:       models.TransactionTypeRefund,
+		Amount:                -clawed, // Negative for debit
+		AmountCents:           &cents,
+		StripePaymentIntentID: purchase.StripePaymentIntentID,
+		StripeRefundID:        stripeRefundID,
+		RelatedTransactionID:  &purchase.ID,
+		Shortfall:             shortfall,
+		Status:                models.TransactionStatusCompleted,
+	}
+	if err := tx.Create(&refund).Error; err != nil {
+		return nil, err
+	}
+
+	if tokens <= 0 {
+		return &refund, nil
+	}
+
+	entry := ledger.Entry{
+		Kind:          models.JournalKindRefund,
+		TransactionID: &refund.ID,
+		Lines:         []ledger.Line{{Account: ledger.Stripe, Amount: tokens}},
+	}
+	if clawed > 0 {
+		// Take back the tokens the purchase credited before any others
+		prefer, err := ledger.CreditsOf(tx, purchase.ID, from)
+		if err != nil {
+			return nil, err
+		}
+		entry.Lines = append(entry.Lines, ledger.Line{Account: from, Amount: -clawed, Prefer: prefer})
+	}
+	if shortfall > 0 {
+		entry.Memo = fmt.Sprintf("%d refunded tokens already spent", shortfall)
+		entry.Lines = append(entry.Lines, ledger.Line{Account: ledger.Losses, Amount: -shortfall})
+	}
+	if _, err := ledger.Post(tx, entry); err != nil {
+		return nil, fmt.Errorf("failed to claw back %d tokens from user %d: %w", tokens, purchase.UserID, err)
+	}
+
+	if shortfall > 0 {
+		log.Printf("[REFUNDS] Purchase %d: %d refunded tokens were already spent and written off", purchase.ID, shortfall)
+	}
+	return &refund, nil
+}
+
+// refundPurchase applies a charge.refunded event to the purchase of a payment
+// intent
+func refundPurchase(tx *gorm.DB, paymentIntentID string, amountRefunded int64) error {
+	purchase, err := lockPurchase(tx, paymentIntentID)
+	if err != nil {
+		return err
+	}
+
+	if purchase.Status != models.TransactionStatusCompleted {
+		return nil
+	}
+
+	_, err = applyRefund(tx, purchase, amountRefunded, nil)
+	return err
+}
+
+// openDispute freezes the tokens covered by a new dispute in the buyer's hold
+// account and flags the buyer for review. Tokens already refunded are not at
+// stake again, and tokens already spent cannot be frozen; they are settled if
+// the dispute is lost.
+func openDispute(tx *gorm.DB, dispute *stripe.Dispute) error {
+	if dispute.PaymentIntent == nil {
+		return fmt.Errorf("dispute %s has no payment intent", dispute.ID)
+	}
+
+	purchase, err := lockPurchase(tx, dispute.PaymentIntent.ID)
+	if err != nil {
+		return err
+	}
+
+	var existing int64
+	if err := tx.Model(&models.PaymentDispute{}).Where("id = ?", dispute.ID).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	record := models.PaymentDispute{
+		ID:            dispute.ID,
+		TransactionID: purchase.ID,
+		UserID:        purchase.UserID,
+		AmountCents:   dispute.Amount,
+		Reason:        string(dispute.Reason),
+		Status:        models.DisputeStatusOpen,
+	}
+
+	// Tokens are only at stake once the purchase was credited
+	if purchase.Status == models.TransactionStatusCompleted {
+		refunded, err := refundedPurchaseCents(tx, purchase.ID)
+		if err != nil {
+			return err
+		}
+		record.DisputedTokens = purchaseTokens(purchase, dispute.Amount)
+		if remaining := purchase.Amount - purchaseTokens(purchase, refunded); record.DisputedTokens > remaining {
+			record.DisputedTokens = remaining
+		}
+		if record.DisputedTokens < 0 {
+			record.DisputedTokens = 0
+		}
+
+		balance, err := ledger.Balance(tx, ledger.User(purchase.UserID))
+		if err != nil {
+			return err
+		}
+		record.FrozenTokens = record.DisputedTokens
+		if record.FrozenTokens > balance {
+			record.FrozenTokens = balance
+		}
+		if record.FrozenTokens < 0 {
+			record.FrozenTokens = 0
+		}
+	}
+
+	if err := tx.Create(&record).Error; err != nil {
+		return err
+	}
+
+	if record.FrozenTokens > 0 {
+		if err := moveDisputed(tx, ledger.User(purchase.UserID), ledger.Hold(purchase.UserID), record.FrozenTokens, purchase.ID, "Dispute "+dispute.ID+" opened"); err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&models.User{}).
+		Where("id = ?", purchase.UserID).
+		Updates(map[string]interface{}{
+			"is_flagged":     true,
+			"flagged_reason": "Payment dispute " + dispute.ID,
+		}).Error
+}
+
+// moveDisputed moves tokens frozen for a dispute over a purchase between a
+// user's wallet and hold, taking the tokens the purchase credited first
+func moveDisputed(tx *gorm.DB, from, to ledger.AccountRef, tokens int, purchaseID uint, memo string) error {
+	prefer, err := ledger.CreditsOf(tx, purchaseID, from)
+	if err != nil {
+		return err
+	}
+	entry := ledger.Transfer(models.JournalKindDispute, from, to, tokens, &purchaseID)
+	entry.Memo = memo
+	entry.Lines[0].Prefer = prefer
+	_, err = ledger.Post(tx, entry)
+	return err
+}
+
+// closeDispute settles a closed dispute. Frozen tokens go back to the buyer
+// when the dispute is won; when it is lost they are returned to Stripe like a
+// refund, with any disputed tokens already spent written off. The account
+// stays flagged until an admin clears it.
+func closeDispute(tx *gorm.DB, dispute *stripe.Dispute) error {
+	var record models.PaymentDispute
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&record, "id = ?", dispute.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("no dispute record for %s", dispute.ID)
+		}
+		return err
+	}
+
+	if record.Status != models.DisputeStatusOpen {
+		return nil
+	}
+
+	status := models.DisputeStatusWon
+	if dispute.Status == stripe.DisputeStatusLost {
+		status = models.DisputeStatusLost
+	}
+
+	if status == models.DisputeStatusLost {
+		var purchase models.TokenTransaction
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&purchase, record.TransactionID).Error; err != nil {
+			return err
+		}
+
+		hold := ledger.Hold(record.UserID)
+		if record.FrozenTokens > 0 {
+			// Release the frozen tokens so the loss is settled from the
+			// wallet the same way as a refund
+			if err := moveDisputed(tx, hold, ledger.User(record.UserID), record.FrozenTokens, purchase.ID, "Dispute "+record.ID+" lost"); err != nil {
+				return err
+			}
+		}
+		if _, err := retireTokens(tx, &purchase, ledger.User(record.UserID), record.DisputedTokens, record.AmountCents, nil); err != nil {
+			return err
+		}
+	} else if record.FrozenTokens > 0 {
+		if err := moveDisputed(tx, ledger.Hold(record.UserID), ledger.User(record.UserID), record.FrozenTokens, record.TransactionID, "Dispute "+record.ID+" won"); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	return tx.Model(&record).Updates(map[string]interface{}{
+		"status":    status,
+		"closed_at": &now,
+	}).Error
+}
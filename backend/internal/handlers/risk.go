@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/risk"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CashoutReviewRequest represents an approve or reject decision
+type CashoutReviewRequest struct {
+	Notes    *string `json:"notes" binding:"omitempty,max=2000"`
+	FlagUser bool    `json:"flag_user"` // On rejection, also put the account under review
+}
+
+// GetCashoutReviews returns the cashout review queue, pending reviews by
+// default, riskiest first
+func GetCashoutReviews(c *gin.Context) {
+	page, limit, offset := paginate(c, 50)
+
+	status := c.DefaultQuery("status", string(models.CashoutReviewPending))
+	query := database.DB.Model(&models.CashoutReview{}).Where("cashout_reviews.status = ?", status)
+
+	var total int64
+	query.Count(&total)
+
+	var reviews []models.CashoutReview
+	if err := query.Preload("Transaction").Preload("User").Preload("Assessment").Preload("Reviewer").
+		Joins("JOIN risk_assessments ON risk_assessments.id = cashout_reviews.assessment_id").
+		Order("risk_assessments.score DESC, cashout_reviews.created_at").
+		Offset(offset).Limit(limit).
+		Find(&reviews).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cashout reviews"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reviews": reviews,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetRiskAssessments returns a user's recent tip and cashout scores
+func GetRiskAssessments(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	page, limit, offset := paginate(c, 50)
+
+	query := database.DB.Model(&models.RiskAssessment{}).Where("user_id = ?", userID)
+	var total int64
+	query.Count(&total)
+
+	var assessments []models.RiskAssessment
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&assessments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch risk assessments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"assessments": assessments,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// ApproveCashoutReview releases a held cashout and pays it out
+func ApproveCashoutReview(c *gin.Context) {
+	reviewID, req, ok := bindCashoutReview(c)
+	if !ok {
+		return
+	}
+	reviewerID, _ := middleware.GetCurrentUserID(c)
+
+	// The cashout and its author are re-checked under lock, as either may
+	// have changed while the cashout waited for review
+	var transaction *models.TokenTransaction
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		review, err := risk.Decide(tx, reviewID, reviewerID, models.CashoutReviewApproved, req.Notes, time.Now())
+		if err != nil {
+			return err
+		}
+
+		transaction, err = lockCashout(tx, "id = ?", review.TransactionID)
+		if err != nil {
+			return err
+		}
+		if transaction.Status != models.TransactionStatusPending {
+			return errCashoutNotPending
+		}
+		if err := tx.First(&transaction.User, transaction.UserID).Error; err != nil {
+			return err
+		}
+		return cashoutBlocked(&transaction.User)
+	})
+	if err != nil {
+		respondReviewError(c, err)
+		return
+	}
+
+	if err := executePayout(transaction, &transaction.User); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":   "Payout transfer failed",
+			"details": err.Error(),
+			"status":  transaction.Status,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":            "Cashout approved and paid out",
+		"stripe_transfer_id": transaction.StripeTransferID,
+	})
+}
+
+// RejectCashoutReview cancels a held cashout and returns its tokens to the
+// author, optionally putting their account under review
+func RejectCashoutReview(c *gin.Context) {
+	reviewID, req, ok := bindCashoutReview(c)
+	if !ok {
+		return
+	}
+	reviewerID, _ := middleware.GetCurrentUserID(c)
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		review, err := risk.Decide(tx, reviewID, reviewerID, models.CashoutReviewRejected, req.Notes, time.Now())
+		if err != nil {
+			return err
+		}
+
+		transaction, err := lockCashout(tx, "id = ?", review.TransactionID)
+		if err != nil {
+			return err
+		}
+		if transaction.Status == models.TransactionStatusPending {
+			if err := reverseCashout(tx, transaction, ledger.Payouts, "Rejected in fraud review"); err != nil {
+				return err
+			}
+		}
+
+		if req.FlagUser {
+			reason := "Cashout rejected in fraud review"
+			return tx.Model(&models.User{}).Where("id = ?", review.UserID).Updates(map[string]interface{}{
+				"is_flagged":     true,
+				"flagged_reason": reason,
+			}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		respondReviewError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cashout rejected and tokens returned"})
+}
+
+// bindCashoutReview reads the review ID and decision of a request,
+// responding with 400 if either is invalid
+func bindCashoutReview(c *gin.Context) (uint, CashoutReviewRequest, bool) {
+	var req CashoutReviewRequest
+	reviewID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return 0, req, false
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, req, false
+	}
+	return uint(reviewID), req, true
+}
+
+// respondReviewError responds to a failed review decision
+func respondReviewError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, risk.ErrReviewNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cashout review not found"})
+	case errors.Is(err, risk.ErrNotPending), errors.Is(err, errCashoutNotPending):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errEmailNotVerified), errors.Is(err, errAccountFlagged), errors.Is(err, errPayoutsNotOnboarded):
+		c.JSON(http.StatusConflict, gin.H{"error": "Author cannot be paid out: " + err.Error()})
+	default:
+		log.Printf("[RISK] Failed to decide cashout review: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decide cashout review"})
+	}
+}
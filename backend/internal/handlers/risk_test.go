@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestApproveCashoutReviewRechecksAuthor(t *testing.T) {
+	setupTestDB(t,
+		&models.User{},
+		&models.TokenTransaction{},
+		&models.UserTokenBalance{},
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.Posting{},
+		&models.TokenBucket{},
+		&models.WebhookEvent{},
+		&models.RiskAssessment{},
+		&models.CashoutReview{},
+	)
+	provider := useFakeProvider(t)
+
+	accountID := "acct_author"
+	now := time.Now()
+	author := models.User{Username: "author", Email: "author@example.com", PasswordHash: "x", StripeAccountID: &accountID, EmailVerifiedAt: &now}
+	if err := database.DB.Create(&author).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	purchase := createPurchase(t, provider, author.ID, 100, 0, 1000)
+	mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+
+	// A held cashout, as CashoutTokens leaves it when the score is too high
+	cents := int64(600)
+	cashout := models.TokenTransaction{
+		UserID:            author.ID,
+		TransactionType:   models.TransactionTypeCashout,
+		Amount:            -100,
+		PayoutAmountCents: &cents,
+		Status:            models.TransactionStatusPending,
+	}
+	var review models.CashoutReview
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&cashout).Error; err != nil {
+			return err
+		}
+		if _, err := ledger.Post(tx, ledger.Transfer(models.JournalKindCashout, ledger.User(author.ID), ledger.Payouts, 100, &cashout.ID)); err != nil {
+			return err
+		}
+		assessment := models.RiskAssessment{UserID: author.ID, Subject: models.RiskSubjectCashout, TransactionID: &cashout.ID, Amount: 100, Score: 90}
+		if err := tx.Create(&assessment).Error; err != nil {
+			return err
+		}
+		review = models.CashoutReview{TransactionID: cashout.ID, UserID: author.ID, AssessmentID: assessment.ID, Status: models.CashoutReviewPending}
+		return tx.Create(&review).Error
+	})
+	if err != nil {
+		t.Fatalf("failed to hold cashout: %v", err)
+	}
+
+	// The author is flagged while the cashout waits
+	database.DB.Model(&author).Update("is_flagged", true)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/cashout-reviews/:id/approve", func(c *gin.Context) {
+		c.Set("user_id", uint(99))
+		ApproveCashoutReview(c)
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/cashout-reviews/%d/approve", review.ID), nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want 409, body %s", w.Code, w.Body.String())
+	}
+
+	if err := database.DB.First(&review, review.ID).Error; err != nil {
+		t.Fatalf("failed to reload review: %v", err)
+	}
+	if review.Status != models.CashoutReviewPending {
+		t.Errorf("review: got status %s, want pending", review.Status)
+	}
+	if err := database.DB.First(&cashout, cashout.ID).Error; err != nil {
+		t.Fatalf("failed to reload cashout: %v", err)
+	}
+	if cashout.Status != models.TransactionStatusPending || cashout.StripeTransferID != nil {
+		t.Errorf("cashout: got status %s, want pending and not transferred", cashout.Status)
+	}
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"fdip/internal/database"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/permissions"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CreateRoleRequest represents a new role and the permissions it holds
+type CreateRoleRequest struct {
+	Name        models.UserRole     `json:"name" binding:"required"`
+	Description string              `json:"description" binding:"max=255"`
+	Permissions []models.Permission `json:"permissions"`
+}
+
+// PermissionChangeRequest represents a permission granted to a role
+type PermissionChangeRequest struct {
+	Permission models.Permission `json:"permission" binding:"required"`
+	Reason     string            `json:"reason" binding:"max=255"`
+}
+
+// AssignRoleRequest represents the role to give a user
+type AssignRoleRequest struct {
+	Role   models.UserRole `json:"role" binding:"required"`
+	Reason string          `json:"reason" binding:"max=255"`
+}
+
+// GetPermissions lists every permission roles can be granted
+func GetPermissions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"permissions": permissions.Catalog})
+}
+
+// GetRoles lists the roles with their permissions and number of users
+func GetRoles(c *gin.Context) {
+	var roles []models.Role
+	if err := database.DB.Preload("Permissions").Order("id").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch roles"})
+		return
+	}
+
+	var counts []struct {
+		Role  models.UserRole
+		Count int64
+	}
+	if err := database.DB.Model(&models.User{}).Select("role, COUNT(*) AS count").Group("role").Scan(&counts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count users"})
+		return
+	}
+	userCounts := map[models.UserRole]int64{}
+	for _, row := range counts {
+		userCounts[row.Role] = row.Count
+	}
+
+	result := make([]gin.H, 0, len(roles))
+	for _, role := range roles {
+		set, err := permissions.For(database.DB, role.Name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch permissions"})
+			return
+		}
+		result = append(result, gin.H{
+			"id":          role.ID,
+			"name":        role.Name,
+			"description": role.Description,
+			"is_system":   role.IsSystem,
+			"permissions": set.List(),
+			"user_count":  userCounts[role.Name],
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": result})
+}
+
+// CreateRole creates a custom role
+func CreateRole(c *gin.Context) {
+	var req CreateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actorID, _ := middleware.GetCurrentUserID(c)
+	role, err := permissions.CreateRole(database.DB, actorID, req.Name, req.Description, req.Permissions)
+	if err != nil {
+		respondPermissionError(c, err, "Failed to create role")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Role created",
+		"role":    role,
+	})
+}
+
+// DeleteRole deletes a custom role no user holds
+func DeleteRole(c *gin.Context) {
+	actorID, _ := middleware.GetCurrentUserID(c)
+	if err := permissions.DeleteRole(database.DB, actorID, models.UserRole(c.Param("name"))); err != nil {
+		respondPermissionError(c, err, "Failed to delete role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted"})
+}
+
+// GrantRolePermission grants a permission to a role
+func GrantRolePermission(c *gin.Context) {
+	var req PermissionChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actorID, _ := middleware.GetCurrentUserID(c)
+	if err := permissions.Grant(database.DB, actorID, models.UserRole(c.Param("name")), req.Permission, req.Reason); err != nil {
+		respondPermissionError(c, err, "Failed to grant permission")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Permission granted"})
+}
+
+// RevokeRolePermission takes a permission away from a role
+func RevokeRolePermission(c *gin.Context) {
+	actorID, _ := middleware.GetCurrentUserID(c)
+	perm := models.Permission(c.Param("permission"))
+	if err := permissions.Revoke(database.DB, actorID, models.UserRole(c.Param("name")), perm, c.Query("reason")); err != nil {
+		respondPermissionError(c, err, "Failed to revoke permission")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Permission revoked"})
+}
+
+// AssignUserRole gives a user a role. Staff cannot change their own role.
+func AssignUserRole(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req AssignRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actorID, _ := middleware.GetCurrentUserID(c)
+	if uint(userID) == actorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+
+	previous, err := permissions.Assign(database.DB, actorID, uint(userID), req.Role, req.Reason)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		respondPermissionError(c, err, "Failed to assign role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Role assigned",
+		"user_id":       userID,
+		"role":          req.Role,
+		"previous_role": previous,
+	})
+}
+
+// GetPermissionAudit lists changes to roles, permissions and role
+// assignments, newest first
+func GetPermissionAudit(c *gin.Context) {
+	page, limit, offset := paginate(c, 50)
+
+	query := database.DB.Model(&models.PermissionAudit{})
+	if role := c.Query("role"); role != "" {
+		query = query.Where("role = ?", role)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("target_user_id = ? OR actor_id = ?", userID, userID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count audit entries"})
+		return
+	}
+
+	var entries []models.PermissionAudit
+	if err := query.Order("id DESC").Limit(limit).Offset(offset).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit entries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+func respondPermissionError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, permissions.ErrUnknownRole):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+	case errors.Is(err, permissions.ErrUnknownPermission), errors.Is(err, permissions.ErrInvalidRoleName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, permissions.ErrRoleExists), errors.Is(err, permissions.ErrRoleInUse), errors.Is(err, permissions.ErrSystemRole):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/publishing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduleRequest represents when to publish a chapter or book
+type ScheduleRequest struct {
+	PublishAt time.Time `json:"publish_at" binding:"required"`
+}
+
+// ScheduleChapter sets the time an unpublished chapter is published
+func ScheduleChapter(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanWrite() || !middleware.HasPermission(c, models.PermBooksPublish) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to publish chapters"})
+		return
+	}
+	if chapter.IsPublished {
+		c.JSON(http.StatusConflict, gin.H{"error": "Chapter is already published"})
+		return
+	}
+	if err := publishing.ValidateSchedule(req.PublishAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.DB.Model(chapter).Update("publish_at", req.PublishAt).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule chapter"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Chapter scheduled",
+		"publish_at": req.PublishAt,
+	})
+}
+
+// UnscheduleChapter cancels a chapter's scheduled publish
+func UnscheduleChapter(c *gin.Context) {
+	chapter, role, ok := findChapterAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanWrite() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can schedule chapters"})
+		return
+	}
+
+	if err := database.DB.Model(chapter).Update("publish_at", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unschedule chapter"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Chapter unscheduled"})
+}
+
+// ScheduleBook sets the time an unpublished book is published
+func ScheduleBook(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanWrite() || !middleware.HasPermission(c, models.PermBooksPublish) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to publish books"})
+		return
+	}
+	if book.IsPublished {
+		c.JSON(http.StatusConflict, gin.H{"error": "Book is already published"})
+		return
+	}
+	if err := publishing.ValidateSchedule(req.PublishAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.DB.Model(book).Update("publish_at", req.PublishAt).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule book"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Book scheduled",
+		"publish_at": req.PublishAt,
+	})
+}
+
+// UnscheduleBook cancels a book's scheduled publish
+func UnscheduleBook(c *gin.Context) {
+	book, role, ok := findBookAs(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !role.CanWrite() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner and co-authors can schedule books"})
+		return
+	}
+
+	if err := database.DB.Model(book).Update("publish_at", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unschedule book"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Book unscheduled"})
+}
+
+// GetReleaseCalendar lists the chapters and books scheduled on the user's
+// books over the next days (90 by default, at most 366)
+func GetReleaseCalendar(c *gin.Context) {
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "90"))
+	if err != nil || days < 1 || days > 366 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 366"})
+		return
+	}
+
+	releases, err := publishing.Calendar(database.DB, currentUserID, time.Now().AddDate(0, 0, days))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch release calendar"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"releases": releases})
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/models"
+	"fdip/internal/search"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxQueryLength bounds the search text accepted
+const maxQueryLength = 200
+
+// Search finds published books by their title, description, author and
+// chapter text. Filters: genre (comma-separated, any of), min_words,
+// max_words, status (completed or ongoing) and updated_after (a date or
+// RFC 3339 time). Titles and snippets are HTML with the matches in <mark>.
+func Search(c *gin.Context) {
+	if !search.Default.Ready() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Search is starting up, please try again shortly"})
+		return
+	}
+
+	page, limit, offset := paginate(c, 20)
+	query := search.Query{
+		Text:   strings.TrimSpace(c.Query("q")),
+		Status: c.Query("status"),
+		Offset: offset,
+		Limit:  limit,
+	}
+	if len(query.Text) > maxQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search text is too long"})
+		return
+	}
+	for _, genre := range strings.Split(c.Query("genre"), ",") {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			query.Genres = append(query.Genres, genre)
+		}
+	}
+
+	var err error
+	if query.MinWords, err = wordFilter(c, "min_words"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_words must be a whole number"})
+		return
+	}
+	if query.MaxWords, err = wordFilter(c, "max_words"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_words must be a whole number"})
+		return
+	}
+	if query.Status != "" && query.Status != search.StatusCompleted && query.Status != search.StatusOngoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be completed or ongoing"})
+		return
+	}
+	if after := c.Query("updated_after"); after != "" {
+		if query.UpdatedAfter, err = time.Parse("2006-01-02", after); err != nil {
+			if query.UpdatedAfter, err = time.Parse(time.RFC3339, after); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "updated_after must be a date such as 2024-01-31"})
+				return
+			}
+		}
+	}
+
+	results := search.Default.Search(query)
+
+	// Load the books on the page; any removed since the index last synced
+	// are left out
+	ids := make([]uint, 0, len(results.Books))
+	for _, hit := range results.Books {
+		ids = append(ids, hit.BookID)
+	}
+	var books []models.Book
+	if len(ids) > 0 {
+		if err := database.DB.Preload("Author").Where("id IN ? AND is_published = ?", ids, true).Find(&books).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch books"})
+			return
+		}
+	}
+	booksByID := make(map[uint]models.Book, len(books))
+	for _, book := range books {
+		booksByID[book.ID] = book
+	}
+	bookResults := []gin.H{}
+	for _, hit := range results.Books {
+		if book, ok := booksByID[hit.BookID]; ok {
+			bookResults = append(bookResults, gin.H{"book": book, "match": hit})
+		}
+	}
+
+	ids = ids[:0]
+	for _, hit := range results.Authors {
+		ids = append(ids, hit.UserID)
+	}
+	var authors []models.User
+	if len(ids) > 0 {
+		if err := database.DB.Where("id IN ?", ids).Find(&authors).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch authors"})
+			return
+		}
+	}
+	authorsByID := make(map[uint]models.User, len(authors))
+	for _, author := range authors {
+		authorsByID[author.ID] = author
+	}
+	authorResults := []gin.H{}
+	for _, hit := range results.Authors {
+		if author, ok := authorsByID[hit.UserID]; ok {
+			authorResults = append(authorResults, gin.H{
+				"id":           author.ID,
+				"username":     author.Username,
+				"display_name": author.DisplayName,
+				"avatar_url":   author.AvatarURL,
+				"match":        hit,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results":    bookResults,
+		"authors":    authorResults,
+		"suggestion": results.Suggestion,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": results.Total,
+		},
+	})
+}
+
+// wordFilter reads an optional non-negative word count parameter
+func wordFilter(c *gin.Context, name string) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return n, nil
+}
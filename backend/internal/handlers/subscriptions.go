@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/subscriptions"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SubscriptionTierRequest represents a tier creation or update request
+type SubscriptionTierRequest struct {
+	Name        string  `json:"name" binding:"required,min=1,max=100"`
+	Description *string `json:"description"`
+	PriceTokens int     `json:"price_tokens" binding:"required"`
+	EarlyAccess bool    `json:"early_access"`
+}
+
+// SubscribeRequest represents a subscription request
+type SubscribeRequest struct {
+	TierID uint `json:"tier_id" binding:"required"`
+}
+
+// GetAuthorTiers returns the tiers readers can subscribe to an author on,
+// and the current user's subscription to them if any
+func GetAuthorTiers(c *gin.Context) {
+	authorID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid author ID"})
+		return
+	}
+
+	var tiers []models.SubscriptionTier
+	if err := database.DB.Where("author_id = ? AND is_active = ?", authorID, true).
+		Order("price_tokens").Find(&tiers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tiers"})
+		return
+	}
+
+	var subscription *models.Subscription
+	if userID, ok := middleware.GetCurrentUserID(c); ok {
+		if subscription, err = subscriptions.Active(database.DB, userID, uint(authorID), time.Now()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tiers": tiers, "subscription": subscription})
+}
+
+// GetMySubscriptionTiers returns the current author's tiers, retired ones
+// included, with their number of subscribers
+func GetMySubscriptionTiers(c *gin.Context) {
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	var tiers []models.SubscriptionTier
+	if err := database.DB.Where("author_id = ?", currentUserID).Order("price_tokens").Find(&tiers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tiers"})
+		return
+	}
+
+	var counts []struct {
+		TierID uint
+		Count  int64
+	}
+	if err := database.DB.Model(&models.Subscription{}).
+		Select("tier_id, COUNT(*) AS count").
+		Where("author_id = ? AND status IN ?", currentUserID, []models.SubscriptionStatus{models.SubscriptionStatusActive, models.SubscriptionStatusPastDue}).
+		Group("tier_id").
+		Scan(&counts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tiers"})
+		return
+	}
+	subscribers := make(map[uint]int64, len(counts))
+	for _, count := range counts {
+		subscribers[count.TierID] = count.Count
+	}
+
+	results := make([]gin.H, 0, len(tiers))
+	for _, tier := range tiers {
+		results = append(results, gin.H{"tier": tier, "subscribers": subscribers[tier.ID]})
+	}
+	c.JSON(http.StatusOK, gin.H{"tiers": results})
+}
+
+// CreateSubscriptionTier adds a tier to the current author
+func CreateSubscriptionTier(c *gin.Context) {
+	var req SubscriptionTierRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := subscriptions.ValidatePrice(req.PriceTokens); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	tier := models.SubscriptionTier{
+		AuthorID:    currentUserID,
+		Name:        req.Name,
+		Description: req.Description,
+		PriceTokens: req.PriceTokens,
+		EarlyAccess: req.EarlyAccess,
+		IsActive:    true,
+	}
+	if err := database.DB.Create(&tier).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tier"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Tier created successfully",
+		"tier":    tier,
+	})
+}
+
+// UpdateSubscriptionTier updates one of the current author's tiers. A new
+// price applies to new subscriptions only; current subscribers keep renewing
+// at the price they subscribed at.
+func UpdateSubscriptionTier(c *gin.Context) {
+	var req SubscriptionTierRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := subscriptions.ValidatePrice(req.PriceTokens); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tier, ok := findMyTier(c)
+	if !ok {
+		return
+	}
+	updates := map[string]interface{}{
+		"name":         req.Name,
+		"description":  req.Description,
+		"price_tokens": req.PriceTokens,
+		"early_access": req.EarlyAccess,
+	}
+	if err := database.DB.Model(tier).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tier"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Tier updated successfully",
+		"tier":    tier,
+	})
+}
+
+// RetireSubscriptionTier stops a tier taking new subscribers. Its current
+// subscribers keep their access until the end of the period they paid for.
+func RetireSubscriptionTier(c *gin.Context) {
+	tier, ok := findMyTier(c)
+	if !ok {
+		return
+	}
+	if err := database.DB.Model(tier).Update("is_active", false).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retire tier"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tier retired successfully"})
+}
+
+// GetMySubscriptions returns the current user's subscriptions
+func GetMySubscriptions(c *gin.Context) {
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	var subs []models.Subscription
+	if err := database.DB.Preload("Tier").Preload("Author").
+		Where("user_id = ? AND status IN ?", currentUserID, []models.SubscriptionStatus{models.SubscriptionStatusActive, models.SubscriptionStatusPastDue}).
+		Order("current_period_end").
+		Find(&subs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscriptions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+// Subscribe subscribes the current user to an author's tier, charging the
+// first month's tokens
+func Subscribe(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var req SubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if currentUser.IsFlagged {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is under review"})
+		return
+	}
+
+	subscription, charged, err := subscriptions.Subscribe(database.DB, currentUser.ID, req.TierID, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, subscriptions.ErrTierNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tier not found"})
+		case errors.Is(err, subscriptions.ErrOwnTier):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot subscribe to yourself"})
+		case errors.Is(err, subscriptions.ErrAlreadySubscribed):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ledger.ErrInsufficientFunds):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient token balance"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe"})
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if charged {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{
+		"message":      "Subscribed successfully",
+		"subscription": subscription,
+	})
+}
+
+// CancelSubscription stops one of the current user's subscriptions from
+// renewing
+func CancelSubscription(c *gin.Context) {
+	subscriptionID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	subscription, err := subscriptions.Cancel(database.DB, currentUserID, uint(subscriptionID))
+	if err != nil {
+		switch {
+		case errors.Is(err, subscriptions.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		case errors.Is(err, subscriptions.ErrNotActive):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription is not active"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel subscription"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Subscription cancelled",
+		"subscription": subscription,
+	})
+}
+
+// findMyTier loads a tier of the current author from the :id parameter,
+// responding with 404 if it is someone else's
+func findMyTier(c *gin.Context) (*models.SubscriptionTier, bool) {
+	currentUserID, _ := middleware.GetCurrentUserID(c)
+
+	var tier models.SubscriptionTier
+	if err := database.DB.Where("id = ? AND author_id = ?", c.Param("id"), currentUserID).First(&tier).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tier not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tier"})
+		return nil, false
+	}
+	return &tier, true
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/models"
+	"fdip/internal/subscriptions"
+)
+
+func TestRenewalChargesTheSubscribedPrice(t *testing.T) {
+	provider := setupWebhookTest(t)
+	if err := database.DB.AutoMigrate(&models.SubscriptionTier{}, &models.Subscription{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	reader := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x"}
+	author := models.User{Username: "author", Email: "author@example.com", PasswordHash: "x"}
+	for _, user := range []*models.User{&reader, &author} {
+		if err := database.DB.Create(user).Error; err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+	}
+	purchase := createPurchase(t, provider, reader.ID, 100, 0, 1000)
+	mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+
+	tier := models.SubscriptionTier{AuthorID: author.ID, Name: "Supporter", PriceTokens: 10, IsActive: true}
+	if err := database.DB.Create(&tier).Error; err != nil {
+		t.Fatalf("failed to create tier: %v", err)
+	}
+	subscription, _, err := subscriptions.Subscribe(database.DB, reader.ID, tier.ID, time.Now().AddDate(0, -1, 0))
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if subscription.PriceTokens != 10 {
+		t.Errorf("subscription price: got %d, want 10", subscription.PriceTokens)
+	}
+
+	// The author raises the price before the period ends
+	database.DB.Model(&tier).Update("price_tokens", 50)
+	if err := subscriptions.RenewDue(context.Background(), database.DB); err != nil {
+		t.Fatalf("RenewDue: %v", err)
+	}
+
+	if got := walletBalance(t, reader.ID); got != 80 {
+		t.Errorf("reader balance: got %d, want 80", got)
+	}
+	if err := database.DB.First(subscription, subscription.ID).Error; err != nil {
+		t.Fatalf("failed to reload subscription: %v", err)
+	}
+	if subscription.Status != models.SubscriptionStatusActive || !subscription.CurrentPeriodEnd.After(time.Now()) {
+		t.Errorf("subscription was not renewed: status %s, period end %s", subscription.Status, subscription.CurrentPeriodEnd)
+	}
+}
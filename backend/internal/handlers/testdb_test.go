@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"testing"
+
+	"fdip/internal/database"
+	"fdip/internal/database/dbtest"
+)
+
+// setupTestDB points database.DB at an in-memory SQLite database holding
+// tables, restoring it when the test ends
+func setupTestDB(t *testing.T, tables ...interface{}) {
+	t.Helper()
+
+	prev := database.DB
+	database.DB = dbtest.Open(t, tables...)
+	t.Cleanup(func() { database.DB = prev })
+}
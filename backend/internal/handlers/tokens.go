@@ -1,28 +1,33 @@
 package handlers
 
 import (
-	"encoding/json"
+	"errors"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/membership"
 	"fdip/internal/middleware"
 	"fdip/internal/models"
-
-	"os"
-
-	"log"
+	"fdip/internal/payments"
+	"fdip/internal/payout"
+	"fdip/internal/pricing"
+	"fdip/internal/risk"
 
 	"github.com/gin-gonic/gin"
-	"github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/paymentintent"
-	"github.com/stripe/stripe-go/v76/webhook"
 	"gorm.io/gorm"
 )
 
-// PurchaseTokensRequest represents the token purchase request
+// PurchaseTokensRequest represents the token purchase and quote request.
+// Readers buy a bundle or a custom amount.
 type PurchaseTokensRequest struct {
-	Amount float64 `json:"amount" binding:"required,min=1"` // Amount in USD
+	BundleID  uint    `json:"bundle_id"`
+	Amount    float64 `json:"amount"` // Custom amount in USD
+	PromoCode string  `json:"promo_code" binding:"max=50"`
 }
 
 // TipRequest represents the tip request
@@ -36,7 +41,8 @@ type CashoutRequest struct {
 	Amount int `json:"amount" binding:"required,min=10"` // Minimum 10 tokens
 }
 
-// GetTokenBalance returns the current user's token balance
+// GetTokenBalance returns the current user's token balance and how much of
+// it is promotional, cashable or about to expire
 func GetTokenBalance(c *gin.Context) {
 	currentUser, exists := middleware.GetCurrentUser(c)
 	if !exists {
@@ -61,10 +67,18 @@ func GetTokenBalance(c *gin.Context) {
 		}
 	}
 
+	buckets, err := ledger.BucketsOf(database.DB, currentUser.ID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get token balance"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"balance":      balance.Balance,
-		"total_earned": balance.TotalEarned,
-		"total_spent":  balance.TotalSpent,
+		"balance":        balance.Balance,
+		"frozen_balance": balance.FrozenBalance,
+		"total_earned":   balance.TotalEarned,
+		"total_spent":    balance.TotalSpent,
+		"buckets":        buckets,
 	})
 }
 
@@ -82,35 +96,66 @@ func PurchaseTokens(c *gin.Context) {
 		return
 	}
 
-	// Calculate tokens to be awarded
-	tokensToAward := models.CalculateTokenCost(req.Amount)
+	if !currentUser.IsEmailVerified() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Verify your email address first"})
+		return
+	}
 
-	// Create Stripe payment intent
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(int64(req.Amount * 100)), // Convert to cents
-		Currency: stripe.String("usd"),
-		Metadata: map[string]string{
-			"user_id":         strconv.FormatUint(uint64(currentUser.ID), 10),
-			"tokens_to_award": strconv.Itoa(tokensToAward),
-		},
+	// Price the purchase on the server
+	now := time.Now()
+	quote, err := pricing.Price(database.DB, currentUser.ID, purchaseRequest(req), now)
+	if err != nil {
+		respondPricingError(c, err)
+		return
 	}
 
-	pi, err := paymentintent.New(params)
+	// Create payment intent
+	metadata := map[string]string{
+		"user_id":         strconv.FormatUint(uint64(currentUser.ID), 10),
+		"tokens_to_award": strconv.Itoa(quote.Tokens),
+	}
+	if quote.BundleID != nil {
+		metadata["bundle_id"] = strconv.FormatUint(uint64(*quote.BundleID), 10)
+	}
+	if quote.PromoCode != "" {
+		metadata["promo_code"] = quote.PromoCode
+	}
+	pi, err := payments.Default.CreatePaymentIntent(payments.PaymentIntentParams{
+		AmountCents: quote.PriceCents,
+		Currency:    "usd",
+		Metadata:    metadata,
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment intent"})
 		return
 	}
 
-	// Create transaction record
+	// Create transaction record with its pricing, holding the promo code
 	transaction := models.TokenTransaction{
 		UserID:                currentUser.ID,
 		TransactionType:       models.TransactionTypePurchase,
-		Amount:                tokensToAward,
+		Amount:                quote.Tokens,
+		AmountCents:           &quote.PriceCents,
+		BundleID:              quote.BundleID,
+		BaseTokens:            &quote.BaseTokens,
+		BonusTokens:           quote.Bonus(),
+		PromotionID:           quote.PromotionID,
+		PromoCodeID:           quote.PromoCodeID,
 		StripePaymentIntentID: &pi.ID,
 		Status:                models.TransactionStatusPending,
 	}
 
-	if err := database.DB.Create(&transaction).Error; err != nil {
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+		return pricing.Reserve(tx, quote, currentUser.ID, transaction.ID, now)
+	})
+	if err != nil {
+		if isPricingError(err) {
+			respondPricingError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction record"})
 		return
 	}
@@ -118,7 +163,8 @@ func PurchaseTokens(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"client_secret":     pi.ClientSecret,
 		"payment_intent_id": pi.ID,
-		"tokens_to_award":   tokensToAward,
+		"tokens_to_award":   quote.Tokens,
+		"quote":             quote,
 	})
 }
 
@@ -136,6 +182,11 @@ func TipAuthor(c *gin.Context) {
 		return
 	}
 
+	if currentUser.IsFlagged {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is under review"})
+		return
+	}
+
 	// Get the chapter and its author
 	var chapter models.Chapter
 	if err := database.DB.Preload("Book").Preload("Book.Author").
@@ -149,102 +200,93 @@ func TipAuthor(c *gin.Context) {
 		return
 	}
 
+	// Split the tip between the owner and co-authors by their revenue shares
+	shares, err := membership.Split(database.DB, chapter.BookID, req.Amount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to split tip"})
+		return
+	}
+
 	// Check if user is trying to tip themselves
 	if chapter.Book.AuthorID == currentUser.ID {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot tip yourself"})
 		return
 	}
-
-	// Check if user has enough tokens
-	var userBalance models.UserTokenBalance
-	if err := database.DB.Where("user_id = ?", currentUser.ID).First(&userBalance).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get token balance"})
-		return
+	for _, share := range shares {
+		if share.UserID == currentUser.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot tip yourself"})
+			return
+		}
 	}
 
-	if userBalance.Balance < req.Amount {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient token balance"})
-		return
+	// Score the tip for fraud and decline the riskiest
+	recipients := make([]uint, 0, len(shares))
+	for _, share := range shares {
+		recipients = append(recipients, share.UserID)
 	}
-
-	// Start transaction
-	tx := database.DB.Begin()
-
-	// Deduct tokens from user
-	if err := tx.Model(&userBalance).Update("balance", userBalance.Balance-req.Amount).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deduct tokens"})
+	origin := risk.NewOrigin(c.ClientIP(), c.Request.UserAgent())
+	assessment, err := risk.ScoreTip(database.DB, currentUser, chapter.Book.AuthorID, recipients, req.Amount, origin, time.Now())
+	if err != nil {
+		log.Printf("[RISK] Failed to score tip from user %d: %v", currentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send tip"})
 		return
 	}
-
-	// Add tokens to author
-	var authorBalance models.UserTokenBalance
-	if err := tx.Where("user_id = ?", chapter.Book.AuthorID).First(&authorBalance).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			// Create balance if it doesn't exist
-			authorBalance = models.UserTokenBalance{
-				UserID:      chapter.Book.AuthorID,
-				Balance:     0,
-				TotalEarned: 0,
-				TotalSpent:  0,
-			}
-			tx.Create(&authorBalance)
-		} else {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get author balance"})
-			return
+	if assessment.Blocked() {
+		if _, err := risk.Record(database.DB, currentUser.ID, models.RiskSubjectTip, nil, req.Amount, assessment); err != nil {
+			log.Printf("[RISK] Failed to record declined tip from user %d: %v", currentUser.ID, err)
 		}
-	}
-
-	if err := tx.Model(&authorBalance).Updates(map[string]interface{}{
-		"balance":      authorBalance.Balance + req.Amount,
-		"total_earned": authorBalance.TotalEarned + req.Amount,
-	}).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add tokens to author"})
+		c.JSON(http.StatusForbidden, gin.H{"error": "This tip could not be sent. Contact support if you think this is a mistake."})
 		return
 	}
 
-	// Create transaction records
-	userTransaction := models.TokenTransaction{
-		UserID:          currentUser.ID,
-		TransactionType: models.TransactionTypeTip,
-		Amount:          -req.Amount, // Negative for debit
-		RecipientID:     &chapter.Book.AuthorID,
-		ChapterID:       &req.ChapterID,
-		Status:          models.TransactionStatusCompleted,
-	}
-
-	authorTransaction := models.TokenTransaction{
-		UserID:          chapter.Book.AuthorID,
-		TransactionType: models.TransactionTypeTip,
-		Amount:          req.Amount, // Positive for credit
-		RecipientID:     &currentUser.ID,
-		ChapterID:       &req.ChapterID,
-		Status:          models.TransactionStatusCompleted,
-	}
+	// Record the tip and move the tokens atomically
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		userTransaction := models.TokenTransaction{
+			UserID:          currentUser.ID,
+			TransactionType: models.TransactionTypeTip,
+			Amount:          -req.Amount, // Negative for debit
+			RecipientID:     &chapter.Book.AuthorID,
+			ChapterID:       &req.ChapterID,
+			Status:          models.TransactionStatusCompleted,
+		}
 
-	if err := tx.Create(&userTransaction).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user transaction"})
-		return
-	}
+		if err := tx.Create(&userTransaction).Error; err != nil {
+			return err
+		}
 
-	if err := tx.Create(&authorTransaction).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create author transaction"})
-		return
-	}
+		entry := ledger.Entry{
+			Kind:          models.JournalKindTip,
+			TransactionID: &userTransaction.ID,
+			Lines:         []ledger.Line{{Account: ledger.User(currentUser.ID), Amount: -req.Amount}},
+		}
+		for _, share := range shares {
+			authorTransaction := models.TokenTransaction{
+				UserID:          share.UserID,
+				TransactionType: models.TransactionTypeTip,
+				Amount:          share.Amount, // Positive for credit
+				RecipientID:     &currentUser.ID,
+				ChapterID:       &req.ChapterID,
+				Status:          models.TransactionStatusCompleted,
+			}
 
-	// Update user's total spent
-	if err := tx.Model(&userBalance).Update("total_spent", userBalance.TotalSpent+req.Amount).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update total spent"})
-		return
-	}
+			if err := tx.Create(&authorTransaction).Error; err != nil {
+				return err
+			}
+			entry.Lines = append(entry.Lines, ledger.Line{Account: ledger.User(share.UserID), Amount: share.Amount})
+		}
 
-	if err := tx.Commit().Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		if _, err := ledger.Post(tx, entry); err != nil {
+			return err
+		}
+		_, err := risk.Record(tx, currentUser.ID, models.RiskSubjectTip, &userTransaction.ID, req.Amount, assessment)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ledger.ErrInsufficientFunds) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient token balance"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send tip"})
 		return
 	}
 
@@ -269,49 +311,113 @@ func CashoutTokens(c *gin.Context) {
 		return
 	}
 
-	// Check if user has enough tokens
-	var userBalance models.UserTokenBalance
-	if err := database.DB.Where("user_id = ?", currentUser.ID).First(&userBalance).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get token balance"})
+	switch cashoutBlocked(currentUser) {
+	case errEmailNotVerified:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Verify your email address first"})
+		return
+	case errAccountFlagged:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is under review"})
+		return
+	case errPayoutsNotOnboarded:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Complete payout onboarding before cashing out"})
 		return
 	}
 
-	if userBalance.Balance < req.Amount {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient token balance"})
+	// Price the cashout under the active payout rules
+	quote, err := payout.QuoteFor(database.DB, currentUser)
+	if err != nil {
+		log.Printf("[PAYOUTS] Failed to quote cashout for user %d: %v", currentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to determine payout rate"})
 		return
 	}
-
-	// Calculate payout rate based on author performance
-	followerCount, _ := models.GetFollowerCount(database.DB, currentUser.ID)
-	payoutRate := models.CalculatePayoutRate(userBalance.TotalEarned, int(followerCount))
+	payoutRate := quote.Rate
 	payoutAmount := models.CalculatePayoutAmount(req.Amount, payoutRate)
+	payoutCents := int64(math.Round(payoutAmount * 100))
 
-	// Create Stripe transfer (this would require the author to have a Stripe Connect account)
-	// For now, we'll just create a transaction record
-	transaction := models.TokenTransaction{
-		UserID:          currentUser.ID,
-		TransactionType: models.TransactionTypeCashout,
-		Amount:          -req.Amount, // Negative for debit
-		Status:          models.TransactionStatusPending,
+	// Score the cashout for fraud; risky ones wait for an admin
+	origin := risk.NewOrigin(c.ClientIP(), c.Request.UserAgent())
+	assessment, err := risk.ScoreCashout(database.DB, currentUser, req.Amount, origin, time.Now())
+	if err != nil {
+		log.Printf("[RISK] Failed to score cashout for user %d: %v", currentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cashout transaction"})
+		return
 	}
 
-	if err := database.DB.Create(&transaction).Error; err != nil {
+	// Record the cashout and hold its tokens in the payouts account until the
+	// Stripe transfer settles
+	var transaction models.TokenTransaction
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		transaction = models.TokenTransaction{
+			UserID:            currentUser.ID,
+			TransactionType:   models.TransactionTypeCashout,
+			Amount:            -req.Amount, // Negative for debit
+			PayoutAmountCents: &payoutCents,
+			PayoutRate:        &payoutRate,
+			PayoutRuleVersion: &quote.RuleVersion,
+			PayoutTier:        &quote.Tier.Name,
+			Status:            models.TransactionStatusPending,
+		}
+		if quote.Override != nil {
+			transaction.PayoutOverrideID = &quote.Override.ID
+		}
+
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+
+		entry := ledger.Transfer(models.JournalKindCashout, ledger.User(currentUser.ID), ledger.Payouts, req.Amount, &transaction.ID)
+		if _, err := ledger.Post(tx, entry); err != nil {
+			return err
+		}
+
+		record, err := risk.Record(tx, currentUser.ID, models.RiskSubjectCashout, &transaction.ID, req.Amount, assessment)
+		if err != nil {
+			return err
+		}
+		if assessment.NeedsReview() {
+			_, err = risk.Hold(tx, &transaction, record)
+		}
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ledger.ErrInsufficientFunds) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient cashable token balance; promotional tokens cannot be cashed out"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cashout transaction"})
 		return
 	}
 
-	// Deduct tokens from user balance
-	if err := database.DB.Model(&userBalance).Update("balance", userBalance.Balance-req.Amount).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update balance"})
+	if assessment.NeedsReview() {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":           "Cashout is held for review",
+			"transaction_id":    transaction.ID,
+			"tokens_cashed_out": req.Amount,
+			"payout_amount_usd": payoutAmount,
+			"status":            transaction.Status,
+		})
+		return
+	}
+
+	// Pay the author through Stripe Connect
+	if err := executePayout(&transaction, currentUser); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":          "Payout transfer failed",
+			"transaction_id": transaction.ID,
+			"status":         transaction.Status,
+		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":           "Cashout request submitted successfully",
-		"tokens_cashed_out": req.Amount,
-		"payout_amount_usd": payoutAmount,
-		"payout_rate":       payoutRate,
-		"status":            "pending",
+		"message":             "Cashout completed successfully",
+		"tokens_cashed_out":   req.Amount,
+		"payout_amount_usd":   payoutAmount,
+		"payout_rate":         payoutRate,
+		"payout_tier":         quote.Tier.Name,
+		"payout_rule_version": quote.RuleVersion,
+		"stripe_transfer_id":  transaction.StripeTransferID,
+		"status":              transaction.Status,
 	})
 }
 
@@ -365,62 +471,17 @@ func GetTokenTransactions(c *gin.Context) {
 	})
 }
 
-// HandleStripeWebhook handles Stripe webhook events
-func HandleStripeWebhook(c *gin.Context) {
-	webhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	payload, err := c.GetRawData()
-	if err != nil {
-		log.Printf("[WEBHOOK] Failed to read request body: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
-		return
-	}
-	sigHeader := c.GetHeader("Stripe-Signature")
-	event, err := webhook.ConstructEventWithOptions(payload, sigHeader, webhookSecret, webhook.ConstructEventOptions{
-		IgnoreAPIVersionMismatch: true,
-	})
+// RebuildTokenBalances recomputes every user's token balance from the ledger
+func RebuildTokenBalances(c *gin.Context) {
+	count, err := ledger.RebuildAll(database.DB)
 	if err != nil {
-		log.Printf("[WEBHOOK] Invalid webhook signature: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+		log.Printf("[LEDGER] Failed to rebuild token balances: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild token balances"})
 		return
 	}
 
-	if event.Type == "payment_intent.succeeded" {
-		var pi stripe.PaymentIntent
-		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
-			log.Printf("[WEBHOOK] Failed to parse payment intent: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse payment intent"})
-			return
-		}
-		userIDStr := pi.Metadata["user_id"]
-		tokensStr := pi.Metadata["tokens_to_award"]
-		userID, err1 := strconv.ParseUint(userIDStr, 10, 32)
-		tokens, err2 := strconv.Atoi(tokensStr)
-		if err1 != nil || err2 != nil {
-			log.Printf("[WEBHOOK] Invalid metadata in payment intent: user_id=%s tokens_to_award=%s", userIDStr, tokensStr)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid metadata in payment intent"})
-			return
-		}
-		// Credit tokens to user
-		var balance models.UserTokenBalance
-		if err := database.DB.Where("user_id = ?", userID).First(&balance).Error; err != nil {
-			log.Printf("[WEBHOOK] Failed to get user balance: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user balance"})
-			return
-		}
-		if err := database.DB.Model(&balance).Update("balance", balance.Balance+tokens).Error; err != nil {
-			log.Printf("[WEBHOOK] Failed to credit tokens: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to credit tokens"})
-			return
-		}
-		// Mark transaction as completed
-		if err := database.DB.Model(&models.TokenTransaction{}).
-			Where("stripe_payment_intent_id = ?", pi.ID).
-			Update("status", models.TransactionStatusCompleted).Error; err != nil {
-			log.Printf("[WEBHOOK] Failed to update transaction status: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update transaction status"})
-			return
-		}
-	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Webhook received"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Token balances rebuilt successfully",
+		"users_rebuilt": count,
+	})
 }
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"fdip/internal/auth"
+	"fdip/internal/database"
+	"fdip/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEnableTwoFactorEndsOtherSessions(t *testing.T) {
+	setupTestDB(t, &models.User{}, &models.Session{}, &models.RefreshToken{}, &models.RecoveryCode{})
+	t.Setenv("JWT_SECRET", "test-secret")
+	if err := auth.InitJWT(); err != nil {
+		t.Fatalf("InitJWT: %v", err)
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %v", err)
+	}
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x", DisplayName: "Reader", TOTPSecret: &secret}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	current, err := auth.StartSession(database.DB, &user, "laptop", "203.0.113.7", false)
+	if err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	other, err := auth.StartSession(database.DB, &user, "stolen", "198.51.100.1", false)
+	if err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/auth/2fa/enable", func(c *gin.Context) {
+		var u models.User
+		if err := database.DB.First(&u, user.ID).Error; err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		sessionID, _ := strconv.ParseUint(c.GetHeader("X-Test-Session"), 10, 64)
+		c.Set("user", &u)
+		c.Set("user_id", u.ID)
+		c.Set("session_id", uint(sessionID))
+	}, EnableTwoFactor)
+
+	code, err := auth.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("TOTPCode: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/auth/2fa/enable", strings.NewReader(`{"code":"`+code+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test-Session", strconv.FormatUint(uint64(current.SessionID), 10))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	var sessions []models.Session
+	if err := database.DB.Order("id").Find(&sessions).Error; err != nil {
+		t.Fatalf("failed to load sessions: %v", err)
+	}
+	for _, s := range sessions {
+		switch s.ID {
+		case current.SessionID:
+			if s.RevokedAt != nil || !s.MFAVerified {
+				t.Errorf("current session: got revoked %v, mfa %v; want active with two factors", s.RevokedAt, s.MFAVerified)
+			}
+		case other.SessionID:
+			if s.RevokedAt == nil {
+				t.Error("other session was not revoked")
+			}
+		}
+	}
+	if _, err := auth.Refresh(database.DB, other.RefreshToken); err == nil {
+		t.Error("other session could still refresh")
+	}
+
+	// Access tokens issued before are invalid; the returned one is not
+	var updated models.User
+	if err := database.DB.First(&updated, user.ID).Error; err != nil {
+		t.Fatalf("failed to load user: %v", err)
+	}
+	if updated.TokenVersion != user.TokenVersion+1 || !updated.TwoFactorEnabled() {
+		t.Errorf("got token version %d, two-factor %v; want %d and enabled", updated.TokenVersion, updated.TwoFactorEnabled(), user.TokenVersion+1)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	claims, err := auth.ValidateToken(resp.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if claims.TokenVersion != updated.TokenVersion || claims.SessionID != current.SessionID || !claims.MFA {
+		t.Errorf("got claims version %d session %d mfa %v, want version %d session %d with two factors", claims.TokenVersion, claims.SessionID, claims.MFA, updated.TokenVersion, current.SessionID)
+	}
+}
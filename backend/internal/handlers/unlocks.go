@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/membership"
+	"fdip/internal/middleware"
+	"fdip/internal/models"
+	"fdip/internal/paywall"
+	"fdip/internal/subscriptions"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// teaserWords is about how much of a locked chapter readers see before
+// unlocking it
+const teaserWords = 150
+
+// UnlockChapter spends the reader's tokens on a premium chapter. Unlocking a
+// chapter the reader already unlocked returns the existing unlock without
+// charging again.
+func UnlockChapter(c *gin.Context) {
+	currentUser, exists := middleware.GetCurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	if currentUser.IsFlagged {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is under review"})
+		return
+	}
+
+	chapterID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chapter ID"})
+		return
+	}
+
+	var chapter models.Chapter
+	if err := database.DB.Where("id = ? AND is_published = ? AND is_private = ?", chapterID, true, false).
+		First(&chapter).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chapter not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chapter"})
+		return
+	}
+
+	unlock, created, err := paywall.Unlock(database.DB, currentUser.ID, &chapter, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, paywall.ErrMember):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You can already read this chapter"})
+		case errors.Is(err, paywall.ErrNotLocked):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This chapter is free to read"})
+		case errors.Is(err, ledger.ErrInsufficientFunds):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient token balance"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock chapter"})
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{
+		"message": "Chapter unlocked",
+		"unlock":  unlock,
+	})
+}
+
+// chapterLock returns the limits on a chapter the current user faces and
+// whether they may read all of it. Chapters open to everyone have no lock.
+// Book members and moderators read every chapter in full; other readers
+// need a subscription to the book's author for subscriber-only and early
+// access chapters, and must unlock premium ones.
+func chapterLock(c *gin.Context, chapter *models.Chapter) (gin.H, bool, error) {
+	now := time.Now()
+	if chapter.IsOpen(now) {
+		return nil, true, nil
+	}
+
+	subscribed, unlocked, canRead := subscriptions.Opens(nil, chapter, now), false, false
+	if middleware.HasPermission(c, models.PermContentModerate) {
+		canRead = true
+	} else if userID, ok := middleware.GetCurrentUserID(c); ok {
+		if _, err := membership.RoleOf(database.DB, chapter.BookID, userID); err == nil {
+			canRead = true
+		} else if !errors.Is(err, membership.ErrNotMember) {
+			return nil, false, err
+		}
+
+		subscription, err := subscriptions.Active(database.DB, userID, chapter.Book.AuthorID, now)
+		if err != nil {
+			return nil, false, err
+		}
+		subscribed = subscriptions.Opens(subscription, chapter, now)
+		if chapter.IsLocked(now) {
+			if unlocked, err = paywall.Unlocked(database.DB, userID, chapter.ID); err != nil {
+				return nil, false, err
+			}
+		}
+		canRead = canRead || (subscribed && (unlocked || !chapter.IsLocked(now)))
+	}
+
+	var earlyAccessUntil *time.Time
+	if chapter.IsEarlyAccess(now) {
+		earlyAccessUntil = chapter.EarlyAccessUntil
+	}
+	return gin.H{
+		"locked":             !canRead,
+		"premium":            chapter.IsLocked(now),
+		"price_tokens":       chapter.PriceTokens,
+		"free_at":            chapter.FreeAt(),
+		"unlocked":           unlocked,
+		"subscribers_only":   chapter.SubscribersOnly,
+		"early_access_until": earlyAccessUntil,
+		"subscribed":         subscribed,
+		"author_id":          chapter.Book.AuthorID,
+	}, canRead, nil
+}
+
+// sameDays reports whether two optional day counts are equal
+func sameDays(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// sameTime reports whether two optional times are equal
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+	"fdip/internal/payments"
+	"fdip/internal/pricing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// HandleStripeWebhook handles Stripe webhook events
+func HandleStripeWebhook(c *gin.Context) {
+	payload, err := c.GetRawData()
+	if err != nil {
+		log.Printf("[WEBHOOK] Failed to read request body: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	sigHeader := c.GetHeader("Stripe-Signature")
+	event, err := payments.Default.VerifyWebhook(payload, sigHeader)
+	if err != nil {
+		log.Printf("[WEBHOOK] Invalid webhook signature: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+		return
+	}
+
+	// Store the event before acting on it so retries can be recognised
+	stored := models.WebhookEvent{
+		ID:      event.ID,
+		Type:    string(event.Type),
+		Payload: string(payload),
+		Status:  models.WebhookEventStatusPending,
+	}
+	if err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&stored).Error; err != nil {
+		log.Printf("[WEBHOOK] Failed to store event %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store webhook event"})
+		return
+	}
+	if err := database.DB.First(&stored, "id = ?", event.ID).Error; err != nil {
+		log.Printf("[WEBHOOK] Failed to load event %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load webhook event"})
+		return
+	}
+
+	if stored.IsDone() {
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook already processed"})
+		return
+	}
+
+	if err := processWebhookEvent(event); err != nil {
+		log.Printf("[WEBHOOK] Failed to process event %s (%s): %v", event.ID, event.Type, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process webhook event"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook received"})
+}
+
+// GetWebhookEvents lists stored webhook events for admins, optionally
+// filtered by status
+func GetWebhookEvents(c *gin.Context) {
+	page, limit, offset := paginate(c, 50)
+
+	query := database.DB.Model(&models.WebhookEvent{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := c.Query("type"); eventType != "" {
+		query = query.Where("type = ?", eventType)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var events []models.WebhookEvent
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// ReplayWebhookEvent re-drives a stored webhook event that has not been
+// applied yet
+func ReplayWebhookEvent(c *gin.Context) {
+	var stored models.WebhookEvent
+	if err := database.DB.First(&stored, "id = ?", c.Param("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook event not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook event"})
+		return
+	}
+
+	if stored.IsDone() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Webhook event already processed"})
+		return
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal([]byte(stored.Payload), &event); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse stored webhook event"})
+		return
+	}
+
+	if err := processWebhookEvent(event); err != nil {
+		log.Printf("[WEBHOOK] Replay of event %s failed: %v", stored.ID, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":   "Webhook event replay failed",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	database.DB.First(&stored, "id = ?", stored.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Webhook event replayed successfully",
+		"event":   stored,
+	})
+}
+
+// processWebhookEvent applies the effects of a stored event exactly once. The
+// event row is locked for the duration of the database transaction, so
+// concurrent deliveries of the same event are serialised and the second one
+// sees it as processed.
+func processWebhookEvent(event stripe.Event) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var stored models.WebhookEvent
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&stored, "id = ?", event.ID).Error; err != nil {
+			return err
+		}
+
+		if stored.IsDone() {
+			return nil
+		}
+
+		handled, err := applyWebhookEvent(tx, event)
+		if err != nil {
+			return err
+		}
+
+		status := models.WebhookEventStatusProcessed
+		if !handled {
+			status = models.WebhookEventStatusIgnored
+		}
+
+		now := time.Now()
+		return tx.Model(&stored).Updates(map[string]interface{}{
+			"status":       status,
+			"attempts":     gorm.Expr("attempts + 1"),
+			"last_error":   nil,
+			"processed_at": &now,
+		}).Error
+	})
+
+	if err != nil {
+		message := err.Error()
+		database.DB.Model(&models.WebhookEvent{}).
+			Where("id = ?", event.ID).
+			Updates(map[string]interface{}{
+				"status":     models.WebhookEventStatusFailed,
+				"attempts":   gorm.Expr("attempts + 1"),
+				"last_error": &message,
+			})
+	}
+
+	return err
+}
+
+// applyWebhookEvent dispatches an event to its handler. It reports false for
+// event types the platform does not act on.
+func applyWebhookEvent(tx *gorm.DB, event stripe.Event) (bool, error) {
+	switch event.Type {
+	case stripe.EventTypePaymentIntentSucceeded:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return false, fmt.Errorf("failed to parse payment intent: %w", err)
+		}
+		return true, completePurchase(tx, pi.ID)
+
+	case stripe.EventTypePaymentIntentPaymentFailed:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return false, fmt.Errorf("failed to parse payment intent: %w", err)
+		}
+		return true, setPurchaseStatus(tx, pi.ID, models.TransactionStatusFailed)
+
+	case stripe.EventTypePaymentIntentCanceled:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return false, fmt.Errorf("failed to parse payment intent: %w", err)
+		}
+		return true, setPurchaseStatus(tx, pi.ID, models.TransactionStatusCancelled)
+
+	case stripe.EventTypeChargeRefunded:
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return false, fmt.Errorf("failed to parse charge: %w", err)
+		}
+		if charge.PaymentIntent == nil {
+			return false, nil
+		}
+		return true, refundPurchase(tx, charge.PaymentIntent.ID, charge.AmountRefunded)
+
+	case stripe.EventTypeChargeDisputeCreated:
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return false, fmt.Errorf("failed to parse dispute: %w", err)
+		}
+		return true, openDispute(tx, &dispute)
+
+	case stripe.EventTypeChargeDisputeClosed:
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return false, fmt.Errorf("failed to parse dispute: %w", err)
+		}
+		return true, closeDispute(tx, &dispute)
+
+	case stripe.EventTypeAccountUpdated:
+		var acct stripe.Account
+		if err := json.Unmarshal(event.Data.Raw, &acct); err != nil {
+			return false, fmt.Errorf("failed to parse account: %w", err)
+		}
+		return true, syncConnectedAccount(tx, &acct)
+
+	case stripe.EventTypeTransferReversed:
+		var tr stripe.Transfer
+		if err := json.Unmarshal(event.Data.Raw, &tr); err != nil {
+			return false, fmt.Errorf("failed to parse transfer: %w", err)
+		}
+		return true, reversePayoutTransfer(tx, &tr)
+	}
+
+	return false, nil
+}
+
+// lockPurchase loads the purchase transaction of a payment intent with a row lock
+func lockPurchase(tx *gorm.DB, paymentIntentID string) (*models.TokenTransaction, error) {
+	var transaction models.TokenTransaction
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("stripe_payment_intent_id = ? AND transaction_type = ?", paymentIntentID, models.TransactionTypePurchase).
+		First(&transaction).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("no purchase transaction for payment intent %s", paymentIntentID)
+		}
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// completePurchase credits the purchased tokens and marks the purchase as
+// completed. A purchase that previously failed can still succeed when the
+// customer retries with another payment method.
+func completePurchase(tx *gorm.DB, paymentIntentID string) error {
+	transaction, err := lockPurchase(tx, paymentIntentID)
+	if err != nil {
+		return err
+	}
+
+	switch transaction.Status {
+	case models.TransactionStatusCompleted:
+		return nil
+	case models.TransactionStatusCancelled:
+		return fmt.Errorf("purchase transaction %d is cancelled", transaction.ID)
+	}
+
+	// Bonus tokens are promotional: they expire and cannot be cashed out
+	entry := ledger.Entry{
+		Kind:          models.JournalKindPurchase,
+		TransactionID: &transaction.ID,
+		Lines: []ledger.Line{
+			{Account: ledger.Stripe, Amount: -transaction.Amount},
+			{Account: ledger.User(transaction.UserID), Amount: transaction.Amount - transaction.BonusTokens, Bucket: models.TokenBucketPurchased},
+		},
+	}
+	if transaction.BonusTokens > 0 {
+		expiresAt := time.Now().Add(models.PromotionalTokenLifetime).Truncate(time.Second)
+		entry.Lines = append(entry.Lines, ledger.Line{
+			Account:   ledger.User(transaction.UserID),
+			Amount:    transaction.BonusTokens,
+			Bucket:    models.TokenBucketPromotional,
+			ExpiresAt: &expiresAt,
+		})
+	}
+	if _, err := ledger.Post(tx, entry); err != nil {
+		return err
+	}
+	if err := pricing.Complete(tx, transaction); err != nil {
+		return err
+	}
+
+	return tx.Model(transaction).Update("status", models.TransactionStatusCompleted).Error
+}
+
+// setPurchaseStatus moves a purchase that has not been credited yet to a
+// failed or cancelled status. A cancelled purchase gives back its promo code;
+// a failed one can still be paid for and keeps it until its hold runs out.
+func setPurchaseStatus(tx *gorm.DB, paymentIntentID string, status models.TransactionStatus) error {
+	transaction, err := lockPurchase(tx, paymentIntentID)
+	if err != nil {
+		return err
+	}
+
+	if transaction.Status == models.TransactionStatusCompleted || transaction.Status == models.TransactionStatusCancelled {
+		return nil
+	}
+	if status == models.TransactionStatusCancelled {
+		if err := pricing.Release(tx, transaction); err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(transaction).Update("status", status).Error
+}
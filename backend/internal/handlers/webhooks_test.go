@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fdip/internal/database"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+	"fdip/internal/payments"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"gorm.io/gorm"
+)
+
+// setupWebhookTest points the database at an in-memory SQLite database and
+// the payment provider at a fake, restoring both when the test ends
+func setupWebhookTest(t *testing.T) *payments.FakeProvider {
+	t.Helper()
+
+	setupTestDB(t,
+		&models.User{},
+		&models.TokenTransaction{},
+		&models.UserTokenBalance{},
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.Posting{},
+		&models.TokenBucket{},
+		&models.WebhookEvent{},
+		&models.PromoRedemption{},
+		&models.PaymentDispute{},
+	)
+	return useFakeProvider(t)
+}
+
+// useFakeProvider points the payment provider at a fake, restoring it when
+// the test ends
+func useFakeProvider(t *testing.T) *payments.FakeProvider {
+	t.Helper()
+
+	provider := payments.NewFakeProvider("whsec_test")
+	prev := payments.Default
+	payments.Default = provider
+	t.Cleanup(func() { payments.Default = prev })
+
+	return provider
+}
+
+// deliver posts a webhook delivery to HandleStripeWebhook
+func deliver(delivery *payments.WebhookDelivery) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/webhooks/stripe", HandleStripeWebhook)
+
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/stripe", bytes.NewReader(delivery.Payload))
+	req.Header.Set("Stripe-Signature", delivery.Signature)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// createPurchase records a pending purchase of tokens, bonus of them
+// promotional, paid for with a fake payment intent for cents
+func createPurchase(t *testing.T, provider *payments.FakeProvider, userID uint, tokens, bonus int, cents int64) models.TokenTransaction {
+	t.Helper()
+
+	pi, err := provider.CreatePaymentIntent(payments.PaymentIntentParams{AmountCents: cents, Currency: "usd"})
+	if err != nil {
+		t.Fatalf("failed to create payment intent: %v", err)
+	}
+	purchase := models.TokenTransaction{
+		UserID:                userID,
+		TransactionType:       models.TransactionTypePurchase,
+		Amount:                tokens,
+		BonusTokens:           bonus,
+		StripePaymentIntentID: &pi.ID,
+		AmountCents:           &pi.AmountCents,
+		Status:                models.TransactionStatusPending,
+	}
+	if err := database.DB.Create(&purchase).Error; err != nil {
+		t.Fatalf("failed to create purchase: %v", err)
+	}
+	return purchase
+}
+
+// mustDeliver posts the delivery built by event and fails the test unless it
+// is accepted
+func mustDeliver(t *testing.T, event func(string) (*payments.WebhookDelivery, error), paymentIntentID string) {
+	t.Helper()
+
+	delivery, err := event(paymentIntentID)
+	if err != nil {
+		t.Fatalf("failed to build delivery: %v", err)
+	}
+	if w := deliver(delivery); w.Code != http.StatusOK {
+		t.Fatalf("delivery rejected: got status %d, body %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleStripeWebhookReplayIsIdempotent(t *testing.T) {
+	provider := setupWebhookTest(t)
+
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x"}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	purchase := createPurchase(t, provider, user.ID, 100, 0, 1000)
+
+	delivery, err := provider.SucceedPaymentIntent(*purchase.StripePaymentIntentID)
+	if err != nil {
+		t.Fatalf("failed to build delivery: %v", err)
+	}
+
+	if w := deliver(delivery); w.Code != http.StatusOK {
+		t.Fatalf("first delivery: got status %d, body %s", w.Code, w.Body.String())
+	}
+	w := deliver(delivery)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replayed delivery: got status %d, body %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "already processed") {
+		t.Errorf("replayed delivery: expected already processed, got %s", w.Body.String())
+	}
+
+	var balance models.UserTokenBalance
+	if err := database.DB.First(&balance, "user_id = ?", user.ID).Error; err != nil {
+		t.Fatalf("failed to load balance: %v", err)
+	}
+	if balance.Balance != 100 {
+		t.Errorf("balance: got %d, want 100", balance.Balance)
+	}
+
+	var entries int64
+	database.DB.Model(&models.JournalEntry{}).Where("transaction_id = ?", purchase.ID).Count(&entries)
+	if entries != 1 {
+		t.Errorf("journal entries: got %d, want 1", entries)
+	}
+
+	if err := database.DB.First(&purchase, purchase.ID).Error; err != nil {
+		t.Fatalf("failed to reload purchase: %v", err)
+	}
+	if purchase.Status != models.TransactionStatusCompleted {
+		t.Errorf("purchase status: got %s, want completed", purchase.Status)
+	}
+
+	var event models.WebhookEvent
+	if err := database.DB.First(&event).Error; err != nil {
+		t.Fatalf("failed to load webhook event: %v", err)
+	}
+	if event.Status != models.WebhookEventStatusProcessed || event.Attempts != 1 {
+		t.Errorf("webhook event: got status %s after %d attempts, want processed after 1", event.Status, event.Attempts)
+	}
+}
+
+func TestHandleStripeWebhookRejectsBadSignature(t *testing.T) {
+	provider := setupWebhookTest(t)
+
+	delivery, err := provider.AccountUpdated("acct_test", true)
+	if err != nil {
+		t.Fatalf("failed to build delivery: %v", err)
+	}
+	delivery.Signature = strings.Replace(delivery.Signature, "v1=", "v1=0", 1)
+
+	if w := deliver(delivery); w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", w.Code)
+	}
+
+	var events int64
+	database.DB.Model(&models.WebhookEvent{}).Count(&events)
+	if events != 0 {
+		t.Errorf("stored %d events for a forged delivery", events)
+	}
+}
+
+func TestRefundTakesBackThePurchasedTokens(t *testing.T) {
+	provider := setupWebhookTest(t)
+
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x"}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	// 100 tokens with 20 promotional ones, then 100 more without a bonus
+	refunded := createPurchase(t, provider, user.ID, 120, 20, 1000)
+	kept := createPurchase(t, provider, user.ID, 100, 0, 1000)
+	for _, purchase := range []models.TokenTransaction{refunded, kept} {
+		mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+	}
+
+	buckets := func() *ledger.Buckets {
+		t.Helper()
+		b, err := ledger.BucketsOf(database.DB, user.ID, time.Now())
+		if err != nil {
+			t.Fatalf("failed to load buckets: %v", err)
+		}
+		return b
+	}
+	if b := buckets(); b.Purchased != 200 || b.Promotional != 20 {
+		t.Fatalf("before refund: got %d purchased and %d promotional tokens, want 200 and 20", b.Purchased, b.Promotional)
+	}
+
+	// Half the purchase is 60 tokens, taken from paid tokens first
+	refund := func(cents int64) {
+		t.Helper()
+		if _, err := provider.CreateRefund(payments.RefundParams{PaymentIntentID: *refunded.StripePaymentIntentID, AmountCents: cents}); err != nil {
+			t.Fatalf("failed to refund: %v", err)
+		}
+		mustDeliver(t, provider.ChargeRefunded, *refunded.StripePaymentIntentID)
+	}
+	refund(500)
+	if b := buckets(); b.Purchased != 140 || b.Promotional != 20 {
+		t.Errorf("after half refund: got %d purchased and %d promotional tokens, want 140 and 20", b.Purchased, b.Promotional)
+	}
+
+	// The rest takes what the purchase still has, its bonus included, and
+	// leaves the other purchase alone
+	refund(500)
+	if b := buckets(); b.Purchased != 100 || b.Promotional != 0 {
+		t.Errorf("after full refund: got %d purchased and %d promotional tokens, want 100 and 0", b.Purchased, b.Promotional)
+	}
+}
+
+func TestDisputeAfterRefundFreezesTheRest(t *testing.T) {
+	provider := setupWebhookTest(t)
+
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x"}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	disputed := createPurchase(t, provider, user.ID, 100, 0, 1000)
+	kept := createPurchase(t, provider, user.ID, 100, 0, 1000)
+	for _, purchase := range []models.TokenTransaction{disputed, kept} {
+		mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+	}
+
+	// Half the purchase is refunded, then the whole charge is disputed
+	if _, err := provider.CreateRefund(payments.RefundParams{PaymentIntentID: *disputed.StripePaymentIntentID, AmountCents: 500}); err != nil {
+		t.Fatalf("failed to refund: %v", err)
+	}
+	mustDeliver(t, provider.ChargeRefunded, *disputed.StripePaymentIntentID)
+	mustDeliver(t, func(id string) (*payments.WebhookDelivery, error) {
+		return provider.DisputeCreated(id, 1000)
+	}, *disputed.StripePaymentIntentID)
+
+	// Only the 50 tokens not refunded are at stake; the other purchase's
+	// tokens stay in the wallet
+	var record models.PaymentDispute
+	if err := database.DB.First(&record).Error; err != nil {
+		t.Fatalf("failed to load dispute: %v", err)
+	}
+	if record.DisputedTokens != 50 || record.FrozenTokens != 50 {
+		t.Errorf("got %d disputed and %d frozen tokens, want 50 and 50", record.DisputedTokens, record.FrozenTokens)
+	}
+	if balance := walletBalance(t, user.ID); balance != 100 {
+		t.Errorf("got wallet balance %d, want 100", balance)
+	}
+	held, err := ledger.Balance(database.DB, ledger.Hold(user.ID))
+	if err != nil {
+		t.Fatalf("Balance: %v", err)
+	}
+	if held != 50 {
+		t.Errorf("got %d tokens on hold, want 50", held)
+	}
+}
+
+// createCashout cashes out tokens of a user for cents the way CashoutTokens
+// does and pays it out through the fake provider
+func createCashout(t *testing.T, user *models.User, tokens int, cents int64) models.TokenTransaction {
+	t.Helper()
+
+	cashout := models.TokenTransaction{
+		UserID:            user.ID,
+		TransactionType:   models.TransactionTypeCashout,
+		Amount:            -tokens,
+		PayoutAmountCents: &cents,
+		Status:            models.TransactionStatusPending,
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&cashout).Error; err != nil {
+			return err
+		}
+		_, err := ledger.Post(tx, ledger.Transfer(models.JournalKindCashout, ledger.User(user.ID), ledger.Payouts, tokens, &cashout.ID))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to create cashout: %v", err)
+	}
+
+	// A rejected transfer leaves the cashout failed rather than erroring
+	executePayout(&cashout, user)
+	return cashout
+}
+
+// walletBalance returns the tokens in a user's wallet
+func walletBalance(t *testing.T, userID uint) int {
+	t.Helper()
+
+	var balance models.UserTokenBalance
+	if err := database.DB.First(&balance, "user_id = ?", userID).Error; err != nil {
+		t.Fatalf("failed to load balance: %v", err)
+	}
+	return balance.Balance
+}
+
+func TestPartialTransferReversal(t *testing.T) {
+	provider := setupWebhookTest(t)
+
+	accountID := "acct_author"
+	author := models.User{Username: "author", Email: "author@example.com", PasswordHash: "x", StripeAccountID: &accountID}
+	if err := database.DB.Create(&author).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	purchase := createPurchase(t, provider, author.ID, 100, 0, 1000)
+	mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+
+	cashout := createCashout(t, &author, 100, 600)
+	if cashout.Status != models.TransactionStatusCompleted || cashout.StripeTransferID == nil {
+		t.Fatalf("cashout was not paid out: status %s", cashout.Status)
+	}
+	transferID := *cashout.StripeTransferID
+
+	reload := func() models.TokenTransaction {
+		t.Helper()
+		var tx models.TokenTransaction
+		if err := database.DB.First(&tx, cashout.ID).Error; err != nil {
+			t.Fatalf("failed to reload cashout: %v", err)
+		}
+		return tx
+	}
+
+	// A quarter of the transfer comes back, and so do a quarter of the tokens
+	mustDeliver(t, func(id string) (*payments.WebhookDelivery, error) { return provider.ReverseTransfer(id, 150) }, transferID)
+	if got := walletBalance(t, author.ID); got != 25 {
+		t.Errorf("after partial reversal: got %d tokens, want 25", got)
+	}
+	if got := reload(); got.Status != models.TransactionStatusCompleted || got.ReversedCents != 150 {
+		t.Errorf("after partial reversal: got status %s with %d cents reversed, want completed with 150", got.Status, got.ReversedCents)
+	}
+
+	// Another event reporting the same total returns nothing more
+	mustDeliver(t, func(id string) (*payments.WebhookDelivery, error) {
+		return provider.Event(stripe.EventTypeTransferReversed, map[string]interface{}{
+			"id": id, "object": "transfer", "amount": 600, "amount_reversed": 150, "reversed": false,
+		})
+	}, transferID)
+	if got := walletBalance(t, author.ID); got != 25 {
+		t.Errorf("after repeated total: got %d tokens, want 25", got)
+	}
+
+	// Reversing the rest returns the rest and fails the cashout
+	mustDeliver(t, func(id string) (*payments.WebhookDelivery, error) { return provider.ReverseTransfer(id, 450) }, transferID)
+	if got := walletBalance(t, author.ID); got != 100 {
+		t.Errorf("after full reversal: got %d tokens, want 100", got)
+	}
+	if got := reload(); got.Status != models.TransactionStatusFailed {
+		t.Errorf("after full reversal: got status %s, want failed", got.Status)
+	}
+}
+
+func TestFailedCashoutReturnsTokensToTheirBuckets(t *testing.T) {
+	provider := setupWebhookTest(t)
+
+	accountID := "acct_author"
+	author := models.User{Username: "author", Email: "author@example.com", PasswordHash: "x", StripeAccountID: &accountID}
+	if err := database.DB.Create(&author).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	purchase := createPurchase(t, provider, author.ID, 100, 0, 1000)
+	mustDeliver(t, provider.SucceedPaymentIntent, *purchase.StripePaymentIntentID)
+
+	buckets := func() *ledger.Buckets {
+		t.Helper()
+		b, err := ledger.BucketsOf(database.DB, author.ID, time.Now())
+		if err != nil {
+			t.Fatalf("failed to load buckets: %v", err)
+		}
+		return b
+	}
+
+	// The purchased tokens come back as purchased ones, not as earnings
+	provider.FailNextTransfer("account closed")
+	if cashout := createCashout(t, &author, 100, 600); cashout.Status != models.TransactionStatusFailed {
+		t.Fatalf("cashout: got status %s, want failed", cashout.Status)
+	}
+	if b := buckets(); b.Purchased != 100 || b.Earned != 0 {
+		t.Errorf("after failed cashout: got %d purchased and %d earned tokens, want 100 and 0", b.Purchased, b.Earned)
+	}
+
+	// So refunding the purchase takes back those very tokens
+	if _, err := provider.CreateRefund(payments.RefundParams{PaymentIntentID: *purchase.StripePaymentIntentID, AmountCents: 1000}); err != nil {
+		t.Fatalf("failed to refund: %v", err)
+	}
+	mustDeliver(t, provider.ChargeRefunded, *purchase.StripePaymentIntentID)
+	if b := buckets(); b.Purchased != 0 || b.Earned != 0 {
+		t.Errorf("after refund: got %d purchased and %d earned tokens, want 0 and 0", b.Purchased, b.Earned)
+	}
+	if got := walletBalance(t, author.ID); got != 0 {
+		t.Errorf("after refund: got %d tokens, want 0", got)
+	}
+}
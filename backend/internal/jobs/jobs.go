@@ -0,0 +1,113 @@
+// Package jobs runs periodic background work inside the API server. Every
+// replica runs the same jobs, but a job only runs on the replica holding its
+// lease in the database, so each run happens on one replica at a time.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Job is work run every Interval
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context, db *gorm.DB) error
+}
+
+// holder identifies this process in the leases it takes
+var holder = newHolder()
+
+// Start runs each job on its own goroutine until ctx is cancelled. A job's
+// lease lasts for two of its intervals, so if the replica holding it stops,
+// another takes over within that time.
+func Start(ctx context.Context, db *gorm.DB, jobs ...Job) {
+	for _, job := range jobs {
+		go loop(ctx, db, job)
+	}
+}
+
+func loop(ctx context.Context, db *gorm.DB, job Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		runOnce(ctx, db, job)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runOnce(ctx context.Context, db *gorm.DB, job Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[JOBS] %s panicked: %v", job.Name, r)
+		}
+	}()
+
+	held, err := Acquire(db, job.Name, 2*job.Interval)
+	if err != nil {
+		log.Printf("[JOBS] Failed to take lease for %s: %v", job.Name, err)
+		return
+	}
+	if !held {
+		return
+	}
+
+	if err := job.Run(ctx, db); err != nil {
+		log.Printf("[JOBS] %s failed: %v", job.Name, err)
+	}
+}
+
+// Acquire takes or renews the named lease for ttl. It reports whether this
+// process holds the lease.
+func Acquire(db *gorm.DB, name string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.JobLease{
+		Name:      name,
+		Holder:    holder,
+		ExpiresAt: now.Add(ttl),
+	}).Error; err != nil {
+		return false, err
+	}
+
+	result := db.Model(&models.JobLease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", name, holder, now).
+		Updates(map[string]interface{}{"holder": holder, "expires_at": now.Add(ttl)})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// MySQL reports no affected rows when a renewal changes nothing, so check
+	// who holds the lease
+	var lease models.JobLease
+	if err := db.Where("name = ?", name).First(&lease).Error; err != nil {
+		return false, err
+	}
+	return lease.Holder == holder, nil
+}
+
+func newHolder() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(b))
+}
@@ -0,0 +1,66 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// acquireAs takes the lease as another replica would
+func acquireAs(t *testing.T, db *gorm.DB, replica string, ttl time.Duration) bool {
+	t.Helper()
+
+	saved := holder
+	holder = replica
+	defer func() { holder = saved }()
+
+	held, err := Acquire(db, "publish", ttl)
+	if err != nil {
+		t.Fatalf("Acquire as %s: %v", replica, err)
+	}
+	return held
+}
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name string
+		// firstTTL is the lease the first replica takes
+		firstTTL time.Duration
+		second   bool
+	}{
+		{name: "live lease", firstTTL: time.Minute},
+		{name: "expired lease", firstTTL: -time.Minute, second: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t, &models.JobLease{})
+
+			if !acquireAs(t, db, "a", tt.firstTTL) {
+				t.Fatal("first replica did not get a free lease")
+			}
+			if got := acquireAs(t, db, "b", time.Minute); got != tt.second {
+				t.Fatalf("second replica: got held %v, want %v", got, tt.second)
+			}
+			// Whoever holds the lease keeps it, and the other cannot take it
+			if got := acquireAs(t, db, "b", time.Minute); got != tt.second {
+				t.Errorf("second replica renewing: got held %v, want %v", got, tt.second)
+			}
+			if got := acquireAs(t, db, "a", time.Minute); got == tt.second {
+				t.Errorf("first replica renewing: got held %v, want %v", got, !tt.second)
+			}
+
+			var leases int64
+			if err := db.Model(&models.JobLease{}).Count(&leases).Error; err != nil {
+				t.Fatalf("failed to count leases: %v", err)
+			}
+			if leases != 1 {
+				t.Errorf("got %d leases, want 1", leases)
+			}
+		})
+	}
+}
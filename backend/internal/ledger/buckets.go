@@ -0,0 +1,507 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// Expired receives promotional tokens that expired unspent
+var Expired = System("expired")
+
+// expireBatch bounds the number of buckets expired per run
+const expireBatch = 100
+
+// spendOrder returns the bucket kinds a debit of an entry kind draws from, in
+// order. Spending uses promotional tokens first; cashouts never touch them.
+// Refunds and disputes take back paid tokens before promotional ones, which
+// the buyer would otherwise lose to expiry instead.
+func spendOrder(kind models.JournalKind) []models.TokenBucketKind {
+	if kind == models.JournalKindCashout {
+		return []models.TokenBucketKind{models.TokenBucketEarned, models.TokenBucketPurchased}
+	}
+	if clawsBack(kind) {
+		return []models.TokenBucketKind{models.TokenBucketPurchased, models.TokenBucketEarned, models.TokenBucketPromotional}
+	}
+	return []models.TokenBucketKind{models.TokenBucketPromotional, models.TokenBucketPurchased, models.TokenBucketEarned}
+}
+
+// clawsBack reports whether an entry kind takes tokens back regardless of
+// expiry. Refunds and disputes are sized by the account balance, which still
+// includes expired tokens until ExpireDue sweeps them.
+func clawsBack(kind models.JournalKind) bool {
+	return kind == models.JournalKindRefund || kind == models.JournalKindDispute
+}
+
+// creditKind returns the bucket that tokens credited by an entry kind land in
+func creditKind(kind models.JournalKind) models.TokenBucketKind {
+	if isEarningKind(kind) || kind == models.JournalKindCashoutReversal {
+		return models.TokenBucketEarned
+	}
+	return models.TokenBucketPurchased
+}
+
+// bucketed reports whether an account's balance is split into buckets
+func bucketed(account *models.LedgerAccount) bool {
+	return account.Type == models.LedgerAccountUser || account.Type == models.LedgerAccountHold
+}
+
+// piece is an amount of tokens in one bucket
+type piece struct {
+	bucket *models.TokenBucket
+	amount int
+}
+
+// allocate turns the lines of an entry into postings, splitting those on
+// user and hold accounts over their buckets and updating the bucket
+// balances. Debits take the line's preferred tokens first, then draw from
+// buckets in spendOrder, soonest expiring first.
+// Credits refill the line's preferred buckets first, then land in the bucket
+// the line or entry kind names, except that tokens moved between a user's
+// wallet and hold keep their buckets.
+func allocate(tx *gorm.DB, entry Entry, accounts map[string]*models.LedgerAccount, checkFunds bool, now time.Time) ([]models.Posting, error) {
+	var postings []models.Posting
+	moved := make(map[uint][]piece) // Debited from each user's buckets
+
+	for _, line := range entry.Lines {
+		account := accounts[line.Account.Code]
+		if line.Amount >= 0 {
+			continue
+		}
+		if !bucketed(account) {
+			postings = append(postings, models.Posting{AccountID: account.ID, Amount: line.Amount})
+			continue
+		}
+
+		pieces, err := debit(tx, account, line, entry.Kind, checkFunds, now)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pieces {
+			if err := adjust(tx, p.bucket, -p.amount); err != nil {
+				return nil, err
+			}
+			postings = append(postings, models.Posting{AccountID: account.ID, Amount: -p.amount, BucketID: &p.bucket.ID})
+		}
+		moved[*account.UserID] = append(moved[*account.UserID], pieces...)
+	}
+
+	for _, line := range entry.Lines {
+		account := accounts[line.Account.Code]
+		if line.Amount < 0 {
+			continue
+		}
+		if !bucketed(account) || line.Amount == 0 {
+			postings = append(postings, models.Posting{AccountID: account.ID, Amount: line.Amount})
+			continue
+		}
+
+		remaining := line.Amount
+		pieces, err := restore(tx, account, line)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pieces {
+			remaining -= p.amount
+		}
+		if line.Bucket == "" {
+			// Keep the kind and expiry of tokens coming from the user's other account
+			for i := range moved[*account.UserID] {
+				source := &moved[*account.UserID][i]
+				if remaining == 0 || source.bucket.AccountID == account.ID || source.amount == 0 {
+					continue
+				}
+				amount := min(remaining, source.amount)
+				bucket, err := findBucket(tx, account.ID, source.bucket.Kind, source.bucket.ExpiresAt)
+				if err != nil {
+					return nil, err
+				}
+				pieces = append(pieces, piece{bucket: bucket, amount: amount})
+				source.amount -= amount
+				remaining -= amount
+			}
+		}
+		if remaining > 0 {
+			kind := line.Bucket
+			if kind == "" {
+				kind = creditKind(entry.Kind)
+			}
+			bucket, err := findBucket(tx, account.ID, kind, line.ExpiresAt)
+			if err != nil {
+				return nil, err
+			}
+			pieces = append(pieces, piece{bucket: bucket, amount: remaining})
+		}
+
+		for _, p := range pieces {
+			if err := adjust(tx, p.bucket, p.amount); err != nil {
+				return nil, err
+			}
+			postings = append(postings, models.Posting{AccountID: account.ID, Amount: p.amount, BucketID: &p.bucket.ID})
+		}
+	}
+
+	return postings, nil
+}
+
+// debit picks the buckets a debit line draws from. The account must be
+// locked.
+func debit(tx *gorm.DB, account *models.LedgerAccount, line Line, kind models.JournalKind, checkFunds bool, now time.Time) ([]piece, error) {
+	order := spendOrder(kind)
+	query := tx.Where("account_id = ? AND balance > 0", account.ID)
+	if line.BucketID != nil {
+		query = query.Where("id = ?", *line.BucketID)
+	} else {
+		query = query.Where("kind IN ?", order)
+		if !clawsBack(kind) {
+			query = query.Where("expires_at IS NULL OR expires_at > ?", now)
+		}
+	}
+	var buckets []models.TokenBucket
+	if err := query.Find(&buckets).Error; err != nil {
+		return nil, fmt.Errorf("failed to load token buckets: %w", err)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if rankA, rankB := rank(order, a.Kind), rank(order, b.Kind); rankA != rankB {
+			return rankA < rankB
+		}
+		if (a.ExpiresAt == nil) != (b.ExpiresAt == nil) {
+			return a.ExpiresAt != nil
+		}
+		if a.ExpiresAt != nil && !a.ExpiresAt.Equal(*b.ExpiresAt) {
+			return a.ExpiresAt.Before(*b.ExpiresAt)
+		}
+		return a.ID < b.ID
+	})
+
+	// Take the preferred tokens first, then whatever else the order allows
+	preferred := make(map[uint]int, len(line.Prefer))
+	for _, credit := range line.Prefer {
+		preferred[credit.BucketID] += credit.Amount
+	}
+	remaining := -line.Amount
+	taken := make([]int, len(buckets))
+	for _, limited := range []bool{true, false} {
+		for i := range buckets {
+			available := buckets[i].Balance - taken[i]
+			if limited {
+				available = min(available, preferred[buckets[i].ID])
+			}
+			amount := min(remaining, max(available, 0))
+			taken[i] += amount
+			remaining -= amount
+		}
+	}
+	var pieces []piece
+	for i := range buckets {
+		if taken[i] > 0 {
+			pieces = append(pieces, piece{bucket: &buckets[i], amount: taken[i]})
+		}
+	}
+	if remaining > 0 {
+		if checkFunds {
+			return nil, ErrInsufficientFunds
+		}
+		// Unchecked entries, like the replay of old transactions, may
+		// overdraw the account for a while
+		bucket, err := findBucket(tx, account.ID, models.TokenBucketPurchased, nil)
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, piece{bucket: bucket, amount: remaining})
+	}
+	return pieces, nil
+}
+
+// restore picks the preferred buckets a credit line refills, up to the
+// amount each lists. Buckets of other accounts are ignored.
+func restore(tx *gorm.DB, account *models.LedgerAccount, line Line) ([]piece, error) {
+	if len(line.Prefer) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, len(line.Prefer))
+	for i, credit := range line.Prefer {
+		ids[i] = credit.BucketID
+	}
+	var buckets []models.TokenBucket
+	if err := tx.Where("account_id = ? AND id IN ?", account.ID, ids).Find(&buckets).Error; err != nil {
+		return nil, fmt.Errorf("failed to load token buckets: %w", err)
+	}
+	byID := make(map[uint]*models.TokenBucket, len(buckets))
+	for i := range buckets {
+		byID[buckets[i].ID] = &buckets[i]
+	}
+
+	var pieces []piece
+	remaining := line.Amount
+	for _, credit := range line.Prefer {
+		bucket := byID[credit.BucketID]
+		if bucket == nil || remaining == 0 || credit.Amount <= 0 {
+			continue
+		}
+		amount := min(remaining, credit.Amount)
+		pieces = append(pieces, piece{bucket: bucket, amount: amount})
+		remaining -= amount
+	}
+	return pieces, nil
+}
+
+func rank(order []models.TokenBucketKind, kind models.TokenBucketKind) int {
+	for i, k := range order {
+		if k == kind {
+			return i
+		}
+	}
+	return len(order)
+}
+
+// findBucket returns the account's bucket of a kind and expiry, creating it
+// if needed. The account must be locked.
+func findBucket(tx *gorm.DB, accountID uint, kind models.TokenBucketKind, expiresAt *time.Time) (*models.TokenBucket, error) {
+	query := tx.Where("account_id = ? AND kind = ?", accountID, kind)
+	if expiresAt != nil {
+		query = query.Where("expires_at = ?", *expiresAt)
+	} else {
+		query = query.Where("expires_at IS NULL")
+	}
+
+	var bucket models.TokenBucket
+	err := query.First(&bucket).Error
+	if err == nil {
+		return &bucket, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to look up token bucket: %w", err)
+	}
+
+	bucket = models.TokenBucket{AccountID: accountID, Kind: kind, ExpiresAt: expiresAt}
+	if err := tx.Create(&bucket).Error; err != nil {
+		return nil, fmt.Errorf("failed to create token bucket: %w", err)
+	}
+	return &bucket, nil
+}
+
+func adjust(tx *gorm.DB, bucket *models.TokenBucket, delta int) error {
+	if err := tx.Model(bucket).Update("balance", gorm.Expr("balance + ?", delta)).Error; err != nil {
+		return fmt.Errorf("failed to update token bucket: %w", err)
+	}
+	bucket.Balance += delta
+	return nil
+}
+
+// CreditsOf returns the tokens a transaction left in each bucket of an
+// account: what its entries and those of the transactions related to it,
+// such as its refunds, put in and took out, where that is still positive
+func CreditsOf(db *gorm.DB, transactionID uint, ref AccountRef) ([]Credit, error) {
+	return netOf(db, transactionID, ref, 1)
+}
+
+// DebitsOf returns the tokens a transaction still has out of each bucket of
+// an account: what its entries and those of the transactions related to it
+// took out and put back, where more was taken than returned
+func DebitsOf(db *gorm.DB, transactionID uint, ref AccountRef) ([]Credit, error) {
+	return netOf(db, transactionID, ref, -1)
+}
+
+// netOf sums the postings of a transaction and its related transactions on
+// each bucket of an account, returning the sums of the given sign as
+// positive amounts
+func netOf(db *gorm.DB, transactionID uint, ref AccountRef, sign int) ([]Credit, error) {
+	related := db.Model(&models.TokenTransaction{}).Select("id").Where("related_transaction_id = ?", transactionID)
+
+	var credits []Credit
+	err := db.Model(&models.Posting{}).
+		Joins("JOIN journal_entries ON journal_entries.id = postings.journal_entry_id").
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = postings.account_id").
+		Select("postings.bucket_id, ? * SUM(postings.amount) AS amount", sign).
+		Where("journal_entries.transaction_id = ? OR journal_entries.transaction_id IN (?)", transactionID, related).
+		Where("ledger_accounts.code = ? AND postings.bucket_id IS NOT NULL", ref.Code).
+		Group("postings.bucket_id").
+		Having("? * SUM(postings.amount) > 0", sign).
+		Order("postings.bucket_id").
+		Scan(&credits).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum bucket postings of transaction %d: %w", transactionID, err)
+	}
+	return credits, nil
+}
+
+// Expiring is an amount of promotional tokens and when they expire
+type Expiring struct {
+	Tokens    int       `json:"tokens"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Buckets is a user's spendable balance split by bucket
+type Buckets struct {
+	Purchased   int        `json:"purchased"`
+	Earned      int        `json:"earned"`
+	Promotional int        `json:"promotional"`
+	Cashable    int        `json:"cashable"` // Purchased and earned tokens
+	Expiring    []Expiring `json:"expiring"` // Soonest first
+}
+
+// BucketsOf returns the spendable balance of a user's wallet by bucket
+func BucketsOf(db *gorm.DB, userID uint, now time.Time) (*Buckets, error) {
+	var buckets []models.TokenBucket
+	if err := db.Joins("JOIN ledger_accounts ON ledger_accounts.id = token_buckets.account_id").
+		Where("ledger_accounts.code = ? AND token_buckets.balance > 0", User(userID).Code).
+		Where("token_buckets.expires_at IS NULL OR token_buckets.expires_at > ?", now).
+		Order("token_buckets.expires_at").
+		Find(&buckets).Error; err != nil {
+		return nil, err
+	}
+
+	summary := &Buckets{Expiring: []Expiring{}}
+	for _, bucket := range buckets {
+		switch bucket.Kind {
+		case models.TokenBucketPurchased:
+			summary.Purchased += bucket.Balance
+		case models.TokenBucketEarned:
+			summary.Earned += bucket.Balance
+		case models.TokenBucketPromotional:
+			summary.Promotional += bucket.Balance
+		}
+		if bucket.ExpiresAt != nil {
+			summary.Expiring = append(summary.Expiring, Expiring{Tokens: bucket.Balance, ExpiresAt: *bucket.ExpiresAt})
+		}
+	}
+	summary.Cashable = summary.Purchased + summary.Earned
+	return summary, nil
+}
+
+// ExpireDue moves the balance of expired promotional buckets to the Expired
+// account, a batch at a time, recording an expiry transaction for each user
+func ExpireDue(ctx context.Context, db *gorm.DB) error {
+	now := time.Now()
+
+	var ids []uint
+	if err := db.Model(&models.TokenBucket{}).
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = token_buckets.account_id").
+		Where("ledger_accounts.type = ? AND token_buckets.kind = ?", models.LedgerAccountUser, models.TokenBucketPromotional).
+		Where("token_buckets.expires_at <= ? AND token_buckets.balance > 0", now).
+		Order("token_buckets.expires_at").Limit(expireBatch).
+		Pluck("token_buckets.id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return expire(tx, id)
+		}); err != nil {
+			log.Printf("[LEDGER] Failed to expire token bucket %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// expire empties one expired bucket
+func expire(tx *gorm.DB, id uint) error {
+	var bucket models.TokenBucket
+	if err := tx.First(&bucket, id).Error; err != nil {
+		return err
+	}
+	var account models.LedgerAccount
+	if err := tx.First(&account, bucket.AccountID).Error; err != nil {
+		return err
+	}
+	wallet := User(*account.UserID)
+
+	// Read the bucket again under the account lock; its tokens may have been
+	// spent in the meantime
+	if _, err := lockAccounts(tx, []Line{{Account: wallet}}); err != nil {
+		return err
+	}
+	if err := tx.First(&bucket, id).Error; err != nil {
+		return err
+	}
+	if bucket.Balance <= 0 {
+		return nil
+	}
+
+	transaction := models.TokenTransaction{
+		UserID:          *account.UserID,
+		TransactionType: models.TransactionTypeExpiry,
+		Amount:          -bucket.Balance,
+		Status:          models.TransactionStatusCompleted,
+	}
+	if err := tx.Create(&transaction).Error; err != nil {
+		return err
+	}
+
+	entry := Entry{
+		Kind:          models.JournalKindExpiry,
+		TransactionID: &transaction.ID,
+		Memo:          "Promotional tokens expired",
+		Lines: []Line{
+			{Account: wallet, Amount: -bucket.Balance, BucketID: &bucket.ID},
+			{Account: Expired, Amount: bucket.Balance},
+		},
+	}
+	_, err := Post(tx, entry)
+	return err
+}
+
+// BackfillBuckets puts the postings of user and hold accounts that predate
+// buckets into a purchased bucket, so their balances stay cashable as they
+// were. It does nothing once every such posting has a bucket.
+func BackfillBuckets(db *gorm.DB) error {
+	var accountIDs []uint
+	if err := db.Model(&models.Posting{}).
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = postings.account_id").
+		Where("postings.bucket_id IS NULL AND ledger_accounts.type IN ?", []models.LedgerAccountType{models.LedgerAccountUser, models.LedgerAccountHold}).
+		Distinct().Pluck("postings.account_id", &accountIDs).Error; err != nil {
+		return fmt.Errorf("failed to find accounts without buckets: %w", err)
+	}
+
+	for _, accountID := range accountIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var account models.LedgerAccount
+			if err := tx.First(&account, accountID).Error; err != nil {
+				return err
+			}
+			if _, err := lockAccounts(tx, []Line{{Account: AccountRef{Code: account.Code}}}); err != nil {
+				return err
+			}
+			bucket, err := findBucket(tx, accountID, models.TokenBucketPurchased, nil)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&models.Posting{}).
+				Where("account_id = ? AND bucket_id IS NULL", accountID).
+				Update("bucket_id", bucket.ID).Error; err != nil {
+				return err
+			}
+			return rebuildBuckets(tx, accountID)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to backfill buckets of account %d: %w", accountID, err)
+		}
+	}
+	if len(accountIDs) > 0 {
+		log.Printf("Backfilled token buckets for %d accounts", len(accountIDs))
+	}
+	return nil
+}
+
+// rebuildBuckets recomputes the cached balances of an account's buckets from
+// their postings
+func rebuildBuckets(tx *gorm.DB, accountID uint) error {
+	err := tx.Model(&models.TokenBucket{}).
+		Where("account_id = ?", accountID).
+		Update("balance", gorm.Expr("(SELECT COALESCE(SUM(postings.amount), 0) FROM postings WHERE postings.bucket_id = token_buckets.id)")).Error
+	if err != nil {
+		return fmt.Errorf("failed to update token bucket balances: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// fund gives user 1 purchased and earned tokens, and promotional tokens
+// expiring at the times promotional maps to their amounts
+func fund(t *testing.T, db *gorm.DB, purchased, earned int, promotional map[time.Time]int) {
+	t.Helper()
+
+	if purchased > 0 {
+		mustPost(t, db, Transfer(models.JournalKindPurchase, Stripe, User(1), purchased, nil))
+	}
+	if earned > 0 {
+		mustPost(t, db, Transfer(models.JournalKindPurchase, Stripe, User(2), earned, nil))
+		mustPost(t, db, Transfer(models.JournalKindTip, User(2), User(1), earned, nil))
+	}
+	for expiresAt, amount := range promotional {
+		expiresAt := expiresAt
+		mustPost(t, db, Entry{
+			Kind: models.JournalKindPurchase,
+			Lines: []Line{
+				{Account: Stripe, Amount: -amount},
+				{Account: User(1), Amount: amount, Bucket: models.TokenBucketPromotional, ExpiresAt: &expiresAt},
+			},
+		})
+	}
+}
+
+// bucketsOf returns user 1's spendable balance by bucket
+func bucketsOf(t *testing.T, db *gorm.DB) *Buckets {
+	t.Helper()
+
+	b, err := BucketsOf(db, 1, time.Now())
+	if err != nil {
+		t.Fatalf("BucketsOf: %v", err)
+	}
+	return b
+}
+
+func TestSpendOrder(t *testing.T) {
+	tests := []struct {
+		kind models.JournalKind
+		want []models.TokenBucketKind
+	}{
+		{kind: models.JournalKindTip, want: []models.TokenBucketKind{models.TokenBucketPromotional, models.TokenBucketPurchased, models.TokenBucketEarned}},
+		{kind: models.JournalKindUnlock, want: []models.TokenBucketKind{models.TokenBucketPromotional, models.TokenBucketPurchased, models.TokenBucketEarned}},
+		{kind: models.JournalKindCashout, want: []models.TokenBucketKind{models.TokenBucketEarned, models.TokenBucketPurchased}},
+		{kind: models.JournalKindRefund, want: []models.TokenBucketKind{models.TokenBucketPurchased, models.TokenBucketEarned, models.TokenBucketPromotional}},
+		{kind: models.JournalKindDispute, want: []models.TokenBucketKind{models.TokenBucketPurchased, models.TokenBucketEarned, models.TokenBucketPromotional}},
+	}
+
+	for _, tt := range tests {
+		got := spendOrder(tt.kind)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.kind, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.kind, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDebitSpendsPromotionalTokensFirst(t *testing.T) {
+	soon := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	later := soon.Add(24 * time.Hour)
+
+	tests := []struct {
+		name                          string
+		spend                         int
+		purchased, earned, soon, late int // Left afterwards
+	}{
+		{name: "from the soonest expiring", spend: 10, purchased: 50, earned: 40, soon: 10, late: 20},
+		{name: "all promotional tokens", spend: 40, purchased: 50, earned: 40},
+		{name: "then purchased tokens", spend: 60, purchased: 30, earned: 40},
+		{name: "then earned tokens", spend: 120, earned: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openLedger(t)
+			fund(t, db, 50, 40, map[time.Time]int{soon: 20, later: 20})
+
+			mustPost(t, db, Transfer(models.JournalKindUnlock, User(1), User(3), tt.spend, nil))
+
+			b := bucketsOf(t, db)
+			if b.Purchased != tt.purchased || b.Earned != tt.earned || b.Promotional != tt.soon+tt.late {
+				t.Errorf("got %d purchased, %d earned and %d promotional, want %d, %d and %d",
+					b.Purchased, b.Earned, b.Promotional, tt.purchased, tt.earned, tt.soon+tt.late)
+			}
+			var soonLeft, laterLeft int
+			for _, e := range b.Expiring {
+				switch {
+				case e.ExpiresAt.Equal(soon):
+					soonLeft = e.Tokens
+				case e.ExpiresAt.Equal(later):
+					laterLeft = e.Tokens
+				}
+			}
+			if soonLeft != tt.soon || laterLeft != tt.late {
+				t.Errorf("got %d expiring soon and %d later, want %d and %d", soonLeft, laterLeft, tt.soon, tt.late)
+			}
+		})
+	}
+}
+
+func TestDebitNeverCashesOutPromotionalTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		ok     bool
+	}{
+		{name: "earned and purchased tokens", amount: 30, ok: true},
+		{name: "more than the cashable tokens", amount: 31},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openLedger(t)
+			fund(t, db, 10, 20, map[time.Time]int{time.Now().Add(time.Hour): 50})
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				_, err := Post(tx, Transfer(models.JournalKindCashout, User(1), Payouts, tt.amount, nil))
+				return err
+			})
+			if !tt.ok {
+				if !errors.Is(err, ErrInsufficientFunds) {
+					t.Fatalf("got error %v, want %v", err, ErrInsufficientFunds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Post: %v", err)
+			}
+			if b := bucketsOf(t, db); b.Cashable != 0 || b.Promotional != 50 {
+				t.Errorf("got %d cashable and %d promotional tokens, want 0 and 50", b.Cashable, b.Promotional)
+			}
+		})
+	}
+}
+
+func TestDebitSkipsExpiredTokens(t *testing.T) {
+	db := openLedger(t)
+	fund(t, db, 10, 0, map[time.Time]int{time.Now().Add(-time.Hour): 50})
+
+	// The account balance still counts the expired tokens until they are
+	// swept, but they cannot be spent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := Post(tx, Transfer(models.JournalKindUnlock, User(1), User(3), 20, nil))
+		return err
+	})
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("got error %v, want %v", err, ErrInsufficientFunds)
+	}
+
+	mustPost(t, db, Transfer(models.JournalKindUnlock, User(1), User(3), 10, nil))
+}
+
+func TestExpireDue(t *testing.T) {
+	db := openLedger(t)
+	expired := time.Now().Add(-time.Hour)
+	valid := time.Now().Add(time.Hour)
+	fund(t, db, 10, 0, map[time.Time]int{expired: 30, valid: 20})
+
+	if err := ExpireDue(context.Background(), db); err != nil {
+		t.Fatalf("ExpireDue: %v", err)
+	}
+
+	if got := accountBalance(t, db, User(1)); got != 30 {
+		t.Errorf("wallet: got balance %d, want 30", got)
+	}
+	if got := accountBalance(t, db, Expired); got != 30 {
+		t.Errorf("expired account: got balance %d, want 30", got)
+	}
+	if b := bucketsOf(t, db); b.Purchased != 10 || b.Promotional != 20 {
+		t.Errorf("got %d purchased and %d promotional tokens, want 10 and 20", b.Purchased, b.Promotional)
+	}
+
+	var expiries []models.TokenTransaction
+	if err := db.Where("transaction_type = ?", models.TransactionTypeExpiry).Find(&expiries).Error; err != nil {
+		t.Fatalf("failed to load expiries: %v", err)
+	}
+	if len(expiries) != 1 || expiries[0].Amount != -30 || expiries[0].UserID != 1 {
+		t.Errorf("got expiry transactions %+v, want one of -30 tokens for user 1", expiries)
+	}
+
+	// A second run finds nothing left to expire
+	if err := ExpireDue(context.Background(), db); err != nil {
+		t.Fatalf("second ExpireDue: %v", err)
+	}
+	var count int64
+	db.Model(&models.TokenTransaction{}).Where("transaction_type = ?", models.TransactionTypeExpiry).Count(&count)
+	if count != 1 {
+		t.Errorf("got %d expiry transactions after a second run, want 1", count)
+	}
+}
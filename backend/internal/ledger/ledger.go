@@ -0,0 +1,339 @@
+// Package ledger implements the double-entry token ledger. Every token
+// movement is a journal entry whose postings sum to zero; the cached account
+// and bucket balances and models.UserTokenBalance are projections of the
+// journal and can be rebuilt from it at any time.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrUnbalanced        = errors.New("ledger: postings do not sum to zero")
+	ErrEmptyEntry        = errors.New("ledger: entry needs at least two postings")
+	ErrInsufficientFunds = errors.New("ledger: insufficient funds")
+)
+
+// AccountRef identifies a ledger account by its code. Accounts are created
+// on first use.
+type AccountRef struct {
+	Code   string
+	Type   models.LedgerAccountType
+	UserID *uint
+}
+
+// User returns the token wallet account of a user
+func User(userID uint) AccountRef {
+	id := userID
+	return AccountRef{Code: fmt.Sprintf("user:%d", userID), Type: models.LedgerAccountUser, UserID: &id}
+}
+
+// Hold returns the account holding a user's frozen tokens. Held tokens are
+// not part of the user's spendable balance.
+func Hold(userID uint) AccountRef {
+	id := userID
+	return AccountRef{Code: fmt.Sprintf("hold:%d", userID), Type: models.LedgerAccountHold, UserID: &id}
+}
+
+// System returns a platform-owned account. System accounts may go negative.
+func System(name string) AccountRef {
+	return AccountRef{Code: "system:" + name, Type: models.LedgerAccountSystem}
+}
+
+var (
+	// Stripe is the source of purchased tokens
+	Stripe = System("stripe")
+	// Payouts holds cashed out tokens until they are paid to the author
+	Payouts = System("payouts")
+	// PaidOut receives cashed out tokens once the Stripe transfer succeeded
+	PaidOut = System("paid_out")
+	// Opening balances the backfill of balances that predate the ledger
+	Opening = System("opening")
+	// Losses absorbs refunded or charged back tokens that were already spent
+	Losses = System("losses")
+)
+
+// earningKinds are the entry kinds that count towards a user's total earned
+// and total spent figures.
+var earningKinds = []models.JournalKind{models.JournalKindTip, models.JournalKindUnlock, models.JournalKindSubscription}
+
+// Line is a single posting of an entry before it is written. Lines on user
+// and hold accounts are split over the account's buckets; see allocate.
+type Line struct {
+	Account AccountRef
+	Amount  int
+
+	// Bucket and ExpiresAt pick the bucket a credit lands in, instead of
+	// the one the entry kind implies
+	Bucket    models.TokenBucketKind
+	ExpiresAt *time.Time
+	// BucketID restricts a debit to one bucket
+	BucketID *uint
+	// Prefer lists tokens a debit takes back before drawing on the account's
+	// buckets in the usual order, so a refund takes back the tokens the
+	// refunded purchase credited. On a credit it lists the buckets refilled
+	// first, so a reversed cashout returns tokens where it took them from.
+	Prefer []Credit
+}
+
+// Credit is an amount of tokens in one bucket
+type Credit struct {
+	BucketID uint
+	Amount   int
+}
+
+// Entry describes a journal entry to post
+type Entry struct {
+	Kind          models.JournalKind
+	TransactionID *uint
+	Memo          string
+	Lines         []Line
+}
+
+// Transfer builds an entry that moves amount tokens from one account to another
+func Transfer(kind models.JournalKind, from, to AccountRef, amount int, transactionID *uint) Entry {
+	return Entry{
+		Kind:          kind,
+		TransactionID: transactionID,
+		Lines: []Line{
+			{Account: from, Amount: -amount},
+			{Account: to, Amount: amount},
+		},
+	}
+}
+
+// Post writes an entry to the journal. It must be called inside a database
+// transaction: the affected accounts are locked in ID order, user accounts are
+// checked for sufficient funds, and the balance projections are updated
+// before returning.
+func Post(tx *gorm.DB, entry Entry) (*models.JournalEntry, error) {
+	return post(tx, entry, true)
+}
+
+func post(tx *gorm.DB, entry Entry, checkFunds bool) (*models.JournalEntry, error) {
+	if len(entry.Lines) < 2 {
+		return nil, ErrEmptyEntry
+	}
+
+	sum := 0
+	for _, line := range entry.Lines {
+		sum += line.Amount
+	}
+	if sum != 0 {
+		return nil, ErrUnbalanced
+	}
+
+	accounts, err := lockAccounts(tx, entry.Lines)
+	if err != nil {
+		return nil, err
+	}
+
+	// Net change, credits and debits per account
+	deltas := make(map[uint]int)
+	credits := make(map[uint]int)
+	debits := make(map[uint]int)
+	for _, line := range entry.Lines {
+		id := accounts[line.Account.Code].ID
+		deltas[id] += line.Amount
+		if line.Amount > 0 {
+			credits[id] += line.Amount
+		} else {
+			debits[id] -= line.Amount
+		}
+	}
+
+	if checkFunds {
+		for _, account := range accounts {
+			if !account.AllowNegative && account.Balance+deltas[account.ID] < 0 {
+				return nil, ErrInsufficientFunds
+			}
+		}
+	}
+
+	postings, err := allocate(tx, entry, accounts, checkFunds, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	journal := models.JournalEntry{
+		Kind:          entry.Kind,
+		TransactionID: entry.TransactionID,
+		Memo:          entry.Memo,
+		Postings:      postings,
+	}
+
+	if err := tx.Create(&journal).Error; err != nil {
+		return nil, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	earning := isEarningKind(entry.Kind)
+	for _, account := range accounts {
+		delta := deltas[account.ID]
+		if delta != 0 {
+			if err := tx.Model(account).Update("balance", gorm.Expr("balance + ?", delta)).Error; err != nil {
+				return nil, fmt.Errorf("failed to update account balance: %w", err)
+			}
+			account.Balance += delta
+		}
+
+		switch account.Type {
+		case models.LedgerAccountUser:
+			earned, spent := 0, 0
+			if earning {
+				earned, spent = credits[account.ID], debits[account.ID]
+			}
+			if err := incrementProjection(tx, *account.UserID, "balance", account.Balance, earned, spent); err != nil {
+				return nil, err
+			}
+		case models.LedgerAccountHold:
+			if err := incrementProjection(tx, *account.UserID, "frozen_balance", account.Balance, 0, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &journal, nil
+}
+
+// lockAccounts creates any missing accounts referenced by lines and locks all
+// of them with SELECT ... FOR UPDATE in ascending ID order so that concurrent
+// entries touching the same accounts cannot deadlock.
+func lockAccounts(tx *gorm.DB, lines []Line) (map[string]*models.LedgerAccount, error) {
+	var ids []uint
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		if seen[line.Account.Code] {
+			continue
+		}
+		seen[line.Account.Code] = true
+		id, err := ensureAccount(tx, line.Account)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var locked []models.LedgerAccount
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ?", ids).
+		Order("id ASC").
+		Find(&locked).Error; err != nil {
+		return nil, fmt.Errorf("failed to lock accounts: %w", err)
+	}
+	if len(locked) != len(ids) {
+		return nil, fmt.Errorf("failed to lock accounts: expected %d, got %d", len(ids), len(locked))
+	}
+
+	accounts := make(map[string]*models.LedgerAccount, len(locked))
+	for i := range locked {
+		accounts[locked[i].Code] = &locked[i]
+	}
+	return accounts, nil
+}
+
+// ensureAccount returns the ID of the account for ref, creating it if it does
+// not exist yet
+func ensureAccount(tx *gorm.DB, ref AccountRef) (uint, error) {
+	var account models.LedgerAccount
+	err := tx.Select("id").Where("code = ?", ref.Code).First(&account).Error
+	if err == nil {
+		return account.ID, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, fmt.Errorf("failed to look up account %s: %w", ref.Code, err)
+	}
+
+	account = models.LedgerAccount{
+		Code:          ref.Code,
+		Type:          ref.Type,
+		UserID:        ref.UserID,
+		AllowNegative: ref.Type == models.LedgerAccountSystem,
+	}
+
+	// A concurrent request may have created the account in the meantime, in
+	// which case the insert is a no-op and the row is read back below. The
+	// read back locks the row: a plain read under REPEATABLE READ would use
+	// the transaction's snapshot and miss a row committed after it started.
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&account)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to create account %s: %w", ref.Code, result.Error)
+	}
+	if result.RowsAffected == 1 && account.ID != 0 {
+		return account.ID, nil
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("code = ?", ref.Code).First(&account).Error; err != nil {
+		return 0, fmt.Errorf("failed to look up account %s: %w", ref.Code, err)
+	}
+	return account.ID, nil
+}
+
+// Balance locks the account for ref and returns its current balance. The lock
+// is held until the surrounding transaction ends, so the balance can be used
+// to size an entry posted in the same transaction.
+func Balance(tx *gorm.DB, ref AccountRef) (int, error) {
+	accounts, err := lockAccounts(tx, []Line{{Account: ref}})
+	if err != nil {
+		return 0, err
+	}
+	return accounts[ref.Code].Balance, nil
+}
+
+// Earnings returns the tokens a user has earned since the given time
+func Earnings(db *gorm.DB, userID uint, since time.Time) (int, error) {
+	var earned int
+	err := db.Model(&models.Posting{}).
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = postings.account_id").
+		Joins("JOIN journal_entries ON journal_entries.id = postings.journal_entry_id").
+		Where("ledger_accounts.code = ? AND journal_entries.kind IN ?", User(userID).Code, earningKinds).
+		Where("postings.amount > 0 AND postings.created_at >= ?", since).
+		Select("COALESCE(SUM(postings.amount), 0)").
+		Scan(&earned).Error
+	return earned, err
+}
+
+// incrementProjection writes the new balance of a user's wallet or hold
+// account to column and adds to their running totals, creating the
+// projection row if needed
+func incrementProjection(tx *gorm.DB, userID uint, column string, balance, earned, spent int) error {
+	projection := models.UserTokenBalance{
+		UserID:      userID,
+		TotalEarned: earned,
+		TotalSpent:  spent,
+	}
+	if column == "frozen_balance" {
+		projection.FrozenBalance = balance
+	} else {
+		projection.Balance = balance
+	}
+
+	err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			column:         balance,
+			"total_earned": gorm.Expr("total_earned + ?", earned),
+			"total_spent":  gorm.Expr("total_spent + ?", spent),
+		}),
+	}).Create(&projection).Error
+	if err != nil {
+		return fmt.Errorf("failed to update token balance: %w", err)
+	}
+	return nil
+}
+
+func isEarningKind(kind models.JournalKind) bool {
+	for _, k := range earningKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// openLedger returns an empty in-memory ledger
+func openLedger(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	return dbtest.Open(t,
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.Posting{},
+		&models.TokenBucket{},
+		&models.UserTokenBalance{},
+		&models.TokenTransaction{},
+	)
+}
+
+// mustPost posts entry in its own transaction and fails the test on error
+func mustPost(t *testing.T, db *gorm.DB, entry Entry) {
+	t.Helper()
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := Post(tx, entry)
+		return err
+	}); err != nil {
+		t.Fatalf("Post %s: %v", entry.Kind, err)
+	}
+}
+
+// accountBalance returns the cached balance of an account, 0 if it does not
+// exist yet
+func accountBalance(t *testing.T, db *gorm.DB, ref AccountRef) int {
+	t.Helper()
+
+	var account models.LedgerAccount
+	if err := db.Where("code = ?", ref.Code).Limit(1).Find(&account).Error; err != nil {
+		t.Fatalf("failed to load account %s: %v", ref.Code, err)
+	}
+	return account.Balance
+}
+
+func TestPostRejectsMalformedEntries(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []Line
+		want  error
+	}{
+		{name: "no lines", want: ErrEmptyEntry},
+		{name: "one line", lines: []Line{{Account: Stripe, Amount: 0}}, want: ErrEmptyEntry},
+		{name: "unbalanced", lines: []Line{{Account: Stripe, Amount: -100}, {Account: User(1), Amount: 90}}, want: ErrUnbalanced},
+		{name: "unbalanced over three lines", lines: []Line{
+			{Account: Stripe, Amount: -100},
+			{Account: User(1), Amount: 60},
+			{Account: User(2), Amount: 60},
+		}, want: ErrUnbalanced},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openLedger(t)
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				_, err := Post(tx, Entry{Kind: models.JournalKindPurchase, Lines: tt.lines})
+				return err
+			})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+
+			var entries int64
+			db.Model(&models.JournalEntry{}).Count(&entries)
+			if entries != 0 {
+				t.Errorf("wrote %d journal entries", entries)
+			}
+		})
+	}
+}
+
+func TestPostBalancesPostings(t *testing.T) {
+	db := openLedger(t)
+
+	mustPost(t, db, Transfer(models.JournalKindPurchase, Stripe, User(1), 100, nil))
+	mustPost(t, db, Transfer(models.JournalKindTip, User(1), User(2), 30, nil))
+
+	var entries []models.JournalEntry
+	if err := db.Preload("Postings").Find(&entries).Error; err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d journal entries, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		sum := 0
+		for _, posting := range entry.Postings {
+			sum += posting.Amount
+		}
+		if sum != 0 {
+			t.Errorf("%s entry: postings sum to %d", entry.Kind, sum)
+		}
+	}
+
+	// System accounts may go negative, and the balances still sum to zero
+	balances := map[string]int{Stripe.Code: -100, User(1).Code: 70, User(2).Code: 30}
+	for code, want := range balances {
+		if got := accountBalance(t, db, AccountRef{Code: code}); got != want {
+			t.Errorf("%s: got balance %d, want %d", code, got, want)
+		}
+	}
+
+	// The projection follows the wallets, and tips count as earned and spent
+	tests := []struct {
+		userID                 uint
+		balance, earned, spent int
+	}{
+		{userID: 1, balance: 70, spent: 30},
+		{userID: 2, balance: 30, earned: 30},
+	}
+	for _, tt := range tests {
+		var projection models.UserTokenBalance
+		if err := db.First(&projection, "user_id = ?", tt.userID).Error; err != nil {
+			t.Fatalf("failed to load balance of user %d: %v", tt.userID, err)
+		}
+		if projection.Balance != tt.balance || projection.TotalEarned != tt.earned || projection.TotalSpent != tt.spent {
+			t.Errorf("user %d: got balance %d, earned %d, spent %d, want %d, %d, %d", tt.userID,
+				projection.Balance, projection.TotalEarned, projection.TotalSpent, tt.balance, tt.earned, tt.spent)
+		}
+	}
+}
+
+func TestPostRejectsInsufficientFunds(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		ok     bool
+	}{
+		{name: "whole balance", amount: 50, ok: true},
+		{name: "more than the balance", amount: 51},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openLedger(t)
+			mustPost(t, db, Transfer(models.JournalKindPurchase, Stripe, User(1), 50, nil))
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				_, err := Post(tx, Transfer(models.JournalKindTip, User(1), User(2), tt.amount, nil))
+				return err
+			})
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Post: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInsufficientFunds) {
+				t.Fatalf("got error %v, want %v", err, ErrInsufficientFunds)
+			}
+			if got := accountBalance(t, db, User(1)); got != 50 {
+				t.Errorf("sender: got balance %d, want 50", got)
+			}
+			if got := accountBalance(t, db, User(2)); got != 0 {
+				t.Errorf("recipient: got balance %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestBalanceCreatesAccount(t *testing.T) {
+	db := openLedger(t)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		balance, err := Balance(tx, User(7))
+		if err != nil {
+			return err
+		}
+		if balance != 0 {
+			t.Errorf("new account: got balance %d, want 0", balance)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Balance: %v", err)
+	}
+
+	var account models.LedgerAccount
+	if err := db.Where("code = ?", User(7).Code).First(&account).Error; err != nil {
+		t.Fatalf("account was not created: %v", err)
+	}
+	if account.AllowNegative || account.UserID == nil || *account.UserID != 7 {
+		t.Errorf("unexpected account: %+v", account)
+	}
+}
@@ -0,0 +1,204 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rebuild recomputes the cached balances of a user's accounts and their
+// buckets, and their models.UserTokenBalance row, from the journal
+func Rebuild(tx *gorm.DB, userID uint) error {
+	var account models.LedgerAccount
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("code = ?", User(userID).Code).
+		First(&account).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// No journal activity yet, so the projection must be empty
+		return tx.Save(&models.UserTokenBalance{UserID: userID}).Error
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock account: %w", err)
+	}
+
+	var balance, earned, spent int
+	if err := tx.Model(&models.Posting{}).
+		Where("account_id = ?", account.ID).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&balance).Error; err != nil {
+		return fmt.Errorf("failed to sum postings: %w", err)
+	}
+
+	earning := tx.Model(&models.Posting{}).
+		Joins("JOIN journal_entries ON journal_entries.id = postings.journal_entry_id").
+		Where("postings.account_id = ? AND journal_entries.kind IN ?", account.ID, earningKinds)
+	if err := earning.Session(&gorm.Session{}).
+		Where("postings.amount > 0").
+		Select("COALESCE(SUM(postings.amount), 0)").
+		Scan(&earned).Error; err != nil {
+		return fmt.Errorf("failed to sum earnings: %w", err)
+	}
+	if err := earning.Session(&gorm.Session{}).
+		Where("postings.amount < 0").
+		Select("COALESCE(-SUM(postings.amount), 0)").
+		Scan(&spent).Error; err != nil {
+		return fmt.Errorf("failed to sum spending: %w", err)
+	}
+
+	if err := tx.Model(&account).Update("balance", balance).Error; err != nil {
+		return fmt.Errorf("failed to update account balance: %w", err)
+	}
+	if err := rebuildBuckets(tx, account.ID); err != nil {
+		return err
+	}
+
+	var frozen int
+	if err := tx.Model(&models.Posting{}).
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = postings.account_id").
+		Where("ledger_accounts.code = ?", Hold(userID).Code).
+		Select("COALESCE(SUM(postings.amount), 0)").
+		Scan(&frozen).Error; err != nil {
+		return fmt.Errorf("failed to sum held tokens: %w", err)
+	}
+	if err := tx.Model(&models.LedgerAccount{}).
+		Where("code = ?", Hold(userID).Code).
+		Update("balance", frozen).Error; err != nil {
+		return fmt.Errorf("failed to update hold balance: %w", err)
+	}
+	var hold models.LedgerAccount
+	if err := tx.Where("code = ?", Hold(userID).Code).Limit(1).Find(&hold).Error; err != nil {
+		return fmt.Errorf("failed to look up hold account: %w", err)
+	}
+	if hold.ID != 0 {
+		if err := rebuildBuckets(tx, hold.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Save(&models.UserTokenBalance{
+		UserID:        userID,
+		Balance:       balance,
+		FrozenBalance: frozen,
+		TotalEarned:   earned,
+		TotalSpent:    spent,
+	}).Error
+}
+
+// RebuildAll rebuilds the projection of every user account, one database
+// transaction per user. It returns the number of users rebuilt.
+func RebuildAll(db *gorm.DB) (int, error) {
+	var userIDs []uint
+	if err := db.Model(&models.LedgerAccount{}).
+		Where("type = ?", models.LedgerAccountUser).
+		Pluck("user_id", &userIDs).Error; err != nil {
+		return 0, fmt.Errorf("failed to list accounts: %w", err)
+	}
+
+	for i, userID := range userIDs {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return Rebuild(tx, userID)
+		}); err != nil {
+			return i, fmt.Errorf("failed to rebuild user %d: %w", userID, err)
+		}
+	}
+	return len(userIDs), nil
+}
+
+// Bootstrap backfills the journal for databases that predate the ledger. It
+// replays completed token transactions as journal entries and then posts an
+// opening entry for any difference between the replayed balance and the
+// stored models.UserTokenBalance, so existing balances are preserved while
+// totals are recomputed from the replayed tips. Pending cashouts are
+// replayed too, but have no payout amount, so they are marked in the memo
+// and must be settled by hand. It does nothing once the journal has any
+// entries.
+func Bootstrap(db *gorm.DB) error {
+	var entryCount int64
+	if err := db.Model(&models.JournalEntry{}).Count(&entryCount).Error; err != nil {
+		return fmt.Errorf("failed to count journal entries: %w", err)
+	}
+	if entryCount > 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var transactions []models.TokenTransaction
+		if err := tx.Order("created_at ASC, id ASC").Find(&transactions).Error; err != nil {
+			return fmt.Errorf("failed to load token transactions: %w", err)
+		}
+
+		legacyCashouts := 0
+		for _, t := range transactions {
+			entry, ok := replayEntry(t)
+			if !ok {
+				continue
+			}
+			if t.TransactionType == models.TransactionTypeCashout && t.Status == models.TransactionStatusPending && t.PayoutAmountCents == nil {
+				entry.Memo = "Legacy cashout: settle by hand"
+				legacyCashouts++
+			}
+			if _, err := post(tx, entry, false); err != nil {
+				return fmt.Errorf("failed to replay transaction %d: %w", t.ID, err)
+			}
+		}
+		if legacyCashouts > 0 {
+			log.Printf("Backfilled %d pending cashouts without a payout amount; they cannot be retried and must be settled by hand", legacyCashouts)
+		}
+
+		var balances []models.UserTokenBalance
+		if err := tx.Find(&balances).Error; err != nil {
+			return fmt.Errorf("failed to load token balances: %w", err)
+		}
+
+		for _, stored := range balances {
+			var replayed int
+			if err := tx.Model(&models.LedgerAccount{}).
+				Where("code = ?", User(stored.UserID).Code).
+				Select("COALESCE(MAX(balance), 0)").
+				Scan(&replayed).Error; err != nil {
+				return fmt.Errorf("failed to read replayed balance: %w", err)
+			}
+
+			if diff := stored.Balance - replayed; diff != 0 {
+				entry := Transfer(models.JournalKindOpening, Opening, User(stored.UserID), diff, nil)
+				entry.Memo = "Opening balance"
+				if _, err := post(tx, entry, false); err != nil {
+					return fmt.Errorf("failed to post opening balance for user %d: %w", stored.UserID, err)
+				}
+			}
+		}
+
+		log.Printf("Backfilled token ledger from %d transactions and %d balances", len(transactions), len(balances))
+		return nil
+	})
+}
+
+// replayEntry maps a pre-ledger token transaction to the entry it should have
+// produced. Tips are replayed from the tipper's side only since the author's
+// row describes the same movement.
+func replayEntry(t models.TokenTransaction) (Entry, bool) {
+	id := t.ID
+	switch t.TransactionType {
+	case models.TransactionTypePurchase:
+		if t.Status != models.TransactionStatusCompleted {
+			return Entry{}, false
+		}
+		return Transfer(models.JournalKindPurchase, Stripe, User(t.UserID), t.Amount, &id), true
+	case models.TransactionTypeTip:
+		if t.Amount >= 0 || t.RecipientID == nil || t.Status != models.TransactionStatusCompleted {
+			return Entry{}, false
+		}
+		return Transfer(models.JournalKindTip, User(t.UserID), User(*t.RecipientID), -t.Amount, &id), true
+	case models.TransactionTypeCashout:
+		if t.Status == models.TransactionStatusFailed || t.Status == models.TransactionStatusCancelled {
+			return Entry{}, false
+		}
+		return Transfer(models.JournalKindCashout, User(t.UserID), Payouts, -t.Amount, &id), true
+	}
+	return Entry{}, false
+}
@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LogMailer records messages instead of delivering them. With a directory
+// set, each message is written there as an .eml file; otherwise it is printed
+// to the server log.
+type LogMailer struct {
+	Dir  string
+	From string
+
+	mu  sync.Mutex
+	seq int
+	// Sent holds the most recent messages, newest last
+	Sent []Message
+}
+
+const keepSent = 100
+
+// NewLogMailer returns a mailer writing messages to dir, or to the log when
+// dir is empty
+func NewLogMailer(dir, from string) *LogMailer {
+	return &LogMailer{Dir: dir, From: from}
+}
+
+// Send records msg
+func (m *LogMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq++
+	m.Sent = append(m.Sent, msg)
+	if len(m.Sent) > keepSent {
+		m.Sent = m.Sent[len(m.Sent)-keepSent:]
+	}
+
+	if m.Dir == "" {
+		log.Printf("[MAIL] To: %s\nSubject: %s\n\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().Format("20060102-150405"), m.seq)
+	if err := os.WriteFile(filepath.Join(m.Dir, name), render(m.From, msg), 0o644); err != nil {
+		return fmt.Errorf("failed to write mail: %w", err)
+	}
+	return nil
+}
+
+// Last returns the most recently sent message
+func (m *LogMailer) Last() (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.Sent) == 0 {
+		return Message{}, false
+	}
+	return m.Sent[len(m.Sent)-1], true
+}
@@ -0,0 +1,60 @@
+// Package mailer sends transactional email. Production uses SMTP; local
+// development and tests use the log mailer, which writes each message to a
+// directory or the server log instead of delivering it.
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Default is the mailer used by the handlers. It is set by Init.
+var Default Mailer
+
+// Mailer delivers a single message
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Init selects the mailer from the MAIL_DRIVER environment variable ("log" by
+// default, or "smtp") and stores it in Default. Production must choose smtp
+// explicitly: the log mailer would write password reset and verification
+// links to the server log.
+func Init() error {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "FDIP <no-reply@fdip.local>"
+	}
+
+	switch driver := os.Getenv("MAIL_DRIVER"); driver {
+	case "", "log":
+		if os.Getenv("ENV") == "production" || os.Getenv("GIN_MODE") == "release" {
+			return errors.New("MAIL_DRIVER must be set to smtp in production")
+		}
+		Default = NewLogMailer(os.Getenv("MAIL_LOG_DIR"), from)
+	case "smtp":
+		port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if err != nil {
+			port = 587
+		}
+		Default = &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	default:
+		return fmt.Errorf("unknown mail driver %q", driver)
+	}
+	return nil
+}
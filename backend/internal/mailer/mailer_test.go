@@ -0,0 +1,43 @@
+package mailer_test
+
+import (
+	"testing"
+
+	"fdip/internal/mailer"
+)
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{name: "log mailer by default", ok: true},
+		{name: "log mailer", env: map[string]string{"MAIL_DRIVER": "log"}, ok: true},
+		{name: "smtp", env: map[string]string{"MAIL_DRIVER": "smtp"}, ok: true},
+		{name: "unknown driver", env: map[string]string{"MAIL_DRIVER": "pigeon"}},
+		{name: "default in production", env: map[string]string{"ENV": "production"}},
+		{name: "log mailer in production", env: map[string]string{"MAIL_DRIVER": "log", "ENV": "production"}},
+		{name: "log mailer in release mode", env: map[string]string{"MAIL_DRIVER": "log", "GIN_MODE": "release"}},
+		{name: "smtp in production", env: map[string]string{"MAIL_DRIVER": "smtp", "ENV": "production"}, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"ENV", "GIN_MODE", "MAIL_DRIVER"} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			prev := mailer.Default
+			t.Cleanup(func() { mailer.Default = prev })
+
+			err := mailer.Init()
+			if tt.ok && err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("Init accepted the driver")
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package manuscript
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// docxStyle is what the import needs of a paragraph style
+type docxStyle struct {
+	heading int // 1-9, 0 for body text
+	title   bool
+	quote   bool
+}
+
+var headingStyleName = regexp.MustCompile(`^heading\s*([1-9])$`)
+
+// parseDOCX converts a Word document to Markdown and splits it into
+// chapters at its top-level headings
+func parseDOCX(m *Manuscript, a *archive) error {
+	data, err := a.readFile("word/document.xml")
+	if err != nil {
+		return fmt.Errorf("invalid DOCX: %w", err)
+	}
+
+	styles := map[string]docxStyle{}
+	if data, err := a.readFile("word/styles.xml"); err == nil {
+		styles = readDOCXStyles(data)
+	}
+	links := map[string]string{}
+	if data, err := a.readFile("word/_rels/document.xml.rels"); err == nil {
+		links = readDOCXLinks(data)
+	}
+	if data, err := a.readFile("docProps/core.xml"); err == nil {
+		var core struct {
+			Title   string `xml:"title"`
+			Creator string `xml:"creator"`
+		}
+		if xml.Unmarshal(data, &core) == nil {
+			m.Title = strings.TrimSpace(core.Title)
+			m.Author = strings.TrimSpace(core.Creator)
+		}
+	}
+
+	markdown, title, images, err := docxToMarkdown(data, styles, links)
+	if err != nil {
+		return fmt.Errorf("invalid DOCX: %w", err)
+	}
+	if title != "" {
+		m.Title = title
+	}
+
+	bookTitle, sections := splitByHeadings(markdown)
+	if m.Title == "" {
+		m.Title = bookTitle
+	}
+	for _, s := range sections {
+		if err := m.addChapter(s.title, s.body); err != nil {
+			return err
+		}
+	}
+	if images > 0 {
+		m.warn("%d images in the document were left out; add them back with image links", images)
+	}
+	return nil
+}
+
+// readDOCXStyles maps paragraph style IDs to headings, titles and quotes by
+// their built-in names, which stay in English whatever the document's
+// language
+func readDOCXStyles(data []byte) map[string]docxStyle {
+	var doc struct {
+		Styles []struct {
+			ID   string `xml:"styleId,attr"`
+			Name struct {
+				Val string `xml:"val,attr"`
+			} `xml:"name"`
+			OutlineLevel *struct {
+				Val string `xml:"val,attr"`
+			} `xml:"pPr>outlineLvl"`
+		} `xml:"style"`
+	}
+	styles := map[string]docxStyle{}
+	if xml.Unmarshal(data, &doc) != nil {
+		return styles
+	}
+	for _, s := range doc.Styles {
+		name := strings.ToLower(s.Name.Val)
+		var style docxStyle
+		switch {
+		case name == "title":
+			style.title = true
+		case strings.Contains(name, "quote"):
+			style.quote = true
+		case headingStyleName.MatchString(name):
+			style.heading = int(headingStyleName.FindStringSubmatch(name)[1][0] - '0')
+		case s.OutlineLevel != nil:
+			if level, err := strconv.Atoi(s.OutlineLevel.Val); err == nil && level < 9 {
+				style.heading = level + 1
+			}
+		}
+		styles[s.ID] = style
+	}
+	return styles
+}
+
+// readDOCXLinks maps relationship IDs to the external URLs of hyperlinks
+func readDOCXLinks(data []byte) map[string]string {
+	var rels struct {
+		Relationships []struct {
+			ID         string `xml:"Id,attr"`
+			Target     string `xml:"Target,attr"`
+			TargetMode string `xml:"TargetMode,attr"`
+		} `xml:"Relationship"`
+	}
+	links := map[string]string{}
+	if xml.Unmarshal(data, &rels) != nil {
+		return links
+	}
+	for _, r := range rels.Relationships {
+		if r.TargetMode == "External" && isExternal(r.Target) {
+			links[r.ID] = r.Target
+		}
+	}
+	return links
+}
+
+// docxRun is a stretch of text with the same formatting
+type docxRun struct {
+	text   string
+	bold   bool
+	italic bool
+	link   string
+}
+
+// docxParagraph collects a paragraph's runs as the document is read
+type docxParagraph struct {
+	style   string
+	list    bool
+	level   int // outline level set on the paragraph itself, 1-9
+	runs    []docxRun
+	current docxRun
+}
+
+// docxToMarkdown streams a document.xml and writes each paragraph as a
+// Markdown block. It returns the text of the Title paragraph separately, and
+// how many images it left out.
+func docxToMarkdown(data []byte, styles map[string]docxStyle, links map[string]string) (string, string, int, error) {
+	var (
+		blocks  []string
+		title   string
+		images  int
+		para    *docxParagraph
+		inRun   bool
+		inText  bool
+		link    string
+		inProps bool
+	)
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", 0, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				para = &docxParagraph{}
+			case "pPr":
+				inProps = true
+			case "pStyle":
+				if para != nil && inProps {
+					para.style = xmlAttr(t, "val")
+				}
+			case "numPr":
+				if para != nil && inProps {
+					para.list = true
+				}
+			case "outlineLvl":
+				if para != nil && inProps {
+					if level, err := strconv.Atoi(xmlAttr(t, "val")); err == nil && level < 9 {
+						para.level = level + 1
+					}
+				}
+			case "hyperlink":
+				link = links[xmlAttr(t, "id")]
+			case "r":
+				inRun = true
+				if para != nil {
+					para.current = docxRun{link: link}
+				}
+			case "b":
+				if para != nil && inRun && isOn(t) {
+					para.current.bold = true
+				}
+			case "i":
+				if para != nil && inRun && isOn(t) {
+					para.current.italic = true
+				}
+			case "t":
+				inText = true
+			case "tab":
+				if para != nil && inRun {
+					para.current.text += " "
+				}
+			case "br", "cr":
+				if para != nil && inRun && xmlAttr(t, "type") != "page" {
+					para.current.text += "\n"
+				}
+			case "drawing", "pict":
+				images++
+				d.Skip()
+			case "footnoteReference", "endnoteReference", "instrText", "delText":
+				d.Skip()
+			}
+		case xml.CharData:
+			if para != nil && inRun && inText {
+				para.current.text += string(t)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "pPr":
+				inProps = false
+			case "r":
+				inRun = false
+				if para != nil && para.current.text != "" {
+					para.runs = append(para.runs, para.current)
+				}
+			case "hyperlink":
+				link = ""
+			case "p":
+				if para == nil {
+					continue
+				}
+				text := strings.TrimSpace(formatRuns(para.runs))
+				style := styles[para.style]
+				level := style.heading
+				if para.level > 0 {
+					level = para.level
+				}
+				switch {
+				case text == "":
+				case style.title && title == "":
+					title = plainRuns(para.runs)
+				case level > 0:
+					heading := strings.Join(strings.Fields(escapeText(plainRuns(para.runs))), " ")
+					if heading != "" {
+						blocks = append(blocks, strings.Repeat("#", min(level, 6))+" "+heading)
+					}
+				case para.list:
+					blocks = append(blocks, prefixLines(text, "- ", "  "))
+				case style.quote:
+					blocks = append(blocks, prefixLines(text, "> ", "> "))
+				default:
+					blocks = append(blocks, escapeLineStart(text))
+				}
+				para = nil
+			}
+		}
+	}
+
+	return joinDOCXBlocks(blocks), strings.Join(strings.Fields(title), " "), images, nil
+}
+
+// joinDOCXBlocks separates blocks with blank lines, except consecutive list
+// items, which stay in one list
+func joinDOCXBlocks(blocks []string) string {
+	var b strings.Builder
+	for i, block := range blocks {
+		if i > 0 {
+			if strings.HasPrefix(block, "- ") && strings.HasPrefix(blocks[i-1], "- ") {
+				b.WriteString("\n")
+			} else {
+				b.WriteString("\n\n")
+			}
+		}
+		b.WriteString(block)
+	}
+	return b.String()
+}
+
+// formatRuns writes runs as Markdown, merging neighbours with the same
+// formatting so emphasis is not broken up
+func formatRuns(runs []docxRun) string {
+	var merged []docxRun
+	for _, r := range runs {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.bold == r.bold && last.italic == r.italic && last.link == r.link {
+				last.text += r.text
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	var b strings.Builder
+	for _, r := range merged {
+		lines := strings.Split(r.text, "\n")
+		for i, line := range lines {
+			if i > 0 {
+				b.WriteString("\\\n")
+			}
+			text := escapeText(line)
+			if r.italic {
+				text = wrap("*", text)
+			}
+			if r.bold {
+				text = wrap("**", text)
+			}
+			if r.link != "" && strings.TrimSpace(text) != "" {
+				text = "[" + text + "](" + destination(r.link) + ")"
+			}
+			b.WriteString(text)
+		}
+	}
+	return b.String()
+}
+
+func plainRuns(runs []docxRun) string {
+	var b strings.Builder
+	for _, r := range runs {
+		b.WriteString(r.text)
+	}
+	return b.String()
+}
+
+// isOn reports whether a toggle property such as bold is switched on
+func isOn(t xml.StartElement) bool {
+	switch xmlAttr(t, "val") {
+	case "0", "false", "off", "none":
+		return false
+	}
+	return true
+}
+
+func xmlAttr(t xml.StartElement, local string) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,217 @@
+package manuscript
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Titles   []string `xml:"metadata>title"`
+	Creators []string `xml:"metadata>creator"`
+	Items    []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		Toc      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type ncxPoint struct {
+	Label  string     `xml:"navLabel>text"`
+	Src    string     `xml:"content>src,attr"`
+	Points []ncxPoint `xml:"navPoint"`
+}
+
+type ncx struct {
+	Points []ncxPoint `xml:"navMap>navPoint"`
+}
+
+// parseEPUB imports each document in an EPUB's reading order as a chapter,
+// titled from the table of contents or the document's first heading
+func parseEPUB(m *Manuscript, a *archive) error {
+	data, err := a.readFile("META-INF/container.xml")
+	if err != nil {
+		return fmt.Errorf("invalid EPUB: %w", err)
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(data, &container); err != nil || len(container.Rootfiles) == 0 {
+		return fmt.Errorf("invalid EPUB: unreadable container.xml")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	data, err = a.readFile(opfPath)
+	if err != nil {
+		return fmt.Errorf("invalid EPUB: %w", err)
+	}
+	var pkg epubPackage
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		return fmt.Errorf("invalid EPUB: unreadable package document: %v", err)
+	}
+	if len(pkg.Titles) > 0 {
+		m.Title = strings.TrimSpace(pkg.Titles[0])
+	}
+	if len(pkg.Creators) > 0 {
+		m.Author = strings.TrimSpace(pkg.Creators[0])
+	}
+
+	base := path.Dir(opfPath)
+	resolve := func(from, href string) string {
+		u, err := url.Parse(href)
+		if err != nil {
+			return ""
+		}
+		return path.Join(from, u.Path)
+	}
+
+	type item struct {
+		href, mediaType, properties string
+	}
+	items := map[string]item{}
+	for _, it := range pkg.Items {
+		items[it.ID] = item{href: resolve(base, it.Href), mediaType: it.MediaType, properties: it.Properties}
+	}
+
+	// Chapter titles from the table of contents, by document path
+	titles := map[string]string{}
+	for _, it := range items {
+		if strings.Contains(" "+it.properties+" ", " nav ") {
+			readNavTitles(a, it.href, titles)
+		}
+	}
+	if toc, ok := items[pkg.Spine.Toc]; ok && len(titles) == 0 {
+		readNCXTitles(a, toc.href, titles)
+	}
+
+	cv := &converter{}
+	for _, ref := range pkg.Spine.Itemrefs {
+		it, ok := items[ref.IDRef]
+		if !ok || ref.Linear == "no" || strings.Contains(" "+it.properties+" ", " nav ") {
+			continue
+		}
+		if it.mediaType != "application/xhtml+xml" && it.mediaType != "text/html" {
+			continue
+		}
+		data, err := a.readFile(it.href)
+		if err != nil {
+			m.warn("Skipped %s, which is missing from the file", it.href)
+			continue
+		}
+		doc, err := html.Parse(bytes.NewReader(data))
+		if err != nil {
+			m.warn("Skipped %s, which could not be read", it.href)
+			continue
+		}
+		body := findElement(doc, atom.Body)
+		if body == nil {
+			continue
+		}
+
+		heading := takeLeadingHeading(body)
+		title := titles[it.href]
+		if title == "" {
+			title = heading
+		}
+		markdown := strings.Join(cv.blocks(body), "\n\n")
+		if err := m.addChapter(title, markdown); err != nil {
+			return err
+		}
+	}
+
+	if cv.droppedImages > 0 {
+		m.warn("%d images inside the EPUB were left out; add them back with image links", cv.droppedImages)
+	}
+	return nil
+}
+
+// readNavTitles collects the entries of an EPUB 3 navigation document
+func readNavTitles(a *archive, navPath string, titles map[string]string) {
+	data, err := a.readFile(navPath)
+	if err != nil {
+		return
+	}
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	dir := path.Dir(navPath)
+
+	var walk func(*html.Node, bool)
+	walk = func(n *html.Node, inToc bool) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Nav {
+			inToc = strings.Contains(attr(n, "epub:type"), "toc")
+		}
+		if inToc && n.Type == html.ElementNode && n.DataAtom == atom.A {
+			href, err := url.Parse(attr(n, "href"))
+			if err == nil && href.Path != "" {
+				target := path.Join(dir, href.Path)
+				if _, seen := titles[target]; !seen {
+					titles[target] = strings.Join(strings.Fields(textContent(n)), " ")
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child, inToc)
+		}
+	}
+	walk(doc, false)
+}
+
+// readNCXTitles collects the entries of an EPUB 2 table of contents
+func readNCXTitles(a *archive, ncxPath string, titles map[string]string) {
+	data, err := a.readFile(ncxPath)
+	if err != nil {
+		return
+	}
+	var toc ncx
+	if err := xml.Unmarshal(data, &toc); err != nil {
+		return
+	}
+	dir := path.Dir(ncxPath)
+
+	var walk func([]ncxPoint)
+	walk = func(points []ncxPoint) {
+		for _, p := range points {
+			if src, err := url.Parse(p.Src); err == nil && src.Path != "" {
+				target := path.Join(dir, src.Path)
+				if _, seen := titles[target]; !seen {
+					titles[target] = strings.Join(strings.Fields(p.Label), " ")
+				}
+			}
+			walk(p.Points)
+		}
+	}
+	walk(toc.Points)
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+// Package manuscript imports books written elsewhere. It reads EPUB, DOCX
+// and Markdown files, splits them into chapters and converts the chapters
+// to Markdown, then creates a draft book from them once the author has
+// reviewed the result.
+package manuscript
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fdip/internal/content"
+)
+
+// MaxUploadSize is the largest file that can be imported
+const MaxUploadSize = 20 << 20
+
+// MaxChapters is the most chapters one import can create
+const MaxChapters = 500
+
+const (
+	// maxUnpacked bounds the bytes read out of an archive, so a small zip
+	// cannot expand without limit
+	maxUnpacked = 100 << 20
+	// maxFiles bounds the entries an archive may hold
+	maxFiles = 5000
+	// excerptLength is the length of the chapter excerpts in previews
+	excerptLength = 200
+	// untitled is the title of chapters with no heading
+	untitled = "Untitled chapter"
+)
+
+type Format string
+
+const (
+	FormatEPUB     Format = "epub"
+	FormatDOCX     Format = "docx"
+	FormatMarkdown Format = "markdown"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported file: upload an EPUB, a DOCX, a Markdown file or a zip of Markdown files")
+	ErrTooLarge          = errors.New("the file expands to more than the import limit")
+	ErrNoChapters        = errors.New("no chapters with text were found in the file")
+	ErrTooManyChapters   = fmt.Errorf("the file has more than %d chapters", MaxChapters)
+)
+
+// Chapter is an imported chapter
+type Chapter struct {
+	Title     string `json:"title"`
+	Content   string `json:"content"` // Markdown
+	WordCount int    `json:"word_count"`
+	Excerpt   string `json:"excerpt"`
+}
+
+// Manuscript is a parsed file, ready to preview and import
+type Manuscript struct {
+	Format   Format    `json:"format"`
+	Title    string    `json:"title"`
+	Author   string    `json:"author"`
+	Chapters []Chapter `json:"chapters"`
+	Warnings []string  `json:"warnings"`
+}
+
+func (m *Manuscript) warn(format string, args ...interface{}) {
+	m.Warnings = append(m.Warnings, fmt.Sprintf(format, args...))
+}
+
+// addChapter renders a chapter's Markdown to count its words and appends it.
+// Chapters without any text are skipped.
+func (m *Manuscript) addChapter(title, markdown string) error {
+	rendered, err := content.Render(markdown, content.Markdown)
+	if err != nil {
+		return err
+	}
+	if rendered.WordCount == 0 {
+		if title != "" {
+			m.warn("Skipped %q, which has no text", title)
+		}
+		return nil
+	}
+	// Chapters are shown with their number, so "Chapter 3: The Storm" is
+	// stored as "The Storm"
+	if trimmed := chapterPrefix.ReplaceAllString(title, ""); trimmed != "" {
+		title = trimmed
+	}
+	if title == "" {
+		title = untitled
+	}
+	m.Chapters = append(m.Chapters, Chapter{
+		Title:     truncate(title, 255),
+		Content:   strings.TrimSpace(markdown),
+		WordCount: rendered.WordCount,
+		Excerpt:   excerpt(rendered.Text),
+	})
+	return nil
+}
+
+// Parse reads an uploaded file. The format is taken from the file name,
+// falling back to the archive's contents.
+func Parse(filename string, data []byte) (*Manuscript, error) {
+	var (
+		m   *Manuscript
+		err error
+	)
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".md", ".markdown", ".txt":
+		m = &Manuscript{Format: FormatMarkdown}
+		err = parseMarkdownFile(m, filename, data)
+	default:
+		var r *zip.Reader
+		r, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, ErrUnsupportedFormat
+		}
+		if len(r.File) > maxFiles {
+			return nil, ErrTooLarge
+		}
+		a := &archive{reader: r, budget: maxUnpacked}
+		switch {
+		case a.find("META-INF/container.xml") != nil:
+			m = &Manuscript{Format: FormatEPUB}
+			err = parseEPUB(m, a)
+		case a.find("word/document.xml") != nil:
+			m = &Manuscript{Format: FormatDOCX}
+			err = parseDOCX(m, a)
+		default:
+			m = &Manuscript{Format: FormatMarkdown}
+			err = parseMarkdownBundle(m, a)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Chapters) == 0 {
+		return nil, ErrNoChapters
+	}
+	if len(m.Chapters) > MaxChapters {
+		return nil, ErrTooManyChapters
+	}
+	if m.Title == "" {
+		m.Title = titleFromFilename(filename)
+	}
+	m.Title = truncate(m.Title, 255)
+	if m.Warnings == nil {
+		m.Warnings = []string{}
+	}
+	return m, nil
+}
+
+// archive reads the files of a zip within a budget of unpacked bytes
+type archive struct {
+	reader *zip.Reader
+	budget int64
+}
+
+func (a *archive) find(name string) *zip.File {
+	for _, f := range a.reader.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (a *archive) read(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, a.budget+1))
+	if err != nil {
+		return nil, err
+	}
+	a.budget -= int64(len(data))
+	if a.budget < 0 {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+func (a *archive) readFile(name string) ([]byte, error) {
+	f := a.find(name)
+	if f == nil {
+		return nil, fmt.Errorf("%s is missing", name)
+	}
+	return a.read(f)
+}
+
+func parseMarkdownFile(m *Manuscript, filename string, data []byte) error {
+	text := decodeText(data)
+	title, sections := splitByHeadings(text)
+	if title != "" {
+		m.Title = title
+	}
+	if len(sections) == 1 && sections[0].title == "" {
+		sections[0].title = titleFromFilename(filename)
+	}
+	for _, s := range sections {
+		if err := m.addChapter(s.title, s.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMarkdownBundle imports each Markdown file of a zip as a chapter, in
+// file name order
+func parseMarkdownBundle(m *Manuscript, a *archive) error {
+	var files []*zip.File
+	for _, f := range a.reader.File {
+		name := f.Name
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		switch strings.ToLower(path.Ext(name)) {
+		case ".md", ".markdown", ".txt":
+			files = append(files, f)
+		default:
+			m.warn("Skipped %s, which is not a Markdown file", name)
+		}
+	}
+	if len(files) == 0 {
+		return ErrUnsupportedFormat
+	}
+	sort.SliceStable(files, func(i, j int) bool { return naturalLess(files[i].Name, files[j].Name) })
+
+	for _, f := range files {
+		data, err := a.read(f)
+		if err != nil {
+			return err
+		}
+		title, body := leadingHeading(decodeText(data))
+		if title == "" {
+			title = titleFromFilename(f.Name)
+		}
+		if err := m.addChapter(title, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type section struct {
+	title string
+	body  string
+}
+
+var (
+	atxHeading = regexp.MustCompile(`^ {0,3}(#{1,6})[ \t]+(.*?)(?:[ \t]+#+)?[ \t]*$`)
+	fence      = regexp.MustCompile("^ {0,3}(```|~~~)")
+)
+
+// splitByHeadings splits Markdown into sections at its top-level headings.
+// A lone heading above higher-level ones is taken as the book title. Text
+// before the first heading becomes an untitled section of its own.
+func splitByHeadings(text string) (string, []section) {
+	lines := strings.Split(text, "\n")
+
+	type heading struct {
+		line  int
+		level int
+		title string
+	}
+	var headings []heading
+	inFence := false
+	for i, line := range lines {
+		if fence.MatchString(line) {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+		if match := atxHeading.FindStringSubmatch(line); match != nil {
+			headings = append(headings, heading{line: i, level: len(match[1]), title: headingText(match[2])})
+		}
+	}
+
+	bookTitle := ""
+	levelCount := map[int]int{}
+	top := 7
+	for _, h := range headings {
+		levelCount[h.level]++
+		if h.level < top {
+			top = h.level
+		}
+	}
+	// "# Book" followed by "## Chapter" headings
+	if levelCount[top] == 1 && len(headings) > 1 && headings[0].level == top && strings.TrimSpace(strings.Join(lines[:headings[0].line], "")) == "" {
+		bookTitle = headings[0].title
+		lines[headings[0].line] = ""
+		headings = headings[1:]
+		top = 7
+		for _, h := range headings {
+			if h.level < top {
+				top = h.level
+			}
+		}
+	}
+
+	var sections []section
+	start, title := 0, ""
+	for _, h := range headings {
+		if h.level != top {
+			continue
+		}
+		if body := strings.Join(lines[start:h.line], "\n"); strings.TrimSpace(body) != "" || title != "" {
+			sections = append(sections, section{title: title, body: body})
+		}
+		start, title = h.line+1, h.title
+	}
+	sections = append(sections, section{title: title, body: strings.Join(lines[start:], "\n")})
+	return bookTitle, sections
+}
+
+// leadingHeading takes the heading off the top of a Markdown document
+func leadingHeading(text string) (string, string) {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if match := atxHeading.FindStringSubmatch(line); match != nil {
+			return headingText(match[2]), strings.Join(lines[i+1:], "\n")
+		}
+		break
+	}
+	return "", text
+}
+
+// headingText returns the plain text of a Markdown heading
+func headingText(markdown string) string {
+	rendered, err := content.Render(markdown, content.Markdown)
+	if err != nil {
+		return strings.TrimSpace(markdown)
+	}
+	return strings.Join(strings.Fields(rendered.Text), " ")
+}
+
+// decodeText returns a file's text as UTF-8, without a byte order mark and
+// with Unix line endings
+func decodeText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := string(data)
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, "�")
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+var chapterPrefix = regexp.MustCompile(`(?i)^chapter\s+([0-9]+|[ivxlc]+)\s*[:.\-–—]\s*`)
+
+var filenamePrefix = regexp.MustCompile(`^[\d\s._-]+`)
+
+// titleFromFilename turns "03-the_long_night.md" into "The long night"
+func titleFromFilename(name string) string {
+	base := path.Base(strings.ReplaceAll(name, "\\", "/"))
+	base = strings.TrimSuffix(base, path.Ext(base))
+	if trimmed := filenamePrefix.ReplaceAllString(base, ""); trimmed != "" {
+		base = trimmed
+	}
+	base = strings.Join(strings.FieldsFunc(base, func(r rune) bool {
+		return r == '-' || r == '_' || unicode.IsSpace(r)
+	}), " ")
+	if base == "" {
+		return untitled
+	}
+	r, size := utf8.DecodeRuneInString(base)
+	return string(unicode.ToUpper(r)) + base[size:]
+}
+
+var digits = regexp.MustCompile(`\d+|\D+`)
+
+// naturalLess orders names so that "2.md" comes before "10.md"
+func naturalLess(a, b string) bool {
+	pa, pb := digits.FindAllString(strings.ToLower(a), -1), digits.FindAllString(strings.ToLower(b), -1)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] == pb[i] {
+			continue
+		}
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		if errA == nil && errB == nil && na != nb {
+			return na < nb
+		}
+		return pa[i] < pb[i]
+	}
+	return len(pa) < len(pb)
+}
+
+func excerpt(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= excerptLength {
+		return text
+	}
+	runes := []rune(text)[:excerptLength]
+	if i := strings.LastIndex(string(runes), " "); i > excerptLength/2 {
+		return string(runes)[:i] + "…"
+	}
+	return string(runes) + "…"
+}
+
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
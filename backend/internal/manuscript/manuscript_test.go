@@ -0,0 +1,233 @@
+package manuscript
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// entry is a file to put in a test archive
+type entry struct {
+	name string
+	body string
+}
+
+// buildZip writes entries to a zip, deflated unless store is set
+func buildZip(t *testing.T, store bool, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	method := zip.Deflate
+	if store {
+		method = zip.Store
+	}
+	for _, e := range entries {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: e.name, Method: method})
+		if err != nil {
+			t.Fatalf("failed to add %s: %v", e.name, err)
+		}
+		if _, err := f.Write([]byte(e.body)); err != nil {
+			t.Fatalf("failed to write %s: %v", e.name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// minimalDOCX is a Word document with a title, two chapters and styles
+// named the way Word names them
+func minimalDOCX(document string) []entry {
+	return []entry{
+		{name: "[Content_Types].xml", body: `<?xml version="1.0"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`},
+		{name: "word/styles.xml", body: `<?xml version="1.0"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+  <w:style w:styleId="Title"><w:name w:val="Title"/></w:style>
+  <w:style w:styleId="Heading1"><w:name w:val="heading 1"/></w:style>
+</w:styles>`},
+		{name: "docProps/core.xml", body: `<?xml version="1.0"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <dc:creator>Ada Writer</dc:creator>
+</cp:coreProperties>`},
+		{name: "word/document.xml", body: document},
+	}
+}
+
+const docxDocument = `<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+  <w:body>
+    <w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr><w:r><w:t>The Long Night</w:t></w:r></w:p>
+    <w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Chapter 1: Dusk</w:t></w:r></w:p>
+    <w:p><w:r><w:t xml:space="preserve">The sun went </w:t></w:r><w:r><w:rPr><w:b/></w:rPr><w:t>down</w:t></w:r><w:r><w:t>.</w:t></w:r></w:p>
+    <w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Dawn</w:t></w:r></w:p>
+    <w:p><w:r><w:t>It came back up again.</w:t></w:r></w:p>
+  </w:body>
+</w:document>`
+
+// minimalEPUB is an EPUB 3 book with a navigation document and two chapters
+// in a subdirectory, plus whatever extra entries a test adds
+func minimalEPUB(extra ...entry) []entry {
+	entries := []entry{
+		{name: "mimetype", body: "application/epub+zip"},
+		{name: "META-INF/container.xml", body: `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+		{name: "OEBPS/content.opf", body: `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>The Long Night</dc:title>
+    <dc:creator>Ada Writer</dc:creator>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="one" href="text/one.xhtml" media-type="application/xhtml+xml"/>
+    <item id="two" href="text/two.xhtml" media-type="application/xhtml+xml"/>
+    <item id="escape" href="../../etc/passwd" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="nav"/><itemref idref="one"/><itemref idref="escape"/><itemref idref="two"/></spine>
+</package>`},
+		{name: "OEBPS/nav.xhtml", body: `<html xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc"><ol>
+  <li><a href="text/one.xhtml">Dusk</a></li>
+  <li><a href="text/two.xhtml#start">Dawn</a></li>
+</ol></nav></body></html>`},
+		{name: "OEBPS/text/one.xhtml", body: `<html><body><h1>Chapter One</h1><p>The sun went <b>down</b>.</p></body></html>`},
+		{name: "OEBPS/text/two.xhtml", body: `<html><body><p>It came back up again.</p><script>alert(1)</script></body></html>`},
+	}
+	return append(entries, extra...)
+}
+
+func TestParseDOCX(t *testing.T) {
+	m, err := Parse("book.docx", buildZip(t, false, minimalDOCX(docxDocument)...))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if m.Format != FormatDOCX || m.Title != "The Long Night" || m.Author != "Ada Writer" {
+		t.Errorf("got %s %q by %q, want docx \"The Long Night\" by \"Ada Writer\"", m.Format, m.Title, m.Author)
+	}
+	if len(m.Chapters) != 2 {
+		t.Fatalf("got %d chapters, want 2", len(m.Chapters))
+	}
+	if m.Chapters[0].Title != "Dusk" || m.Chapters[1].Title != "Dawn" {
+		t.Errorf("got chapters %q and %q, want Dusk and Dawn", m.Chapters[0].Title, m.Chapters[1].Title)
+	}
+	if m.Chapters[0].Content != "The sun went **down**." {
+		t.Errorf("got content %q", m.Chapters[0].Content)
+	}
+}
+
+func TestParseEPUB(t *testing.T) {
+	m, err := Parse("book.epub", buildZip(t, false, minimalEPUB()...))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if m.Format != FormatEPUB || m.Title != "The Long Night" || m.Author != "Ada Writer" {
+		t.Errorf("got %s %q by %q, want epub \"The Long Night\" by \"Ada Writer\"", m.Format, m.Title, m.Author)
+	}
+	// The navigation document is not a chapter, and the spine entry that
+	// points outside the archive is skipped with a warning
+	if len(m.Chapters) != 2 {
+		t.Fatalf("got %d chapters, want 2", len(m.Chapters))
+	}
+	if m.Chapters[0].Title != "Dusk" || m.Chapters[1].Title != "Dawn" {
+		t.Errorf("got chapters %q and %q, want Dusk and Dawn from the table of contents", m.Chapters[0].Title, m.Chapters[1].Title)
+	}
+	if m.Chapters[0].Content != "The sun went **down**." {
+		t.Errorf("got content %q", m.Chapters[0].Content)
+	}
+	if strings.Contains(m.Chapters[1].Content, "alert") {
+		t.Errorf("script kept in %q", m.Chapters[1].Content)
+	}
+	if len(m.Warnings) != 1 || !strings.Contains(m.Warnings[0], "etc/passwd") {
+		t.Errorf("got warnings %q, want one for the missing document", m.Warnings)
+	}
+}
+
+func TestParseMarkdownBundleIgnoresPaths(t *testing.T) {
+	data := buildZip(t, false,
+		entry{name: "../../chapters/10-the-end.md", body: "The end."},
+		entry{name: "../../chapters/2-middle.md", body: "# The Middle\n\nSome middle."},
+		entry{name: "/etc/passwd", body: "root:x:0:0"},
+		entry{name: "__MACOSX/._2-middle.md", body: "junk"},
+		entry{name: "cover.png", body: "png"},
+	)
+
+	m, err := Parse("book.zip", data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	// Entry names only ever give titles and order; nothing is written out
+	var titles []string
+	for _, c := range m.Chapters {
+		titles = append(titles, c.Title)
+	}
+	if strings.Join(titles, "|") != "The Middle|The end" {
+		t.Errorf("got chapters %q, want The Middle and The end", titles)
+	}
+}
+
+func TestParseRejectsBadArchives(t *testing.T) {
+	valid := buildZip(t, false, minimalDOCX(docxDocument)...)
+
+	// Flip bytes in the middle of the deflated document so it no longer
+	// inflates, keeping the central directory intact
+	corrupt := append([]byte(nil), valid...)
+	r, err := zip.NewReader(bytes.NewReader(valid), int64(len(valid)))
+	if err != nil {
+		t.Fatalf("failed to read zip: %v", err)
+	}
+	for _, f := range r.File {
+		if f.Name == "word/document.xml" {
+			offset, err := f.DataOffset()
+			if err != nil {
+				t.Fatalf("DataOffset: %v", err)
+			}
+			for i := offset; i < offset+int64(f.CompressedSize64); i++ {
+				corrupt[i] ^= 0xff
+			}
+		}
+	}
+
+	tooMany := make([]entry, maxFiles+1)
+	for i := range tooMany {
+		tooMany[i] = entry{name: strings.Repeat("x", i%50+1) + ".md", body: ""}
+	}
+
+	tests := []struct {
+		name string
+		file string
+		data []byte
+		err  error // nil for any error
+	}{
+		{name: "not a zip", file: "book.epub", data: []byte("plain text"), err: ErrUnsupportedFormat},
+		{name: "empty", file: "book.docx", err: ErrUnsupportedFormat},
+		{name: "truncated archive", file: "book.docx", data: valid[:len(valid)/2], err: ErrUnsupportedFormat},
+		{name: "corrupt entry", file: "book.docx", data: corrupt},
+		{name: "too many entries", file: "book.zip", data: buildZip(t, true, tooMany...), err: ErrTooLarge},
+		{name: "zip bomb", file: "book.zip", data: buildZip(t, false, entry{name: "bomb.md", body: strings.Repeat("a", maxUnpacked+1)}), err: ErrTooLarge},
+		{name: "zip bomb across entries", file: "book.zip", data: buildZip(t, false,
+			entry{name: "1.md", body: strings.Repeat("\n", maxUnpacked/2+1)},
+			entry{name: "2.md", body: strings.Repeat("b", maxUnpacked/2+1)},
+		), err: ErrTooLarge},
+		{name: "malformed document", file: "book.docx", data: buildZip(t, false, minimalDOCX("<w:document><w:body><w:p>")...)},
+		{name: "epub without package", file: "book.epub", data: buildZip(t, false, minimalEPUB()[:2]...)},
+		{name: "epub without chapters", file: "book.epub", data: buildZip(t, false, minimalEPUB()[:4]...), err: ErrNoChapters},
+		{name: "no markdown files", file: "book.zip", data: buildZip(t, false, entry{name: "cover.png", body: "png"}), err: ErrUnsupportedFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse(tt.file, tt.data)
+			if err == nil {
+				t.Fatalf("got %d chapters, want an error", len(m.Chapters))
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
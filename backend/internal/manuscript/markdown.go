@@ -0,0 +1,414 @@
+package manuscript
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// converter turns HTML into Markdown. Only what chapters use survives:
+// headings, paragraphs, emphasis, links, lists, quotes, code and breaks.
+type converter struct {
+	// droppedImages counts images that could not be carried over, because
+	// they are packaged inside the imported file
+	droppedImages int
+}
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// blocks converts the children of n to Markdown blocks
+func (cv *converter) blocks(n *html.Node) []string {
+	var (
+		out    []string
+		inline strings.Builder
+	)
+	flush := func() {
+		if text := strings.TrimSpace(inline.String()); text != "" {
+			out = append(out, escapeLineStart(text))
+		}
+		inline.Reset()
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || !isBlock(child) {
+			inline.WriteString(cv.inline(child))
+			continue
+		}
+		flush()
+
+		if isNoteList(child) {
+			out = append(out, cv.notes(child)...)
+			continue
+		}
+		if isNote(child) {
+			if note := cv.note(child); note != "" {
+				out = append(out, note)
+			}
+			continue
+		}
+
+		switch child.DataAtom {
+		case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			if text := strings.TrimSpace(cv.inlineChildren(child)); text != "" {
+				level := int(child.Data[1] - '0')
+				out = append(out, strings.Repeat("#", level)+" "+strings.ReplaceAll(text, "\\\n", " "))
+			}
+		case atom.P:
+			if text := strings.TrimSpace(cv.inlineChildren(child)); text != "" {
+				out = append(out, escapeLineStart(text))
+			}
+		case atom.Blockquote:
+			if inner := cv.blocks(child); len(inner) > 0 {
+				out = append(out, prefixLines(strings.Join(inner, "\n\n"), "> ", "> "))
+			}
+		case atom.Ul, atom.Ol:
+			if list := cv.list(child); list != "" {
+				out = append(out, list)
+			}
+		case atom.Pre:
+			code := strings.TrimRight(textContent(child), "\n")
+			marker := "```"
+			for strings.Contains(code, marker) {
+				marker += "`"
+			}
+			out = append(out, marker+"\n"+code+"\n"+marker)
+		case atom.Hr:
+			out = append(out, "---")
+		case atom.Table:
+			out = append(out, cv.table(child)...)
+		case atom.Script, atom.Style, atom.Head, atom.Template:
+		default:
+			// div, section and other containers
+			out = append(out, cv.blocks(child)...)
+		}
+	}
+	flush()
+	return out
+}
+
+// list converts a ul or ol element
+func (cv *converter) list(n *html.Node) string {
+	var items []string
+	number := 1
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		body := strings.Join(cv.blocks(li), "\n\n")
+		if body == "" {
+			continue
+		}
+		items = append(items, prefixLines(body, marker, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+// table converts each row of a table to a paragraph, since chapters do not
+// support tables
+func (cv *converter) table(n *html.Node) []string {
+	var rows []string
+	var walk func(*html.Node)
+	walk = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			if child.DataAtom != atom.Tr {
+				walk(child)
+				continue
+			}
+			var cells []string
+			for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					if text := strings.TrimSpace(cv.inlineChildren(cell)); text != "" {
+						cells = append(cells, text)
+					}
+				}
+			}
+			if len(cells) > 0 {
+				rows = append(rows, escapeLineStart(strings.Join(cells, " — ")))
+			}
+		}
+	}
+	walk(n)
+	return rows
+}
+
+func (cv *converter) inlineChildren(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(cv.inline(child))
+	}
+	return b.String()
+}
+
+// inline converts a node inside a paragraph
+func (cv *converter) inline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return escapeText(spaces.ReplaceAllString(n.Data, " "))
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.Em, atom.I, atom.Cite, atom.Var:
+		return wrap("*", cv.inlineChildren(n))
+	case atom.Strong, atom.B:
+		return wrap("**", cv.inlineChildren(n))
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		code := spaces.ReplaceAllString(textContent(n), " ")
+		if code == "" {
+			return ""
+		}
+		marker := "`"
+		for strings.Contains(code, marker) {
+			marker += "`"
+		}
+		return marker + code + marker
+	case atom.Br:
+		return "\\\n"
+	case atom.A:
+		if hasRole(n, "noteref") {
+			if label := noteLabel(attr(n, "href")); label != "" {
+				return "[^" + label + "]"
+			}
+		}
+		if hasRole(n, "backlink") {
+			return ""
+		}
+		text := cv.inlineChildren(n)
+		href := attr(n, "href")
+		if !isExternal(href) || strings.TrimSpace(text) == "" {
+			return text
+		}
+		return "[" + text + "](" + destination(href) + ")"
+	case atom.Img:
+		src := attr(n, "src")
+		if !isExternal(src) {
+			cv.droppedImages++
+			return ""
+		}
+		return "![" + escapeText(attr(n, "alt")) + "](" + destination(src) + ")"
+	case atom.Script, atom.Style:
+		return ""
+	default:
+		return cv.inlineChildren(n)
+	}
+}
+
+// notes converts a footnote or endnote list to Markdown footnote
+// definitions
+func (cv *converter) notes(n *html.Node) []string {
+	var out []string
+	var walk func(*html.Node)
+	walk = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			if child.DataAtom == atom.Li || isNote(child) {
+				if note := cv.note(child); note != "" {
+					out = append(out, note)
+				}
+				continue
+			}
+			walk(child)
+		}
+	}
+	walk(n)
+	return out
+}
+
+// note converts one footnote to a Markdown footnote definition
+func (cv *converter) note(n *html.Node) string {
+	label := noteLabel("#" + attr(n, "id"))
+	body := strings.Join(cv.blocks(n), "\n\n")
+	if label == "" || body == "" {
+		return body
+	}
+	return prefixLines(body, "[^"+label+"]: ", "    ")
+}
+
+// hasRole reports whether an element has an ARIA role or EPUB semantic
+// type, such as noteref, or the class goldmark gives the same thing
+func hasRole(n *html.Node, role string) bool {
+	if attr(n, "role") == "doc-"+role || strings.Contains(" "+attr(n, "epub:type")+" ", " "+role+" ") {
+		return true
+	}
+	class := map[string]string{"noteref": "footnote-ref", "backlink": "footnote-backref"}[role]
+	return class != "" && strings.Contains(" "+attr(n, "class")+" ", " "+class+" ")
+}
+
+// isNoteList reports whether n holds a book's or chapter's notes
+func isNoteList(n *html.Node) bool {
+	return hasRole(n, "endnotes") || hasRole(n, "footnotes") || hasRole(n, "rearnotes") ||
+		strings.Contains(" "+attr(n, "class")+" ", " footnotes ")
+}
+
+// isNote reports whether n is a single footnote
+func isNote(n *html.Node) bool {
+	return hasRole(n, "footnote") || hasRole(n, "endnote") || hasRole(n, "rearnote")
+}
+
+var labelChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// noteLabel turns a link to a note into a footnote label
+func noteLabel(href string) string {
+	i := strings.LastIndex(href, "#")
+	if i < 0 {
+		return ""
+	}
+	return labelChars.ReplaceAllString(href[i+1:], "-")
+}
+
+var blockAtoms = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Body: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Figcaption: true, atom.Figure: true, atom.Footer: true, atom.H1: true,
+	atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Head: true, atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true,
+	atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true, atom.Script: true,
+	atom.Section: true, atom.Style: true, atom.Table: true, atom.Template: true, atom.Ul: true,
+}
+
+func isBlock(n *html.Node) bool {
+	return blockAtoms[n.DataAtom]
+}
+
+// wrap puts emphasis markers around text, keeping surrounding spaces outside
+// them as Markdown requires
+func wrap(marker, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := text[:strings.Index(text, trimmed)]
+	end := text[len(start)+len(trimmed):]
+	return start + marker + trimmed + marker + end
+}
+
+var (
+	specialChars = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`)
+	lineStart    = regexp.MustCompile(`^(#|>|[-+=](\s|$)|\d+[.)](\s|$))`)
+)
+
+func escapeText(text string) string {
+	return specialChars.Replace(text)
+}
+
+// escapeLineStart escapes characters that would start a heading, quote or
+// list at the start of a paragraph
+func escapeLineStart(text string) string {
+	if loc := lineStart.FindStringIndex(text); loc != nil {
+		match := text[loc[0]:loc[1]]
+		if i := strings.IndexAny(match, ".)"); i > 0 {
+			return match[:i] + `\` + text[i:]
+		}
+		return `\` + text
+	}
+	return text
+}
+
+func prefixLines(text, first, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if line == "" {
+			lines[i] = strings.TrimRight(prefix, " ")
+		} else {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && child.DataAtom == atom.Br {
+			b.WriteString("\n")
+			continue
+		}
+		b.WriteString(textContent(child))
+	}
+	return b.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func isExternal(href string) bool {
+	u, err := url.Parse(strings.TrimSpace(href))
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "mailto")
+}
+
+// destination formats a link target, bracketing ones with spaces or
+// parentheses
+func destination(href string) string {
+	href = strings.TrimSpace(href)
+	if strings.ContainsAny(href, " ()<>") {
+		return "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(href) + ">"
+	}
+	return href
+}
+
+// takeLeadingHeading removes the heading that opens a document, if one
+// comes before any text, and returns its text
+func takeLeadingHeading(body *html.Node) string {
+	var found *html.Node
+	var walk func(*html.Node) bool
+	walk = func(n *html.Node) bool {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			switch child.Type {
+			case html.TextNode:
+				if strings.TrimSpace(child.Data) != "" {
+					return true
+				}
+			case html.ElementNode:
+				switch child.DataAtom {
+				case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+					found = child
+					return true
+				case atom.Img:
+					continue
+				case atom.Script, atom.Style, atom.Head:
+					continue
+				}
+				if walk(child) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	walk(body)
+	if found == nil {
+		return ""
+	}
+	title := strings.Join(strings.Fields(textContent(found)), " ")
+	found.Parent.RemoveChild(found)
+	return title
+}
@@ -0,0 +1,201 @@
+package manuscript
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"fdip/internal/membership"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// ImportTTL is how long an uploaded manuscript waits to be committed
+const ImportTTL = 24 * time.Hour
+
+var (
+	ErrImportNotFound = errors.New("import not found")
+	ErrImportClosed   = errors.New("import has already been committed")
+	ErrNoSelection    = errors.New("select at least one chapter to import")
+	ErrBadSelection   = errors.New("selected chapter is not in the import")
+)
+
+// Save stores a parsed manuscript for its uploader to review
+func Save(db *gorm.DB, userID uint, filename string, m *Manuscript) (*models.ManuscriptImport, error) {
+	chapters, err := json.Marshal(m.Chapters)
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := json.Marshal(m.Warnings)
+	if err != nil {
+		return nil, err
+	}
+
+	imp := models.ManuscriptImport{
+		UserID:    userID,
+		Filename:  truncate(filename, 255),
+		Format:    string(m.Format),
+		Title:     m.Title,
+		Author:    truncate(m.Author, 255),
+		Chapters:  string(chapters),
+		Warnings:  string(warnings),
+		Status:    models.ImportStatusPending,
+		ExpiresAt: time.Now().Add(ImportTTL),
+	}
+	if err := db.Create(&imp).Error; err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// Find returns one of userID's imports that has not expired
+func Find(db *gorm.DB, id, userID uint) (*models.ManuscriptImport, error) {
+	var imp models.ManuscriptImport
+	if err := db.Where("id = ? AND user_id = ? AND expires_at > ?", id, userID, time.Now()).First(&imp).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrImportNotFound
+		}
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// Load returns the manuscript stored in an import. Committed imports no
+// longer hold their chapters.
+func Load(imp *models.ManuscriptImport) (*Manuscript, error) {
+	m := &Manuscript{
+		Format:   Format(imp.Format),
+		Title:    imp.Title,
+		Author:   imp.Author,
+		Chapters: []Chapter{},
+		Warnings: []string{},
+	}
+	if imp.Chapters != "" {
+		if err := json.Unmarshal([]byte(imp.Chapters), &m.Chapters); err != nil {
+			return nil, fmt.Errorf("corrupt import %d: %w", imp.ID, err)
+		}
+	}
+	if imp.Warnings != "" {
+		if err := json.Unmarshal([]byte(imp.Warnings), &m.Warnings); err != nil {
+			return nil, fmt.Errorf("corrupt import %d: %w", imp.ID, err)
+		}
+	}
+	return m, nil
+}
+
+// CommitOptions are the author's choices when committing an import
+type CommitOptions struct {
+	Title       string
+	Description string
+	Genres      []string
+	// Chapters are the numbers, counted from 1 in the preview, of the
+	// chapters to import. Empty imports them all.
+	Chapters []int
+}
+
+// Commit creates a draft book from an import, with its chapters unpublished
+// and numbered in order. An import can be committed once.
+func Commit(db *gorm.DB, imp *models.ManuscriptImport, opts CommitOptions) (*models.Book, error) {
+	m, err := Load(imp)
+	if err != nil {
+		return nil, err
+	}
+	if imp.Status != models.ImportStatusPending {
+		return nil, ErrImportClosed
+	}
+
+	selected := m.Chapters
+	if len(opts.Chapters) > 0 {
+		selected = nil
+		seen := map[int]bool{}
+		for _, n := range opts.Chapters {
+			if n < 1 || n > len(m.Chapters) {
+				return nil, fmt.Errorf("%w: %d", ErrBadSelection, n)
+			}
+			if !seen[n] {
+				seen[n] = true
+				selected = append(selected, m.Chapters[n-1])
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return nil, ErrNoSelection
+	}
+
+	title := opts.Title
+	if title == "" {
+		title = m.Title
+	}
+	book := models.Book{
+		AuthorID: imp.UserID,
+		Title:    truncate(title, 255),
+	}
+	book.SetGenres(opts.Genres)
+	if opts.Description != "" {
+		book.Description = &opts.Description
+	}
+
+	chapters := make([]models.Chapter, len(selected))
+	for i, imported := range selected {
+		chapters[i] = models.Chapter{
+			Title:         imported.Title,
+			Content:       imported.Content,
+			ContentType:   models.ContentTypeMarkdown,
+			ChapterNumber: uint(i + 1),
+		}
+		if err := chapters[i].Render(); err != nil {
+			return nil, fmt.Errorf("failed to render chapter %d: %w", i+1, err)
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Claim the import first so a second commit creates nothing
+		result := tx.Model(&models.ManuscriptImport{}).
+			Where("id = ? AND status = ?", imp.ID, models.ImportStatusPending).
+			Update("status", models.ImportStatusCommitted)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrImportClosed
+		}
+
+		if err := tx.Create(&book).Error; err != nil {
+			return err
+		}
+		if err := membership.AddOwner(tx, &book); err != nil {
+			return err
+		}
+		for i := range chapters {
+			chapters[i].BookID = book.ID
+		}
+		if err := tx.CreateInBatches(chapters, 50).Error; err != nil {
+			return err
+		}
+
+		// The chapters now live in the book
+		return tx.Model(&models.ManuscriptImport{}).Where("id = ?", imp.ID).
+			Updates(map[string]interface{}{"book_id": book.ID, "chapters": ""}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	imp.Status = models.ImportStatusCommitted
+	imp.BookID = &book.ID
+	imp.Chapters = ""
+	return &book, nil
+}
+
+// Discard deletes an import
+func Discard(db *gorm.DB, imp *models.ManuscriptImport) error {
+	return db.Delete(imp).Error
+}
+
+// DeleteExpired deletes imports past their expiry time
+func DeleteExpired(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&models.ManuscriptImport{}).Error
+}
@@ -0,0 +1,211 @@
+// Package media turns uploaded images into the files readers are served.
+// Uploads are identified by their bytes, not their name or declared type,
+// decoded and re-encoded, which drops EXIF and any other metadata, and
+// scaled to a set of sizes per kind of image.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Registers the WebP decoder
+)
+
+type Kind string
+
+const (
+	KindCover        Kind = "cover"
+	KindAvatar       Kind = "avatar"
+	KindChapterImage Kind = "chapter_image"
+)
+
+// maxPixels bounds the size of images decoded, so a small file cannot
+// claim huge dimensions and exhaust memory
+const maxPixels = 50_000_000
+
+// jpegQuality is the quality JPEG variants are encoded at
+const jpegQuality = 85
+
+var (
+	ErrUnsupportedType = errors.New("upload a JPEG, PNG, GIF or WebP image")
+	ErrTooLarge        = errors.New("image file is too large")
+	ErrTooManyPixels   = errors.New("image dimensions are too large")
+	ErrInvalidImage    = errors.New("image could not be decoded")
+	ErrUnknownKind     = errors.New("unknown media kind")
+)
+
+// size is a variant of an image: its longest side, or its side for square
+// kinds
+type size struct {
+	Name string
+	Side int
+}
+
+// spec is how a kind of image is processed
+type spec struct {
+	MaxBytes int64
+	Square   bool
+	Private  bool
+	Sizes    []size // Largest first
+}
+
+var specs = map[Kind]spec{
+	KindCover: {
+		MaxBytes: 10 << 20,
+		Sizes:    []size{{"original", 2000}, {"large", 800}, {"medium", 400}, {"small", 200}},
+	},
+	KindAvatar: {
+		MaxBytes: 5 << 20,
+		Square:   true,
+		Sizes:    []size{{"original", 512}, {"large", 256}, {"medium", 128}, {"small", 64}},
+	},
+	KindChapterImage: {
+		MaxBytes: 10 << 20,
+		Private:  true,
+		Sizes:    []size{{"original", 2400}, {"large", 1200}, {"medium", 600}, {"small", 300}},
+	},
+}
+
+// MaxBytes returns the largest upload accepted for a kind
+func MaxBytes(kind Kind) int64 {
+	return specs[kind].MaxBytes
+}
+
+// IsPrivate reports whether a kind is only served through signed URLs
+func IsPrivate(kind Kind) bool {
+	return specs[kind].Private
+}
+
+// Variant is one encoded size of an image
+type Variant struct {
+	Name   string
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// Processed is an upload ready to store
+type Processed struct {
+	ContentType string
+	Ext         string
+	Variants    []Variant
+}
+
+// Process checks, decodes and re-encodes an upload at each size of its
+// kind. Sizes are never scaled up. PNG and GIF uploads are kept as PNG for
+// their transparency; everything else becomes JPEG.
+func Process(kind Kind, data []byte) (*Processed, error) {
+	spec, ok := specs[kind]
+	if !ok {
+		return nil, ErrUnknownKind
+	}
+	if int64(len(data)) > spec.MaxBytes {
+		return nil, ErrTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return nil, ErrUnsupportedType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return nil, ErrTooManyPixels
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	result := &Processed{ContentType: "image/jpeg", Ext: "jpg"}
+	if contentType == "image/png" || contentType == "image/gif" {
+		result.ContentType, result.Ext = "image/png", "png"
+	}
+
+	// Scale before turning the image upright: it is cheaper on the smaller
+	// image, and a scaled longest side stays the longest side
+	img = fit(img, spec.Sizes[0].Side, spec.Square)
+	if contentType == "image/jpeg" {
+		img = orient(img, exifOrientation(data))
+	}
+
+	for _, size := range spec.Sizes {
+		scaled := fit(img, size.Side, spec.Square)
+		encoded, err := encode(scaled, result.ContentType)
+		if err != nil {
+			return nil, err
+		}
+		bounds := scaled.Bounds()
+		result.Variants = append(result.Variants, Variant{
+			Name:   size.Name,
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+			Data:   encoded,
+		})
+	}
+	return result, nil
+}
+
+// fit scales img so its longest side is at most side. Square fits crop the
+// centre square first.
+func fit(img image.Image, side int, square bool) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	src := bounds
+	if square && w != h {
+		short := min(w, h)
+		x := bounds.Min.X + (w-short)/2
+		y := bounds.Min.Y + (h-short)/2
+		src = image.Rect(x, y, x+short, y+short)
+		w, h = short, short
+	}
+
+	scale := 1.0
+	if long := max(w, h); long > side {
+		scale = float64(side) / float64(long)
+	}
+	dw, dh := max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+	if scale == 1 && src == bounds {
+		return img
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+func encode(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	if contentType == "image/png" {
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	// JPEG has no transparency; put see-through pixels on white rather
+	// than black
+	if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flat
+	}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,117 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// jpegWithOrientation returns a 40x20 JPEG, red on its left half, with an
+// EXIF segment that sets orientation and carries a camera serial number
+func jpegWithOrientation(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	data := buf.Bytes()
+
+	// A big-endian TIFF header with one IFD entry for the orientation
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "SERIAL-0042"...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	// The EXIF segment goes straight after the start of image marker
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		if got := exifOrientation(jpegWithOrientation(t, orientation)); got != int(orientation) {
+			t.Errorf("got orientation %d, want %d", got, orientation)
+		}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "no EXIF", data: jpegWithOrientation(t, 1)[:2]},
+		{name: "not a JPEG", data: []byte("GIF89a")},
+		{name: "truncated segment", data: jpegWithOrientation(t, 6)[:12]},
+		{name: "out of range", data: jpegWithOrientation(t, 9)},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.data); got != 1 {
+			t.Errorf("%s: got orientation %d, want 1", tt.name, got)
+		}
+	}
+}
+
+func TestProcessStripsEXIF(t *testing.T) {
+	tests := []struct {
+		orientation   uint16
+		width, height int
+		// redAt is a pixel that is red once the image is upright
+		redAt image.Point
+	}{
+		{orientation: 1, width: 40, height: 20, redAt: image.Pt(5, 10)},
+		{orientation: 3, width: 40, height: 20, redAt: image.Pt(35, 10)},
+		{orientation: 6, width: 20, height: 40, redAt: image.Pt(10, 5)},
+		{orientation: 8, width: 20, height: 40, redAt: image.Pt(10, 35)},
+	}
+
+	for _, tt := range tests {
+		data := jpegWithOrientation(t, tt.orientation)
+		if !bytes.Contains(data, []byte("SERIAL-0042")) {
+			t.Fatal("test image has no EXIF")
+		}
+
+		processed, err := Process(KindChapterImage, data)
+		if err != nil {
+			t.Fatalf("orientation %d: Process: %v", tt.orientation, err)
+		}
+		original := processed.Variants[0]
+		if original.Width != tt.width || original.Height != tt.height {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tt.orientation, original.Width, original.Height, tt.width, tt.height)
+		}
+		for _, v := range processed.Variants {
+			if bytes.Contains(v.Data, []byte("Exif")) || bytes.Contains(v.Data, []byte("SERIAL-0042")) {
+				t.Errorf("orientation %d: %s variant kept the EXIF", tt.orientation, v.Name)
+			}
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(original.Data))
+		if err != nil {
+			t.Fatalf("orientation %d: failed to decode result: %v", tt.orientation, err)
+		}
+		if r, _, b, _ := img.At(tt.redAt.X, tt.redAt.Y).RGBA(); r < b {
+			t.Errorf("orientation %d: pixel %v is not red", tt.orientation, tt.redAt)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"fdip/internal/models"
+	"fdip/internal/storage"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotFound is returned for media or variants that do not exist
+var ErrNotFound = errors.New("media not found")
+
+// Key returns the storage key of a variant of m
+func Key(m *models.Media, variant string) string {
+	return fmt.Sprintf("media/%d/%s.%s", m.ID, variant, m.Ext)
+}
+
+// Save processes an upload and stores each of its sizes. It replaces any
+// earlier image of the same kind for the subject, so a book has one cover
+// and a user one avatar.
+func Save(ctx context.Context, db *gorm.DB, store storage.Storage, ownerID uint, kind Kind, subjectID uint, data []byte) (*models.Media, error) {
+	processed, err := Process(kind, data)
+	if err != nil {
+		return nil, err
+	}
+
+	m := models.Media{
+		OwnerID:     ownerID,
+		Kind:        string(kind),
+		SubjectID:   subjectID,
+		Private:     IsPrivate(kind),
+		ContentType: processed.ContentType,
+		Ext:         processed.Ext,
+	}
+	variants := make([]models.MediaVariant, 0, len(processed.Variants))
+	for _, v := range processed.Variants {
+		variants = append(variants, models.MediaVariant{Name: v.Name, Width: v.Width, Height: v.Height, Size: len(v.Data)})
+		m.Size += int64(len(v.Data))
+	}
+	encoded, err := json.Marshal(variants)
+	if err != nil {
+		return nil, err
+	}
+	m.Variants = string(encoded)
+
+	// The row comes first so its ID can name the objects
+	if err := db.Create(&m).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range processed.Variants {
+		if err := store.Put(ctx, Key(&m, v.Name), v.Data, m.ContentType); err != nil {
+			Delete(ctx, db, store, &m)
+			return nil, fmt.Errorf("failed to store image: %w", err)
+		}
+	}
+
+	var previous []models.Media
+	db.Where("kind = ? AND subject_id = ? AND id <> ?", m.Kind, m.SubjectID, m.ID).Find(&previous)
+	for i := range previous {
+		if err := Delete(ctx, db, store, &previous[i]); err != nil {
+			log.Printf("[MEDIA] Failed to delete replaced media %d: %v", previous[i].ID, err)
+		}
+	}
+	return &m, nil
+}
+
+// Delete removes a media's objects and its row
+func Delete(ctx context.Context, db *gorm.DB, store storage.Storage, m *models.Media) error {
+	for _, v := range m.GetVariants() {
+		if err := store.Delete(ctx, Key(m, v.Name)); err != nil {
+			return err
+		}
+	}
+	return db.Delete(m).Error
+}
+
+// DeleteFor removes every image of a kind belonging to a subject, such as
+// a deleted book's cover
+func DeleteFor(ctx context.Context, db *gorm.DB, store storage.Storage, kind Kind, subjectID uint) error {
+	var items []models.Media
+	if err := db.Where("kind = ? AND subject_id = ?", string(kind), subjectID).Find(&items).Error; err != nil {
+		return err
+	}
+	for i := range items {
+		if err := Delete(ctx, db, store, &items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open returns a variant's contents
+func Open(ctx context.Context, store storage.Storage, m *models.Media, variant string) (io.ReadCloser, error) {
+	if !m.HasVariant(variant) {
+		return nil, ErrNotFound
+	}
+	r, err := store.Open(ctx, Key(m, variant))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// Read returns the contents and type of the image a media URL points to
+func Read(ctx context.Context, db *gorm.DB, store storage.Storage, rawURL string) ([]byte, string, error) {
+	id, variant, ok := Parse(rawURL)
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	var m models.Media
+	if err := db.First(&m, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrNotFound
+		}
+		return nil, "", err
+	}
+	r, err := Open(ctx, store, &m, variant)
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, m.ContentType, nil
+}
@@ -0,0 +1,104 @@
+package media
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInitRequiresSigningKeyInProduction(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{name: "random key in development", ok: true},
+		{name: "key in development", env: map[string]string{"MEDIA_SIGNING_KEY": "secret"}, ok: true},
+		{name: "no key in production", env: map[string]string{"ENV": "production"}},
+		{name: "no key in release mode", env: map[string]string{"GIN_MODE": "release"}},
+		{name: "key in production", env: map[string]string{"ENV": "production", "MEDIA_SIGNING_KEY": "secret"}, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"ENV", "GIN_MODE", "MEDIA_SIGNING_KEY", "MEDIA_BASE_URL", "PORT"} {
+				t.Setenv(key, tt.env[key])
+			}
+			prevBase, prevKey := baseURL, signingKey
+			t.Cleanup(func() { baseURL, signingKey = prevBase, prevKey })
+
+			err := Init()
+			if tt.ok && err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("Init accepted a missing signing key")
+			}
+		})
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	prevKey := signingKey
+	signingKey = []byte("test key")
+	t.Cleanup(func() { signingKey = prevKey })
+
+	signed, err := url.Parse(Sign(URL(12, "small")))
+	if err != nil {
+		t.Fatalf("failed to parse signed URL: %v", err)
+	}
+	query := signed.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatalf("got expires %q", query.Get("expires"))
+	}
+	if ttl := time.Until(time.Unix(expires, 0)); ttl < SignedURLTTL || ttl > SignedURLTTL+10*time.Minute {
+		t.Errorf("got URL valid for %v, want about %v", ttl, SignedURLTTL)
+	}
+
+	with := func(key, value string) url.Values {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set(key, value)
+		return q
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+
+	tests := []struct {
+		name    string
+		id      uint
+		variant string
+		query   url.Values
+		ok      bool
+	}{
+		{name: "signed URL", id: 12, variant: "small", query: query, ok: true},
+		{name: "other variant", id: 12, variant: "original", query: query},
+		{name: "other media", id: 13, variant: "small", query: query},
+		{name: "later expiry", id: 12, variant: "small", query: with("expires", strconv.FormatInt(expires+600, 10))},
+		{name: "tampered signature", id: 12, variant: "small", query: with("sig", "00"+query.Get("sig")[2:])},
+		{name: "expired", id: 12, variant: "small", query: url.Values{"expires": {strconv.FormatInt(past, 10)}, "sig": {signature(12, "small", past)}}},
+		{name: "unsigned", id: 12, variant: "small", query: url.Values{}},
+	}
+	for _, tt := range tests {
+		if got := Verify(tt.id, tt.variant, tt.query); got != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+
+	// A key change invalidates every URL signed with the old one
+	signingKey = []byte("another key")
+	if Verify(12, "small", query) {
+		t.Error("accepted a URL signed with another key")
+	}
+}
+
+func TestSignLeavesOtherURLs(t *testing.T) {
+	for _, raw := range []string{"https://example.com/cover.jpg", baseURL + "/12", baseURL + "/x/small"} {
+		if got := Sign(raw); got != raw {
+			t.Errorf("Sign(%q) = %q, want it unchanged", raw, got)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+// Package membership manages the users who work on a book: the owner,
+// co-authors, editors and beta readers. Members join by accepting an
+// invitation, and the book's tips are split between the owner and
+// co-authors by their revenue shares.
+package membership
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotMember          = errors.New("user is not a member of this book")
+	ErrInvalidRole        = errors.New("role must be co_author, editor or beta_reader")
+	ErrAlreadyMember      = errors.New("user is already a member of this book")
+	ErrAlreadyInvited     = errors.New("user already has a pending invitation to this book")
+	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrInvitationClosed   = errors.New("invitation is no longer pending")
+	ErrOwner              = errors.New("the owner cannot be removed or given another role")
+	ErrInvalidShare       = errors.New("only the owner and co-authors can hold a revenue share, between 0 and 100")
+	ErrShareUnavailable   = errors.New("the owner does not hold enough revenue share")
+	ErrSharesTotal        = errors.New("revenue shares must cover the owner and every co-author and add up to 100")
+)
+
+// RoleOf returns the role userID holds on a book
+func RoleOf(db *gorm.DB, bookID, userID uint) (models.BookRole, error) {
+	var member models.BookMember
+	if err := db.Where("book_id = ? AND user_id = ?", bookID, userID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrNotMember
+		}
+		return "", err
+	}
+	return member.Role, nil
+}
+
+// BookIDs returns a subquery selecting the IDs of the books userID is a
+// member of
+func BookIDs(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Model(&models.BookMember{}).Select("book_id").Where("user_id = ?", userID)
+}
+
+// AddOwner makes the book's author its owner with the whole revenue share.
+// It must be called when a book is created.
+func AddOwner(tx *gorm.DB, book *models.Book) error {
+	return tx.Create(&models.BookMember{
+		BookID:       book.ID,
+		UserID:       book.AuthorID,
+		Role:         models.BookRoleOwner,
+		RevenueShare: 100,
+	}).Error
+}
+
+// EnsureOwners adds the owner member to books created before memberships
+// existed
+func EnsureOwners(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO book_members (book_id, user_id, role, revenue_share, created_at, updated_at)
+		SELECT books.id, books.author_id, ?, 100, NOW(), NOW() FROM books
+		WHERE NOT EXISTS (SELECT 1 FROM book_members WHERE book_members.book_id = books.id AND book_members.role = ?)`,
+		models.BookRoleOwner, models.BookRoleOwner).Error
+}
+
+// Invite invites invitee to a book. Only co-authors may be offered a revenue
+// share, and the owner must hold at least that much when the invitation is
+// sent.
+func Invite(db *gorm.DB, bookID, inviterID, inviteeID uint, role models.BookRole, share int) (*models.BookInvitation, error) {
+	if !role.Valid() || role == models.BookRoleOwner {
+		return nil, ErrInvalidRole
+	}
+	if share < 0 || share > 100 || (share > 0 && !role.EarnsRevenue()) {
+		return nil, ErrInvalidShare
+	}
+
+	invitation := models.BookInvitation{
+		BookID:       bookID,
+		InviterID:    inviterID,
+		InviteeID:    inviteeID,
+		Role:         role,
+		RevenueShare: share,
+		Status:       models.BookInvitationPending,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		owner, err := lockOwner(tx, bookID)
+		if err != nil {
+			return err
+		}
+		if owner.RevenueShare < share {
+			return ErrShareUnavailable
+		}
+
+		if _, err := RoleOf(tx, bookID, inviteeID); err == nil {
+			return ErrAlreadyMember
+		} else if !errors.Is(err, ErrNotMember) {
+			return err
+		}
+
+		var pending int64
+		if err := tx.Model(&models.BookInvitation{}).
+			Where("book_id = ? AND invitee_id = ? AND status = ?", bookID, inviteeID, models.BookInvitationPending).
+			Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrAlreadyInvited
+		}
+
+		return tx.Create(&invitation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// Accept adds the invitee to the book, moving the offered revenue share from
+// the owner
+func Accept(db *gorm.DB, invitationID, userID uint) (*models.BookMember, error) {
+	var member models.BookMember
+	err := db.Transaction(func(tx *gorm.DB) error {
+		invitation, err := lockInvitation(tx, invitationID, userID)
+		if err != nil {
+			return err
+		}
+
+		owner, err := lockOwner(tx, invitation.BookID)
+		if err != nil {
+			return err
+		}
+		if owner.RevenueShare < invitation.RevenueShare {
+			return ErrShareUnavailable
+		}
+		if _, err := RoleOf(tx, invitation.BookID, userID); err == nil {
+			return ErrAlreadyMember
+		} else if !errors.Is(err, ErrNotMember) {
+			return err
+		}
+
+		member = models.BookMember{
+			BookID:       invitation.BookID,
+			UserID:       userID,
+			Role:         invitation.Role,
+			RevenueShare: invitation.RevenueShare,
+			InvitedByID:  &invitation.InviterID,
+		}
+		if err := tx.Create(&member).Error; err != nil {
+			return err
+		}
+		if invitation.RevenueShare > 0 {
+			if err := tx.Model(owner).Update("revenue_share", owner.RevenueShare-invitation.RevenueShare).Error; err != nil {
+				return err
+			}
+		}
+		return respond(tx, invitation, models.BookInvitationAccepted)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Decline turns down an invitation sent to userID
+func Decline(db *gorm.DB, invitationID, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		invitation, err := lockInvitation(tx, invitationID, userID)
+		if err != nil {
+			return err
+		}
+		return respond(tx, invitation, models.BookInvitationDeclined)
+	})
+}
+
+// Revoke withdraws a pending invitation to a book
+func Revoke(db *gorm.DB, bookID, invitationID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var invitation models.BookInvitation
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND book_id = ?", invitationID, bookID).
+			First(&invitation).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvitationNotFound
+			}
+			return err
+		}
+		if invitation.Status != models.BookInvitationPending {
+			return ErrInvitationClosed
+		}
+		return respond(tx, &invitation, models.BookInvitationRevoked)
+	})
+}
+
+// ChangeRole gives a member another role. A member who can no longer earn
+// from the book hands their revenue share back to the owner.
+func ChangeRole(db *gorm.DB, bookID, userID uint, role models.BookRole) error {
+	if !role.Valid() || role == models.BookRoleOwner {
+		return ErrInvalidRole
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		member, err := lockMember(tx, bookID, userID)
+		if err != nil {
+			return err
+		}
+		if member.Role == models.BookRoleOwner {
+			return ErrOwner
+		}
+
+		updates := map[string]interface{}{"role": role}
+		if !role.EarnsRevenue() && member.RevenueShare > 0 {
+			if err := returnShare(tx, bookID, member.RevenueShare); err != nil {
+				return err
+			}
+			updates["revenue_share"] = 0
+		}
+		return tx.Model(member).Updates(updates).Error
+	})
+}
+
+// Remove takes a member off a book and hands their revenue share back to the
+// owner
+func Remove(db *gorm.DB, bookID, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		member, err := lockMember(tx, bookID, userID)
+		if err != nil {
+			return err
+		}
+		if member.Role == models.BookRoleOwner {
+			return ErrOwner
+		}
+
+		if member.RevenueShare > 0 {
+			if err := returnShare(tx, bookID, member.RevenueShare); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(member).Error
+	})
+}
+
+// SetShares replaces the revenue shares of a book. shares maps user IDs to
+// percentages and must name the owner and every co-author, adding up to 100.
+func SetShares(db *gorm.DB, bookID uint, shares map[uint]int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var members []models.BookMember
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("book_id = ?", bookID).
+			Find(&members).Error; err != nil {
+			return err
+		}
+
+		total, named := 0, 0
+		for _, member := range members {
+			share, ok := shares[member.UserID]
+			if !ok {
+				continue
+			}
+			if !member.Role.EarnsRevenue() || share < 0 {
+				return ErrInvalidShare
+			}
+			total += share
+			named++
+		}
+		if named != len(shares) {
+			return ErrNotMember
+		}
+		for _, member := range members {
+			if _, ok := shares[member.UserID]; member.Role.EarnsRevenue() && !ok {
+				return ErrSharesTotal
+			}
+		}
+		if total != 100 {
+			return ErrSharesTotal
+		}
+
+		for _, member := range members {
+			share, ok := shares[member.UserID]
+			if !ok || share == member.RevenueShare {
+				continue
+			}
+			if err := tx.Model(&models.BookMember{}).Where("id = ?", member.ID).Update("revenue_share", share).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Allocation is the part of an amount one member receives
+type Allocation struct {
+	UserID uint
+	Amount int
+}
+
+// Split divides amount tokens between the members of a book who hold a
+// revenue share. Whole tokens are handed out by largest remainder, with ties
+// going to the owner and then to the earliest member, so the allocations
+// always add up to amount. Members whose part rounds to nothing are left out.
+func Split(db *gorm.DB, bookID uint, amount int) ([]Allocation, error) {
+	var members []models.BookMember
+	if err := db.Where("book_id = ? AND revenue_share > 0", bookID).Order("id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, ErrNotMember
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].Role == models.BookRoleOwner && members[j].Role != models.BookRoleOwner
+	})
+
+	parts := make([]Allocation, len(members))
+	remainders := make([]int, len(members))
+	left := amount
+	for i, member := range members {
+		exact := amount * member.RevenueShare
+		parts[i] = Allocation{UserID: member.UserID, Amount: exact / 100}
+		remainders[i] = exact % 100
+		left -= parts[i].Amount
+	}
+
+	order := make([]int, len(members))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for i := 0; left > 0; i = (i + 1) % len(order) {
+		parts[order[i]].Amount++
+		left--
+	}
+
+	allocations := parts[:0]
+	for _, part := range parts {
+		if part.Amount > 0 {
+			allocations = append(allocations, part)
+		}
+	}
+	return allocations, nil
+}
+
+func lockOwner(tx *gorm.DB, bookID uint) (*models.BookMember, error) {
+	var owner models.BookMember
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("book_id = ? AND role = ?", bookID, models.BookRoleOwner).
+		First(&owner).Error; err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+func lockMember(tx *gorm.DB, bookID, userID uint) (*models.BookMember, error) {
+	var member models.BookMember
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("book_id = ? AND user_id = ?", bookID, userID).
+		First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotMember
+		}
+		return nil, err
+	}
+	return &member, nil
+}
+
+func lockInvitation(tx *gorm.DB, invitationID, inviteeID uint) (*models.BookInvitation, error) {
+	var invitation models.BookInvitation
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND invitee_id = ?", invitationID, inviteeID).
+		First(&invitation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvitationNotFound
+		}
+		return nil, err
+	}
+	if invitation.Status != models.BookInvitationPending {
+		return nil, ErrInvitationClosed
+	}
+	return &invitation, nil
+}
+
+func returnShare(tx *gorm.DB, bookID uint, share int) error {
+	owner, err := lockOwner(tx, bookID)
+	if err != nil {
+		return err
+	}
+	return tx.Model(owner).Update("revenue_share", owner.RevenueShare+share).Error
+}
+
+func respond(tx *gorm.DB, invitation *models.BookInvitation, status models.BookInvitationStatus) error {
+	now := time.Now()
+	return tx.Model(invitation).Updates(map[string]interface{}{
+		"status":       status,
+		"responded_at": &now,
+	}).Error
+}
@@ -0,0 +1,177 @@
+package membership
+
+import (
+	"errors"
+	"testing"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// member is a book member as created in a test, in creation order
+type member struct {
+	userID uint
+	role   models.BookRole
+	share  int
+}
+
+// openBook returns a database holding book 1 with the given members
+func openBook(t *testing.T, members ...member) *gorm.DB {
+	t.Helper()
+
+	db := dbtest.Open(t, &models.BookMember{}, &models.BookInvitation{})
+	for _, m := range members {
+		if err := db.Create(&models.BookMember{BookID: 1, UserID: m.userID, Role: m.role, RevenueShare: m.share}).Error; err != nil {
+			t.Fatalf("failed to create member: %v", err)
+		}
+	}
+	return db
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []member
+		amount  int
+		want    []Allocation
+	}{
+		{
+			name:    "sole owner",
+			members: []member{{1, models.BookRoleOwner, 100}},
+			amount:  7,
+			want:    []Allocation{{1, 7}},
+		},
+		{
+			name:    "tie goes to the owner",
+			members: []member{{1, models.BookRoleOwner, 50}, {2, models.BookRoleCoAuthor, 50}},
+			amount:  7,
+			want:    []Allocation{{1, 4}, {2, 3}},
+		},
+		{
+			name:    "owner first even when added later",
+			members: []member{{2, models.BookRoleCoAuthor, 50}, {1, models.BookRoleOwner, 50}},
+			amount:  1,
+			want:    []Allocation{{1, 1}},
+		},
+		{
+			name:    "largest remainder",
+			members: []member{{1, models.BookRoleOwner, 20}, {2, models.BookRoleCoAuthor, 45}, {3, models.BookRoleCoAuthor, 35}},
+			amount:  3,
+			// Exact parts are 0.6, 1.35 and 1.05
+			want: []Allocation{{1, 1}, {2, 1}, {3, 1}},
+		},
+		{
+			name:    "tie between co-authors goes to the earliest",
+			members: []member{{1, models.BookRoleOwner, 10}, {2, models.BookRoleCoAuthor, 45}, {3, models.BookRoleCoAuthor, 45}},
+			amount:  1,
+			want:    []Allocation{{2, 1}},
+		},
+		{
+			name:    "members without a share are left out",
+			members: []member{{1, models.BookRoleOwner, 100}, {2, models.BookRoleEditor, 0}},
+			amount:  10,
+			want:    []Allocation{{1, 10}},
+		},
+		{
+			name:    "nothing to split",
+			members: []member{{1, models.BookRoleOwner, 60}, {2, models.BookRoleCoAuthor, 40}},
+			amount:  0,
+			want:    []Allocation{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openBook(t, tt.members...)
+
+			got, err := Split(db, 1, tt.amount)
+			if err != nil {
+				t.Fatalf("Split: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitAddsUpToAmount(t *testing.T) {
+	db := openBook(t,
+		member{1, models.BookRoleOwner, 34},
+		member{2, models.BookRoleCoAuthor, 33},
+		member{3, models.BookRoleCoAuthor, 33},
+	)
+
+	for amount := 0; amount <= 500; amount++ {
+		allocations, err := Split(db, 1, amount)
+		if err != nil {
+			t.Fatalf("Split %d: %v", amount, err)
+		}
+		total := 0
+		for _, a := range allocations {
+			total += a.Amount
+		}
+		if total != amount {
+			t.Fatalf("split of %d: allocations %v add up to %d", amount, allocations, total)
+		}
+	}
+}
+
+func TestSplitWithoutShares(t *testing.T) {
+	db := openBook(t)
+
+	if _, err := Split(db, 1, 10); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("got error %v, want %v", err, ErrNotMember)
+	}
+}
+
+func TestSetShares(t *testing.T) {
+	tests := []struct {
+		name   string
+		shares map[uint]int
+		want   error
+	}{
+		{name: "valid", shares: map[uint]int{1: 70, 2: 30}},
+		{name: "owner may give up every share", shares: map[uint]int{1: 0, 2: 100}},
+		{name: "below 100", shares: map[uint]int{1: 60, 2: 30}, want: ErrSharesTotal},
+		{name: "co-author left out", shares: map[uint]int{1: 100}, want: ErrSharesTotal},
+		{name: "share for an editor", shares: map[uint]int{1: 60, 2: 30, 3: 10}, want: ErrInvalidShare},
+		{name: "negative share", shares: map[uint]int{1: 110, 2: -10}, want: ErrInvalidShare},
+		{name: "not a member", shares: map[uint]int{1: 60, 2: 30, 9: 10}, want: ErrNotMember},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openBook(t,
+				member{1, models.BookRoleOwner, 80},
+				member{2, models.BookRoleCoAuthor, 20},
+				member{3, models.BookRoleEditor, 0},
+			)
+
+			err := SetShares(db, 1, tt.shares)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+
+			// A rejected change leaves the shares as they were
+			want := map[uint]int{1: 80, 2: 20, 3: 0}
+			if tt.want == nil {
+				want = tt.shares
+			}
+			var members []models.BookMember
+			db.Find(&members)
+			for _, m := range members {
+				if m.RevenueShare != want[m.UserID] {
+					t.Errorf("user %d: got share %d, want %d", m.UserID, m.RevenueShare, want[m.UserID])
+				}
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fdip/internal/auth"
 	"fdip/internal/database"
 	"fdip/internal/models"
+	"fdip/internal/permissions"
 	"github.com/gin-gonic/gin"
 )
 
@@ -44,10 +45,14 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if !isCurrent(claims, &user) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			c.Abort()
+			return
+		}
+
 		// Set user in context
-		c.Set("user", &user)
-		c.Set("user_id", user.ID)
-		c.Set("user_role", user.Role)
+		setUser(c, &user, claims)
 		c.Next()
 	}
 }
@@ -80,47 +85,116 @@ func OptionalAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		c.Set("user", &user)
-		c.Set("user_id", user.ID)
-		c.Set("user_role", user.Role)
+		if !isCurrent(claims, &user) {
+			c.Next()
+			return
+		}
+
+		setUser(c, &user, claims)
 		c.Next()
 	}
 }
 
-// RequireRole middleware ensures the user has the required role
-func RequireRole(requiredRole models.UserRole) gin.HandlerFunc {
+// isCurrent reports whether an access token has not been invalidated by a
+// token version bump or by revoking its session. Every access token is
+// issued for a session, so one without is rejected.
+func isCurrent(claims *auth.Claims, user *models.User) bool {
+	if claims.TokenVersion != user.TokenVersion || claims.SessionID == 0 {
+		return false
+	}
+	if auth.CheckSession(database.DB, claims.SessionID) != nil {
+		return false
+	}
+	return true
+}
+
+func setUser(c *gin.Context, user *models.User, claims *auth.Claims) {
+	c.Set("user", user)
+	c.Set("user_id", user.ID)
+	c.Set("user_role", user.Role)
+	c.Set("session_id", claims.SessionID)
+	c.Set("mfa", claims.MFA)
+}
+
+// RequirePermission middleware ensures the user's role holds all of the
+// given permissions
+func RequirePermission(perms ...models.Permission) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userRole, exists := c.Get("user_role")
+		user, exists := GetCurrentUser(c)
 		if !exists {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 			c.Abort()
 			return
 		}
 
-		role := userRole.(models.UserRole)
-		if role != requiredRole && role != models.RoleAdmin {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		set, err := permissions.For(database.DB, user.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
 			c.Abort()
 			return
 		}
 
+		for _, perm := range perms {
+			if !set.Has(perm) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions", "permission": perm})
+				c.Abort()
+				return
+			}
+		}
+
 		c.Next()
 	}
 }
 
-// RequireAuthorOrAdmin middleware ensures the user is an author or admin
-func RequireAuthorOrAdmin() gin.HandlerFunc {
+// RequireAnyPermission middleware ensures the user's role holds at least one
+// of the given permissions
+func RequireAnyPermission(perms ...models.Permission) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userRole, exists := c.Get("user_role")
+		user, exists := GetCurrentUser(c)
 		if !exists {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 			c.Abort()
 			return
 		}
 
-		role := userRole.(models.UserRole)
-		if !(role == models.RoleAuthor || role == models.RoleAdmin) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Author or admin access required"})
+		set, err := permissions.For(database.DB, user.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			c.Abort()
+			return
+		}
+
+		for _, perm := range perms {
+			if set.Has(perm) {
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		c.Abort()
+	}
+}
+
+// RequireTwoFactor middleware ensures the user has two-factor authentication
+// enabled and signed in to this session with it
+func RequireTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := GetCurrentUser(c)
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		if !user.TwoFactorEnabled() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication must be enabled", "code": "mfa_setup_required"})
+			c.Abort()
+			return
+		}
+
+		if !IsMFAVerified(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Sign in again with your two-factor code", "code": "mfa_required"})
 			c.Abort()
 			return
 		}
@@ -145,4 +219,30 @@ func GetCurrentUserID(c *gin.Context) (uint, bool) {
 		return 0, false
 	}
 	return userID.(uint), true
-} 
\ No newline at end of file
+}
+
+// GetCurrentSessionID extracts the session of the current access token from
+// context. It is 0 when the request is not authenticated.
+func GetCurrentSessionID(c *gin.Context) uint {
+	sessionID, exists := c.Get("session_id")
+	if !exists {
+		return 0
+	}
+	return sessionID.(uint)
+}
+
+// IsMFAVerified reports whether the current session signed in with a second
+// factor
+func IsMFAVerified(c *gin.Context) bool {
+	return c.GetBool("mfa")
+}
+
+// HasPermission reports whether the current user's role holds perm
+func HasPermission(c *gin.Context, perm models.Permission) bool {
+	user, exists := GetCurrentUser(c)
+	if !exists {
+		return false
+	}
+	ok, err := permissions.Has(database.DB, user, perm)
+	return err == nil && ok
+}
@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"testing"
+
+	"fdip/internal/auth"
+	"fdip/internal/models"
+)
+
+func TestIsCurrentRejectsTokenWithoutSession(t *testing.T) {
+	user := &models.User{ID: 1}
+	claims := &auth.Claims{UserID: user.ID, TokenVersion: user.TokenVersion}
+
+	if isCurrent(claims, user) {
+		t.Fatal("accepted an access token without a session")
+	}
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// LoginGuard locks out repeated failed sign-in attempts. Failures are counted
+// per username and client IP, so an attacker cannot lock a user out from
+// everywhere. Once Threshold failures are reached each further failure
+// doubles the lockout, starting at BaseLockout and capped at MaxLockout.
+//
+// Failures are also counted per username alone against the higher
+// UserThreshold, so an attacker rotating through IPs is still locked out.
+type LoginGuard struct {
+	Store         RateLimitStore
+	Threshold     int
+	UserThreshold int
+	BaseLockout   time.Duration
+	MaxLockout    time.Duration
+	// FailureTTL is how long failures are remembered after the last one
+	FailureTTL time.Duration
+}
+
+// Logins guards the login endpoints. main may replace its store.
+var Logins = NewLoginGuard(NewMemoryRateLimitStore())
+
+// NewLoginGuard returns a guard with the default lockout settings
+func NewLoginGuard(store RateLimitStore) *LoginGuard {
+	return &LoginGuard{
+		Store:         store,
+		Threshold:     5,
+		UserThreshold: 20,
+		BaseLockout:   30 * time.Second,
+		MaxLockout:    time.Hour,
+		FailureTTL:    24 * time.Hour,
+	}
+}
+
+// Check returns how much longer sign-ins for username from ip are locked out,
+// or zero if they are allowed
+func (g *LoginGuard) Check(username, ip string) time.Duration {
+	now := time.Now()
+	var remaining time.Duration
+	for _, key := range []string{g.lockKey(username, ip), g.userLockKey(username)} {
+		until, err := g.Store.Until(key, now)
+		if err != nil {
+			log.Printf("[RATELIMIT] Failed to check login lockout: %v", err)
+			continue
+		}
+		if !until.IsZero() && until.Sub(now) > remaining {
+			remaining = until.Sub(now)
+		}
+	}
+	return remaining
+}
+
+// Fail records a failed sign-in and returns the lockout it triggered, if any
+func (g *LoginGuard) Fail(username, ip string) time.Duration {
+	now := time.Now()
+	lockout := g.fail(g.failureKey(username, ip), g.lockKey(username, ip), g.Threshold, now)
+	if userLockout := g.fail(g.userFailureKey(username), g.userLockKey(username), g.UserThreshold, now); userLockout > lockout {
+		lockout = userLockout
+	}
+	if lockout > 0 {
+		log.Printf("[RATELIMIT] Locked out sign-in for %q from %s for %s", username, ip, lockout)
+	}
+	return lockout
+}
+
+// fail counts a failure under failureKey and, once threshold failures are
+// reached, locks lockKey out
+func (g *LoginGuard) fail(failureKey, lockKey string, threshold int, now time.Time) time.Duration {
+	failures, err := g.Store.Incr(failureKey, g.FailureTTL, now)
+	if err != nil {
+		log.Printf("[RATELIMIT] Failed to record login failure: %v", err)
+		return 0
+	}
+	if failures < threshold {
+		return 0
+	}
+
+	lockout := g.BaseLockout
+	for i := threshold; i < failures && lockout < g.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > g.MaxLockout {
+		lockout = g.MaxLockout
+	}
+
+	if err := g.Store.SetUntil(lockKey, now.Add(lockout)); err != nil {
+		log.Printf("[RATELIMIT] Failed to lock out login: %v", err)
+		return 0
+	}
+	return lockout
+}
+
+// Succeed clears the failures of username, from ip and overall
+func (g *LoginGuard) Succeed(username, ip string) {
+	g.Store.Delete(g.failureKey(username, ip))
+	g.Store.Delete(g.lockKey(username, ip))
+	g.Store.Delete(g.userFailureKey(username))
+	g.Store.Delete(g.userLockKey(username))
+}
+
+func (g *LoginGuard) failureKey(username, ip string) string {
+	return "login:fail:" + strings.ToLower(username) + ":" + ip
+}
+
+func (g *LoginGuard) lockKey(username, ip string) string {
+	return "login:lock:" + strings.ToLower(username) + ":" + ip
+}
+
+// userFailureKey and userLockKey have their own prefixes, so no username and
+// IP pair can collide with them
+func (g *LoginGuard) userFailureKey(username string) string {
+	return "login:userfail:" + strings.ToLower(username)
+}
+
+func (g *LoginGuard) userLockKey(username string) string {
+	return "login:userlock:" + strings.ToLower(username)
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginGuardBackoff(t *testing.T) {
+	guard := NewLoginGuard(NewMemoryRateLimitStore())
+	guard.Threshold = 3
+	guard.BaseLockout = 30 * time.Second
+	guard.MaxLockout = 5 * time.Minute
+
+	// The lockout doubles with every failure past the threshold, up to the cap
+	want := []time.Duration{
+		0,
+		0,
+		30 * time.Second,
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		5 * time.Minute,
+		5 * time.Minute,
+	}
+	for i, lockout := range want {
+		if got := guard.Fail("Reader", "203.0.113.7"); got != lockout {
+			t.Errorf("failure %d: got lockout %s, want %s", i+1, got, lockout)
+		}
+	}
+}
+
+func TestLoginGuardCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		ip       string
+		locked   bool
+	}{
+		{name: "same username and IP", username: "reader", ip: "203.0.113.7", locked: true},
+		{name: "username in another case", username: "READER", ip: "203.0.113.7", locked: true},
+		{name: "another IP", username: "reader", ip: "198.51.100.1"},
+		{name: "another username", username: "writer", ip: "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := NewLoginGuard(NewMemoryRateLimitStore())
+			guard.Threshold = 1
+			guard.Fail("reader", "203.0.113.7")
+
+			got := guard.Check(tt.username, tt.ip)
+			if tt.locked && (got <= 0 || got > guard.BaseLockout) {
+				t.Errorf("got lockout %s, want up to %s", got, guard.BaseLockout)
+			}
+			if !tt.locked && got != 0 {
+				t.Errorf("got lockout %s, want none", got)
+			}
+		})
+	}
+}
+
+func TestLoginGuardSucceedClearsFailures(t *testing.T) {
+	guard := NewLoginGuard(NewMemoryRateLimitStore())
+	guard.Threshold = 2
+
+	guard.Fail("reader", "203.0.113.7")
+	if guard.Fail("reader", "203.0.113.7") == 0 {
+		t.Fatal("second failure did not lock out")
+	}
+
+	guard.Succeed("reader", "203.0.113.7")
+	if got := guard.Check("reader", "203.0.113.7"); got != 0 {
+		t.Errorf("after success: got lockout %s, want none", got)
+	}
+	if got := guard.Fail("reader", "203.0.113.7"); got != 0 {
+		t.Errorf("first failure after success: got lockout %s, want none", got)
+	}
+}
+
+func TestLoginGuardLocksUsernameAcrossIPs(t *testing.T) {
+	guard := NewLoginGuard(NewMemoryRateLimitStore())
+	guard.Threshold = 3
+	guard.UserThreshold = 5
+
+	// One failure from each of many IPs never reaches the per-IP threshold
+	for i := 1; i < guard.UserThreshold; i++ {
+		if got := guard.Fail("reader", fmt.Sprintf("203.0.113.%d", i)); got != 0 {
+			t.Fatalf("failure %d: got lockout %s, want none", i, got)
+		}
+	}
+	if got := guard.Fail("Reader", "203.0.113.99"); got != guard.BaseLockout {
+		t.Fatalf("failure %d: got lockout %s, want %s", guard.UserThreshold, got, guard.BaseLockout)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		ip       string
+		locked   bool
+	}{
+		{name: "an IP that failed", username: "reader", ip: "203.0.113.1", locked: true},
+		{name: "a new IP", username: "reader", ip: "198.51.100.1", locked: true},
+		{name: "another username", username: "writer", ip: "203.0.113.1"},
+	}
+	for _, tt := range tests {
+		got := guard.Check(tt.username, tt.ip)
+		if tt.locked && got <= 0 {
+			t.Errorf("%s: got no lockout, want one", tt.name)
+		}
+		if !tt.locked && got != 0 {
+			t.Errorf("%s: got lockout %s, want none", tt.name, got)
+		}
+	}
+
+	// Further failures from new IPs keep doubling the lockout
+	if got := guard.Fail("reader", "198.51.100.2"); got != 2*guard.BaseLockout {
+		t.Errorf("next failure: got lockout %s, want %s", got, 2*guard.BaseLockout)
+	}
+
+	guard.Succeed("reader", "198.51.100.3")
+	if got := guard.Check("reader", "198.51.100.4"); got != 0 {
+		t.Errorf("after success: got lockout %s, want none", got)
+	}
+}
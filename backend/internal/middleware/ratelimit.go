@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitKey derives the bucket a request is counted against
+type RateLimitKey func(c *gin.Context) string
+
+// RateLimitByIP counts requests per client IP. The IP is only taken from
+// X-Forwarded-For when the request comes through a trusted proxy, see
+// TrustedProxiesFromEnv.
+func RateLimitByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// TrustedProxiesFromEnv returns the proxies listed in the comma separated
+// TRUSTED_PROXIES environment variable, as IPs or CIDRs, for
+// gin.Engine.SetTrustedProxies. It returns nil when unset, so no proxy is
+// trusted and forwarded headers cannot change the client IP.
+func TrustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// RateLimitByUser counts requests per signed in user and falls back to the
+// client IP for anonymous requests. It must run after the auth middleware.
+func RateLimitByUser(c *gin.Context) string {
+	if userID, ok := GetCurrentUserID(c); ok {
+		return fmt.Sprintf("user:%d", userID)
+	}
+	return RateLimitByIP(c)
+}
+
+// RateLimitPolicy is a token bucket: Limit requests per Window on average,
+// with up to Burst requests at once
+type RateLimitPolicy struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Burst  int // Defaults to Limit
+	Key    RateLimitKey
+}
+
+func (p RateLimitPolicy) burst() int {
+	if p.Burst > 0 {
+		return p.Burst
+	}
+	return p.Limit
+}
+
+// refillRate returns the tokens added to the bucket per second
+func (p RateLimitPolicy) refillRate() float64 {
+	return float64(p.Limit) / p.Window.Seconds()
+}
+
+// RateLimitPolicyFromEnv returns policy with its limit and window replaced by
+// the RATE_LIMIT_<NAME> environment variable when set, e.g.
+// RATE_LIMIT_AUTH=20/1m
+func RateLimitPolicyFromEnv(policy RateLimitPolicy) RateLimitPolicy {
+	name := "RATE_LIMIT_" + strings.ToUpper(policy.Name)
+	value := os.Getenv(name)
+	if value == "" {
+		return policy
+	}
+
+	limitStr, windowStr, ok := strings.Cut(value, "/")
+	limit, err := strconv.Atoi(limitStr)
+	if !ok || err != nil || limit < 1 {
+		log.Printf("[RATELIMIT] Ignoring invalid %s=%q", name, value)
+		return policy
+	}
+	window, err := time.ParseDuration(windowStr)
+	if err != nil || window <= 0 {
+		log.Printf("[RATELIMIT] Ignoring invalid %s=%q", name, value)
+		return policy
+	}
+
+	policy.Limit = limit
+	policy.Window = window
+	policy.Burst = 0
+	return policy
+}
+
+// RateLimit middleware limits requests according to policy and sets the
+// RateLimit-* headers. Rejected requests get a 429 with Retry-After. If the
+// store fails, requests are let through.
+func RateLimit(store RateLimitStore, policy RateLimitPolicy) gin.HandlerFunc {
+	if policy.Key == nil {
+		policy.Key = RateLimitByIP
+	}
+	policyHeader := fmt.Sprintf("%d;w=%d", policy.burst(), int(policy.Window.Seconds()))
+
+	return func(c *gin.Context) {
+		key := "rl:" + policy.Name + ":" + policy.Key(c)
+		state, err := store.Take(key, policy, time.Now())
+		if err != nil {
+			log.Printf("[RATELIMIT] Store error for %s: %v", key, err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Policy", policyHeader)
+		c.Header("RateLimit-Limit", strconv.Itoa(state.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(state.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(state.ResetAfter)))
+
+		if !state.Allowed {
+			retryAfter := ceilSeconds(state.RetryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":       "Too many requests",
+				"retry_after": retryAfter,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds, the unit of the
+// Retry-After and RateLimit-Reset headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitStore holds rate limiter state. Each operation is atomic, so a
+// shared store such as Redis can back several API instances: Take maps to a
+// small Lua script, Incr to INCR plus PEXPIRE, SetUntil and Until to SET PX
+// and PTTL, and Delete to DEL.
+type RateLimitStore interface {
+	// Take removes one token from the bucket at key, refilling it according
+	// to the policy first
+	Take(key string, policy RateLimitPolicy, now time.Time) (BucketState, error)
+	// Incr increments the counter at key and returns the new value. The
+	// counter expires ttl after its last increment.
+	Incr(key string, ttl time.Duration, now time.Time) (int, error)
+	// SetUntil marks key as set until the given time
+	SetUntil(key string, until time.Time) error
+	// Until returns the time key is set until, or the zero time if it is not
+	// set or has expired
+	Until(key string, now time.Time) (time.Time, error)
+	// Delete removes counters and marks at key
+	Delete(key string) error
+}
+
+// BucketState is the outcome of taking a token from a bucket
+type BucketState struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until a token is available when not allowed
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again
+	ResetAfter time.Duration
+}
+
+// MemoryRateLimitStore keeps rate limiter state in process memory. It is
+// suitable for a single API instance.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	counters  map[string]*counter
+	marks     map[string]time.Time
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket will be full, after which it can be dropped
+}
+
+type counter struct {
+	value   int
+	expires time.Time
+}
+
+// sweepInterval is how often expired entries are dropped
+const sweepInterval = time.Minute
+
+// NewMemoryRateLimitStore returns an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:  make(map[string]*bucket),
+		counters: make(map[string]*counter),
+		marks:    make(map[string]time.Time),
+	}
+}
+
+// Take implements RateLimitStore
+func (s *MemoryRateLimitStore) Take(key string, policy RateLimitPolicy, now time.Time) (BucketState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	capacity := float64(policy.burst())
+	rate := policy.refillRate()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*rate)
+		b.updated = now
+	}
+
+	state := BucketState{Limit: policy.burst()}
+	if b.tokens >= 1 {
+		b.tokens--
+		state.Allowed = true
+	} else {
+		state.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	state.Remaining = int(b.tokens)
+	state.ResetAfter = seconds((capacity - b.tokens) / rate)
+	b.full = now.Add(state.ResetAfter)
+
+	return state, nil
+}
+
+// Incr implements RateLimitStore
+func (s *MemoryRateLimitStore) Incr(key string, ttl time.Duration, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	c, ok := s.counters[key]
+	if !ok || !c.expires.After(now) {
+		c = &counter{}
+		s.counters[key] = c
+	}
+	c.value++
+	c.expires = now.Add(ttl)
+	return c.value, nil
+}
+
+// SetUntil implements RateLimitStore
+func (s *MemoryRateLimitStore) SetUntil(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marks[key] = until
+	return nil
+}
+
+// Until implements RateLimitStore
+func (s *MemoryRateLimitStore) Until(key string, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.marks[key]
+	if !ok || !until.After(now) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// Delete implements RateLimitStore
+func (s *MemoryRateLimitStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets, key)
+	delete(s.counters, key)
+	delete(s.marks, key)
+	return nil
+}
+
+// sweep drops entries that no longer affect any decision. The caller must
+// hold mu.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		if !b.full.After(now) {
+			delete(s.buckets, key)
+		}
+	}
+	for key, c := range s.counters {
+		if !c.expires.After(now) {
+			delete(s.counters, key)
+		}
+	}
+	for key, until := range s.marks {
+		if !until.After(now) {
+			delete(s.marks, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
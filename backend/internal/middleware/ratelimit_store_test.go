@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	// Three requests at once, then one every ten seconds
+	policy := RateLimitPolicy{Name: "test", Limit: 6, Window: time.Minute, Burst: 3}
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		after      time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		resetAfter time.Duration
+	}{
+		{after: 0, allowed: true, remaining: 2, resetAfter: 10 * time.Second},
+		{after: 0, allowed: true, remaining: 1, resetAfter: 20 * time.Second},
+		{after: 0, allowed: true, remaining: 0, resetAfter: 30 * time.Second},
+		{after: 0, retryAfter: 10 * time.Second, resetAfter: 30 * time.Second},
+		{after: 5 * time.Second, retryAfter: 5 * time.Second, resetAfter: 25 * time.Second},
+		{after: 10 * time.Second, allowed: true, remaining: 0, resetAfter: 30 * time.Second},
+		{after: 60 * time.Second, allowed: true, remaining: 2, resetAfter: 10 * time.Second},
+	}
+
+	store := NewMemoryRateLimitStore()
+	for i, tt := range tests {
+		state, err := store.Take("client", policy, start.Add(tt.after))
+		if err != nil {
+			t.Fatalf("take %d: %v", i, err)
+		}
+		if state.Allowed != tt.allowed || state.Remaining != tt.remaining || state.Limit != 3 {
+			t.Errorf("take %d: got allowed %v, %d of %d remaining, want %v, %d of 3",
+				i, state.Allowed, state.Remaining, state.Limit, tt.allowed, tt.remaining)
+		}
+		if got := state.RetryAfter.Round(time.Millisecond); got != tt.retryAfter {
+			t.Errorf("take %d: got retry after %s, want %s", i, got, tt.retryAfter)
+		}
+		if got := state.ResetAfter.Round(time.Millisecond); got != tt.resetAfter {
+			t.Errorf("take %d: got reset after %s, want %s", i, got, tt.resetAfter)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreKeysAreIndependent(t *testing.T) {
+	policy := RateLimitPolicy{Name: "test", Limit: 1, Window: time.Hour}
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+
+	for _, key := range []string{"a", "b"} {
+		if state, _ := store.Take(key, policy, now); !state.Allowed {
+			t.Errorf("%s: first request was not allowed", key)
+		}
+	}
+	if state, _ := store.Take("a", policy, now); state.Allowed {
+		t.Error("a: second request was allowed")
+	}
+
+	store.Delete("a")
+	if state, _ := store.Take("a", policy, now); !state.Allowed {
+		t.Error("a: request after Delete was not allowed")
+	}
+}
+
+func TestMemoryRateLimitStoreIncr(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+
+	tests := []struct {
+		after time.Duration
+		want  int
+	}{
+		{after: 0, want: 1},
+		{after: 30 * time.Second, want: 2},
+		// Each increment extends the counter's life
+		{after: 80 * time.Second, want: 3},
+		{after: 141 * time.Second, want: 1},
+	}
+
+	for _, tt := range tests {
+		got, err := store.Incr("counter", time.Minute, now.Add(tt.after))
+		if err != nil {
+			t.Fatalf("Incr: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("after %s: got %d, want %d", tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreUntil(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+
+	if until, _ := store.Until("mark", now); !until.IsZero() {
+		t.Errorf("unset mark: got %s, want zero time", until)
+	}
+	store.SetUntil("mark", now.Add(time.Minute))
+	if until, _ := store.Until("mark", now); !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("set mark: got %s, want %s", until, now.Add(time.Minute))
+	}
+	if until, _ := store.Until("mark", now.Add(time.Minute)); !until.IsZero() {
+		t.Errorf("expired mark: got %s, want zero time", until)
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newLimitedRouter returns a router allowing one request per client IP per
+// hour, trusting proxies as read from the environment
+func newLimitedRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	if err := router.SetTrustedProxies(TrustedProxiesFromEnv()); err != nil {
+		t.Fatalf("SetTrustedProxies: %v", err)
+	}
+	router.Use(RateLimit(NewMemoryRateLimitStore(), RateLimitPolicy{Name: "test", Limit: 1, Window: time.Hour}))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return router
+}
+
+// get sends a request from remoteAddr claiming to be forwarded for
+// forwardedFor
+func get(router *gin.Engine, remoteAddr, forwardedFor string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRateLimitIgnoresForgedForwardedFor(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+	router := newLimitedRouter(t)
+
+	if code := get(router, "203.0.113.7:4000", "198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("first request: got status %d, want 200", code)
+	}
+	if code := get(router, "203.0.113.7:4000", "198.51.100.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("forged X-Forwarded-For: got status %d, want 429", code)
+	}
+}
+
+func TestRateLimitUsesForwardedForFromTrustedProxy(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 10.1.2.3")
+	router := newLimitedRouter(t)
+
+	if code := get(router, "10.1.2.3:4000", "198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("first client: got status %d, want 200", code)
+	}
+	if code := get(router, "10.1.2.3:4000", "198.51.100.2"); code != http.StatusOK {
+		t.Fatalf("second client: got status %d, want 200", code)
+	}
+	if code := get(router, "10.1.2.3:4000", "198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("first client again: got status %d, want 429", code)
+	}
+}
+
+func TestTrustedProxiesFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{value: "", want: nil},
+		{value: " , ", want: nil},
+		{value: "10.0.0.1", want: []string{"10.0.0.1"}},
+		{value: "10.0.0.0/8, 192.168.1.1", want: []string{"10.0.0.0/8", "192.168.1.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("TRUSTED_PROXIES", tt.value)
+		got := TrustedProxiesFromEnv()
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.value, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: got %q, want %q", tt.value, got, tt.want)
+			}
+		}
+	}
+}
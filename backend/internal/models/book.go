@@ -8,21 +8,38 @@ import (
 )
 
 type Book struct {
-	ID            uint      `json:"id" gorm:"primaryKey"`
-	AuthorID      uint      `json:"author_id" gorm:"not null"`
-	Title         string    `json:"title" gorm:"size:255;not null"`
-	Description   *string   `json:"description"`
-	CoverImageURL *string   `json:"cover_image_url" gorm:"size:500"`
-	Genres        string    `json:"genres" gorm:"type:text;default:'[]'"`
-	IsPublished   bool      `json:"is_published" gorm:"default:false"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	AuthorID       uint       `json:"author_id" gorm:"not null"`
+	Title          string     `json:"title" gorm:"size:255;not null"`
+	Description    *string    `json:"description"`
+	CoverImageURL  *string    `json:"cover_image_url" gorm:"size:500"`
+	Genres         string     `json:"genres" gorm:"type:text;default:'[]'"`
+	IsPublished    bool       `json:"is_published" gorm:"default:false"`
+	PublishAt      *time.Time `json:"publish_at" gorm:"index"`             // Scheduled publish time of an unpublished book
+	AllowDownloads bool       `json:"allow_downloads" gorm:"default:true"` // Readers may download the book as an EPUB
+	IsCompleted    bool       `json:"is_completed" gorm:"default:false"`   // The authors have finished the story
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
 
 	// Relationships
 	Author   User      `json:"author,omitempty" gorm:"foreignKey:AuthorID"`
 	Chapters []Chapter `json:"chapters,omitempty" gorm:"foreignKey:BookID;order:chapter_number"`
 }
 
+// BookExport is the most recent file generated for a book in a format.
+// Revision identifies the book, chapter and pipeline state it was built
+// from, so it is rebuilt only when one of them changes.
+type BookExport struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	BookID    uint      `json:"book_id" gorm:"not null;uniqueIndex:idx_book_export"`
+	Format    string    `json:"format" gorm:"size:20;not null;uniqueIndex:idx_book_export"`
+	Revision  string    `json:"revision" gorm:"size:64;not null"`
+	Data      []byte    `json:"-" gorm:"type:longblob"`
+	Size      int       `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 // GetGenres returns the genres as a string slice
 func (b *Book) GetGenres() []string {
 	if b.Genres == "" {
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"time"
+)
+
+// BookRole is the part a user plays on a single book
+type BookRole string
+
+const (
+	BookRoleOwner      BookRole = "owner"
+	BookRoleCoAuthor   BookRole = "co_author"
+	BookRoleEditor     BookRole = "editor"
+	BookRoleBetaReader BookRole = "beta_reader"
+)
+
+// Valid reports whether r is a known book role
+func (r BookRole) Valid() bool {
+	switch r {
+	case BookRoleOwner, BookRoleCoAuthor, BookRoleEditor, BookRoleBetaReader:
+		return true
+	}
+	return false
+}
+
+// CanWrite reports whether the role may edit the book's details, add and
+// delete chapters and publish
+func (r BookRole) CanWrite() bool {
+	return r == BookRoleOwner || r == BookRoleCoAuthor
+}
+
+// CanEditChapters reports whether the role may edit existing chapters
+func (r BookRole) CanEditChapters() bool {
+	return r.CanWrite() || r == BookRoleEditor
+}
+
+// CanManageMembers reports whether the role may invite, remove and change
+// members and their revenue shares
+func (r BookRole) CanManageMembers() bool {
+	return r == BookRoleOwner
+}
+
+// EarnsRevenue reports whether the role may hold a share of the book's tips
+func (r BookRole) EarnsRevenue() bool {
+	return r == BookRoleOwner || r == BookRoleCoAuthor
+}
+
+// BookMember gives a user a role on a book. Book.AuthorID is the owner;
+// every book has an owner member. RevenueShare is the whole percentage of
+// the book's tips the member receives, and the shares of a book's members
+// always add up to 100.
+type BookMember struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	BookID       uint      `json:"book_id" gorm:"not null;uniqueIndex:idx_book_member"`
+	UserID       uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_book_member;index"`
+	Role         BookRole  `json:"role" gorm:"size:20;not null"`
+	RevenueShare int       `json:"revenue_share" gorm:"not null;default:0"`
+	InvitedByID  *uint     `json:"invited_by_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	// Relationships
+	User User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
+
+type BookInvitationStatus string
+
+const (
+	BookInvitationPending  BookInvitationStatus = "pending"
+	BookInvitationAccepted BookInvitationStatus = "accepted"
+	BookInvitationDeclined BookInvitationStatus = "declined"
+	BookInvitationRevoked  BookInvitationStatus = "revoked"
+)
+
+// BookInvitation invites a user to join a book. A co-author's RevenueShare
+// is moved from the owner's share when the invitation is accepted.
+type BookInvitation struct {
+	ID           uint                 `json:"id" gorm:"primaryKey"`
+	BookID       uint                 `json:"book_id" gorm:"not null;index"`
+	InviterID    uint                 `json:"inviter_id" gorm:"not null"`
+	InviteeID    uint                 `json:"invitee_id" gorm:"not null;index"`
+	Role         BookRole             `json:"role" gorm:"size:20;not null"`
+	RevenueShare int                  `json:"revenue_share" gorm:"not null;default:0"`
+	Status       BookInvitationStatus `json:"status" gorm:"size:20;not null;default:'pending'"`
+	RespondedAt  *time.Time           `json:"responded_at"`
+	CreatedAt    time.Time            `json:"created_at"`
+	UpdatedAt    time.Time            `json:"updated_at"`
+
+	// Relationships
+	Book    Book `json:"book,omitempty" gorm:"foreignKey:BookID"`
+	Inviter User `json:"inviter,omitempty" gorm:"foreignKey:InviterID"`
+	Invitee User `json:"invitee,omitempty" gorm:"foreignKey:InviteeID"`
+}
@@ -1,9 +1,13 @@
 package models
 
 import (
-	"time"
-	"strings"
+	"context"
 	"fmt"
+	"time"
+
+	"fdip/internal/content"
+
+	"gorm.io/gorm"
 )
 
 type ContentType string
@@ -14,73 +18,165 @@ const (
 )
 
 type Chapter struct {
-	ID           uint        `json:"id" gorm:"primaryKey"`
-	BookID       uint        `json:"book_id" gorm:"not null"`
-	Title        string      `json:"title" gorm:"size:255;not null"`
-	Content      string      `json:"content" gorm:"type:longtext;not null"`
-	ContentType  ContentType `json:"content_type" gorm:"type:ENUM('markdown', 'html');default:'markdown'"`
-	ImageURL     *string     `json:"image_url" gorm:"size:500"`
-	ChapterNumber uint       `json:"chapter_number" gorm:"not null"`
-	IsPublished  bool        `json:"is_published" gorm:"default:false"`
-	IsPrivate    bool        `json:"is_private" gorm:"default:false"`
-	WordCount    uint        `json:"word_count" gorm:"default:0"`
-	CreatedAt    time.Time   `json:"created_at"`
-	UpdatedAt    time.Time   `json:"updated_at"`
+	ID               uint        `json:"id" gorm:"primaryKey"`
+	BookID           uint        `json:"book_id" gorm:"not null"`
+	Title            string      `json:"title" gorm:"size:255;not null"`
+	Content          string      `json:"content" gorm:"type:longtext;not null"`
+	ContentType      ContentType `json:"content_type" gorm:"type:ENUM('markdown', 'html');default:'markdown'"`
+	ImageURL         *string     `json:"image_url" gorm:"size:500"`
+	ChapterNumber    uint        `json:"chapter_number" gorm:"not null"`
+	IsPublished      bool        `json:"is_published" gorm:"default:false"`
+	IsPrivate        bool        `json:"is_private" gorm:"default:false"`
+	PublishAt        *time.Time  `json:"publish_at" gorm:"index"` // Scheduled publish time of an unpublished chapter
+	PublishedAt      *time.Time  `json:"published_at"`            // When the chapter was first published
+	IsPremium        bool        `json:"is_premium" gorm:"default:false"`
+	PriceTokens      int         `json:"price_tokens" gorm:"default:0"`         // Tokens readers spend to unlock a premium chapter
+	FreeAfterDays    *int        `json:"free_after_days"`                       // Days after publishing a premium chapter becomes free
+	SubscribersOnly  bool        `json:"subscribers_only" gorm:"default:false"` // Readable by the author's subscribers only
+	EarlyAccessUntil *time.Time  `json:"early_access_until"`                    // Until then, readable by early access subscribers only
+	WordCount        uint        `json:"word_count" gorm:"default:0"`
+	RenderedHTML     string      `json:"html" gorm:"type:longtext"` // Sanitized HTML served to readers
+	ReadingMinutes   uint        `json:"reading_minutes" gorm:"default:0"`
+	RenderVersion    uint        `json:"-" gorm:"default:0"` // content.Version RenderedHTML was made with
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
 
 	// Relationships
 	Book     Book             `json:"book,omitempty" gorm:"foreignKey:BookID"`
 	Versions []ChapterVersion `json:"versions,omitempty" gorm:"foreignKey:ChapterID"`
 }
 
+type VersionSource string
+
+const (
+	VersionSourcePublish  VersionSource = "publish"
+	VersionSourceSave     VersionSource = "save"
+	VersionSourceRestore  VersionSource = "restore"
+	VersionSourceSchedule VersionSource = "schedule"
+)
+
+// ChapterVersion is a snapshot of a published chapter. A version is written
+// each time a published chapter's content or title changes.
 type ChapterVersion struct {
-	ID           uint        `json:"id" gorm:"primaryKey"`
-	ChapterID    uint        `json:"chapter_id" gorm:"not null"`
-	Content      string      `json:"content" gorm:"type:longtext;not null"`
-	ContentType  ContentType `json:"content_type" gorm:"type:ENUM('markdown', 'html');default:'markdown'"`
-	VersionNumber uint       `json:"version_number" gorm:"not null"`
-	CreatedAt    time.Time   `json:"created_at"`
+	ID            uint          `json:"id" gorm:"primaryKey"`
+	ChapterID     uint          `json:"chapter_id" gorm:"not null;uniqueIndex:idx_chapter_version"`
+	Title         string        `json:"title" gorm:"size:255"`
+	Content       string        `json:"content,omitempty" gorm:"type:longtext;not null"`
+	ContentType   ContentType   `json:"content_type" gorm:"type:ENUM('markdown', 'html');default:'markdown'"`
+	VersionNumber uint          `json:"version_number" gorm:"not null;uniqueIndex:idx_chapter_version"`
+	WordCount     uint          `json:"word_count" gorm:"default:0"`
+	Source        VersionSource `json:"source" gorm:"size:20;default:'publish'"`
+	AuthorID      *uint         `json:"author_id"`
+	RestoredFrom  *uint         `json:"restored_from,omitempty"` // Version number a restore copied
+	CreatedAt     time.Time     `json:"created_at"`
 
 	// Relationships
 	Chapter Chapter `json:"chapter,omitempty" gorm:"foreignKey:ChapterID"`
+	Author  *User   `json:"author,omitempty" gorm:"foreignKey:AuthorID"`
+}
+
+// ChapterDraft is a user's autosaved, unsaved edit of a chapter. Readers
+// never see drafts; saving the chapter discards the saver's draft.
+type ChapterDraft struct {
+	ID          uint        `json:"id" gorm:"primaryKey"`
+	ChapterID   uint        `json:"chapter_id" gorm:"not null;uniqueIndex:idx_chapter_draft"`
+	UserID      uint        `json:"user_id" gorm:"not null;uniqueIndex:idx_chapter_draft"`
+	Title       string      `json:"title" gorm:"size:255"`
+	Content     string      `json:"content" gorm:"type:longtext;not null"`
+	ContentType ContentType `json:"content_type" gorm:"type:ENUM('markdown', 'html');default:'markdown'"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// Render converts the chapter's content to sanitized HTML and updates its
+// word count and reading time
+func (c *Chapter) Render() error {
+	rendered, err := content.Render(c.Content, content.Format(c.ContentType))
+	if err != nil {
+		return err
+	}
+	c.RenderedHTML = rendered.HTML
+	c.WordCount = uint(rendered.WordCount)
+	c.ReadingMinutes = uint(rendered.ReadingMinutes)
+	c.RenderVersion = content.Version
+	return nil
+}
+
+// RenderedColumns returns the columns Render sets, for use in updates
+func (c *Chapter) RenderedColumns() map[string]interface{} {
+	return map[string]interface{}{
+		"rendered_html":   c.RenderedHTML,
+		"word_count":      c.WordCount,
+		"reading_minutes": c.ReadingMinutes,
+		"render_version":  c.RenderVersion,
+	}
 }
 
-func (c *Chapter) CalculateWordCount() {
-	if c.ContentType == ContentTypeMarkdown {
-		// Remove markdown syntax for word count
-		content := c.Content
-		// Remove headers
-		content = strings.ReplaceAll(content, "#", "")
-		// Remove bold/italic
-		content = strings.ReplaceAll(content, "*", "")
-		content = strings.ReplaceAll(content, "_", "")
-		// Remove links
-		content = strings.ReplaceAll(content, "[", "")
-		content = strings.ReplaceAll(content, "]", "")
-		// Remove code blocks
-		content = strings.ReplaceAll(content, "```", "")
-		// Remove inline code
-		content = strings.ReplaceAll(content, "`", "")
-		
-		words := strings.Fields(content)
-		c.WordCount = uint(len(words))
-	} else {
-		// For HTML, strip tags and count words
-		content := c.Content
-		// Simple HTML tag removal (in production, use proper HTML parser)
-		content = strings.ReplaceAll(content, "<", " <")
-		content = strings.ReplaceAll(content, ">", "> ")
-		words := strings.Fields(content)
-		c.WordCount = uint(len(words))
+// RenderStaleChapters re-renders chapters rendered by an older version of
+// the content pipeline, or never rendered, a batch at a time
+func RenderStaleChapters(ctx context.Context, db *gorm.DB) error {
+	var chapters []Chapter
+	if err := db.Where("render_version < ?", content.Version).Order("id").Limit(200).Find(&chapters).Error; err != nil {
+		return err
+	}
+
+	for i := range chapters {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		chapter := &chapters[i]
+		if err := chapter.Render(); err != nil {
+			return fmt.Errorf("failed to render chapter %d: %w", chapter.ID, err)
+		}
+		if err := db.Model(chapter).UpdateColumns(chapter.RenderedColumns()).Error; err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (c *Chapter) IsVisible() bool {
 	return c.IsPublished && !c.IsPrivate
 }
 
+// IsEarlyAccess reports whether the chapter is still limited to early
+// access subscribers at now
+func (c *Chapter) IsEarlyAccess(now time.Time) bool {
+	return c.EarlyAccessUntil != nil && now.Before(*c.EarlyAccessUntil)
+}
+
+// IsOpen reports whether every reader may read all of the chapter at now:
+// it is not locked, for subscribers only or in early access
+func (c *Chapter) IsOpen(now time.Time) bool {
+	return !c.IsLocked(now) && !c.SubscribersOnly && !c.IsEarlyAccess(now)
+}
+
+// FreeAt returns when a premium chapter with a free-after period becomes
+// free, or nil if it never does
+func (c *Chapter) FreeAt() *time.Time {
+	if c.FreeAfterDays == nil {
+		return nil
+	}
+	published := c.CreatedAt
+	if c.PublishedAt != nil {
+		published = *c.PublishedAt
+	}
+	freeAt := published.AddDate(0, 0, *c.FreeAfterDays)
+	return &freeAt
+}
+
+// IsLocked reports whether readers must unlock the chapter at now
+func (c *Chapter) IsLocked(now time.Time) bool {
+	if !c.IsPremium || c.PriceTokens <= 0 {
+		return false
+	}
+	freeAt := c.FreeAt()
+	return freeAt == nil || now.Before(*freeAt)
+}
+
 func (c *Chapter) GetDisplayTitle() string {
 	if c.ChapterNumber > 0 {
 		return fmt.Sprintf("Chapter %d: %s", c.ChapterNumber, c.Title)
 	}
 	return c.Title
-} 
\ No newline at end of file
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+type DisputeStatus string
+
+const (
+	DisputeStatusOpen DisputeStatus = "open"
+	DisputeStatusWon  DisputeStatus = "won"
+	DisputeStatusLost DisputeStatus = "lost"
+)
+
+// PaymentDispute is a chargeback opened against a token purchase. The tokens
+// it covers are frozen in the buyer's hold account until it closes.
+type PaymentDispute struct {
+	ID             string        `json:"id" gorm:"primaryKey;size:255"` // Stripe dispute ID
+	TransactionID  uint          `json:"transaction_id" gorm:"not null;index"`
+	UserID         uint          `json:"user_id" gorm:"not null;index"`
+	AmountCents    int64         `json:"amount_cents" gorm:"not null"`
+	DisputedTokens int           `json:"disputed_tokens" gorm:"not null"`
+	FrozenTokens   int           `json:"frozen_tokens" gorm:"not null"`
+	Reason         string        `json:"reason" gorm:"size:50"`
+	Status         DisputeStatus `json:"status" gorm:"type:ENUM('open', 'won', 'lost');default:'open'"`
+	ClosedAt       *time.Time    `json:"closed_at"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+
+	// Relationships
+	Transaction TokenTransaction `json:"transaction,omitempty" gorm:"foreignKey:TransactionID"`
+	User        User             `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+type EmailTokenPurpose string
+
+const (
+	EmailTokenVerifyEmail   EmailTokenPurpose = "verify_email"
+	EmailTokenResetPassword EmailTokenPurpose = "reset_password"
+)
+
+// EmailToken is a single-use token sent to a user by email. Only its SHA-256
+// hash is stored.
+type EmailToken struct {
+	ID        uint              `json:"id" gorm:"primaryKey"`
+	UserID    uint              `json:"user_id" gorm:"not null;index"`
+	Purpose   EmailTokenPurpose `json:"purpose" gorm:"size:20;not null"`
+	Email     string            `json:"email" gorm:"size:255;not null"` // Address the token was sent to
+	TokenHash string            `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	UsedAt    *time.Time        `json:"used_at"`
+	CreatedAt time.Time         `json:"created_at"`
+}
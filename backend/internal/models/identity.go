@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// UserIdentity links a user to their account at an external OpenID Connect
+// provider
+type UserIdentity struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"user_id" gorm:"not null;index"`
+	Provider    string     `json:"provider" gorm:"size:50;not null;uniqueIndex:idx_identity_provider_subject"`
+	Subject     string     `json:"-" gorm:"size:255;not null;uniqueIndex:idx_identity_provider_subject"`
+	Email       string     `json:"email" gorm:"size:255"` // Address reported by the provider
+	LastLoginAt *time.Time `json:"last_login_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// OIDCLoginState is a sign-in started with an external provider and not yet
+// completed. Only the SHA-256 hash of the state parameter is stored.
+type OIDCLoginState struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	StateHash    string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	Provider     string     `json:"provider" gorm:"size:50;not null"`
+	Nonce        string     `json:"-" gorm:"size:64;not null"`
+	CodeVerifier string     `json:"-" gorm:"size:64;not null"`
+	LinkUserID   *uint      `json:"link_user_id"` // Set when a signed-in user is linking a provider
+	ExpiresAt    time.Time  `json:"expires_at"`
+	UsedAt       *time.Time `json:"used_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+type ImportStatus string
+
+const (
+	ImportStatusPending   ImportStatus = "pending"
+	ImportStatusCommitted ImportStatus = "committed"
+)
+
+// ManuscriptImport is an uploaded manuscript waiting for its author to
+// review the chapters found in it. Committing it creates a draft book.
+// Imports expire if they are not committed in time.
+type ManuscriptImport struct {
+	ID        uint         `json:"id" gorm:"primaryKey"`
+	UserID    uint         `json:"user_id" gorm:"not null;index"`
+	Filename  string       `json:"filename" gorm:"size:255"`
+	Format    string       `json:"format" gorm:"size:20;not null"`
+	Title     string       `json:"title" gorm:"size:255"`
+	Author    string       `json:"author" gorm:"size:255"`
+	Chapters  string       `json:"-" gorm:"type:longtext"` // JSON array of the parsed chapters
+	Warnings  string       `json:"-" gorm:"type:text"`     // JSON array of messages about the parse
+	Status    ImportStatus `json:"status" gorm:"size:20;default:'pending'"`
+	BookID    *uint        `json:"book_id"` // Book created on commit
+	ExpiresAt time.Time    `json:"expires_at" gorm:"not null;index"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
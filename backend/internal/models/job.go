@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// JobLease records which server process runs a background job. A process
+// only runs the job while it holds an unexpired lease.
+type JobLease struct {
+	Name      string    `json:"name" gorm:"primaryKey;size:100"`
+	Holder    string    `json:"holder" gorm:"size:255;not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
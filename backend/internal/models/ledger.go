@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+)
+
+type LedgerAccountType string
+
+const (
+	LedgerAccountUser   LedgerAccountType = "user"
+	LedgerAccountHold   LedgerAccountType = "hold"
+	LedgerAccountSystem LedgerAccountType = "system"
+)
+
+type JournalKind string
+
+const (
+	JournalKindPurchase        JournalKind = "purchase"
+	JournalKindTip             JournalKind = "tip"
+	JournalKindCashout         JournalKind = "cashout"
+	JournalKindRefund          JournalKind = "refund"
+	JournalKindOpening         JournalKind = "opening"
+	JournalKindCashoutReversal JournalKind = "cashout_reversal"
+	JournalKindDispute         JournalKind = "dispute"
+	JournalKindUnlock          JournalKind = "unlock"
+	JournalKindSubscription    JournalKind = "subscription"
+	JournalKindExpiry          JournalKind = "expiry"
+)
+
+type TokenBucketKind string
+
+const (
+	TokenBucketPurchased   TokenBucketKind = "purchased"
+	TokenBucketEarned      TokenBucketKind = "earned"
+	TokenBucketPromotional TokenBucketKind = "promotional"
+)
+
+// LedgerAccount is a token account in the double-entry ledger. Balance is a
+// cache of the sum of the account's postings and is only changed by the
+// ledger package while the row is locked.
+type LedgerAccount struct {
+	ID            uint              `json:"id" gorm:"primaryKey"`
+	Code          string            `json:"code" gorm:"uniqueIndex;size:100;not null"`
+	Type          LedgerAccountType `json:"type" gorm:"size:20;not null"`
+	UserID        *uint             `json:"user_id" gorm:"index"`
+	Balance       int               `json:"balance" gorm:"not null;default:0"`
+	AllowNegative bool              `json:"allow_negative" gorm:"default:false"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// JournalEntry groups the postings of a single token movement. The amounts of
+// its postings always sum to zero.
+type JournalEntry struct {
+	ID            uint        `json:"id" gorm:"primaryKey"`
+	Kind          JournalKind `json:"kind" gorm:"size:50;not null;index"`
+	TransactionID *uint       `json:"transaction_id" gorm:"index"`
+	Memo          string      `json:"memo" gorm:"size:255"`
+	CreatedAt     time.Time   `json:"created_at"`
+
+	// Relationships
+	Postings []Posting `json:"postings,omitempty" gorm:"foreignKey:JournalEntryID"`
+}
+
+// Posting is a signed amount applied to one account. Positive amounts credit
+// the account, negative amounts debit it.
+type Posting struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	JournalEntryID uint      `json:"journal_entry_id" gorm:"not null;index"`
+	AccountID      uint      `json:"account_id" gorm:"not null;index"`
+	Amount         int       `json:"amount" gorm:"not null"`
+	BucketID       *uint     `json:"bucket_id" gorm:"index"` // Set on postings to user and hold accounts
+	CreatedAt      time.Time `json:"created_at"`
+
+	// Relationships
+	Account LedgerAccount `json:"account,omitempty" gorm:"foreignKey:AccountID"`
+}
+
+// TokenBucket is a part of a user or hold account's balance with its own
+// rules: promotional tokens expire and cannot be cashed out. Balance is a
+// cache of the sum of the bucket's postings and is only changed by the
+// ledger package while the account row is locked.
+type TokenBucket struct {
+	ID        uint            `json:"id" gorm:"primaryKey"`
+	AccountID uint            `json:"account_id" gorm:"not null;index"`
+	Kind      TokenBucketKind `json:"kind" gorm:"size:20;not null"`
+	ExpiresAt *time.Time      `json:"expires_at" gorm:"index"`
+	Balance   int             `json:"balance" gorm:"not null;default:0"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
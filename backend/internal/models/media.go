@@ -0,0 +1,48 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Media is an uploaded image. Each size of it is stored as a separate
+// object; Variants lists them.
+type Media struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	OwnerID     uint      `json:"owner_id" gorm:"not null;index"`
+	Kind        string    `json:"kind" gorm:"size:20;not null;index:idx_media_subject"`
+	SubjectID   uint      `json:"subject_id" gorm:"not null;index:idx_media_subject"` // Book, user or chapter the image belongs to
+	Private     bool      `json:"private" gorm:"default:false"`                       // Only served through signed URLs
+	ContentType string    `json:"content_type" gorm:"size:50;not null"`
+	Ext         string    `json:"-" gorm:"size:10;not null"`
+	Size        int64     `json:"size"`               // Bytes across all variants
+	Variants    string    `json:"-" gorm:"type:text"` // JSON array of MediaVariant
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// MediaVariant is one stored size of a Media
+type MediaVariant struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int    `json:"size"`
+}
+
+// GetVariants decodes the stored variants
+func (m *Media) GetVariants() []MediaVariant {
+	var variants []MediaVariant
+	if m.Variants != "" {
+		json.Unmarshal([]byte(m.Variants), &variants)
+	}
+	return variants
+}
+
+// HasVariant reports whether a size of the media was stored
+func (m *Media) HasVariant(name string) bool {
+	for _, v := range m.GetVariants() {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
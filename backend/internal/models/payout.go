@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+)
+
+// PayoutRuleSet is one version of the author payout tiers. Rule sets are
+// never edited once created; finance publishes a new version instead, so every
+// cashout can point at the exact rules it was priced with.
+type PayoutRuleSet struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Version     int        `json:"version" gorm:"uniqueIndex;not null"`
+	Notes       string     `json:"notes" gorm:"type:text"`
+	IsActive    bool       `json:"is_active" gorm:"default:false;index"`
+	CreatedByID *uint      `json:"created_by_id"`
+	ActivatedAt *time.Time `json:"activated_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// Relationships
+	Tiers []PayoutTier `json:"tiers" gorm:"foreignKey:RuleSetID"`
+}
+
+// PayoutTier is a payout rate an author qualifies for by meeting every one of
+// its thresholds
+type PayoutTier struct {
+	ID                uint    `json:"id" gorm:"primaryKey"`
+	RuleSetID         uint    `json:"rule_set_id" gorm:"not null;index"`
+	Name              string  `json:"name" gorm:"size:50;not null"`
+	Rate              float64 `json:"rate" gorm:"not null"`              // USD per 10 tokens
+	MinEarnings90d    int     `json:"min_earnings_90d" gorm:"default:0"` // Tokens earned in the trailing 90 days
+	MinFollowers      int     `json:"min_followers" gorm:"default:0"`
+	MinAccountAgeDays int     `json:"min_account_age_days" gorm:"default:0"`
+}
+
+// PayoutRateOverride pins an author to a rate regardless of the active tiers.
+// Replaced and removed overrides are kept with RevokedAt set.
+type PayoutRateOverride struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"user_id" gorm:"not null;index"`
+	Rate        float64    `json:"rate" gorm:"not null"`
+	Reason      string     `json:"reason" gorm:"size:255;not null"`
+	CreatedByID *uint      `json:"created_by_id"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// IsActive reports whether the override applies at the given time
+func (o *PayoutRateOverride) IsActive(now time.Time) bool {
+	return o.RevokedAt == nil && (o.ExpiresAt == nil || o.ExpiresAt.After(now))
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+)
+
+// TokenBundle is a pack of tokens sold at a fixed price
+type TokenBundle struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	Name       string    `json:"name" gorm:"size:100;not null"`
+	PriceCents int64     `json:"price_cents" gorm:"not null"`
+	Tokens     int       `json:"tokens" gorm:"not null"`
+	SortOrder  int       `json:"sort_order" gorm:"default:0"`
+	IsActive   bool      `json:"is_active"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Promotion adds bonus tokens to purchases made while it runs. The best
+// running promotion a purchase qualifies for applies.
+type Promotion struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	Name              string     `json:"name" gorm:"size:100;not null"`
+	BonusPercent      int        `json:"bonus_percent" gorm:"not null"` // Of the tokens bought
+	BundleID          *uint      `json:"bundle_id"`                     // Limits the promotion to one bundle
+	FirstPurchaseOnly bool       `json:"first_purchase_only" gorm:"default:false"`
+	StartsAt          time.Time  `json:"starts_at"`
+	EndsAt            *time.Time `json:"ends_at"`
+	IsActive          bool       `json:"is_active"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// IsRunning reports whether the promotion applies at now
+func (p *Promotion) IsRunning(now time.Time) bool {
+	return p.IsActive && !now.Before(p.StartsAt) && (p.EndsAt == nil || now.Before(*p.EndsAt))
+}
+
+// PromoCode adds bonus tokens to a purchase made with it, on top of any
+// promotion
+type PromoCode struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	Code           string     `json:"code" gorm:"size:50;uniqueIndex;not null"` // Stored upper case
+	BonusPercent   int        `json:"bonus_percent" gorm:"default:0"`           // Of the tokens bought
+	BonusTokens    int        `json:"bonus_tokens" gorm:"default:0"`
+	BundleID       *uint      `json:"bundle_id"`       // Limits the code to one bundle
+	MaxRedemptions *int       `json:"max_redemptions"` // Across all users; nil for no limit, 1 for a single-use code
+	MaxPerUser     int        `json:"max_per_user"`    // 0 for no limit
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	IsActive       bool       `json:"is_active"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// IsRunning reports whether the code can be redeemed at now
+func (p *PromoCode) IsRunning(now time.Time) bool {
+	return p.IsActive && (p.StartsAt == nil || !now.Before(*p.StartsAt)) && (p.EndsAt == nil || now.Before(*p.EndsAt))
+}
+
+type PromoRedemptionStatus string
+
+const (
+	PromoRedemptionPending   PromoRedemptionStatus = "pending"
+	PromoRedemptionCompleted PromoRedemptionStatus = "completed"
+)
+
+// PromoRedemption is the use of a promo code on a purchase. It is pending
+// until the purchase is paid for.
+type PromoRedemption struct {
+	ID            uint                  `json:"id" gorm:"primaryKey"`
+	PromoCodeID   uint                  `json:"promo_code_id" gorm:"not null;index"`
+	UserID        uint                  `json:"user_id" gorm:"not null;index"`
+	TransactionID uint                  `json:"transaction_id" gorm:"not null;uniqueIndex"`
+	Status        PromoRedemptionStatus `json:"status" gorm:"size:20;not null"`
+	CreatedAt     time.Time             `json:"created_at"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+}
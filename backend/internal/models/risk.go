@@ -0,0 +1,94 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type RiskSubject string
+
+const (
+	RiskSubjectTip     RiskSubject = "tip"
+	RiskSubjectCashout RiskSubject = "cashout"
+)
+
+// RiskSignal is one reason a tip or cashout looks risky and the points it
+// adds to the score
+type RiskSignal struct {
+	Name   string `json:"name"`
+	Score  int    `json:"score"`
+	Detail string `json:"detail"`
+}
+
+// RiskAssessment records the fraud score of a tip or cashout and the
+// signals behind it
+type RiskAssessment struct {
+	ID            uint        `json:"id" gorm:"primaryKey"`
+	UserID        uint        `json:"user_id" gorm:"not null;index"` // Tipper or author cashing out
+	Subject       RiskSubject `json:"subject" gorm:"size:20;not null"`
+	TransactionID *uint       `json:"transaction_id" gorm:"index"` // Unset when the tip was declined
+	Amount        int         `json:"amount" gorm:"not null"`
+	Score         int         `json:"score" gorm:"not null;index"`
+	Signals       string      `json:"-" gorm:"type:text"` // JSON array of RiskSignal
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// GetSignals returns the signals as a slice
+func (a *RiskAssessment) GetSignals() []RiskSignal {
+	signals := []RiskSignal{}
+	if a.Signals != "" {
+		json.Unmarshal([]byte(a.Signals), &signals)
+	}
+	return signals
+}
+
+// SetSignals sets the signals from a slice
+func (a *RiskAssessment) SetSignals(signals []RiskSignal) {
+	if len(signals) == 0 {
+		a.Signals = "[]"
+		return
+	}
+	bytes, _ := json.Marshal(signals)
+	a.Signals = string(bytes)
+}
+
+// MarshalJSON customizes the JSON output for the RiskAssessment struct
+func (a *RiskAssessment) MarshalJSON() ([]byte, error) {
+	type Alias RiskAssessment
+	return json.Marshal(&struct {
+		*Alias
+		Signals []RiskSignal `json:"signals"`
+	}{
+		Alias:   (*Alias)(a),
+		Signals: a.GetSignals(),
+	})
+}
+
+type CashoutReviewStatus string
+
+const (
+	CashoutReviewPending  CashoutReviewStatus = "pending"
+	CashoutReviewApproved CashoutReviewStatus = "approved"
+	CashoutReviewRejected CashoutReviewStatus = "rejected"
+)
+
+// CashoutReview holds a risky cashout until an admin approves or rejects
+// it. The cashout's tokens stay in the payouts account meanwhile.
+type CashoutReview struct {
+	ID            uint                `json:"id" gorm:"primaryKey"`
+	TransactionID uint                `json:"transaction_id" gorm:"not null;uniqueIndex"`
+	UserID        uint                `json:"user_id" gorm:"not null;index"`
+	AssessmentID  uint                `json:"assessment_id" gorm:"not null"`
+	Status        CashoutReviewStatus `json:"status" gorm:"type:ENUM('pending', 'approved', 'rejected');default:'pending';index"`
+	ReviewerID    *uint               `json:"reviewer_id"`
+	Notes         *string             `json:"notes" gorm:"type:text"`
+	DecidedAt     *time.Time          `json:"decided_at"`
+	CreatedAt     time.Time           `json:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at"`
+
+	// Relationships
+	Transaction TokenTransaction `json:"transaction,omitempty" gorm:"foreignKey:TransactionID"`
+	User        User             `json:"user,omitempty" gorm:"foreignKey:UserID"`
+	Assessment  RiskAssessment   `json:"assessment,omitempty" gorm:"foreignKey:AssessmentID"`
+	Reviewer    *User            `json:"reviewer,omitempty" gorm:"foreignKey:ReviewerID"`
+}
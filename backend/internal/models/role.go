@@ -0,0 +1,80 @@
+package models
+
+import (
+	"time"
+)
+
+// Permission names an action that can be granted to roles
+type Permission string
+
+const (
+	PermBooksWrite      Permission = "books.write"
+	PermBooksPublish    Permission = "books.publish"
+	PermContentModerate Permission = "content.moderate"
+	PermPayoutsReceive  Permission = "payouts.receive"
+	PermPayoutsApprove  Permission = "payouts.approve"
+	PermPayoutsManage   Permission = "payouts.manage"
+	PermRefundsIssue    Permission = "refunds.issue"
+	PermDisputesView    Permission = "disputes.view"
+	PermUsersReview     Permission = "users.review"
+	PermUsersPromote    Permission = "users.promote"
+	PermRolesManage     Permission = "roles.manage"
+	PermLedgerRebuild   Permission = "ledger.rebuild"
+	PermWebhooksManage  Permission = "webhooks.manage"
+	PermAuditView       Permission = "audit.view"
+	PermPricingManage   Permission = "pricing.manage"
+)
+
+// Role is a named set of permissions. Every user has exactly one role, stored
+// by name in User.Role. System roles are created on startup and cannot be
+// deleted.
+type Role struct {
+	ID          uint             `json:"id" gorm:"primaryKey"`
+	Name        UserRole         `json:"name" gorm:"size:50;uniqueIndex;not null"`
+	Description string           `json:"description" gorm:"size:255"`
+	IsSystem    bool             `json:"is_system" gorm:"default:false"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	Permissions []RolePermission `json:"permissions,omitempty" gorm:"foreignKey:RoleID"`
+}
+
+// RolePermission grants a permission to a role
+type RolePermission struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	RoleID     uint       `json:"role_id" gorm:"not null;uniqueIndex:idx_role_permission"`
+	Permission Permission `json:"permission" gorm:"size:50;not null;uniqueIndex:idx_role_permission"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// PermissionSeed records a default grant that has been applied, so a default
+// an admin later revokes is not granted again on the next start
+type PermissionSeed struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	Role       UserRole   `json:"role" gorm:"size:50;not null;uniqueIndex:idx_permission_seed"`
+	Permission Permission `json:"permission" gorm:"size:50;not null;uniqueIndex:idx_permission_seed"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type PermissionAuditAction string
+
+const (
+	AuditRoleCreated       PermissionAuditAction = "role_created"
+	AuditRoleDeleted       PermissionAuditAction = "role_deleted"
+	AuditPermissionGranted PermissionAuditAction = "permission_granted"
+	AuditPermissionRevoked PermissionAuditAction = "permission_revoked"
+	AuditRoleAssigned      PermissionAuditAction = "role_assigned"
+)
+
+// PermissionAudit records a change to roles, their permissions or the role a
+// user holds. ActorID is empty for changes made by the system on startup.
+type PermissionAudit struct {
+	ID           uint                  `json:"id" gorm:"primaryKey"`
+	ActorID      *uint                 `json:"actor_id" gorm:"index"`
+	Action       PermissionAuditAction `json:"action" gorm:"size:30;not null"`
+	Role         UserRole              `json:"role" gorm:"size:50;not null;index"`
+	Permission   *Permission           `json:"permission" gorm:"size:50"`
+	TargetUserID *uint                 `json:"target_user_id" gorm:"index"`
+	PreviousRole *UserRole             `json:"previous_role" gorm:"size:50"`
+	Reason       string                `json:"reason" gorm:"size:255"`
+	CreatedAt    time.Time             `json:"created_at"`
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a signed-in device. Each session owns a chain of refresh tokens
+// where every refresh replaces the previous token; revoking the session ends
+// the whole chain.
+type Session struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	UserID        uint       `json:"user_id" gorm:"not null;index"`
+	UserAgent     string     `json:"user_agent" gorm:"size:255"`
+	IPAddress     string     `json:"ip_address" gorm:"size:45"`
+	MFAVerified   bool       `json:"mfa_verified" gorm:"default:false"` // Signed in with a second factor
+	ExpiresAt     time.Time  `json:"expires_at"`
+	LastUsedAt    time.Time  `json:"last_used_at"`
+	RevokedAt     *time.Time `json:"revoked_at"`
+	RevokedReason *string    `json:"revoked_reason" gorm:"size:100"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// IsActive reports whether the session can still be refreshed
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == nil && s.ExpiresAt.After(now)
+}
+
+// RefreshToken is an opaque single-use refresh token. Only its SHA-256 hash
+// is stored.
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	SessionID uint       `json:"session_id" gorm:"not null;index"`
+	TokenHash string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// RecoveryCode is a single-use code that replaces a TOTP code when the
+// authenticator is lost. Only its SHA-256 hash is stored.
+type RecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"size:64;not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+)
+
+// SubscriptionTier is a monthly plan readers subscribe to an author on.
+// Every tier opens the author's subscriber-only chapters; tiers with early
+// access also open chapters before their early access date.
+type SubscriptionTier struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	AuthorID    uint      `json:"author_id" gorm:"not null;index"`
+	Name        string    `json:"name" gorm:"size:100;not null"`
+	Description *string   `json:"description" gorm:"type:text"`
+	PriceTokens int       `json:"price_tokens" gorm:"not null"` // Monthly price for new subscribers
+	EarlyAccess bool      `json:"early_access" gorm:"default:false"`
+	IsActive    bool      `json:"is_active" gorm:"default:true"` // Retired tiers take no new subscribers and are not renewed
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Relationships
+	Author User `json:"author,omitempty" gorm:"foreignKey:AuthorID"`
+}
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionStatusActive    SubscriptionStatus = "active"
+	SubscriptionStatusPastDue   SubscriptionStatus = "past_due" // Renewal failed; access continues until GraceUntil
+	SubscriptionStatusLapsed    SubscriptionStatus = "lapsed"
+	SubscriptionStatusCancelled SubscriptionStatus = "cancelled"
+)
+
+// Subscription is a reader's subscription to an author. A reader holds at
+// most one subscription per author, which is reused when they subscribe
+// again.
+type Subscription struct {
+	ID                uint               `json:"id" gorm:"primaryKey"`
+	UserID            uint               `json:"user_id" gorm:"not null;uniqueIndex:idx_subscription"`
+	AuthorID          uint               `json:"author_id" gorm:"not null;uniqueIndex:idx_subscription;index"`
+	TierID            uint               `json:"tier_id" gorm:"not null;index"`
+	PriceTokens       int                `json:"price_tokens" gorm:"not null;default:0"` // Tier's price when subscribed, charged at each renewal
+	Status            SubscriptionStatus `json:"status" gorm:"size:20;not null;index"`
+	CurrentPeriodEnd  time.Time          `json:"current_period_end" gorm:"index"`
+	GraceUntil        *time.Time         `json:"grace_until"` // Set while past due
+	CancelAtPeriodEnd bool               `json:"cancel_at_period_end" gorm:"default:false"`
+	RenewAt           time.Time          `json:"-" gorm:"index"` // When the renewal job next looks at the subscription
+	CreatedAt         time.Time          `json:"created_at"`
+	UpdatedAt         time.Time          `json:"updated_at"`
+
+	// Relationships
+	Tier   SubscriptionTier `json:"tier,omitempty" gorm:"foreignKey:TierID"`
+	Author User             `json:"author,omitempty" gorm:"foreignKey:AuthorID"`
+}
+
+// SubscriptionGracePeriod is how long a subscriber keeps access after a
+// renewal fails
+const SubscriptionGracePeriod = 3 * 24 * time.Hour
+
+// HasAccess reports whether the subscription opens chapters at now. An
+// active subscription past its period end is waiting for the renewal job.
+func (s *Subscription) HasAccess(now time.Time) bool {
+	switch s.Status {
+	case SubscriptionStatusActive:
+		return now.Before(s.CurrentPeriodEnd.Add(SubscriptionGracePeriod))
+	case SubscriptionStatusPastDue:
+		return s.GraceUntil != nil && now.Before(*s.GraceUntil)
+	}
+	return false
+}
@@ -7,10 +7,13 @@ import (
 type TransactionType string
 
 const (
-	TransactionTypePurchase TransactionType = "purchase"
-	TransactionTypeTip     TransactionType = "tip"
-	TransactionTypeCashout TransactionType = "cashout"
-	TransactionTypeRefund  TransactionType = "refund"
+	TransactionTypePurchase     TransactionType = "purchase"
+	TransactionTypeTip          TransactionType = "tip"
+	TransactionTypeCashout      TransactionType = "cashout"
+	TransactionTypeRefund       TransactionType = "refund"
+	TransactionTypeUnlock       TransactionType = "unlock"
+	TransactionTypeSubscription TransactionType = "subscription"
+	TransactionTypeExpiry       TransactionType = "expiry"
 )
 
 type TransactionStatus string
@@ -25,28 +28,46 @@ const (
 type TokenTransaction struct {
 	ID                    uint              `json:"id" gorm:"primaryKey"`
 	UserID                uint              `json:"user_id" gorm:"not null"`
-	TransactionType       TransactionType   `json:"transaction_type" gorm:"type:ENUM('purchase', 'tip', 'cashout', 'refund');not null"`
+	TransactionType       TransactionType   `json:"transaction_type" gorm:"type:ENUM('purchase', 'tip', 'cashout', 'refund', 'unlock', 'subscription', 'expiry');not null"`
 	Amount                int               `json:"amount" gorm:"not null"` // Positive for credits, negative for debits
 	StripePaymentIntentID *string           `json:"stripe_payment_intent_id" gorm:"size:255"`
-	StripeTransferID      *string           `json:"stripe_transfer_id" gorm:"size:255"`
-	RecipientID           *uint             `json:"recipient_id"` // For tips
-	ChapterID             *uint             `json:"chapter_id"`   // For tips
+	StripeTransferID      *string           `json:"stripe_transfer_id" gorm:"size:255;index"`
+	StripeRefundID        *string           `json:"stripe_refund_id" gorm:"size:255"`
+	AmountCents           *int64            `json:"amount_cents"`                    // USD paid for purchases, returned for refunds
+	BundleID              *uint             `json:"bundle_id"`                       // Bundle a purchase bought
+	BaseTokens            *int              `json:"base_tokens"`                     // Tokens a purchase bought before bonuses
+	BonusTokens           int               `json:"bonus_tokens" gorm:"default:0"`   // Promotional tokens included in Amount
+	PromotionID           *uint             `json:"promotion_id"`                    // Promotion that added a bonus
+	PromoCodeID           *uint             `json:"promo_code_id"`                   // Promo code that added a bonus
+	PayoutAmountCents     *int64            `json:"payout_amount_cents"`             // For cashouts
+	ReversedCents         int64             `json:"reversed_cents" gorm:"default:0"` // Part of a cashout's transfer Stripe reversed
+	PayoutRate            *float64          `json:"payout_rate"`                     // Rate the cashout was priced at
+	PayoutRuleVersion     *int              `json:"payout_rule_version"`             // Payout rule set version used
+	PayoutTier            *string           `json:"payout_tier" gorm:"size:50"`
+	PayoutOverrideID      *uint             `json:"payout_override_id"`         // Set when an override decided the rate
+	RelatedTransactionID  *uint             `json:"related_transaction_id"`     // Purchase a refund belongs to
+	Shortfall             int               `json:"shortfall" gorm:"default:0"` // Refunded tokens that were already spent
+	FailureReason         *string           `json:"failure_reason" gorm:"type:text"`
+	RecipientID           *uint             `json:"recipient_id"`    // For tips
+	ChapterID             *uint             `json:"chapter_id"`      // For tips and unlocks
+	SubscriptionID        *uint             `json:"subscription_id"` // For subscription charges
 	Status                TransactionStatus `json:"status" gorm:"type:ENUM('pending', 'completed', 'failed', 'cancelled');default:'pending'"`
 	CreatedAt             time.Time         `json:"created_at"`
 	UpdatedAt             time.Time         `json:"updated_at"`
 
 	// Relationships
-	User      User      `json:"user,omitempty" gorm:"foreignKey:UserID"`
-	Recipient *User     `json:"recipient,omitempty" gorm:"foreignKey:RecipientID"`
-	Chapter   *Chapter  `json:"chapter,omitempty" gorm:"foreignKey:ChapterID"`
+	User      User     `json:"user,omitempty" gorm:"foreignKey:UserID"`
+	Recipient *User    `json:"recipient,omitempty" gorm:"foreignKey:RecipientID"`
+	Chapter   *Chapter `json:"chapter,omitempty" gorm:"foreignKey:ChapterID"`
 }
 
 type UserTokenBalance struct {
-	UserID       uint      `json:"user_id" gorm:"primaryKey"`
-	Balance      int       `json:"balance" gorm:"not null;default:0"`
-	TotalEarned  int       `json:"total_earned" gorm:"not null;default:0"`
-	TotalSpent   int       `json:"total_spent" gorm:"not null;default:0"`
-	LastUpdated  time.Time `json:"last_updated" gorm:"autoUpdateTime"`
+	UserID        uint      `json:"user_id" gorm:"primaryKey"`
+	Balance       int       `json:"balance" gorm:"not null;default:0"`
+	FrozenBalance int       `json:"frozen_balance" gorm:"not null;default:0"` // Held while a payment dispute is open
+	TotalEarned   int       `json:"total_earned" gorm:"not null;default:0"`
+	TotalSpent    int       `json:"total_spent" gorm:"not null;default:0"`
+	LastUpdated   time.Time `json:"last_updated" gorm:"autoUpdateTime"`
 
 	// Relationships
 	User User `json:"user,omitempty" gorm:"foreignKey:UserID"`
@@ -57,31 +78,9 @@ const (
 	TokensPerDollar = 10
 	MinPayoutRate   = 0.60 // $0.60 per 10 tokens
 	MaxPayoutRate   = 0.90 // $0.90 per 10 tokens
-)
 
-// CalculatePayoutRate determines the payout rate based on author performance
-// This is a simplified version - in production, you might want more sophisticated logic
-func CalculatePayoutRate(totalEarnings int, followerCount int) float64 {
-	// Base rate starts at minimum
-	rate := MinPayoutRate
-	
-	// Increase rate based on earnings (up to a point)
-	if totalEarnings > 1000 { // 1000 tokens = $100
-		rate += 0.10
-	}
-	
-	// Increase rate based on follower count
-	if followerCount > 100 {
-		rate += 0.10
-	}
-	
-	// Cap at maximum rate
-	if rate > MaxPayoutRate {
-		rate = MaxPayoutRate
-	}
-	
-	return rate
-}
+	PromotionalTokenLifetime = 90 * 24 * time.Hour // Bonus tokens expire after this long
+)
 
 // CalculatePayoutAmount calculates the USD amount for a given token amount
 func CalculatePayoutAmount(tokens int, payoutRate float64) float64 {
@@ -96,4 +95,4 @@ func CalculateTokenCost(usdAmount float64) int {
 // CalculateUSDValue calculates the USD value of tokens at purchase rate
 func CalculateUSDValue(tokens int) float64 {
 	return float64(tokens) / float64(TokensPerDollar)
-} 
\ No newline at end of file
+}
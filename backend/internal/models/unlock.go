@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// ChapterUnlock records that a reader paid to read a premium chapter. A
+// reader unlocks a chapter at most once.
+type ChapterUnlock struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_chapter_unlock"`
+	ChapterID     uint      `json:"chapter_id" gorm:"not null;uniqueIndex:idx_chapter_unlock;index"`
+	PriceTokens   int       `json:"price_tokens" gorm:"not null"`
+	TransactionID *uint     `json:"transaction_id"` // The reader's unlock transaction
+	CreatedAt     time.Time `json:"created_at"`
+
+	// Relationships
+	Chapter Chapter `json:"chapter,omitempty" gorm:"foreignKey:ChapterID"`
+}
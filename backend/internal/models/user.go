@@ -4,46 +4,59 @@ import (
 	"time"
 )
 
+// UserRole is the name of a Role. These are the system roles; admins can
+// create others.
 type UserRole string
 
 const (
-	RoleReader UserRole = "reader"
-	RoleAuthor UserRole = "author"
-	RoleAdmin  UserRole = "admin"
+	RoleReader    UserRole = "reader"
+	RoleAuthor    UserRole = "author"
+	RoleModerator UserRole = "moderator"
+	RoleFinance   UserRole = "finance"
+	RoleAdmin     UserRole = "admin"
 )
 
 type User struct {
-	ID           uint      `json:"id" gorm:"primaryKey"`
-	Username     string    `json:"username" gorm:"uniqueIndex;size:50;not null"`
-	Email        string    `json:"email" gorm:"uniqueIndex;size:255;not null"`
-	PasswordHash string    `json:"-" gorm:"size:255;not null"`
-	Role         UserRole  `json:"role" gorm:"type:ENUM('reader', 'author', 'admin');default:'reader'"`
-	DisplayName  string    `json:"display_name" gorm:"size:100;not null"`
-	Bio          *string   `json:"bio"`
-	AvatarURL    *string   `json:"avatar_url" gorm:"size:500"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID                   uint       `json:"id" gorm:"primaryKey"`
+	Username             string     `json:"username" gorm:"uniqueIndex;size:50;not null"`
+	Email                string     `json:"email" gorm:"uniqueIndex;size:255;not null"`
+	PasswordHash         string     `json:"-" gorm:"size:255;not null"`
+	Role                 UserRole   `json:"role" gorm:"size:50;not null;default:'reader';index"`
+	DisplayName          string     `json:"display_name" gorm:"size:100;not null"`
+	Bio                  *string    `json:"bio"`
+	AvatarURL            *string    `json:"avatar_url" gorm:"size:500"`
+	StripeAccountID      *string    `json:"-" gorm:"size:255;uniqueIndex"`
+	StripePayoutsEnabled bool       `json:"stripe_payouts_enabled" gorm:"default:false"`
+	EmailVerifiedAt      *time.Time `json:"email_verified_at"`
+	TokenVersion         int        `json:"-" gorm:"default:0"` // Bumped to invalidate issued access tokens
+	TOTPSecret           *string    `json:"-" gorm:"size:64"`
+	TOTPEnabledAt        *time.Time `json:"-"`
+	TOTPLastStep         int64      `json:"-" gorm:"default:0"` // Last time step accepted, to stop code replay
+	IsFlagged            bool       `json:"is_flagged" gorm:"default:false"`
+	FlaggedReason        *string    `json:"flagged_reason,omitempty" gorm:"size:255"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
 
 	// Relationships
-	Books           []Book              `json:"books,omitempty" gorm:"foreignKey:AuthorID"`
-	TokenBalance    *UserTokenBalance   `json:"token_balance,omitempty"`
+	Books             []Book             `json:"books,omitempty" gorm:"foreignKey:AuthorID"`
+	TokenBalance      *UserTokenBalance  `json:"token_balance,omitempty"`
 	TokenTransactions []TokenTransaction `json:"token_transactions,omitempty" gorm:"foreignKey:UserID"`
-	Followers       []UserFollow        `json:"followers,omitempty" gorm:"foreignKey:FollowedID"`
-	Following       []UserFollow        `json:"following,omitempty" gorm:"foreignKey:FollowerID"`
+	Followers         []UserFollow       `json:"followers,omitempty" gorm:"foreignKey:FollowedID"`
+	Following         []UserFollow       `json:"following,omitempty" gorm:"foreignKey:FollowerID"`
 }
 
-func (u *User) IsAuthor() bool {
-	return u.Role == RoleAuthor || u.Role == RoleAdmin
+// TwoFactorEnabled reports whether the user signs in with a TOTP code
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != nil && u.TOTPEnabledAt != nil
 }
 
-func (u *User) IsAdmin() bool {
-	return u.Role == RoleAdmin
+// IsEmailVerified reports whether the user has confirmed their email address
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
-func (u *User) CanAccessAuthorFeatures() bool {
-	return u.IsAuthor()
+// CanReceivePayouts reports whether the user has a Stripe Connect account
+// that is ready to receive transfers
+func (u *User) CanReceivePayouts() bool {
+	return u.StripeAccountID != nil && u.StripePayoutsEnabled
 }
-
-func (u *User) CanAccessAdminFeatures() bool {
-	return u.IsAdmin()
-} 
\ No newline at end of file
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+)
+
+type WebhookEventStatus string
+
+const (
+	WebhookEventStatusPending   WebhookEventStatus = "pending"
+	WebhookEventStatusProcessed WebhookEventStatus = "processed"
+	WebhookEventStatusIgnored   WebhookEventStatus = "ignored"
+	WebhookEventStatusFailed    WebhookEventStatus = "failed"
+)
+
+// WebhookEvent stores every verified Stripe event keyed by its event ID so
+// that retried deliveries are applied exactly once and failed events can be
+// replayed from the stored payload.
+type WebhookEvent struct {
+	ID          string             `json:"id" gorm:"primaryKey;size:255"`
+	Type        string             `json:"type" gorm:"size:100;not null;index"`
+	Payload     string             `json:"-" gorm:"type:longtext;not null"`
+	Status      WebhookEventStatus `json:"status" gorm:"type:ENUM('pending', 'processed', 'ignored', 'failed');default:'pending';index"`
+	Attempts    int                `json:"attempts" gorm:"not null;default:0"`
+	LastError   *string            `json:"last_error" gorm:"type:text"`
+	ProcessedAt *time.Time         `json:"processed_at"`
+	CreatedAt   time.Time          `json:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+}
+
+// IsDone reports whether the event's effects no longer need to be applied
+func (e *WebhookEvent) IsDone() bool {
+	return e.Status == WebhookEventStatusProcessed || e.Status == WebhookEventStatusIgnored
+}
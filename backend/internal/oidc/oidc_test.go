@@ -0,0 +1,263 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"fdip/internal/oidc"
+	"fdip/internal/oidc/oidctest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newIssuer starts a test provider and a client registered with it
+func newIssuer(t *testing.T) (*oidctest.Issuer, *oidc.Provider) {
+	t.Helper()
+
+	issuer, err := oidctest.NewIssuer("fdip-client", "fdip-secret")
+	if err != nil {
+		t.Fatalf("failed to start issuer: %v", err)
+	}
+	t.Cleanup(issuer.Close)
+
+	provider := &oidc.Provider{
+		Name:         "test",
+		DisplayName:  "Test",
+		Issuer:       issuer.URL,
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  "http://localhost:3000/auth/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+	return issuer, provider
+}
+
+func TestDiscover(t *testing.T) {
+	issuer, provider := newIssuer(t)
+
+	d, err := provider.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if d.Issuer != issuer.URL || d.TokenEndpoint != issuer.URL+"/token" || d.JWKSURI != issuer.URL+"/jwks" {
+		t.Errorf("unexpected discovery document: %+v", d)
+	}
+}
+
+func TestDiscoverRejectsOtherIssuer(t *testing.T) {
+	issuer, provider := newIssuer(t)
+	issuer.AdvertisedIssuer = "https://attacker.example"
+
+	if _, err := provider.Discover(context.Background()); err == nil {
+		t.Fatal("Discover accepted a document naming another issuer")
+	}
+}
+
+func TestLoginRoundTrip(t *testing.T) {
+	issuer, provider := newIssuer(t)
+	ctx := context.Background()
+
+	const state, nonce, verifier = "state-123", "nonce-456", "verifier-0123456789-0123456789-0123456789"
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL: %v", err)
+	}
+	q := u.Query()
+	if q.Get("state") != state || q.Get("nonce") != nonce {
+		t.Errorf("state and nonce not passed through: %s", authURL)
+	}
+	if q.Get("code_challenge") != oidc.CodeChallenge(verifier) || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("missing S256 code challenge: %s", authURL)
+	}
+	if strings.Contains(authURL, verifier) {
+		t.Error("authorization URL leaks the code verifier")
+	}
+
+	code, returnedState, err := issuer.Authorize(authURL, jwt.MapClaims{
+		"sub":            "user-1",
+		"email":          "reader@example.com",
+		"email_verified": "true",
+		"name":           "Reader",
+	})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if returnedState != state {
+		t.Errorf("got state %q, want %q", returnedState, state)
+	}
+
+	identity, err := provider.Exchange(ctx, code, verifier, nonce)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Provider != "test" || identity.Subject != "user-1" || identity.Email != "reader@example.com" || !identity.EmailVerified {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	if _, err := provider.Exchange(ctx, code, verifier, nonce); err == nil {
+		t.Error("Exchange redeemed the same code twice")
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	issuer, provider := newIssuer(t)
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", "the-real-verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, _, err := issuer.Authorize(authURL, jwt.MapClaims{"sub": "user-1"})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	if _, err := provider.Exchange(ctx, code, "a-stolen-code-without-verifier", "nonce"); err == nil {
+		t.Fatal("Exchange succeeded with the wrong code verifier")
+	}
+}
+
+func TestExchangeRejectsWrongNonce(t *testing.T) {
+	issuer, provider := newIssuer(t)
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce-of-this-login", "verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, _, err := issuer.Authorize(authURL, jwt.MapClaims{"sub": "user-1"})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	if _, err := provider.Exchange(ctx, code, "verifier", "nonce-of-another-login"); err == nil {
+		t.Fatal("Exchange accepted an ID token for another login")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer, provider := newIssuer(t)
+	ctx := context.Background()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		edit  func(jwt.MapClaims)
+		key   *rsa.PrivateKey
+		nonce string
+		ok    bool
+	}{
+		{name: "valid", ok: true},
+		{name: "signed by another key", key: otherKey},
+		{name: "other audience", edit: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "several audiences without azp", edit: func(c jwt.MapClaims) { c["aud"] = []string{issuer.ClientID, "another-client"} }},
+		{name: "several audiences with azp", ok: true, edit: func(c jwt.MapClaims) {
+			c["aud"] = []string{issuer.ClientID, "another-client"}
+			c["azp"] = issuer.ClientID
+		}},
+		{name: "other issuer", edit: func(c jwt.MapClaims) { c["iss"] = "https://attacker.example" }},
+		{name: "expired", edit: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "expired within leeway", ok: true, edit: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() }},
+		{name: "no expiry", edit: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "other nonce", nonce: "another-nonce"},
+		{name: "no nonce", edit: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "no subject", edit: func(c jwt.MapClaims) { delete(c, "sub") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := issuer.Claims("user-1", "the-nonce")
+			if tt.edit != nil {
+				tt.edit(claims)
+			}
+
+			key := issuer.Key
+			if tt.key != nil {
+				key = tt.key
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = issuer.KeyID
+			raw, err := token.SignedString(key)
+			if err != nil {
+				t.Fatalf("failed to sign token: %v", err)
+			}
+
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = "the-nonce"
+			}
+			identity, err := provider.VerifyIDToken(ctx, raw, nonce)
+			if tt.ok && err != nil {
+				t.Fatalf("rejected a valid token: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("accepted an invalid token: %+v", identity)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsUnsignedToken(t *testing.T) {
+	issuer, provider := newIssuer(t)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, issuer.Claims("user-1", "the-nonce"))
+	raw, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("failed to build token: %v", err)
+	}
+
+	if _, err := provider.VerifyIDToken(context.Background(), raw, "the-nonce"); err == nil {
+		t.Fatal("accepted an unsigned token")
+	}
+}
+
+func TestVerifyIDTokenEmailVerified(t *testing.T) {
+	issuer, provider := newIssuer(t)
+
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		verified bool
+	}{
+		{name: "boolean", claims: jwt.MapClaims{"email": "a@example.com", "email_verified": true}, verified: true},
+		{name: "string", claims: jwt.MapClaims{"email": "a@example.com", "email_verified": "true"}, verified: true},
+		{name: "unverified", claims: jwt.MapClaims{"email": "a@example.com", "email_verified": false}},
+		{name: "missing", claims: jwt.MapClaims{"email": "a@example.com"}},
+		{name: "no email", claims: jwt.MapClaims{"email_verified": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := issuer.Claims("user-1", "the-nonce")
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			raw, err := issuer.Sign(claims)
+			if err != nil {
+				t.Fatalf("failed to sign token: %v", err)
+			}
+
+			identity, err := provider.VerifyIDToken(context.Background(), raw, "the-nonce")
+			if err != nil {
+				t.Fatalf("VerifyIDToken: %v", err)
+			}
+			if identity.EmailVerified != tt.verified {
+				t.Errorf("got email verified %v, want %v", identity.EmailVerified, tt.verified)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// FakeProvider is a deterministic in-process payment provider. It never talks
+// to the network, hands out sequential IDs, and can produce webhook
+// deliveries signed with its webhook secret so the full purchase, tip and
+// cashout flows can be exercised offline.
+type FakeProvider struct {
+	mu            sync.Mutex
+	webhookSecret string
+	seq           int
+	idempotent    map[string]interface{}
+	failTransfer  string
+
+	// IDPrefix is embedded in every generated ID, "fake" by default
+	IDPrefix string
+
+	PaymentIntents map[string]*FakePaymentIntent
+	Transfers      []Transfer
+	reversedCents  map[string]int64 // By transfer ID
+	Refunds        []Refund
+	Accounts       []ConnectedAccount
+}
+
+// FakePaymentIntent is a payment intent held by the fake provider
+type FakePaymentIntent struct {
+	PaymentIntent
+	Currency      string
+	Metadata      map[string]string
+	ChargeID      string
+	RefundedCents int64
+	Status        stripe.PaymentIntentStatus
+}
+
+// WebhookDelivery is a webhook request body with its Stripe-Signature header
+type WebhookDelivery struct {
+	Payload   []byte
+	Signature string
+}
+
+// NewFakeProvider returns a fake provider that signs webhooks with secret
+func NewFakeProvider(webhookSecret string) *FakeProvider {
+	return &FakeProvider{
+		webhookSecret:  webhookSecret,
+		IDPrefix:       "fake",
+		idempotent:     make(map[string]interface{}),
+		PaymentIntents: make(map[string]*FakePaymentIntent),
+		reversedCents:  make(map[string]int64),
+	}
+}
+
+// nextID returns a sequential ID with the given prefix. The caller must hold mu.
+func (p *FakeProvider) nextID(prefix string) string {
+	p.seq++
+	return fmt.Sprintf("%s_%s_%06d", prefix, p.IDPrefix, p.seq)
+}
+
+// CreatePaymentIntent records a payment intent awaiting confirmation
+func (p *FakeProvider) CreatePaymentIntent(params PaymentIntentParams) (*PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prev, ok := p.idempotent[params.IdempotencyKey].(*PaymentIntent); ok {
+		return prev, nil
+	}
+
+	id := p.nextID("pi")
+	pi := &FakePaymentIntent{
+		PaymentIntent: PaymentIntent{
+			ID:           id,
+			ClientSecret: id + "_secret_fake",
+			AmountCents:  params.AmountCents,
+		},
+		Currency: params.Currency,
+		Metadata: params.Metadata,
+		ChargeID: p.nextID("ch"),
+		Status:   stripe.PaymentIntentStatusRequiresPaymentMethod,
+	}
+	p.PaymentIntents[id] = pi
+
+	result := pi.PaymentIntent
+	if params.IdempotencyKey != "" {
+		p.idempotent[params.IdempotencyKey] = &result
+	}
+	return &result, nil
+}
+
+// FailNextTransfer makes the next CreateTransfer call fail with a rejection
+func (p *FakeProvider) FailNextTransfer(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failTransfer = reason
+}
+
+// CreateTransfer records a payout to a connected account
+func (p *FakeProvider) CreateTransfer(params TransferParams) (*Transfer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prev, ok := p.idempotent[params.IdempotencyKey].(*Transfer); ok {
+		return prev, nil
+	}
+
+	if p.failTransfer != "" {
+		reason := p.failTransfer
+		p.failTransfer = ""
+		return nil, fmt.Errorf("%w: %s", ErrRejected, reason)
+	}
+
+	tr := Transfer{ID: p.nextID("tr"), AmountCents: params.AmountCents}
+	p.Transfers = append(p.Transfers, tr)
+
+	if params.IdempotencyKey != "" {
+		p.idempotent[params.IdempotencyKey] = &tr
+	}
+	return &tr, nil
+}
+
+// CreateRefund refunds a succeeded fake payment intent
+func (p *FakeProvider) CreateRefund(params RefundParams) (*Refund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prev, ok := p.idempotent[params.IdempotencyKey].(*Refund); ok {
+		return prev, nil
+	}
+
+	pi, ok := p.PaymentIntents[params.PaymentIntentID]
+	if !ok {
+		return nil, fmt.Errorf("%w: no such payment intent %s", ErrRejected, params.PaymentIntentID)
+	}
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, fmt.Errorf("%w: payment intent %s has not succeeded", ErrRejected, pi.ID)
+	}
+
+	amount := params.AmountCents
+	if amount == 0 {
+		amount = pi.AmountCents - pi.RefundedCents
+	}
+	if amount <= 0 || pi.RefundedCents+amount > pi.AmountCents {
+		return nil, fmt.Errorf("%w: refund exceeds remaining amount", ErrRejected)
+	}
+	pi.RefundedCents += amount
+
+	r := Refund{ID: p.nextID("re"), AmountCents: amount, Status: string(stripe.RefundStatusSucceeded)}
+	p.Refunds = append(p.Refunds, r)
+
+	if params.IdempotencyKey != "" {
+		p.idempotent[params.IdempotencyKey] = &r
+	}
+	return &r, nil
+}
+
+// CreateConnectedAccount records a connected account
+func (p *FakeProvider) CreateConnectedAccount(params ConnectedAccountParams) (*ConnectedAccount, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prev, ok := p.idempotent[params.IdempotencyKey].(*ConnectedAccount); ok {
+		return prev, nil
+	}
+
+	acct := ConnectedAccount{ID: p.nextID("acct")}
+	p.Accounts = append(p.Accounts, acct)
+
+	if params.IdempotencyKey != "" {
+		p.idempotent[params.IdempotencyKey] = &acct
+	}
+	return &acct, nil
+}
+
+// CreateAccountLink returns a placeholder onboarding link
+func (p *FakeProvider) CreateAccountLink(params AccountLinkParams) (*AccountLink, error) {
+	return &AccountLink{
+		URL:       "https://connect.fake.invalid/onboarding/" + params.AccountID,
+		ExpiresAt: time.Now().Add(5 * time.Minute).Unix(),
+	}, nil
+}
+
+// VerifyWebhook checks a delivery signed by this provider
+func (p *FakeProvider) VerifyWebhook(payload []byte, signature string) (stripe.Event, error) {
+	return verifyWebhook(payload, signature, []string{p.webhookSecret})
+}
+
+// Event builds a signed webhook delivery of eventType carrying object
+func (p *FakeProvider) Event(eventType stripe.EventType, object interface{}) (*WebhookDelivery, error) {
+	p.mu.Lock()
+	id := p.nextID("evt")
+	p.mu.Unlock()
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          id,
+		"object":      "event",
+		"type":        eventType,
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"data":        map[string]interface{}{"object": object},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  p.webhookSecret,
+	})
+	return &WebhookDelivery{Payload: signed.Payload, Signature: signed.Header}, nil
+}
+
+// SucceedPaymentIntent confirms a payment intent and returns its
+// payment_intent.succeeded delivery
+func (p *FakeProvider) SucceedPaymentIntent(id string) (*WebhookDelivery, error) {
+	return p.paymentIntentEvent(id, stripe.PaymentIntentStatusSucceeded, stripe.EventTypePaymentIntentSucceeded)
+}
+
+// FailPaymentIntent declines a payment intent and returns its
+// payment_intent.payment_failed delivery
+func (p *FakeProvider) FailPaymentIntent(id string) (*WebhookDelivery, error) {
+	return p.paymentIntentEvent(id, stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.EventTypePaymentIntentPaymentFailed)
+}
+
+// CancelPaymentIntent cancels a payment intent and returns its
+// payment_intent.canceled delivery
+func (p *FakeProvider) CancelPaymentIntent(id string) (*WebhookDelivery, error) {
+	return p.paymentIntentEvent(id, stripe.PaymentIntentStatusCanceled, stripe.EventTypePaymentIntentCanceled)
+}
+
+func (p *FakeProvider) paymentIntentEvent(id string, status stripe.PaymentIntentStatus, eventType stripe.EventType) (*WebhookDelivery, error) {
+	p.mu.Lock()
+	pi, ok := p.PaymentIntents[id]
+	if !ok {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("no such payment intent %s", id)
+	}
+	pi.Status = status
+	object := map[string]interface{}{
+		"id":       pi.ID,
+		"object":   "payment_intent",
+		"amount":   pi.AmountCents,
+		"currency": pi.Currency,
+		"metadata": pi.Metadata,
+		"status":   pi.Status,
+	}
+	p.mu.Unlock()
+
+	return p.Event(eventType, object)
+}
+
+// ChargeRefunded returns the charge.refunded delivery reflecting all refunds
+// issued so far for a payment intent
+func (p *FakeProvider) ChargeRefunded(paymentIntentID string) (*WebhookDelivery, error) {
+	p.mu.Lock()
+	pi, ok := p.PaymentIntents[paymentIntentID]
+	if !ok {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("no such payment intent %s", paymentIntentID)
+	}
+	object := map[string]interface{}{
+		"id":              pi.ChargeID,
+		"object":          "charge",
+		"amount":          pi.AmountCents,
+		"amount_refunded": pi.RefundedCents,
+		"refunded":        pi.RefundedCents == pi.AmountCents,
+		"payment_intent":  pi.ID,
+	}
+	p.mu.Unlock()
+
+	return p.Event(stripe.EventTypeChargeRefunded, object)
+}
+
+// ReverseTransfer reverses amountCents of a transfer and returns the
+// transfer.reversed delivery reflecting all reversals so far
+func (p *FakeProvider) ReverseTransfer(transferID string, amountCents int64) (*WebhookDelivery, error) {
+	p.mu.Lock()
+	var tr *Transfer
+	for i := range p.Transfers {
+		if p.Transfers[i].ID == transferID {
+			tr = &p.Transfers[i]
+		}
+	}
+	if tr == nil {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("no such transfer %s", transferID)
+	}
+	reversed := p.reversedCents[transferID] + amountCents
+	if amountCents <= 0 || reversed > tr.AmountCents {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("reversal exceeds the remaining amount of transfer %s", transferID)
+	}
+	p.reversedCents[transferID] = reversed
+	object := map[string]interface{}{
+		"id":              tr.ID,
+		"object":          "transfer",
+		"amount":          tr.AmountCents,
+		"amount_reversed": reversed,
+		"reversed":        reversed == tr.AmountCents,
+	}
+	p.mu.Unlock()
+
+	return p.Event(stripe.EventTypeTransferReversed, object)
+}
+
+// AccountUpdated returns the account.updated delivery for a connected account
+func (p *FakeProvider) AccountUpdated(accountID string, payoutsEnabled bool) (*WebhookDelivery, error) {
+	return p.Event(stripe.EventTypeAccountUpdated, map[string]interface{}{
+		"id":                accountID,
+		"object":            "account",
+		"details_submitted": payoutsEnabled,
+		"payouts_enabled":   payoutsEnabled,
+	})
+}
+
+// DisputeCreated opens a dispute for amountCents of a payment intent and
+// returns its charge.dispute.created delivery
+func (p *FakeProvider) DisputeCreated(paymentIntentID string, amountCents int64) (*WebhookDelivery, error) {
+	p.mu.Lock()
+	pi, ok := p.PaymentIntents[paymentIntentID]
+	if !ok {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("no such payment intent %s", paymentIntentID)
+	}
+	object := map[string]interface{}{
+		"id":             p.nextID("dp"),
+		"object":         "dispute",
+		"amount":         amountCents,
+		"charge":         pi.ChargeID,
+		"payment_intent": pi.ID,
+		"reason":         stripe.DisputeReasonFraudulent,
+		"status":         stripe.DisputeStatusNeedsResponse,
+	}
+	p.mu.Unlock()
+
+	return p.Event(stripe.EventTypeChargeDisputeCreated, object)
+}
+
+// DisputeClosed returns the charge.dispute.closed delivery for a dispute
+// with its final status
+func (p *FakeProvider) DisputeClosed(disputeID, paymentIntentID string, amountCents int64, status stripe.DisputeStatus) (*WebhookDelivery, error) {
+	return p.Event(stripe.EventTypeChargeDisputeClosed, map[string]interface{}{
+		"id":             disputeID,
+		"object":         "dispute",
+		"amount":         amountCents,
+		"payment_intent": paymentIntentID,
+		"status":         status,
+	})
+}
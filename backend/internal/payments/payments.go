@@ -0,0 +1,136 @@
+// Package payments hides the payment processor behind the Provider interface
+// so the purchase, tip and cashout flows can run against Stripe in production
+// and against the in-process fake provider in local development and tests.
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// ErrRejected is wrapped by provider errors where the processor definitively
+// refused the request, as opposed to network errors where the outcome is
+// unknown and the request may be retried with the same idempotency key.
+var ErrRejected = errors.New("payments: request rejected")
+
+// Default is the provider used by the handlers. It is set by Init.
+var Default Provider
+
+// Provider is the set of payment processor operations the platform uses.
+// Webhook events are represented as Stripe events regardless of provider.
+type Provider interface {
+	CreatePaymentIntent(params PaymentIntentParams) (*PaymentIntent, error)
+	CreateTransfer(params TransferParams) (*Transfer, error)
+	CreateRefund(params RefundParams) (*Refund, error)
+	CreateConnectedAccount(params ConnectedAccountParams) (*ConnectedAccount, error)
+	CreateAccountLink(params AccountLinkParams) (*AccountLink, error)
+	VerifyWebhook(payload []byte, signature string) (stripe.Event, error)
+}
+
+// PaymentIntentParams describes a customer payment to collect
+type PaymentIntentParams struct {
+	AmountCents    int64
+	Currency       string
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+// PaymentIntent is a payment the customer completes on the client
+type PaymentIntent struct {
+	ID           string
+	ClientSecret string
+	AmountCents  int64
+}
+
+// TransferParams describes a payout to a connected account
+type TransferParams struct {
+	AmountCents          int64
+	Currency             string
+	DestinationAccountID string
+	TransferGroup        string
+	Metadata             map[string]string
+	IdempotencyKey       string
+}
+
+// Transfer is a completed payout to a connected account
+type Transfer struct {
+	ID          string
+	AmountCents int64
+}
+
+// RefundParams describes a refund of a payment intent. A zero AmountCents
+// refunds the remaining amount.
+type RefundParams struct {
+	PaymentIntentID string
+	AmountCents     int64
+	Reason          string
+	Metadata        map[string]string
+	IdempotencyKey  string
+}
+
+// Refund is a refund issued to the customer
+type Refund struct {
+	ID          string
+	AmountCents int64
+	Status      string
+}
+
+// ConnectedAccountParams describes an author account to create for payouts
+type ConnectedAccountParams struct {
+	Email          string
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+// ConnectedAccount is an account that can receive transfers
+type ConnectedAccount struct {
+	ID string
+}
+
+// AccountLinkParams describes a hosted onboarding link for a connected account
+type AccountLinkParams struct {
+	AccountID  string
+	RefreshURL string
+	ReturnURL  string
+}
+
+// AccountLink is a hosted onboarding link
+type AccountLink struct {
+	URL       string
+	ExpiresAt int64
+}
+
+// Init selects the payment provider from the PAYMENT_PROVIDER environment
+// variable ("stripe" by default, or "fake") and stores it in Default. The fake
+// provider is refused in production and without a webhook secret, since
+// anyone who can sign its webhooks can mint tokens.
+func Init() error {
+	webhookSecrets := []string{os.Getenv("STRIPE_WEBHOOK_SECRET")}
+	if connectSecret := os.Getenv("STRIPE_CONNECT_WEBHOOK_SECRET"); connectSecret != "" {
+		webhookSecrets = append(webhookSecrets, connectSecret)
+	}
+
+	switch provider := os.Getenv("PAYMENT_PROVIDER"); provider {
+	case "", "stripe":
+		Default = NewStripeProvider(os.Getenv("STRIPE_SECRET_KEY"), webhookSecrets...)
+	case "fake":
+		if os.Getenv("ENV") == "production" || os.Getenv("GIN_MODE") == "release" {
+			return errors.New("the fake payment provider cannot be used in production")
+		}
+		if webhookSecrets[0] == "" {
+			return errors.New("STRIPE_WEBHOOK_SECRET must be set to use the fake payment provider")
+		}
+		// Namespace the IDs per process so a restarted dev server does not
+		// reuse event IDs that are already stored
+		fake := NewFakeProvider(webhookSecrets[0])
+		fake.IDPrefix = fmt.Sprintf("fake%d", time.Now().Unix())
+		Default = fake
+	default:
+		return fmt.Errorf("unknown payment provider %q", provider)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package payments_test
+
+import (
+	"testing"
+
+	"fdip/internal/payments"
+)
+
+func TestInitFakeProvider(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{name: "with a secret", env: map[string]string{"STRIPE_WEBHOOK_SECRET": "whsec_dev"}, ok: true},
+		{name: "without a secret"},
+		{name: "in production", env: map[string]string{"STRIPE_WEBHOOK_SECRET": "whsec_dev", "ENV": "production"}},
+		{name: "in release mode", env: map[string]string{"STRIPE_WEBHOOK_SECRET": "whsec_dev", "GIN_MODE": "release"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"ENV", "GIN_MODE", "STRIPE_WEBHOOK_SECRET", "STRIPE_CONNECT_WEBHOOK_SECRET"} {
+				t.Setenv(key, tt.env[key])
+			}
+			t.Setenv("PAYMENT_PROVIDER", "fake")
+
+			prev := payments.Default
+			t.Cleanup(func() { payments.Default = prev })
+
+			err := payments.Init()
+			if tt.ok && err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("Init accepted the fake provider")
+			}
+		})
+	}
+}
+
+func TestFakeProviderRejectsOtherSecret(t *testing.T) {
+	signer := payments.NewFakeProvider("whsec_attacker")
+	delivery, err := signer.AccountUpdated("acct_test", true)
+	if err != nil {
+		t.Fatalf("failed to build delivery: %v", err)
+	}
+
+	provider := payments.NewFakeProvider("whsec_server")
+	if _, err := provider.VerifyWebhook(delivery.Payload, delivery.Signature); err == nil {
+		t.Fatal("accepted a webhook signed with another secret")
+	}
+}
@@ -0,0 +1,160 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/account"
+	"github.com/stripe/stripe-go/v76/accountlink"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+	"github.com/stripe/stripe-go/v76/transfer"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// StripeProvider talks to the Stripe API
+type StripeProvider struct {
+	webhookSecrets []string
+}
+
+// NewStripeProvider sets the global Stripe API key and returns a provider that
+// accepts webhooks signed with any of the given secrets
+func NewStripeProvider(secretKey string, webhookSecrets ...string) *StripeProvider {
+	stripe.Key = secretKey
+	return &StripeProvider{webhookSecrets: webhookSecrets}
+}
+
+// CreatePaymentIntent creates a Stripe payment intent
+func (p *StripeProvider) CreatePaymentIntent(params PaymentIntentParams) (*PaymentIntent, error) {
+	piParams := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(params.AmountCents),
+		Currency: stripe.String(params.Currency),
+		Metadata: params.Metadata,
+	}
+	setIdempotencyKey(&piParams.Params, params.IdempotencyKey)
+
+	pi, err := paymentintent.New(piParams)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &PaymentIntent{ID: pi.ID, ClientSecret: pi.ClientSecret, AmountCents: pi.Amount}, nil
+}
+
+// CreateTransfer creates a Stripe transfer to a connected account
+func (p *StripeProvider) CreateTransfer(params TransferParams) (*Transfer, error) {
+	trParams := &stripe.TransferParams{
+		Amount:      stripe.Int64(params.AmountCents),
+		Currency:    stripe.String(params.Currency),
+		Destination: stripe.String(params.DestinationAccountID),
+		Metadata:    params.Metadata,
+	}
+	if params.TransferGroup != "" {
+		trParams.TransferGroup = stripe.String(params.TransferGroup)
+	}
+	setIdempotencyKey(&trParams.Params, params.IdempotencyKey)
+
+	tr, err := transfer.New(trParams)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &Transfer{ID: tr.ID, AmountCents: tr.Amount}, nil
+}
+
+// CreateRefund refunds all or part of a Stripe payment intent
+func (p *StripeProvider) CreateRefund(params RefundParams) (*Refund, error) {
+	refundParams := &stripe.RefundParams{
+		PaymentIntent: stripe.String(params.PaymentIntentID),
+		Metadata:      params.Metadata,
+	}
+	if params.AmountCents > 0 {
+		refundParams.Amount = stripe.Int64(params.AmountCents)
+	}
+	if params.Reason != "" {
+		refundParams.Reason = stripe.String(params.Reason)
+	}
+	setIdempotencyKey(&refundParams.Params, params.IdempotencyKey)
+
+	r, err := refund.New(refundParams)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &Refund{ID: r.ID, AmountCents: r.Amount, Status: string(r.Status)}, nil
+}
+
+// CreateConnectedAccount creates a Stripe Connect Express account that can
+// receive transfers
+func (p *StripeProvider) CreateConnectedAccount(params ConnectedAccountParams) (*ConnectedAccount, error) {
+	acctParams := &stripe.AccountParams{
+		Type:  stripe.String(string(stripe.AccountTypeExpress)),
+		Email: stripe.String(params.Email),
+		Capabilities: &stripe.AccountCapabilitiesParams{
+			Transfers: &stripe.AccountCapabilitiesTransfersParams{
+				Requested: stripe.Bool(true),
+			},
+		},
+		Metadata: params.Metadata,
+	}
+	setIdempotencyKey(&acctParams.Params, params.IdempotencyKey)
+
+	acct, err := account.New(acctParams)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &ConnectedAccount{ID: acct.ID}, nil
+}
+
+// CreateAccountLink creates a Stripe hosted onboarding link
+func (p *StripeProvider) CreateAccountLink(params AccountLinkParams) (*AccountLink, error) {
+	link, err := accountlink.New(&stripe.AccountLinkParams{
+		Account:    stripe.String(params.AccountID),
+		RefreshURL: stripe.String(params.RefreshURL),
+		ReturnURL:  stripe.String(params.ReturnURL),
+		Type:       stripe.String(string(stripe.AccountLinkTypeAccountOnboarding)),
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &AccountLink{URL: link.URL, ExpiresAt: link.ExpiresAt}, nil
+}
+
+// VerifyWebhook checks the Stripe-Signature header against each configured
+// webhook secret and returns the parsed event
+func (p *StripeProvider) VerifyWebhook(payload []byte, signature string) (stripe.Event, error) {
+	return verifyWebhook(payload, signature, p.webhookSecrets)
+}
+
+func verifyWebhook(payload []byte, signature string, secrets []string) (stripe.Event, error) {
+	options := webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	}
+
+	err := errors.New("no webhook secret configured")
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		var event stripe.Event
+		event, err = webhook.ConstructEventWithOptions(payload, signature, secret, options)
+		if err == nil {
+			return event, nil
+		}
+	}
+	return stripe.Event{}, err
+}
+
+func setIdempotencyKey(params *stripe.Params, key string) {
+	if key != "" {
+		params.SetIdempotencyKey(key)
+	}
+}
+
+// wrapError marks errors where Stripe answered with a client error as
+// rejections
+func wrapError(err error) error {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode >= 400 && stripeErr.HTTPStatusCode < 500 {
+		return fmt.Errorf("%w: %s", ErrRejected, stripeErr.Msg)
+	}
+	return err
+}
@@ -0,0 +1,327 @@
+// Package payout decides the rate authors are paid when they cash out tokens.
+// Rates come from versioned tier rules stored in the database rather than
+// code, and a per-author override can pin a rate for special arrangements.
+package payout
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EarningsWindow is the trailing period whose earnings count towards a tier
+const EarningsWindow = 90 * 24 * time.Hour
+
+// MaxRate is the highest rate a tier or override may pay, the same cap the
+// built-in rates had
+const MaxRate = models.MaxPayoutRate
+
+var (
+	ErrNoActiveRules   = errors.New("no active payout rules")
+	ErrRuleSetNotFound = errors.New("payout rule set not found")
+)
+
+// Metrics are the author statistics tiers are evaluated against
+type Metrics struct {
+	Earnings90d    int `json:"earnings_90d"`
+	Followers      int `json:"followers"`
+	AccountAgeDays int `json:"account_age_days"`
+}
+
+// NextTier is the cheapest tier above the current rate and what is still
+// missing to reach it. Thresholds already met are zero in Needs.
+type NextTier struct {
+	Tier  models.PayoutTier `json:"tier"`
+	Needs Metrics           `json:"needs"`
+}
+
+// Quote is the rate an author would be paid right now and how it was decided
+type Quote struct {
+	RuleVersion int                        `json:"rule_version"`
+	Tier        *models.PayoutTier         `json:"tier"`
+	Rate        float64                    `json:"rate"`
+	Override    *models.PayoutRateOverride `json:"override,omitempty"`
+	Metrics     Metrics                    `json:"metrics"`
+	Next        *NextTier                  `json:"next,omitempty"`
+}
+
+// ActiveRuleSet returns the rule set currently used for cashouts
+func ActiveRuleSet(db *gorm.DB) (*models.PayoutRuleSet, error) {
+	var rules models.PayoutRuleSet
+	err := db.Preload("Tiers").Where("is_active = ?", true).First(&rules).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNoActiveRules
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// LoadMetrics gathers the statistics of an author as of now
+func LoadMetrics(db *gorm.DB, user *models.User, now time.Time) (Metrics, error) {
+	earned, err := ledger.Earnings(db, user.ID, now.Add(-EarningsWindow))
+	if err != nil {
+		return Metrics{}, fmt.Errorf("failed to sum earnings: %w", err)
+	}
+
+	followers, err := models.GetFollowerCount(db, user.ID)
+	if err != nil {
+		return Metrics{}, fmt.Errorf("failed to count followers: %w", err)
+	}
+
+	return Metrics{
+		Earnings90d:    earned,
+		Followers:      int(followers),
+		AccountAgeDays: int(now.Sub(user.CreatedAt).Hours() / 24),
+	}, nil
+}
+
+// Evaluate returns the best paying tier whose thresholds are all met and the
+// next tier the author could reach
+func Evaluate(rules *models.PayoutRuleSet, metrics Metrics) (*models.PayoutTier, *NextTier) {
+	var current *models.PayoutTier
+	for i := range rules.Tiers {
+		tier := &rules.Tiers[i]
+		if qualifies(tier, metrics) && (current == nil || tier.Rate > current.Rate) {
+			current = tier
+		}
+	}
+
+	var next *models.PayoutTier
+	for i := range rules.Tiers {
+		tier := &rules.Tiers[i]
+		if current != nil && tier.Rate <= current.Rate {
+			continue
+		}
+		if next == nil || tier.Rate < next.Rate {
+			next = tier
+		}
+	}
+
+	if next == nil {
+		return current, nil
+	}
+	return current, &NextTier{
+		Tier: *next,
+		Needs: Metrics{
+			Earnings90d:    shortOf(next.MinEarnings90d, metrics.Earnings90d),
+			Followers:      shortOf(next.MinFollowers, metrics.Followers),
+			AccountAgeDays: shortOf(next.MinAccountAgeDays, metrics.AccountAgeDays),
+		},
+	}
+}
+
+// QuoteFor prices a cashout for an author under the active rules. An active
+// override replaces the tier rate, but the tier is still reported.
+func QuoteFor(db *gorm.DB, user *models.User) (*Quote, error) {
+	rules, err := ActiveRuleSet(db)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	metrics, err := LoadMetrics(db, user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	tier, next := Evaluate(rules, metrics)
+	if tier == nil {
+		return nil, fmt.Errorf("payout rules version %d have no tier for user %d", rules.Version, user.ID)
+	}
+
+	quote := &Quote{
+		RuleVersion: rules.Version,
+		Tier:        tier,
+		Rate:        tier.Rate,
+		Metrics:     metrics,
+		Next:        next,
+	}
+
+	override, err := ActiveOverride(db, user.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if override != nil {
+		quote.Override = override
+		quote.Rate = override.Rate
+	}
+
+	return quote, nil
+}
+
+// ActiveOverride returns the override currently applying to a user, if any
+func ActiveOverride(db *gorm.DB, userID uint, now time.Time) (*models.PayoutRateOverride, error) {
+	var override models.PayoutRateOverride
+	err := db.Where("user_id = ? AND revoked_at IS NULL", userID).
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Order("created_at DESC").
+		First(&override).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+// ValidateTiers checks a set of tiers before it is published. There must be a
+// tier without thresholds so every author has a rate.
+func ValidateTiers(tiers []models.PayoutTier) error {
+	if len(tiers) == 0 {
+		return errors.New("at least one tier is required")
+	}
+
+	names := make(map[string]bool)
+	hasBase := false
+	for _, tier := range tiers {
+		if tier.Name == "" {
+			return errors.New("every tier needs a name")
+		}
+		if names[tier.Name] {
+			return fmt.Errorf("duplicate tier name %q", tier.Name)
+		}
+		names[tier.Name] = true
+
+		if err := ValidateRate(tier.Rate); err != nil {
+			return fmt.Errorf("tier %q: %w", tier.Name, err)
+		}
+		if tier.MinEarnings90d < 0 || tier.MinFollowers < 0 || tier.MinAccountAgeDays < 0 {
+			return fmt.Errorf("tier %q: thresholds cannot be negative", tier.Name)
+		}
+		if tier.MinEarnings90d == 0 && tier.MinFollowers == 0 && tier.MinAccountAgeDays == 0 {
+			hasBase = true
+		}
+	}
+
+	if !hasBase {
+		return errors.New("a base tier without thresholds is required")
+	}
+	return nil
+}
+
+// ValidateRate checks that a payout rate is positive and at most MaxRate
+func ValidateRate(rate float64) error {
+	if rate <= 0 || rate > MaxRate {
+		return fmt.Errorf("rate must be greater than 0 and at most %.2f", MaxRate)
+	}
+	return nil
+}
+
+// Publish stores tiers as the next rule set version, activating it if asked
+func Publish(tx *gorm.DB, tiers []models.PayoutTier, notes string, createdByID *uint, activate bool) (*models.PayoutRuleSet, error) {
+	if err := ValidateTiers(tiers); err != nil {
+		return nil, err
+	}
+
+	// Lock the newest version so concurrent publishes get distinct numbers
+	var latest models.PayoutRuleSet
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("version DESC").First(&latest).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	rules := models.PayoutRuleSet{
+		Version:     latest.Version + 1,
+		Notes:       notes,
+		CreatedByID: createdByID,
+	}
+	for _, tier := range tiers {
+		tier.ID = 0
+		tier.RuleSetID = 0
+		rules.Tiers = append(rules.Tiers, tier)
+	}
+	if err := tx.Create(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	if activate {
+		if err := Activate(tx, rules.Version); err != nil {
+			return nil, err
+		}
+		return loadVersion(tx, rules.Version)
+	}
+	return &rules, nil
+}
+
+// Activate makes a rule set version the one used for cashouts
+func Activate(tx *gorm.DB, version int) error {
+	var rules models.PayoutRuleSet
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("version = ?", version).First(&rules).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrRuleSetNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(&models.PayoutRuleSet{}).
+		Where("is_active = ? AND id <> ?", true, rules.ID).
+		Update("is_active", false).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return tx.Model(&rules).Updates(map[string]interface{}{
+		"is_active":    true,
+		"activated_at": &now,
+	}).Error
+}
+
+// EnsureDefault publishes the original hardcoded rates as version 1 when no
+// rule set exists yet
+func EnsureDefault(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&models.PayoutRuleSet{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// The built-in rates needed more than 1000 tokens and more than 100
+	// followers, while tier thresholds are minimums
+	tiers := []models.PayoutTier{
+		{Name: "Standard", Rate: models.MinPayoutRate},
+		{Name: "Established", Rate: models.MinPayoutRate + 0.10, MinEarnings90d: 1001},
+		{Name: "Popular", Rate: models.MinPayoutRate + 0.10, MinFollowers: 101},
+		{Name: "Partner", Rate: models.MinPayoutRate + 0.20, MinEarnings90d: 1001, MinFollowers: 101},
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		_, err := Publish(tx, tiers, "Initial tiers carried over from the built-in payout rates", nil, true)
+		return err
+	})
+}
+
+func loadVersion(db *gorm.DB, version int) (*models.PayoutRuleSet, error) {
+	var rules models.PayoutRuleSet
+	err := db.Preload("Tiers").Where("version = ?", version).First(&rules).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRuleSetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+func qualifies(tier *models.PayoutTier, metrics Metrics) bool {
+	return metrics.Earnings90d >= tier.MinEarnings90d &&
+		metrics.Followers >= tier.MinFollowers &&
+		metrics.AccountAgeDays >= tier.MinAccountAgeDays
+}
+
+func shortOf(threshold, value int) int {
+	if value >= threshold {
+		return 0
+	}
+	return threshold - value
+}
@@ -0,0 +1,178 @@
+package payout
+
+import (
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// testTiers is a rule set with a base tier, two tiers with one threshold
+// each and one with both
+func testTiers() *models.PayoutRuleSet {
+	return &models.PayoutRuleSet{
+		Version: 1,
+		Tiers: []models.PayoutTier{
+			{Name: "Standard", Rate: 0.60},
+			{Name: "Established", Rate: 0.70, MinEarnings90d: 1001},
+			{Name: "Veteran", Rate: 0.65, MinAccountAgeDays: 365},
+			{Name: "Partner", Rate: 0.80, MinEarnings90d: 1001, MinFollowers: 101},
+		},
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics Metrics
+		tier    string
+		next    string
+		needs   Metrics
+	}{
+		{name: "new author", tier: "Standard", next: "Veteran", needs: Metrics{AccountAgeDays: 365}},
+		{name: "threshold is a minimum", metrics: Metrics{Earnings90d: 1001}, tier: "Established", next: "Partner", needs: Metrics{Followers: 101}},
+		{name: "just below a threshold", metrics: Metrics{Earnings90d: 1000, AccountAgeDays: 365}, tier: "Veteran", next: "Established", needs: Metrics{Earnings90d: 1}},
+		{name: "best of several tiers", metrics: Metrics{Earnings90d: 2000, AccountAgeDays: 400}, tier: "Established", next: "Partner", needs: Metrics{Followers: 101}},
+		{name: "every threshold of a tier", metrics: Metrics{Earnings90d: 1001, Followers: 101}, tier: "Partner"},
+		{name: "one threshold of a tier", metrics: Metrics{Followers: 500}, tier: "Standard", next: "Veteran", needs: Metrics{AccountAgeDays: 365}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tier, next := Evaluate(testTiers(), tt.metrics)
+			if tier == nil || tier.Name != tt.tier {
+				t.Fatalf("got tier %v, want %s", tier, tt.tier)
+			}
+			if tt.next == "" {
+				if next != nil {
+					t.Errorf("got next tier %s, want none", next.Tier.Name)
+				}
+				return
+			}
+			if next == nil || next.Tier.Name != tt.next {
+				t.Fatalf("got next tier %v, want %s", next, tt.next)
+			}
+			if next.Needs != tt.needs {
+				t.Errorf("got needs %+v, want %+v", next.Needs, tt.needs)
+			}
+		})
+	}
+}
+
+func TestEvaluateWithoutBaseTier(t *testing.T) {
+	rules := &models.PayoutRuleSet{Tiers: []models.PayoutTier{{Name: "Established", Rate: 0.70, MinEarnings90d: 1001}}}
+
+	tier, next := Evaluate(rules, Metrics{Earnings90d: 10})
+	if tier != nil {
+		t.Errorf("got tier %s, want none", tier.Name)
+	}
+	if next == nil || next.Needs.Earnings90d != 991 {
+		t.Errorf("got next tier %+v, want Established needing 991 tokens", next)
+	}
+}
+
+func TestValidateTiers(t *testing.T) {
+	tests := []struct {
+		name  string
+		tiers []models.PayoutTier
+		ok    bool
+	}{
+		{name: "valid", tiers: testTiers().Tiers, ok: true},
+		{name: "no tiers"},
+		{name: "no base tier", tiers: []models.PayoutTier{{Name: "Established", Rate: 0.70, MinEarnings90d: 1}}},
+		{name: "unnamed tier", tiers: []models.PayoutTier{{Rate: 0.60}}},
+		{name: "duplicate name", tiers: []models.PayoutTier{{Name: "Standard", Rate: 0.60}, {Name: "Standard", Rate: 0.70, MinFollowers: 1}}},
+		{name: "rate above the cap", tiers: []models.PayoutTier{{Name: "Standard", Rate: MaxRate + 0.01}}},
+		{name: "rate at the cap", tiers: []models.PayoutTier{{Name: "Standard", Rate: MaxRate}}, ok: true},
+		{name: "zero rate", tiers: []models.PayoutTier{{Name: "Standard"}}},
+		{name: "negative threshold", tiers: []models.PayoutTier{{Name: "Standard", Rate: 0.60}, {Name: "Odd", Rate: 0.70, MinFollowers: -1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTiers(tt.tiers)
+			if tt.ok && err != nil {
+				t.Fatalf("rejected valid tiers: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("accepted invalid tiers")
+			}
+		})
+	}
+}
+
+func TestQuoteForOverride(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		override *models.PayoutRateOverride
+		rate     float64
+	}{
+		{name: "no override", rate: 0.70},
+		{name: "active override", override: &models.PayoutRateOverride{Rate: 0.85}, rate: 0.85},
+		{name: "override until later", override: &models.PayoutRateOverride{Rate: 0.85, ExpiresAt: &future}, rate: 0.85},
+		{name: "expired override", override: &models.PayoutRateOverride{Rate: 0.85, ExpiresAt: &past}, rate: 0.70},
+		{name: "revoked override", override: &models.PayoutRateOverride{Rate: 0.85, RevokedAt: &past}, rate: 0.70},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t,
+				&models.User{},
+				&models.UserFollow{},
+				&models.PayoutRuleSet{},
+				&models.PayoutTier{},
+				&models.PayoutRateOverride{},
+				&models.LedgerAccount{},
+				&models.JournalEntry{},
+				&models.Posting{},
+				&models.TokenBucket{},
+				&models.UserTokenBalance{},
+			)
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if _, err := Publish(tx, testTiers().Tiers, "", nil, true); err != nil {
+					return err
+				}
+				// Earnings only count when they come from readers
+				if _, err := ledger.Post(tx, ledger.Transfer(models.JournalKindPurchase, ledger.Stripe, ledger.User(2), 1500, nil)); err != nil {
+					return err
+				}
+				_, err := ledger.Post(tx, ledger.Transfer(models.JournalKindTip, ledger.User(2), ledger.User(1), 1500, nil))
+				return err
+			})
+			if err != nil {
+				t.Fatalf("failed to set up rules and earnings: %v", err)
+			}
+
+			author := models.User{ID: 1, CreatedAt: time.Now()}
+			if tt.override != nil {
+				tt.override.UserID = author.ID
+				tt.override.Reason = "test"
+				if err := db.Create(tt.override).Error; err != nil {
+					t.Fatalf("failed to create override: %v", err)
+				}
+			}
+
+			quote, err := QuoteFor(db, &author)
+			if err != nil {
+				t.Fatalf("QuoteFor: %v", err)
+			}
+			if quote.Tier.Name != "Established" || quote.Metrics.Earnings90d != 1500 {
+				t.Errorf("got tier %s for %d tokens earned, want Established for 1500", quote.Tier.Name, quote.Metrics.Earnings90d)
+			}
+			if quote.Rate != tt.rate {
+				t.Errorf("got rate %.2f, want %.2f", quote.Rate, tt.rate)
+			}
+			if (quote.Override != nil) != (tt.rate != quote.Tier.Rate) {
+				t.Errorf("override reported as %+v", quote.Override)
+			}
+		})
+	}
+}
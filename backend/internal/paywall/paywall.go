@@ -0,0 +1,127 @@
+// Package paywall sells access to premium chapters. Readers unlock a chapter
+// once with tokens, which are split between the book's owner and co-authors
+// by their revenue shares like a tip.
+package paywall
+
+import (
+	"errors"
+	"time"
+
+	"fdip/internal/ledger"
+	"fdip/internal/membership"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Limits on the premium settings of a chapter
+const (
+	MaxPriceTokens   = 1000
+	MaxFreeAfterDays = 3650
+)
+
+var (
+	ErrNotLocked     = errors.New("chapter is not locked")
+	ErrMember        = errors.New("members of a book can read its chapters without unlocking them")
+	ErrInvalidPrice  = errors.New("premium chapters must cost between 1 and 1000 tokens")
+	ErrInvalidPeriod = errors.New("free after must be between 1 and 3650 days")
+)
+
+// Validate checks the premium settings of a chapter
+func Validate(isPremium bool, priceTokens int, freeAfterDays *int) error {
+	if isPremium && (priceTokens < 1 || priceTokens > MaxPriceTokens) {
+		return ErrInvalidPrice
+	}
+	if freeAfterDays != nil && (*freeAfterDays < 1 || *freeAfterDays > MaxFreeAfterDays) {
+		return ErrInvalidPeriod
+	}
+	return nil
+}
+
+// Unlocked reports whether userID has unlocked a chapter
+func Unlocked(db *gorm.DB, userID, chapterID uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.ChapterUnlock{}).
+		Where("user_id = ? AND chapter_id = ?", userID, chapterID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// Unlock charges userID the price of a locked chapter and records the
+// unlock. Unlocking a chapter twice returns the first unlock without
+// charging again; created reports whether this call made it. It returns
+// ledger.ErrInsufficientFunds when the reader cannot afford the chapter.
+func Unlock(db *gorm.DB, userID uint, chapter *models.Chapter, now time.Time) (unlock *models.ChapterUnlock, created bool, err error) {
+	if _, err := membership.RoleOf(db, chapter.BookID, userID); err == nil {
+		return nil, false, ErrMember
+	} else if !errors.Is(err, membership.ErrNotMember) {
+		return nil, false, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		unlock = &models.ChapterUnlock{
+			UserID:      userID,
+			ChapterID:   chapter.ID,
+			PriceTokens: chapter.PriceTokens,
+		}
+		// The unique index makes a concurrent unlock of the same chapter wait
+		// here, then find the row
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(unlock)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return tx.Where("user_id = ? AND chapter_id = ?", userID, chapter.ID).First(unlock).Error
+		}
+		created = true
+
+		if !chapter.IsLocked(now) {
+			return ErrNotLocked
+		}
+		shares, err := membership.Split(tx, chapter.BookID, chapter.PriceTokens)
+		if err != nil {
+			return err
+		}
+
+		readerTransaction := models.TokenTransaction{
+			UserID:          userID,
+			TransactionType: models.TransactionTypeUnlock,
+			Amount:          -chapter.PriceTokens, // Negative for debit
+			ChapterID:       &chapter.ID,
+			Status:          models.TransactionStatusCompleted,
+		}
+		if err := tx.Create(&readerTransaction).Error; err != nil {
+			return err
+		}
+
+		entry := ledger.Entry{
+			Kind:          models.JournalKindUnlock,
+			TransactionID: &readerTransaction.ID,
+			Lines:         []ledger.Line{{Account: ledger.User(userID), Amount: -chapter.PriceTokens}},
+		}
+		for _, share := range shares {
+			authorTransaction := models.TokenTransaction{
+				UserID:          share.UserID,
+				TransactionType: models.TransactionTypeUnlock,
+				Amount:          share.Amount, // Positive for credit
+				RecipientID:     &userID,
+				ChapterID:       &chapter.ID,
+				Status:          models.TransactionStatusCompleted,
+			}
+			if err := tx.Create(&authorTransaction).Error; err != nil {
+				return err
+			}
+			entry.Lines = append(entry.Lines, ledger.Line{Account: ledger.User(share.UserID), Amount: share.Amount})
+		}
+		if _, err := ledger.Post(tx, entry); err != nil {
+			return err
+		}
+
+		return tx.Model(unlock).Update("transaction_id", readerTransaction.ID).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return unlock, created, nil
+}
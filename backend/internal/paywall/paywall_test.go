@@ -0,0 +1,178 @@
+package paywall
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	owner    = 1
+	coAuthor = 2
+	reader   = 3
+)
+
+// openBook returns a database holding book 1, owned by user 1 with a 70%
+// share and co-written by user 2 with 30%, and a reader holding balance
+// tokens
+func openBook(t *testing.T, balance int) *gorm.DB {
+	t.Helper()
+
+	db := dbtest.Open(t,
+		&models.BookMember{},
+		&models.ChapterUnlock{},
+		&models.TokenTransaction{},
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.Posting{},
+		&models.TokenBucket{},
+		&models.UserTokenBalance{},
+	)
+	members := []models.BookMember{
+		{BookID: 1, UserID: owner, Role: models.BookRoleOwner, RevenueShare: 70},
+		{BookID: 1, UserID: coAuthor, Role: models.BookRoleCoAuthor, RevenueShare: 30},
+	}
+	if err := db.Create(&members).Error; err != nil {
+		t.Fatalf("failed to create members: %v", err)
+	}
+	if balance > 0 {
+		if _, err := ledger.Post(db, ledger.Transfer(models.JournalKindPurchase, ledger.Stripe, ledger.User(reader), balance, nil)); err != nil {
+			t.Fatalf("failed to fund the reader: %v", err)
+		}
+	}
+	return db
+}
+
+// lockedChapter is a premium chapter of book 1
+func lockedChapter(price int) *models.Chapter {
+	return &models.Chapter{ID: 10, BookID: 1, IsPremium: true, PriceTokens: price}
+}
+
+func balanceOf(t *testing.T, db *gorm.DB, userID uint) int {
+	t.Helper()
+	balance, err := ledger.Balance(db, ledger.User(userID))
+	if err != nil {
+		t.Fatalf("Balance: %v", err)
+	}
+	return balance
+}
+
+func countUnlocks(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(&models.ChapterUnlock{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count unlocks: %v", err)
+	}
+	return count
+}
+
+func TestUnlockSplitsThePrice(t *testing.T) {
+	tests := []struct {
+		price           int
+		owner, coAuthor int
+	}{
+		{price: 10, owner: 7, coAuthor: 3},
+		{price: 7, owner: 5, coAuthor: 2},
+		{price: 1, owner: 1},
+	}
+
+	for _, tt := range tests {
+		db := openBook(t, 100)
+
+		unlock, created, err := Unlock(db, reader, lockedChapter(tt.price), time.Now())
+		if err != nil {
+			t.Fatalf("price %d: Unlock: %v", tt.price, err)
+		}
+		if !created || unlock.PriceTokens != tt.price || unlock.TransactionID == nil {
+			t.Errorf("price %d: got unlock %+v created %v", tt.price, unlock, created)
+		}
+
+		got := map[uint]int{reader: balanceOf(t, db, reader), owner: balanceOf(t, db, owner), coAuthor: balanceOf(t, db, coAuthor)}
+		want := map[uint]int{reader: 100 - tt.price, owner: tt.owner, coAuthor: tt.coAuthor}
+		if got[reader] != want[reader] || got[owner] != want[owner] || got[coAuthor] != want[coAuthor] {
+			t.Errorf("price %d: got balances %v, want %v", tt.price, got, want)
+		}
+		if got[owner]+got[coAuthor] != tt.price {
+			t.Errorf("price %d: shares add up to %d", tt.price, got[owner]+got[coAuthor])
+		}
+	}
+}
+
+func TestUnlockTwiceChargesOnce(t *testing.T) {
+	db := openBook(t, 100)
+	chapter := lockedChapter(10)
+
+	first, created, err := Unlock(db, reader, chapter, time.Now())
+	if err != nil || !created {
+		t.Fatalf("first unlock: created %v, error %v", created, err)
+	}
+	second, created, err := Unlock(db, reader, chapter, time.Now())
+	if err != nil {
+		t.Fatalf("second unlock: %v", err)
+	}
+	if created || second.ID != first.ID {
+		t.Errorf("got unlock %d created %v, want the first unlock %d", second.ID, created, first.ID)
+	}
+	if balance := balanceOf(t, db, reader); balance != 90 {
+		t.Errorf("got balance %d, want 90", balance)
+	}
+
+	var transactions int64
+	if err := db.Model(&models.TokenTransaction{}).Where("user_id = ?", reader).Count(&transactions).Error; err != nil {
+		t.Fatalf("failed to count transactions: %v", err)
+	}
+	if transactions != 1 {
+		t.Errorf("got %d reader transactions, want 1", transactions)
+	}
+}
+
+func TestUnlockFailuresLeaveNoUnlock(t *testing.T) {
+	published := time.Now().Add(-48 * time.Hour)
+	oneDay := 1
+	free := &models.Chapter{ID: 10, BookID: 1}
+	expired := &models.Chapter{ID: 10, BookID: 1, IsPremium: true, PriceTokens: 10, PublishedAt: &published, FreeAfterDays: &oneDay}
+
+	tests := []struct {
+		name    string
+		userID  uint
+		balance int
+		chapter *models.Chapter
+		err     error
+	}{
+		{name: "free chapter", userID: reader, balance: 100, chapter: free, err: ErrNotLocked},
+		{name: "free after its period", userID: reader, balance: 100, chapter: expired, err: ErrNotLocked},
+		{name: "owner", userID: owner, balance: 100, chapter: lockedChapter(10), err: ErrMember},
+		{name: "co-author", userID: coAuthor, balance: 100, chapter: lockedChapter(10), err: ErrMember},
+		{name: "insufficient funds", userID: reader, balance: 9, chapter: lockedChapter(10), err: ledger.ErrInsufficientFunds},
+		{name: "no tokens", userID: reader, chapter: lockedChapter(10), err: ledger.ErrInsufficientFunds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openBook(t, tt.balance)
+
+			unlock, created, err := Unlock(db, tt.userID, tt.chapter, time.Now())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if unlock != nil || created {
+				t.Errorf("got unlock %+v created %v, want none", unlock, created)
+			}
+			if count := countUnlocks(t, db); count != 0 {
+				t.Errorf("got %d unlock rows, want none", count)
+			}
+			if balance := balanceOf(t, db, reader); balance != tt.balance {
+				t.Errorf("got reader balance %d, want %d", balance, tt.balance)
+			}
+			if balance := balanceOf(t, db, owner); balance != 0 {
+				t.Errorf("got owner balance %d, want 0", balance)
+			}
+		})
+	}
+}
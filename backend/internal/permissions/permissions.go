@@ -0,0 +1,200 @@
+// Package permissions resolves what a user may do from the permissions
+// granted to their role, and manages roles and grants. Every change to a
+// role, a grant or the role a user holds is written to the permission audit
+// log.
+package permissions
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// cacheTTL bounds how long another API instance can act on permissions that
+// have since changed
+const cacheTTL = 30 * time.Second
+
+// Definition describes a permission
+type Definition struct {
+	Name        models.Permission `json:"name"`
+	Description string            `json:"description"`
+}
+
+// Catalog lists every permission the platform checks
+var Catalog = []Definition{
+	{models.PermBooksWrite, "Create and edit your own books and chapters"},
+	{models.PermBooksPublish, "Publish your own books and chapters"},
+	{models.PermContentModerate, "View, edit, unpublish and delete any book or chapter"},
+	{models.PermPayoutsReceive, "Set up payouts and cash out earned tokens"},
+	{models.PermPayoutsApprove, "Retry failed payouts and review held cashouts"},
+	{models.PermPayoutsManage, "Manage payout tiers and per-user payout rates"},
+	{models.PermRefundsIssue, "Refund token purchases"},
+	{models.PermDisputesView, "View payment disputes"},
+	{models.PermUsersReview, "Clear the flag on accounts under review"},
+	{models.PermUsersPromote, "Promote readers to authors"},
+	{models.PermRolesManage, "Create roles, change their permissions and assign them to users"},
+	{models.PermLedgerRebuild, "Rebuild token balances from the ledger"},
+	{models.PermWebhooksManage, "View and replay payment webhooks"},
+	{models.PermAuditView, "View the permission audit log"},
+	{models.PermPricingManage, "Manage token bundles, promotions and promo codes"},
+}
+
+// systemRoles are created on startup with their default permissions. The
+// admin role always holds every permission.
+var systemRoles = []struct {
+	Name        models.UserRole
+	Description string
+	Defaults    []models.Permission
+}{
+	{models.RoleReader, "Reads and tips", nil},
+	{models.RoleAuthor, "Writes and publishes books and earns from tips", []models.Permission{
+		models.PermBooksWrite, models.PermBooksPublish, models.PermPayoutsReceive,
+	}},
+	{models.RoleModerator, "Moderates content and reviews flagged accounts", []models.Permission{
+		models.PermContentModerate, models.PermUsersReview,
+	}},
+	{models.RoleFinance, "Handles payouts, refunds and disputes", []models.Permission{
+		models.PermPayoutsApprove, models.PermPayoutsManage, models.PermRefundsIssue,
+		models.PermDisputesView, models.PermUsersReview, models.PermLedgerRebuild,
+		models.PermWebhooksManage, models.PermAuditView, models.PermPricingManage,
+	}},
+	{models.RoleAdmin, "Full access", nil},
+}
+
+// Set is the permissions a role holds
+type Set map[models.Permission]bool
+
+// Has reports whether the set holds perm
+func (s Set) Has(perm models.Permission) bool {
+	return s[perm]
+}
+
+// List returns the permissions in the set sorted by name
+func (s Set) List() []models.Permission {
+	list := make([]models.Permission, 0, len(s))
+	for perm := range s {
+		list = append(list, perm)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+type cachedSet struct {
+	set     Set
+	expires time.Time
+}
+
+var cache = struct {
+	sync.Mutex
+	roles map[models.UserRole]cachedSet
+}{roles: map[models.UserRole]cachedSet{}}
+
+// Known reports whether perm is in the catalog
+func Known(perm models.Permission) bool {
+	for _, d := range Catalog {
+		if d.Name == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// For returns the permissions held by role. Unknown roles hold none.
+func For(db *gorm.DB, role models.UserRole) (Set, error) {
+	now := time.Now()
+
+	cache.Lock()
+	cached, ok := cache.roles[role]
+	cache.Unlock()
+	if ok && cached.expires.After(now) {
+		return cached.set, nil
+	}
+
+	set := Set{}
+	if role == models.RoleAdmin {
+		for _, d := range Catalog {
+			set[d.Name] = true
+		}
+	} else {
+		var perms []models.Permission
+		if err := db.Model(&models.RolePermission{}).
+			Joins("JOIN roles ON roles.id = role_permissions.role_id").
+			Where("roles.name = ?", role).
+			Pluck("role_permissions.permission", &perms).Error; err != nil {
+			return nil, err
+		}
+		for _, perm := range perms {
+			set[perm] = true
+		}
+	}
+
+	cache.Lock()
+	cache.roles[role] = cachedSet{set: set, expires: now.Add(cacheTTL)}
+	cache.Unlock()
+	return set, nil
+}
+
+// Has reports whether user's role holds perm
+func Has(db *gorm.DB, user *models.User, perm models.Permission) (bool, error) {
+	set, err := For(db, user.Role)
+	if err != nil {
+		return false, err
+	}
+	return set.Has(perm), nil
+}
+
+// Invalidate drops the cached permissions of role
+func Invalidate(role models.UserRole) {
+	cache.Lock()
+	delete(cache.roles, role)
+	cache.Unlock()
+}
+
+// EnsureDefaults creates missing system roles and grants their default
+// permissions. Each default is granted only once, so defaults an admin has
+// revoked stay revoked.
+func EnsureDefaults(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, sr := range systemRoles {
+			var role models.Role
+			err := tx.Where("name = ?", sr.Name).First(&role).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				role = models.Role{Name: sr.Name, Description: sr.Description, IsSystem: true}
+				if err := tx.Create(&role).Error; err != nil {
+					return fmt.Errorf("failed to create role %s: %w", sr.Name, err)
+				}
+				if err := audit(tx, models.PermissionAudit{Action: models.AuditRoleCreated, Role: sr.Name}); err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+
+			for _, perm := range sr.Defaults {
+				var seeded int64
+				if err := tx.Model(&models.PermissionSeed{}).
+					Where("role = ? AND permission = ?", sr.Name, perm).
+					Count(&seeded).Error; err != nil {
+					return err
+				}
+				if seeded > 0 {
+					continue
+				}
+
+				if err := grant(tx, nil, &role, perm, ""); err != nil {
+					return err
+				}
+				if err := tx.Create(&models.PermissionSeed{Role: sr.Name, Permission: perm}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
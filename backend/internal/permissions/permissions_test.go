@@ -0,0 +1,261 @@
+package permissions
+
+import (
+	"errors"
+	"testing"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// openRoles returns a database holding the system roles, with the permission
+// cache emptied so no set is carried over from another test
+func openRoles(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	cache.Lock()
+	cache.roles = map[models.UserRole]cachedSet{}
+	cache.Unlock()
+
+	db := dbtest.Open(t,
+		&models.User{},
+		&models.Role{},
+		&models.RolePermission{},
+		&models.PermissionSeed{},
+		&models.PermissionAudit{},
+	)
+	if err := EnsureDefaults(db); err != nil {
+		t.Fatalf("EnsureDefaults: %v", err)
+	}
+	return db
+}
+
+func has(t *testing.T, db *gorm.DB, role models.UserRole, perm models.Permission) bool {
+	t.Helper()
+
+	set, err := For(db, role)
+	if err != nil {
+		t.Fatalf("For %s: %v", role, err)
+	}
+	return set.Has(perm)
+}
+
+func TestForSystemRoles(t *testing.T) {
+	db := openRoles(t)
+
+	tests := []struct {
+		role models.UserRole
+		perm models.Permission
+		want bool
+	}{
+		{role: models.RoleReader, perm: models.PermBooksWrite, want: false},
+		{role: models.RoleAuthor, perm: models.PermBooksPublish, want: true},
+		{role: models.RoleAuthor, perm: models.PermContentModerate, want: false},
+		{role: models.RoleModerator, perm: models.PermContentModerate, want: true},
+		{role: models.RoleModerator, perm: models.PermRefundsIssue, want: false},
+		{role: models.RoleFinance, perm: models.PermRefundsIssue, want: true},
+		{role: models.RoleFinance, perm: models.PermRolesManage, want: false},
+		{role: models.RoleAdmin, perm: models.PermRolesManage, want: true},
+		{role: "unknown", perm: models.PermBooksWrite, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := has(t, db, tt.role, tt.perm); got != tt.want {
+			t.Errorf("%s holds %s: got %v, want %v", tt.role, tt.perm, got, tt.want)
+		}
+	}
+
+	admin, err := For(db, models.RoleAdmin)
+	if err != nil {
+		t.Fatalf("For admin: %v", err)
+	}
+	if len(admin.List()) != len(Catalog) {
+		t.Errorf("admin holds %d permissions, want all %d", len(admin.List()), len(Catalog))
+	}
+}
+
+func TestEnsureDefaultsKeepsRevokedDefaults(t *testing.T) {
+	db := openRoles(t)
+
+	if err := Revoke(db, 1, models.RoleAuthor, models.PermBooksPublish, "test"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if err := EnsureDefaults(db); err != nil {
+		t.Fatalf("second EnsureDefaults: %v", err)
+	}
+	Invalidate(models.RoleAuthor)
+
+	if has(t, db, models.RoleAuthor, models.PermBooksPublish) {
+		t.Error("revoked default was granted again")
+	}
+	if !has(t, db, models.RoleAuthor, models.PermBooksWrite) {
+		t.Error("other defaults were lost")
+	}
+
+	var roles int64
+	db.Model(&models.Role{}).Count(&roles)
+	if roles != int64(len(systemRoles)) {
+		t.Errorf("got %d roles, want %d", roles, len(systemRoles))
+	}
+}
+
+func TestCreateRole(t *testing.T) {
+	tests := []struct {
+		name  models.UserRole
+		perms []models.Permission
+		want  error
+	}{
+		{name: "support", perms: []models.Permission{models.PermUsersReview}},
+		{name: "no", want: ErrInvalidRoleName},
+		{name: "Support", want: ErrInvalidRoleName},
+		{name: "support team", want: ErrInvalidRoleName},
+		{name: "support", perms: []models.Permission{"books.burn"}, want: ErrUnknownPermission},
+		{name: models.RoleModerator, want: ErrRoleExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			db := openRoles(t)
+
+			_, err := CreateRole(db, 1, tt.name, "", tt.perms)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			if !has(t, db, tt.name, models.PermUsersReview) {
+				t.Error("new role does not hold its permissions")
+			}
+		})
+	}
+}
+
+func TestGrantAndRevoke(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(db *gorm.DB) error
+		want   error
+	}{
+		{name: "grant to admin", change: func(db *gorm.DB) error {
+			return Grant(db, 1, models.RoleAdmin, models.PermBooksWrite, "")
+		}, want: ErrSystemRole},
+		{name: "revoke from admin", change: func(db *gorm.DB) error {
+			return Revoke(db, 1, models.RoleAdmin, models.PermBooksWrite, "")
+		}, want: ErrSystemRole},
+		{name: "grant unknown permission", change: func(db *gorm.DB) error {
+			return Grant(db, 1, models.RoleReader, "books.burn", "")
+		}, want: ErrUnknownPermission},
+		{name: "grant to unknown role", change: func(db *gorm.DB) error {
+			return Grant(db, 1, "ghost", models.PermBooksWrite, "")
+		}, want: ErrUnknownRole},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openRoles(t)
+			if err := tt.change(db); !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Changes apply at once on this instance and are audited once each
+	db := openRoles(t)
+	has(t, db, models.RoleReader, models.PermBooksWrite) // Fill the cache
+	for i := 0; i < 2; i++ {
+		if err := Grant(db, 1, models.RoleReader, models.PermBooksWrite, "beta"); err != nil {
+			t.Fatalf("Grant: %v", err)
+		}
+	}
+	if !has(t, db, models.RoleReader, models.PermBooksWrite) {
+		t.Error("granted permission is not held")
+	}
+	for i := 0; i < 2; i++ {
+		if err := Revoke(db, 1, models.RoleReader, models.PermBooksWrite, "beta over"); err != nil {
+			t.Fatalf("Revoke: %v", err)
+		}
+	}
+	if has(t, db, models.RoleReader, models.PermBooksWrite) {
+		t.Error("revoked permission is still held")
+	}
+
+	var entries []models.PermissionAudit
+	db.Where("role = ?", models.RoleReader).Order("id").Find(&entries)
+	if len(entries) != 3 || entries[1].Action != models.AuditPermissionGranted || entries[2].Action != models.AuditPermissionRevoked {
+		t.Errorf("got audit entries %+v, want the role's creation, one grant and one revoke", entries)
+	}
+}
+
+func TestDeleteRole(t *testing.T) {
+	db := openRoles(t)
+	for _, name := range []models.UserRole{"support", "editor"} {
+		if _, err := CreateRole(db, 1, name, "", nil); err != nil {
+			t.Fatalf("CreateRole %s: %v", name, err)
+		}
+	}
+	if err := db.Create(&models.User{Username: "editor", Email: "editor@example.com", PasswordHash: "x", Role: "editor"}).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	tests := []struct {
+		name models.UserRole
+		want error
+	}{
+		{name: models.RoleAuthor, want: ErrSystemRole},
+		{name: "editor", want: ErrRoleInUse},
+		{name: "ghost", want: ErrUnknownRole},
+		{name: "support"},
+	}
+
+	for _, tt := range tests {
+		if err := DeleteRole(db, 1, tt.name); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	var count int64
+	db.Model(&models.Role{}).Where("name = ?", "support").Count(&count)
+	if count != 0 {
+		t.Error("deleted role still exists")
+	}
+}
+
+func TestAssign(t *testing.T) {
+	db := openRoles(t)
+	user := models.User{Username: "reader", Email: "reader@example.com", PasswordHash: "x", Role: models.RoleReader}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if _, err := Assign(db, 1, user.ID, "ghost", ""); !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("unknown role: got error %v, want %v", err, ErrUnknownRole)
+	}
+
+	previous, err := Assign(db, 1, user.ID, models.RoleAuthor, "promoted")
+	if err != nil {
+		t.Fatalf("Assign: %v", err)
+	}
+	if previous != models.RoleReader {
+		t.Errorf("got previous role %s, want %s", previous, models.RoleReader)
+	}
+
+	// Assigning the role held already changes nothing
+	if _, err := Assign(db, 1, user.ID, models.RoleAuthor, ""); err != nil {
+		t.Fatalf("second Assign: %v", err)
+	}
+
+	var updated models.User
+	db.First(&updated, user.ID)
+	if updated.Role != models.RoleAuthor || updated.TokenVersion != user.TokenVersion+1 {
+		t.Errorf("got role %s and token version %d, want %s and %d", updated.Role, updated.TokenVersion, models.RoleAuthor, user.TokenVersion+1)
+	}
+
+	var assignments int64
+	db.Model(&models.PermissionAudit{}).Where("action = ? AND target_user_id = ?", models.AuditRoleAssigned, user.ID).Count(&assignments)
+	if assignments != 1 {
+		t.Errorf("got %d assignment audit entries, want 1", assignments)
+	}
+}
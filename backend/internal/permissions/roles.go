@@ -0,0 +1,237 @@
+package permissions
+
+import (
+	"errors"
+	"regexp"
+
+	"fdip/internal/auth"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrUnknownRole       = errors.New("unknown role")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrRoleExists        = errors.New("role already exists")
+	ErrInvalidRoleName   = errors.New("role names are 3-50 lowercase letters, digits, dashes or underscores")
+	ErrSystemRole        = errors.New("system roles cannot be deleted and the admin role always holds every permission")
+	ErrRoleInUse         = errors.New("role is assigned to users")
+)
+
+var roleName = regexp.MustCompile(`^[a-z0-9_-]{3,50}$`)
+
+// CreateRole creates a role holding perms
+func CreateRole(db *gorm.DB, actorID uint, name models.UserRole, description string, perms []models.Permission) (*models.Role, error) {
+	if !roleName.MatchString(string(name)) {
+		return nil, ErrInvalidRoleName
+	}
+	for _, perm := range perms {
+		if !Known(perm) {
+			return nil, ErrUnknownPermission
+		}
+	}
+
+	role := models.Role{Name: name, Description: description}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Role{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRoleExists
+		}
+
+		if err := tx.Create(&role).Error; err != nil {
+			return err
+		}
+		if err := audit(tx, models.PermissionAudit{ActorID: &actorID, Action: models.AuditRoleCreated, Role: name}); err != nil {
+			return err
+		}
+		for _, perm := range perms {
+			if err := grant(tx, &actorID, &role, perm, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	Invalidate(name)
+	return &role, nil
+}
+
+// DeleteRole deletes a role that is neither a system role nor assigned to
+// any user
+func DeleteRole(db *gorm.DB, actorID uint, name models.UserRole) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		role, err := lockRole(tx, name)
+		if err != nil {
+			return err
+		}
+		if role.IsSystem {
+			return ErrSystemRole
+		}
+
+		var holders int64
+		if err := tx.Model(&models.User{}).Where("role = ?", name).Count(&holders).Error; err != nil {
+			return err
+		}
+		if holders > 0 {
+			return ErrRoleInUse
+		}
+
+		if err := tx.Where("role_id = ?", role.ID).Delete(&models.RolePermission{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(role).Error; err != nil {
+			return err
+		}
+		return audit(tx, models.PermissionAudit{ActorID: &actorID, Action: models.AuditRoleDeleted, Role: name})
+	})
+	if err != nil {
+		return err
+	}
+
+	Invalidate(name)
+	return nil
+}
+
+// Grant gives perm to a role. Granting a permission the role already holds
+// does nothing.
+func Grant(db *gorm.DB, actorID uint, name models.UserRole, perm models.Permission, reason string) error {
+	if !Known(perm) {
+		return ErrUnknownPermission
+	}
+	if name == models.RoleAdmin {
+		return ErrSystemRole
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		role, err := lockRole(tx, name)
+		if err != nil {
+			return err
+		}
+		return grant(tx, &actorID, role, perm, reason)
+	})
+	if err != nil {
+		return err
+	}
+
+	Invalidate(name)
+	return nil
+}
+
+// Revoke takes perm away from a role. Revoking a permission the role does not
+// hold does nothing.
+func Revoke(db *gorm.DB, actorID uint, name models.UserRole, perm models.Permission, reason string) error {
+	if name == models.RoleAdmin {
+		return ErrSystemRole
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		role, err := lockRole(tx, name)
+		if err != nil {
+			return err
+		}
+
+		result := tx.Where("role_id = ? AND permission = ?", role.ID, perm).Delete(&models.RolePermission{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		return audit(tx, models.PermissionAudit{
+			ActorID:    &actorID,
+			Action:     models.AuditPermissionRevoked,
+			Role:       name,
+			Permission: &perm,
+			Reason:     reason,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	Invalidate(name)
+	return nil
+}
+
+// Assign gives a user a role and returns the role they held before. The
+// user's access tokens are invalidated so clients pick up the change. actorID
+// is the user's own ID for self-service changes.
+func Assign(db *gorm.DB, actorID uint, userID uint, name models.UserRole, reason string) (models.UserRole, error) {
+	var previous models.UserRole
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockRole(tx, name); err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+		previous = user.Role
+		if previous == name {
+			return nil
+		}
+
+		if err := tx.Model(&user).Update("role", name).Error; err != nil {
+			return err
+		}
+		if err := auth.InvalidateAccessTokens(tx, user.ID); err != nil {
+			return err
+		}
+		return audit(tx, models.PermissionAudit{
+			ActorID:      &actorID,
+			Action:       models.AuditRoleAssigned,
+			Role:         name,
+			TargetUserID: &user.ID,
+			PreviousRole: &previous,
+			Reason:       reason,
+		})
+	})
+	return previous, err
+}
+
+func grant(tx *gorm.DB, actorID *uint, role *models.Role, perm models.Permission, reason string) error {
+	var count int64
+	if err := tx.Model(&models.RolePermission{}).
+		Where("role_id = ? AND permission = ?", role.ID, perm).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if err := tx.Create(&models.RolePermission{RoleID: role.ID, Permission: perm}).Error; err != nil {
+		return err
+	}
+	return audit(tx, models.PermissionAudit{
+		ActorID:    actorID,
+		Action:     models.AuditPermissionGranted,
+		Role:       role.Name,
+		Permission: &perm,
+		Reason:     reason,
+	})
+}
+
+func lockRole(tx *gorm.DB, name models.UserRole) (*models.Role, error) {
+	var role models.Role
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUnknownRole
+		}
+		return nil, err
+	}
+	return &role, nil
+}
+
+func audit(tx *gorm.DB, entry models.PermissionAudit) error {
+	return tx.Create(&entry).Error
+}
@@ -0,0 +1,261 @@
+// Package pricing prices token purchases on the server: bundles from the
+// catalog or custom amounts at the base rate, plus the bonus tokens of the
+// best running promotion and of a promo code. The resulting quote is
+// recorded on the purchase transaction.
+package pricing
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MinCustomCents is the smallest custom purchase
+const MinCustomCents = 100
+
+// MaxBonusPercent bounds the bonus of a promotion or promo code
+const MaxBonusPercent = 500
+
+// reservationTTL is how long an unpaid purchase holds its promo code
+// redemption and first-purchase bonus. Abandoned payments release them
+// when it runs out.
+const reservationTTL = time.Hour
+
+var (
+	ErrBundleNotFound    = errors.New("token bundle not found")
+	ErrInvalidAmount     = errors.New("purchases must be at least $1.00")
+	ErrBundleAndAmount   = errors.New("choose a bundle or an amount, not both")
+	ErrCodeNotFound      = errors.New("promo code is not valid")
+	ErrCodeNotApplicable = errors.New("promo code does not apply to this purchase")
+	ErrCodeUsedUp        = errors.New("promo code has been fully redeemed")
+	ErrCodeUserLimit     = errors.New("you have already used this promo code")
+)
+
+// Request is what a reader asks to buy: a bundle, or a custom amount
+type Request struct {
+	BundleID    uint
+	AmountCents int64
+	Code        string
+}
+
+// Quote is the price of a purchase and the tokens it credits
+type Quote struct {
+	BundleID       *uint  `json:"bundle_id"`
+	PriceCents     int64  `json:"price_cents"`
+	BaseTokens     int    `json:"base_tokens"`
+	PromotionID    *uint  `json:"promotion_id"`
+	PromotionName  string `json:"promotion_name,omitempty"`
+	PromotionBonus int    `json:"promotion_bonus"`
+	PromoCodeID    *uint  `json:"promo_code_id"`
+	PromoCode      string `json:"promo_code,omitempty"`
+	CodeBonus      int    `json:"code_bonus"`
+	Tokens         int    `json:"tokens"` // Base tokens plus every bonus
+}
+
+// Bonus returns the bonus tokens in the quote
+func (q *Quote) Bonus() int {
+	return q.PromotionBonus + q.CodeBonus
+}
+
+// NormalizeCode returns the stored form of a promo code
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Price quotes a purchase for userID at now
+func Price(db *gorm.DB, userID uint, req Request, now time.Time) (*Quote, error) {
+	quote := &Quote{}
+	switch {
+	case req.BundleID != 0 && req.AmountCents != 0:
+		return nil, ErrBundleAndAmount
+	case req.BundleID != 0:
+		var bundle models.TokenBundle
+		if err := db.Where("id = ? AND is_active = ?", req.BundleID, true).First(&bundle).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrBundleNotFound
+			}
+			return nil, err
+		}
+		quote.BundleID = &bundle.ID
+		quote.PriceCents = bundle.PriceCents
+		quote.BaseTokens = bundle.Tokens
+	default:
+		if req.AmountCents < MinCustomCents {
+			return nil, ErrInvalidAmount
+		}
+		quote.PriceCents = req.AmountCents
+		quote.BaseTokens = int(req.AmountCents * models.TokensPerDollar / 100)
+	}
+
+	promotion, err := bestPromotion(db, userID, quote.BundleID, now)
+	if err != nil {
+		return nil, err
+	}
+	if promotion != nil {
+		quote.PromotionID = &promotion.ID
+		quote.PromotionName = promotion.Name
+		quote.PromotionBonus = quote.BaseTokens * promotion.BonusPercent / 100
+	}
+
+	if code := NormalizeCode(req.Code); code != "" {
+		promo, err := findCode(db, code, quote.BundleID, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLimits(db, promo, userID, now); err != nil {
+			return nil, err
+		}
+		quote.PromoCodeID = &promo.ID
+		quote.PromoCode = promo.Code
+		quote.CodeBonus = quote.BaseTokens*promo.BonusPercent/100 + promo.BonusTokens
+	}
+
+	quote.Tokens = quote.BaseTokens + quote.Bonus()
+	return quote, nil
+}
+
+// bestPromotion returns the running promotion with the largest bonus that a
+// purchase of bundleID by userID qualifies for, or nil
+func bestPromotion(db *gorm.DB, userID uint, bundleID *uint, now time.Time) (*models.Promotion, error) {
+	query := db.Where("is_active = ? AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)", true, now, now)
+	if bundleID != nil {
+		query = query.Where("bundle_id IS NULL OR bundle_id = ?", *bundleID)
+	} else {
+		query = query.Where("bundle_id IS NULL")
+	}
+	var promotions []models.Promotion
+	if err := query.Order("bonus_percent DESC, id").Find(&promotions).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range promotions {
+		if !promotions[i].FirstPurchaseOnly {
+			return &promotions[i], nil
+		}
+		first, err := isFirstPurchase(db, userID, now)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			return &promotions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// isFirstPurchase reports whether userID has neither a completed purchase
+// nor a recent unpaid one holding a first-purchase bonus
+func isFirstPurchase(db *gorm.DB, userID uint, now time.Time) (bool, error) {
+	var count int64
+	err := db.Model(&models.TokenTransaction{}).
+		Where("user_id = ? AND transaction_type = ?", userID, models.TransactionTypePurchase).
+		Where("status = ? OR (status = ? AND created_at > ? AND promotion_id IN (?))",
+			models.TransactionStatusCompleted, models.TransactionStatusPending, now.Add(-reservationTTL),
+			db.Model(&models.Promotion{}).Select("id").Where("first_purchase_only = ?", true)).
+		Count(&count).Error
+	return count == 0, err
+}
+
+// findCode loads a running promo code that applies to bundleID
+func findCode(db *gorm.DB, code string, bundleID *uint, now time.Time) (*models.PromoCode, error) {
+	var promo models.PromoCode
+	if err := db.Where("code = ?", code).First(&promo).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCodeNotFound
+		}
+		return nil, err
+	}
+	if !promo.IsRunning(now) {
+		return nil, ErrCodeNotFound
+	}
+	if promo.BundleID != nil && (bundleID == nil || *promo.BundleID != *bundleID) {
+		return nil, ErrCodeNotApplicable
+	}
+	return &promo, nil
+}
+
+// checkLimits checks that a promo code has redemptions left, overall and
+// for userID. Paid redemptions count, as do unpaid ones still reserved.
+func checkLimits(db *gorm.DB, promo *models.PromoCode, userID uint, now time.Time) error {
+	held := db.Model(&models.PromoRedemption{}).
+		Where("promo_code_id = ? AND (status = ? OR created_at > ?)", promo.ID, models.PromoRedemptionCompleted, now.Add(-reservationTTL))
+
+	if promo.MaxRedemptions != nil {
+		var total int64
+		if err := held.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			return err
+		}
+		if total >= int64(*promo.MaxRedemptions) {
+			return ErrCodeUsedUp
+		}
+	}
+	if promo.MaxPerUser > 0 {
+		var mine int64
+		if err := held.Session(&gorm.Session{}).Where("user_id = ?", userID).Count(&mine).Error; err != nil {
+			return err
+		}
+		if mine >= int64(promo.MaxPerUser) {
+			return ErrCodeUserLimit
+		}
+	}
+	return nil
+}
+
+// Reserve records a quote's promo code against a new purchase transaction.
+// It must be called inside a database transaction; the code's row is locked
+// and its limits checked again so concurrent purchases cannot overspend it.
+func Reserve(tx *gorm.DB, quote *Quote, userID, transactionID uint, now time.Time) error {
+	if quote.PromoCodeID == nil {
+		return nil
+	}
+
+	var promo models.PromoCode
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&promo, *quote.PromoCodeID).Error; err != nil {
+		return err
+	}
+	if !promo.IsRunning(now) {
+		return ErrCodeNotFound
+	}
+	if err := checkLimits(tx, &promo, userID, now); err != nil {
+		return err
+	}
+
+	return tx.Create(&models.PromoRedemption{
+		PromoCodeID:   promo.ID,
+		UserID:        userID,
+		TransactionID: transactionID,
+		Status:        models.PromoRedemptionPending,
+	}).Error
+}
+
+// Complete marks the promo code redemption of a paid purchase as completed.
+// A redemption whose reservation was released is recorded again: the
+// customer paid for the quoted tokens.
+func Complete(tx *gorm.DB, purchase *models.TokenTransaction) error {
+	if purchase.PromoCodeID == nil {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "transaction_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"status": models.PromoRedemptionCompleted}),
+	}).Create(&models.PromoRedemption{
+		PromoCodeID:   *purchase.PromoCodeID,
+		UserID:        purchase.UserID,
+		TransactionID: purchase.ID,
+		Status:        models.PromoRedemptionCompleted,
+	}).Error
+}
+
+// Release frees the promo code redemption of a cancelled purchase
+func Release(tx *gorm.DB, purchase *models.TokenTransaction) error {
+	if purchase.PromoCodeID == nil {
+		return nil
+	}
+	return tx.Where("transaction_id = ? AND status = ?", purchase.ID, models.PromoRedemptionPending).
+		Delete(&models.PromoRedemption{}).Error
+}
@@ -0,0 +1,296 @@
+package pricing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// openCatalog returns a database with an active $5 bundle of 50 tokens
+// (ID 1), an active $20 bundle of 220 tokens (ID 2) and an inactive bundle
+// (ID 3)
+func openCatalog(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db := dbtest.Open(t,
+		&models.TokenBundle{},
+		&models.Promotion{},
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+		&models.TokenTransaction{},
+	)
+	bundles := []models.TokenBundle{
+		{Name: "Small", PriceCents: 500, Tokens: 50, IsActive: true},
+		{Name: "Large", PriceCents: 2000, Tokens: 220, IsActive: true},
+		{Name: "Retired", PriceCents: 1000, Tokens: 100},
+	}
+	if err := db.Create(&bundles).Error; err != nil {
+		t.Fatalf("failed to create bundles: %v", err)
+	}
+	return db
+}
+
+func mustCreate(t *testing.T, db *gorm.DB, value interface{}) {
+	t.Helper()
+
+	if err := db.Create(value).Error; err != nil {
+		t.Fatalf("failed to create %T: %v", value, err)
+	}
+}
+
+func TestPrice(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    Request
+		price  int64
+		tokens int
+		want   error
+	}{
+		{name: "bundle", req: Request{BundleID: 2}, price: 2000, tokens: 220},
+		{name: "custom amount", req: Request{AmountCents: 1250}, price: 1250, tokens: 125},
+		{name: "smallest custom amount", req: Request{AmountCents: MinCustomCents}, price: MinCustomCents, tokens: 10},
+		{name: "custom amount too small", req: Request{AmountCents: MinCustomCents - 1}, want: ErrInvalidAmount},
+		{name: "nothing", want: ErrInvalidAmount},
+		{name: "bundle and amount", req: Request{BundleID: 1, AmountCents: 500}, want: ErrBundleAndAmount},
+		{name: "inactive bundle", req: Request{BundleID: 3}, want: ErrBundleNotFound},
+		{name: "unknown bundle", req: Request{BundleID: 9}, want: ErrBundleNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openCatalog(t)
+
+			quote, err := Price(db, 1, tt.req, time.Now())
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if quote.PriceCents != tt.price || quote.BaseTokens != tt.tokens || quote.Tokens != tt.tokens {
+				t.Errorf("got %d cents for %d tokens (%d base), want %d for %d", quote.PriceCents, quote.Tokens, quote.BaseTokens, tt.price, tt.tokens)
+			}
+		})
+	}
+}
+
+func TestPricePromotions(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+	large := uint(2)
+	welcome := uint(1) // The first promotion created
+
+	tests := []struct {
+		name       string
+		promotions []models.Promotion
+		purchases  []models.TokenTransaction // Earlier purchases by the user
+		req        Request
+		bonus      int
+		promotion  string
+	}{
+		{
+			name:       "best promotion",
+			promotions: []models.Promotion{{Name: "Ten", BonusPercent: 10, IsActive: true}, {Name: "Twenty", BonusPercent: 20, IsActive: true}},
+			req:        Request{AmountCents: 1000},
+			bonus:      20,
+			promotion:  "Twenty",
+		},
+		{
+			name:       "inactive, ended and future promotions",
+			promotions: []models.Promotion{{Name: "Off", BonusPercent: 50}, {Name: "Ended", BonusPercent: 50, IsActive: true, EndsAt: &earlier}, {Name: "Future", BonusPercent: 50, IsActive: true, StartsAt: later}},
+			req:        Request{AmountCents: 1000},
+		},
+		{
+			name:       "promotion for this bundle",
+			promotions: []models.Promotion{{Name: "Large", BonusPercent: 50, IsActive: true, BundleID: &large}},
+			req:        Request{BundleID: 2},
+			bonus:      110,
+			promotion:  "Large",
+		},
+		{
+			name:       "promotion for another bundle",
+			promotions: []models.Promotion{{Name: "Large", BonusPercent: 50, IsActive: true, BundleID: &large}},
+			req:        Request{BundleID: 1},
+		},
+		{
+			name:       "bundle promotion and a custom amount",
+			promotions: []models.Promotion{{Name: "Large", BonusPercent: 50, IsActive: true, BundleID: &large}},
+			req:        Request{AmountCents: 2000},
+		},
+		{
+			name:       "first purchase",
+			promotions: []models.Promotion{{Name: "Welcome", BonusPercent: 100, IsActive: true, FirstPurchaseOnly: true}, {Name: "Ten", BonusPercent: 10, IsActive: true}},
+			purchases:  []models.TokenTransaction{{Status: models.TransactionStatusFailed}},
+			req:        Request{AmountCents: 1000},
+			bonus:      100,
+			promotion:  "Welcome",
+		},
+		{
+			name:       "after a completed purchase",
+			promotions: []models.Promotion{{Name: "Welcome", BonusPercent: 100, IsActive: true, FirstPurchaseOnly: true}, {Name: "Ten", BonusPercent: 10, IsActive: true}},
+			purchases:  []models.TokenTransaction{{Status: models.TransactionStatusCompleted}},
+			req:        Request{AmountCents: 1000},
+			bonus:      10,
+			promotion:  "Ten",
+		},
+		{
+			name:       "while an unpaid purchase holds the first purchase bonus",
+			promotions: []models.Promotion{{Name: "Welcome", BonusPercent: 100, IsActive: true, FirstPurchaseOnly: true}},
+			purchases:  []models.TokenTransaction{{Status: models.TransactionStatusPending, PromotionID: &welcome}},
+			req:        Request{AmountCents: 1000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openCatalog(t)
+			for _, p := range tt.promotions {
+				if p.StartsAt.IsZero() {
+					p.StartsAt = earlier
+				}
+				mustCreate(t, db, &p)
+			}
+			for _, purchase := range tt.purchases {
+				purchase.UserID = 1
+				purchase.TransactionType = models.TransactionTypePurchase
+				purchase.Amount = 100
+				mustCreate(t, db, &purchase)
+			}
+
+			quote, err := Price(db, 1, tt.req, now)
+			if err != nil {
+				t.Fatalf("Price: %v", err)
+			}
+			if quote.PromotionBonus != tt.bonus || quote.PromotionName != tt.promotion {
+				t.Errorf("got %d bonus tokens from %q, want %d from %q", quote.PromotionBonus, quote.PromotionName, tt.bonus, tt.promotion)
+			}
+			if quote.Tokens != quote.BaseTokens+tt.bonus {
+				t.Errorf("got %d tokens, want %d", quote.Tokens, quote.BaseTokens+tt.bonus)
+			}
+		})
+	}
+}
+
+func TestPriceCodes(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+	large := uint(2)
+
+	tests := []struct {
+		name  string
+		code  models.PromoCode
+		req   Request
+		bonus int
+		want  error
+	}{
+		{name: "percent bonus", code: models.PromoCode{BonusPercent: 25}, req: Request{AmountCents: 1000, Code: "spring"}, bonus: 25},
+		{name: "tokens and percent", code: models.PromoCode{BonusPercent: 10, BonusTokens: 5}, req: Request{BundleID: 1, Code: " Spring "}, bonus: 10},
+		{name: "code for this bundle", code: models.PromoCode{BonusTokens: 30, BundleID: &large}, req: Request{BundleID: 2, Code: "SPRING"}, bonus: 30},
+		{name: "code for another bundle", code: models.PromoCode{BonusTokens: 30, BundleID: &large}, req: Request{BundleID: 1, Code: "SPRING"}, want: ErrCodeNotApplicable},
+		{name: "bundle code and a custom amount", code: models.PromoCode{BonusTokens: 30, BundleID: &large}, req: Request{AmountCents: 2000, Code: "SPRING"}, want: ErrCodeNotApplicable},
+		{name: "ended code", code: models.PromoCode{BonusTokens: 30, EndsAt: &earlier}, req: Request{AmountCents: 1000, Code: "SPRING"}, want: ErrCodeNotFound},
+		{name: "unknown code", code: models.PromoCode{BonusTokens: 30}, req: Request{AmountCents: 1000, Code: "AUTUMN"}, want: ErrCodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openCatalog(t)
+			tt.code.Code = "SPRING"
+			tt.code.IsActive = true
+			mustCreate(t, db, &tt.code)
+
+			quote, err := Price(db, 1, tt.req, now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if quote.CodeBonus != tt.bonus || quote.PromoCode != "SPRING" || quote.Tokens != quote.BaseTokens+tt.bonus {
+				t.Errorf("got %d bonus tokens from %q for %d tokens, want %d from SPRING", quote.CodeBonus, quote.PromoCode, quote.Tokens, tt.bonus)
+			}
+		})
+	}
+}
+
+func TestReserveLimits(t *testing.T) {
+	once := 1
+
+	tests := []struct {
+		name      string
+		code      models.PromoCode
+		otherUser bool          // The second purchase is by another user
+		after     time.Duration // How long after the first the second is reserved
+		// outcome settles the first purchase before the second is reserved
+		outcome func(tx *gorm.DB, purchase *models.TokenTransaction) error
+		want    error
+	}{
+		{name: "single-use code", code: models.PromoCode{MaxRedemptions: &once}, otherUser: true, want: ErrCodeUsedUp},
+		{name: "single-use code, paid", code: models.PromoCode{MaxRedemptions: &once}, otherUser: true, after: 2 * reservationTTL, outcome: Complete, want: ErrCodeUsedUp},
+		{name: "single-use code, released", code: models.PromoCode{MaxRedemptions: &once}, otherUser: true, outcome: Release},
+		{name: "single-use code, reservation lapsed", code: models.PromoCode{MaxRedemptions: &once}, otherUser: true, after: 2 * reservationTTL},
+		{name: "once per user", code: models.PromoCode{MaxPerUser: 1}, want: ErrCodeUserLimit},
+		{name: "once per user, another user", code: models.PromoCode{MaxPerUser: 1}, otherUser: true},
+		{name: "no limits", code: models.PromoCode{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openCatalog(t)
+			tt.code.Code = "SPRING"
+			tt.code.BonusTokens = 10
+			tt.code.IsActive = true
+			mustCreate(t, db, &tt.code)
+
+			now := time.Now()
+			req := Request{AmountCents: 1000, Code: "spring"}
+			second := uint(1)
+			if tt.otherUser {
+				second = 2
+			}
+
+			// Both quotes are given before either purchase is made, so the
+			// limits must hold when the second is reserved
+			first, err := Price(db, 1, req, now)
+			if err != nil {
+				t.Fatalf("first Price: %v", err)
+			}
+			secondQuote, err := Price(db, second, req, now)
+			if err != nil {
+				t.Fatalf("second Price: %v", err)
+			}
+
+			purchase := models.TokenTransaction{UserID: 1, TransactionType: models.TransactionTypePurchase, Amount: first.Tokens, PromoCodeID: first.PromoCodeID}
+			mustCreate(t, db, &purchase)
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				return Reserve(tx, first, 1, purchase.ID, now)
+			}); err != nil {
+				t.Fatalf("first Reserve: %v", err)
+			}
+			if tt.outcome != nil {
+				if err := tt.outcome(db, &purchase); err != nil {
+					t.Fatalf("failed to settle the first purchase: %v", err)
+				}
+			}
+
+			err = db.Transaction(func(tx *gorm.DB) error {
+				return Reserve(tx, secondQuote, second, purchase.ID+1, now.Add(tt.after))
+			})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("second Reserve: got error %v, want %v", err, tt.want)
+			}
+			// A new quote is refused for the same reason
+			if tt.want != nil {
+				if _, err := Price(db, second, req, now.Add(tt.after)); !errors.Is(err, tt.want) {
+					t.Errorf("new Price: got error %v, want %v", err, tt.want)
+				}
+			}
+		})
+	}
+}
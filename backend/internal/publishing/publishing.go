@@ -0,0 +1,177 @@
+// Package publishing publishes chapters and books at the time their authors
+// scheduled, and lists upcoming releases.
+package publishing
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"fdip/internal/membership"
+	"fdip/internal/models"
+	"fdip/internal/versions"
+
+	"gorm.io/gorm"
+)
+
+// batchSize bounds how many chapters and books one run publishes
+const batchSize = 100
+
+// MaxSchedule is how far ahead a release can be scheduled
+const MaxSchedule = 366 * 24 * time.Hour
+
+var (
+	ErrScheduleInPast = errors.New("publish_at must be in the future")
+	ErrScheduleTooFar = errors.New("publish_at must be within a year")
+)
+
+// ValidateSchedule checks that publishAt is a time a release can be
+// scheduled for
+func ValidateSchedule(publishAt time.Time) error {
+	now := time.Now()
+	if !publishAt.After(now) {
+		return ErrScheduleInPast
+	}
+	if publishAt.After(now.Add(MaxSchedule)) {
+		return ErrScheduleTooFar
+	}
+	return nil
+}
+
+// PublishDue publishes the chapters and books whose scheduled time has
+// passed. Each item is published with a conditional update, so an item is
+// published exactly once even if two runs overlap.
+func PublishDue(ctx context.Context, db *gorm.DB) error {
+	now := time.Now()
+
+	var chapterIDs []uint
+	if err := db.Model(&models.Chapter{}).
+		Where("is_published = ? AND publish_at IS NOT NULL AND publish_at <= ?", false, now).
+		Order("publish_at").Limit(batchSize).
+		Pluck("id", &chapterIDs).Error; err != nil {
+		return err
+	}
+	for _, id := range chapterIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		published, err := publishChapter(db, id, now)
+		if err != nil {
+			log.Printf("[PUBLISHING] Failed to publish chapter %d: %v", id, err)
+			continue
+		}
+		if published {
+			log.Printf("[PUBLISHING] Published scheduled chapter %d", id)
+		}
+	}
+
+	var bookIDs []uint
+	if err := db.Model(&models.Book{}).
+		Where("is_published = ? AND publish_at IS NOT NULL AND publish_at <= ?", false, now).
+		Order("publish_at").Limit(batchSize).
+		Pluck("id", &bookIDs).Error; err != nil {
+		return err
+	}
+	for _, id := range bookIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		result := db.Model(&models.Book{}).
+			Where("id = ? AND is_published = ? AND publish_at <= ?", id, false, now).
+			Updates(map[string]interface{}{"is_published": true, "publish_at": nil})
+		if result.Error != nil {
+			log.Printf("[PUBLISHING] Failed to publish book %d: %v", id, result.Error)
+			continue
+		}
+		if result.RowsAffected > 0 {
+			log.Printf("[PUBLISHING] Published scheduled book %d", id)
+		}
+	}
+	return nil
+}
+
+// publishChapter publishes a due chapter and records its version. It reports
+// false if the chapter was published or rescheduled in the meantime.
+func publishChapter(db *gorm.DB, id uint, now time.Time) (bool, error) {
+	published := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Chapter{}).
+			Where("id = ? AND is_published = ? AND publish_at <= ?", id, false, now).
+			Updates(map[string]interface{}{
+				"is_published": true,
+				"publish_at":   nil,
+				"published_at": gorm.Expr("COALESCE(published_at, ?)", now),
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		published = true
+
+		var chapter models.Chapter
+		if err := tx.First(&chapter, id).Error; err != nil {
+			return err
+		}
+		_, err := versions.Record(tx, &chapter, nil, models.VersionSourceSchedule, nil)
+		return err
+	})
+	return published && err == nil, err
+}
+
+// Release is a scheduled chapter or book
+type Release struct {
+	Type          string    `json:"type"` // "chapter" or "book"
+	ID            uint      `json:"id"`
+	BookID        uint      `json:"book_id"`
+	BookTitle     string    `json:"book_title"`
+	Title         string    `json:"title"`
+	ChapterNumber *uint     `json:"chapter_number,omitempty"`
+	PublishAt     time.Time `json:"publish_at"`
+}
+
+// Calendar lists the releases scheduled before until on the books userID is
+// a member of, soonest first
+func Calendar(db *gorm.DB, userID uint, until time.Time) ([]Release, error) {
+	bookIDs := membership.BookIDs(db, userID)
+
+	var chapters []models.Chapter
+	if err := db.Preload("Book").
+		Where("book_id IN (?) AND is_published = ? AND publish_at IS NOT NULL AND publish_at <= ?", bookIDs, false, until).
+		Find(&chapters).Error; err != nil {
+		return nil, err
+	}
+
+	var books []models.Book
+	if err := db.Where("id IN (?) AND is_published = ? AND publish_at IS NOT NULL AND publish_at <= ?", bookIDs, false, until).
+		Find(&books).Error; err != nil {
+		return nil, err
+	}
+
+	releases := make([]Release, 0, len(chapters)+len(books))
+	for i := range chapters {
+		chapter := &chapters[i]
+		releases = append(releases, Release{
+			Type:          "chapter",
+			ID:            chapter.ID,
+			BookID:        chapter.BookID,
+			BookTitle:     chapter.Book.Title,
+			Title:         chapter.Title,
+			ChapterNumber: &chapter.ChapterNumber,
+			PublishAt:     *chapter.PublishAt,
+		})
+	}
+	for _, book := range books {
+		releases = append(releases, Release{
+			Type:      "book",
+			ID:        book.ID,
+			BookID:    book.ID,
+			BookTitle: book.Title,
+			Title:     book.Title,
+			PublishAt: *book.PublishAt,
+		})
+	}
+
+	sort.SliceStable(releases, func(i, j int) bool { return releases[i].PublishAt.Before(releases[j].PublishAt) })
+	return releases, nil
+}
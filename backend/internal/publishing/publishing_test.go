@@ -0,0 +1,59 @@
+package publishing
+
+import (
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/models"
+)
+
+func TestPublishChapterPublishesOnce(t *testing.T) {
+	db := dbtest.Open(t, &models.Chapter{}, &models.ChapterVersion{})
+
+	now := time.Now()
+	due := now.Add(-time.Minute)
+	later := now.Add(time.Hour)
+	chapters := []models.Chapter{
+		{BookID: 1, Title: "Due", Content: "Text", PublishAt: &due},
+		{BookID: 1, Title: "Later", Content: "Text", PublishAt: &later},
+	}
+	if err := db.Create(&chapters).Error; err != nil {
+		t.Fatalf("failed to create chapters: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		id   uint
+		want bool
+	}{
+		{name: "due chapter", id: chapters[0].ID, want: true},
+		{name: "same chapter again", id: chapters[0].ID},
+		{name: "chapter not yet due", id: chapters[1].ID},
+	}
+	for _, tt := range tests {
+		published, err := publishChapter(db, tt.id, now)
+		if err != nil {
+			t.Fatalf("%s: publishChapter: %v", tt.name, err)
+		}
+		if published != tt.want {
+			t.Errorf("%s: got published %v, want %v", tt.name, published, tt.want)
+		}
+	}
+
+	var chapter models.Chapter
+	if err := db.First(&chapter, chapters[0].ID).Error; err != nil {
+		t.Fatalf("failed to load chapter: %v", err)
+	}
+	if !chapter.IsPublished || chapter.PublishAt != nil || chapter.PublishedAt == nil {
+		t.Errorf("got published %v, publish_at %v, published_at %v", chapter.IsPublished, chapter.PublishAt, chapter.PublishedAt)
+	}
+
+	var versions int64
+	if err := db.Model(&models.ChapterVersion{}).Where("chapter_id = ?", chapter.ID).Count(&versions).Error; err != nil {
+		t.Fatalf("failed to count versions: %v", err)
+	}
+	if versions != 1 {
+		t.Errorf("got %d versions, want 1", versions)
+	}
+}
@@ -0,0 +1,332 @@
+// Package risk scores tips and cashouts for fraud. Each check adds points
+// for a signal such as a new account, a network shared with the other party,
+// or earnings concentrated on a few readers. Risky tips are declined and
+// risky cashouts are held for an admin to review.
+package risk
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// ReviewScore holds a cashout for review and marks a tip as risky
+	ReviewScore = 50
+	// BlockScore declines a tip
+	BlockScore = 80
+)
+
+const (
+	lookback          = 30 * 24 * time.Hour // Earnings and tips scored against
+	sessionLookback   = 90 * 24 * time.Hour // Sign-ins compared for shared networks
+	newAccountAge     = 7 * 24 * time.Hour
+	newAuthorAge      = 30 * 24 * time.Hour
+	purchaseWindow    = time.Hour
+	maxTipsPerHour    = 10
+	maxCashoutsPerDay = 3
+	minConcentrated   = 100 // Tokens before concentration counts
+)
+
+var (
+	ErrReviewNotFound = errors.New("cashout review not found")
+	ErrNotPending     = errors.New("cashout review has already been decided")
+)
+
+// Origin is where a request came from
+type Origin struct {
+	IPAddress string
+	UserAgent string
+}
+
+// NewOrigin returns the origin of a request. The user agent is cut to the
+// length sessions store so the two can be compared.
+func NewOrigin(ipAddress, userAgent string) Origin {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	return Origin{IPAddress: ipAddress, UserAgent: userAgent}
+}
+
+// Result is the score of a tip or cashout and the signals behind it
+type Result struct {
+	Score   int                 `json:"score"`
+	Signals []models.RiskSignal `json:"signals"`
+}
+
+func (r *Result) add(name string, score int, detail string) {
+	r.Score += score
+	r.Signals = append(r.Signals, models.RiskSignal{Name: name, Score: score, Detail: detail})
+}
+
+// Blocked reports whether a tip with this result should be declined
+func (r *Result) Blocked() bool {
+	return r.Score >= BlockScore
+}
+
+// NeedsReview reports whether a cashout with this result should be held
+func (r *Result) NeedsReview() bool {
+	return r.Score >= ReviewScore
+}
+
+// ScoreTip scores a tip of amount tokens from tipper to the authors of a
+// chapter
+func ScoreTip(db *gorm.DB, tipper *models.User, authorID uint, recipients []uint, amount int, origin Origin, now time.Time) (*Result, error) {
+	result := &Result{Signals: []models.RiskSignal{}}
+
+	scoreAge(result, tipper, newAccountAge, 15, now)
+
+	if err := scoreNetwork(db, result, tipper.ID, recipients, origin, now, "author"); err != nil {
+		return nil, err
+	}
+
+	// Concentration: a sockpuppet tips one author and nobody else
+	tips := db.Model(&models.TokenTransaction{}).
+		Where("user_id = ? AND transaction_type = ? AND status = ? AND created_at >= ?",
+			tipper.ID, models.TransactionTypeTip, models.TransactionStatusCompleted, now.Add(-lookback))
+	var total, toAuthor int
+	if err := tips.Session(&gorm.Session{}).Select("COALESCE(-SUM(amount), 0)").Where("amount < 0").Scan(&total).Error; err != nil {
+		return nil, err
+	}
+	if err := tips.Session(&gorm.Session{}).Select("COALESCE(-SUM(amount), 0)").Where("amount < 0 AND recipient_id = ?", authorID).Scan(&toAuthor).Error; err != nil {
+		return nil, err
+	}
+	total, toAuthor = total+amount, toAuthor+amount
+	if total >= minConcentrated && toAuthor*10 >= total*9 {
+		result.add("concentration", 15, fmt.Sprintf("%d of %d tokens tipped in 30 days went to this author", toAuthor, total))
+	}
+
+	// Velocity
+	var recent int64
+	if err := tips.Session(&gorm.Session{}).Where("amount < 0 AND created_at >= ?", now.Add(-time.Hour)).Count(&recent).Error; err != nil {
+		return nil, err
+	}
+	if recent >= maxTipsPerHour {
+		result.add("velocity", 15, fmt.Sprintf("%d tips in the last hour", recent))
+	}
+
+	// Tokens bought just to be passed on
+	var purchased int
+	if err := db.Model(&models.TokenTransaction{}).
+		Where("user_id = ? AND transaction_type = ? AND status = ? AND created_at >= ?",
+			tipper.ID, models.TransactionTypePurchase, models.TransactionStatusCompleted, now.Add(-purchaseWindow)).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&purchased).Error; err != nil {
+		return nil, err
+	}
+	if purchased > 0 && amount*2 >= purchased {
+		result.add("purchase_then_tip", 20, fmt.Sprintf("tipping %d of %d tokens bought in the last hour", amount, purchased))
+	}
+
+	return result, nil
+}
+
+// ScoreCashout scores a cashout of amount tokens by author against where
+// their last 30 days of earnings came from
+func ScoreCashout(db *gorm.DB, author *models.User, amount int, origin Origin, now time.Time) (*Result, error) {
+	result := &Result{Signals: []models.RiskSignal{}}
+	since := now.Add(-lookback)
+
+	scoreAge(result, author, newAuthorAge, 15, now)
+
+	// Tokens paid to the author by each reader
+	var payers []struct {
+		RecipientID uint
+		Tokens      int
+		CreatedAt   time.Time
+	}
+	if err := db.Model(&models.TokenTransaction{}).
+		Joins("JOIN users ON users.id = token_transactions.recipient_id").
+		Select("token_transactions.recipient_id, SUM(token_transactions.amount) AS tokens, users.created_at").
+		Where("token_transactions.user_id = ? AND token_transactions.amount > 0 AND token_transactions.status = ?", author.ID, models.TransactionStatusCompleted).
+		Where("token_transactions.transaction_type IN ? AND token_transactions.created_at >= ?",
+			[]models.TransactionType{models.TransactionTypeTip, models.TransactionTypeUnlock, models.TransactionTypeSubscription}, since).
+		Group("token_transactions.recipient_id, users.created_at").
+		Scan(&payers).Error; err != nil {
+		return nil, err
+	}
+
+	earned, top, fromNew := 0, 0, 0
+	payerIDs := make([]uint, 0, len(payers))
+	for _, payer := range payers {
+		earned += payer.Tokens
+		top = max(top, payer.Tokens)
+		if payer.CreatedAt.After(since) {
+			fromNew += payer.Tokens
+		}
+		payerIDs = append(payerIDs, payer.RecipientID)
+	}
+
+	if earned >= minConcentrated && top*2 >= earned {
+		result.add("concentration", 20, fmt.Sprintf("one reader paid %d of %d tokens earned in 30 days", top, earned))
+	}
+	if earned >= minConcentrated && fromNew*2 >= earned {
+		result.add("new_payers", 20, fmt.Sprintf("%d of %d tokens earned in 30 days came from accounts created in that time", fromNew, earned))
+	}
+
+	if err := scoreNetwork(db, result, author.ID, payerIDs, origin, now, "reader who paid them"); err != nil {
+		return nil, err
+	}
+
+	// Tips that scored as risky when they were sent. Tips are split between
+	// a book's owner and co-authors, so count the author's own credit from
+	// each tip's journal entry rather than the tips addressed to them.
+	var risky int
+	if err := db.Model(&models.RiskAssessment{}).
+		Joins("JOIN journal_entries ON journal_entries.transaction_id = risk_assessments.transaction_id").
+		Joins("JOIN postings ON postings.journal_entry_id = journal_entries.id").
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = postings.account_id").
+		Where("risk_assessments.subject = ? AND risk_assessments.score >= ? AND risk_assessments.created_at >= ?", models.RiskSubjectTip, ReviewScore, since).
+		Where("journal_entries.kind = ? AND ledger_accounts.code = ? AND postings.amount > 0", models.JournalKindTip, ledger.User(author.ID).Code).
+		Select("COALESCE(SUM(postings.amount), 0)").
+		Scan(&risky).Error; err != nil {
+		return nil, err
+	}
+	if risky > 0 && risky*4 >= max(earned, 1) {
+		result.add("risky_tips", 30, fmt.Sprintf("%d tokens earned in 30 days came from risky tips", risky))
+	}
+
+	// Velocity
+	var cashouts int64
+	if err := db.Model(&models.TokenTransaction{}).
+		Where("user_id = ? AND transaction_type = ? AND status <> ? AND created_at >= ?",
+			author.ID, models.TransactionTypeCashout, models.TransactionStatusFailed, now.Add(-24*time.Hour)).
+		Count(&cashouts).Error; err != nil {
+		return nil, err
+	}
+	if cashouts >= maxCashoutsPerDay {
+		result.add("velocity", 10, fmt.Sprintf("%d cashouts in the last day", cashouts))
+	}
+
+	if amount > earned && earned > 0 {
+		result.add("exceeds_earnings", 10, fmt.Sprintf("cashing out %d tokens after earning %d in 30 days", amount, earned))
+	}
+
+	return result, nil
+}
+
+// scoreAge adds points for an account younger than age
+func scoreAge(result *Result, user *models.User, age time.Duration, score int, now time.Time) {
+	if user.CreatedAt.After(now.Add(-24 * time.Hour)) {
+		result.add("new_account", score+10, "account created in the last day")
+	} else if user.CreatedAt.After(now.Add(-age)) {
+		result.add("new_account", score, fmt.Sprintf("account created %d days ago", int(now.Sub(user.CreatedAt).Hours()/24)))
+	}
+}
+
+// scoreNetwork adds points when userID and any of others signed in from the
+// same IP address, and more when from the same device
+func scoreNetwork(db *gorm.DB, result *Result, userID uint, others []uint, origin Origin, now time.Time, party string) error {
+	if len(others) == 0 {
+		return nil
+	}
+
+	var sessions []models.Session
+	if err := db.Select("user_id, ip_address, user_agent").
+		Where("(user_id = ? OR user_id IN ?) AND created_at >= ? AND ip_address <> ''", userID, others, now.Add(-sessionLookback)).
+		Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	ips := make(map[string]bool)
+	devices := make(map[string]bool)
+	if origin.IPAddress != "" {
+		ips[origin.IPAddress] = true
+		devices[origin.IPAddress+"|"+origin.UserAgent] = true
+	}
+	for _, session := range sessions {
+		if session.UserID == userID {
+			ips[session.IPAddress] = true
+			devices[session.IPAddress+"|"+session.UserAgent] = true
+		}
+	}
+
+	sharedIP, sharedDevice := false, false
+	for _, session := range sessions {
+		if session.UserID == userID {
+			continue
+		}
+		sharedIP = sharedIP || ips[session.IPAddress]
+		sharedDevice = sharedDevice || devices[session.IPAddress+"|"+session.UserAgent]
+	}
+	if sharedIP {
+		result.add("shared_ip", 30, "signed in from the same IP address as a "+party)
+	}
+	if sharedDevice {
+		result.add("shared_device", 20, "signed in from the same device as a "+party)
+	}
+	return nil
+}
+
+// Record stores the assessment of a tip or cashout
+func Record(tx *gorm.DB, userID uint, subject models.RiskSubject, transactionID *uint, amount int, result *Result) (*models.RiskAssessment, error) {
+	assessment := models.RiskAssessment{
+		UserID:        userID,
+		Subject:       subject,
+		TransactionID: transactionID,
+		Amount:        amount,
+		Score:         result.Score,
+	}
+	assessment.SetSignals(result.Signals)
+	if err := tx.Create(&assessment).Error; err != nil {
+		return nil, err
+	}
+	return &assessment, nil
+}
+
+// Hold puts a cashout in the review queue
+func Hold(tx *gorm.DB, transaction *models.TokenTransaction, assessment *models.RiskAssessment) (*models.CashoutReview, error) {
+	review := models.CashoutReview{
+		TransactionID: transaction.ID,
+		UserID:        transaction.UserID,
+		AssessmentID:  assessment.ID,
+		Status:        models.CashoutReviewPending,
+	}
+	if err := tx.Create(&review).Error; err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// Held reports whether a cashout is waiting for review or was rejected, so
+// it must not be paid out
+func Held(db *gorm.DB, transactionID uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.CashoutReview{}).
+		Where("transaction_id = ? AND status <> ?", transactionID, models.CashoutReviewApproved).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// Decide locks a pending review and records the reviewer's decision. It
+// must be called inside a database transaction so the caller can settle the
+// cashout atomically.
+func Decide(tx *gorm.DB, reviewID, reviewerID uint, status models.CashoutReviewStatus, notes *string, now time.Time) (*models.CashoutReview, error) {
+	var review models.CashoutReview
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&review, reviewID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrReviewNotFound
+		}
+		return nil, err
+	}
+	if review.Status != models.CashoutReviewPending {
+		return nil, ErrNotPending
+	}
+
+	updates := map[string]interface{}{
+		"status":      status,
+		"reviewer_id": reviewerID,
+		"notes":       notes,
+		"decided_at":  now,
+	}
+	if err := tx.Model(&review).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
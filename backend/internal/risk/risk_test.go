@@ -0,0 +1,114 @@
+package risk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"fdip/internal/database/dbtest"
+	"fdip/internal/ledger"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// tip records a tip from tipper split between recipients the way TipAuthor
+// does, addressed to the first recipient, with the score it was sent with
+func tip(t *testing.T, db *gorm.DB, tipper uint, score int, shares map[uint]int, owner uint) {
+	t.Helper()
+
+	total := 0
+	for _, amount := range shares {
+		total += amount
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := ledger.Post(tx, ledger.Transfer(models.JournalKindPurchase, ledger.Stripe, ledger.User(tipper), total, nil)); err != nil {
+			return err
+		}
+		sent := models.TokenTransaction{UserID: tipper, TransactionType: models.TransactionTypeTip, Amount: -total, RecipientID: &owner, Status: models.TransactionStatusCompleted}
+		if err := tx.Create(&sent).Error; err != nil {
+			return err
+		}
+		entry := ledger.Entry{
+			Kind:          models.JournalKindTip,
+			TransactionID: &sent.ID,
+			Lines:         []ledger.Line{{Account: ledger.User(tipper), Amount: -total}},
+		}
+		for userID, amount := range shares {
+			credit := models.TokenTransaction{UserID: userID, TransactionType: models.TransactionTypeTip, Amount: amount, RecipientID: &tipper, Status: models.TransactionStatusCompleted}
+			if err := tx.Create(&credit).Error; err != nil {
+				return err
+			}
+			entry.Lines = append(entry.Lines, ledger.Line{Account: ledger.User(userID), Amount: amount})
+		}
+		if _, err := ledger.Post(tx, entry); err != nil {
+			return err
+		}
+		return tx.Create(&models.RiskAssessment{UserID: tipper, Subject: models.RiskSubjectTip, TransactionID: &sent.ID, Amount: total, Score: score}).Error
+	})
+	if err != nil {
+		t.Fatalf("failed to record tip: %v", err)
+	}
+}
+
+func TestScoreCashoutRiskyTips(t *testing.T) {
+	const owner, coAuthor, other, reader, fan = 1, 2, 3, 4, 5
+
+	tests := []struct {
+		name   string
+		author uint
+		score  int
+		risky  bool
+	}{
+		{name: "owner of a risky tip", author: owner, score: ReviewScore, risky: true},
+		{name: "co-author of a risky tip", author: coAuthor, score: ReviewScore, risky: true},
+		{name: "co-author of a safe tip", author: coAuthor, score: ReviewScore - 1},
+		{name: "not credited by the tip", author: other, score: ReviewScore},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t,
+				&models.User{},
+				&models.Session{},
+				&models.TokenTransaction{},
+				&models.RiskAssessment{},
+				&models.LedgerAccount{},
+				&models.JournalEntry{},
+				&models.Posting{},
+				&models.TokenBucket{},
+				&models.UserTokenBalance{},
+			)
+			old := time.Now().Add(-365 * 24 * time.Hour)
+			for id := uint(1); id <= fan; id++ {
+				user := models.User{ID: id, Username: fmt.Sprintf("user%d", id), Email: fmt.Sprintf("user%d@example.com", id), PasswordHash: "x", CreatedAt: old}
+				if err := db.Create(&user).Error; err != nil {
+					t.Fatalf("failed to create user: %v", err)
+				}
+			}
+			// The tip is addressed to the owner and split with the co-author
+			tip(t, db, reader, tt.score, map[uint]int{owner: 60, coAuthor: 40}, owner)
+			// A safe tip as well, so the risky share is weighed against other earnings
+			tip(t, db, fan, 0, map[uint]int{tt.author: 100}, tt.author)
+
+			var author models.User
+			if err := db.First(&author, tt.author).Error; err != nil {
+				t.Fatalf("failed to load author: %v", err)
+			}
+			result, err := ScoreCashout(db, &author, 10, Origin{}, time.Now())
+			if err != nil {
+				t.Fatalf("ScoreCashout: %v", err)
+			}
+
+			found := false
+			for _, signal := range result.Signals {
+				if signal.Name == "risky_tips" {
+					found = true
+				}
+			}
+			if found != tt.risky {
+				t.Errorf("got risky_tips %v, want %v in %+v", found, tt.risky, result.Signals)
+			}
+		})
+	}
+}
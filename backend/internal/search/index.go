@@ -0,0 +1,577 @@
+// Package search finds published books, their chapters and authors. It
+// keeps an inverted index in memory, ranks matches with BM25 weighted by
+// field, tolerates typos in longer words and highlights the matches in
+// titles and snippets. Every server builds its own index from the database
+// and keeps it in step by polling for changed rows (see Start).
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type kind uint8
+
+const (
+	kindBook kind = iota
+	kindChapter
+	kindAuthor
+	numKinds
+)
+
+// numFields is the number of text fields a document has. What each holds
+// depends on its kind: a book's title, author name and description; a
+// chapter's title and text; an author's display name, bio and username.
+const numFields = 3
+
+// weights is how much a match in each field counts, by kind
+var weights = [numKinds][numFields]float64{
+	kindBook:    {6, 3, 2},
+	kindChapter: {2, 1, 0},
+	kindAuthor:  {5, 1, 4},
+}
+
+// BM25 parameters
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// maxQueryTerms bounds the work a single query can cause
+const maxQueryTerms = 10
+
+type key struct {
+	kind kind
+	id   uint
+}
+
+// document is an indexed book, chapter or author
+type document struct {
+	key     key
+	stamp   string // Version of the row the document was built from
+	fields  [numFields]string
+	lengths [numFields]int
+	terms   []string
+
+	bookID    uint // Chapters: the book they belong to
+	number    uint // Chapters: chapter number
+	words     int  // Chapters: word count
+	genres    []string
+	completed bool
+	updatedAt time.Time
+}
+
+// frequencies counts a term in each field of a document
+type frequencies [numFields]uint16
+
+// Index is an in-memory search index. It is safe for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	ready    bool
+	docs     map[key]*document
+	postings map[string]map[key]*frequencies
+	chapters map[uint]map[uint]bool // Book ID to its chapter IDs
+	totalLen [numKinds][numFields]int
+	counts   [numKinds]int
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		docs:     make(map[key]*document),
+		postings: make(map[string]map[key]*frequencies),
+		chapters: make(map[uint]map[uint]bool),
+	}
+}
+
+// Ready reports whether the index has been filled from the database
+func (ix *Index) Ready() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.ready
+}
+
+// put adds or replaces a document. The caller holds the write lock.
+func (ix *Index) put(doc *document) {
+	ix.remove(doc.key)
+
+	seen := map[string]bool{}
+	for f, text := range doc.fields {
+		tokens := tokenize(text)
+		doc.lengths[f] = len(tokens)
+		ix.totalLen[doc.key.kind][f] += len(tokens)
+		for _, t := range tokens {
+			if stopWords[t.Term] {
+				continue
+			}
+			if !seen[t.Term] {
+				seen[t.Term] = true
+				doc.terms = append(doc.terms, t.Term)
+			}
+			postings := ix.postings[t.Term]
+			if postings == nil {
+				postings = make(map[key]*frequencies)
+				ix.postings[t.Term] = postings
+			}
+			freq := postings[doc.key]
+			if freq == nil {
+				freq = &frequencies{}
+				postings[doc.key] = freq
+			}
+			if freq[f] < math.MaxUint16 {
+				freq[f]++
+			}
+		}
+	}
+
+	ix.docs[doc.key] = doc
+	ix.counts[doc.key.kind]++
+	if doc.key.kind == kindChapter {
+		if ix.chapters[doc.bookID] == nil {
+			ix.chapters[doc.bookID] = make(map[uint]bool)
+		}
+		ix.chapters[doc.bookID][doc.key.id] = true
+	}
+}
+
+// remove drops a document. The caller holds the write lock.
+func (ix *Index) remove(k key) {
+	doc := ix.docs[k]
+	if doc == nil {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(ix.postings[term], k)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	for f, n := range doc.lengths {
+		ix.totalLen[k.kind][f] -= n
+	}
+	ix.counts[k.kind]--
+	delete(ix.docs, k)
+
+	if k.kind == kindChapter {
+		delete(ix.chapters[doc.bookID], k.id)
+		if len(ix.chapters[doc.bookID]) == 0 {
+			delete(ix.chapters, doc.bookID)
+		}
+	}
+}
+
+// Book completion statuses to filter by
+const (
+	StatusCompleted = "completed"
+	StatusOngoing   = "ongoing"
+)
+
+// Query is a search. An empty Text lists the books matching the filters,
+// most recently updated first.
+type Query struct {
+	Text         string
+	Genres       []string // Books in any of these genres
+	MinWords     int
+	MaxWords     int // No limit when 0
+	Status       string
+	UpdatedAfter time.Time
+	Offset       int
+	Limit        int
+}
+
+// BookHit is a matching book. Title and snippets are HTML with the matched
+// words in <mark> elements.
+type BookHit struct {
+	BookID    uint         `json:"book_id"`
+	Score     float64      `json:"score"`
+	Title     string       `json:"title"`
+	Snippet   string       `json:"snippet"`
+	WordCount int          `json:"word_count"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	Chapters  []ChapterHit `json:"chapters"`
+}
+
+// ChapterHit is a chapter of a matching book that matched too
+type ChapterHit struct {
+	ChapterID     uint   `json:"id"`
+	ChapterNumber uint   `json:"chapter_number"`
+	Title         string `json:"title"`
+	Snippet       string `json:"snippet"`
+}
+
+// AuthorHit is a matching author
+type AuthorHit struct {
+	UserID  uint   `json:"id"`
+	Name    string `json:"name"`
+	Snippet string `json:"snippet"`
+}
+
+// Results is a page of books matching a query, with the best matching
+// authors on the first page
+type Results struct {
+	Total      int         `json:"total"`
+	Books      []BookHit   `json:"books"`
+	Authors    []AuthorHit `json:"authors"`
+	Suggestion string      `json:"suggestion,omitempty"` // The query with its typos corrected
+}
+
+// expansion is an indexed term a query word matches, and how strongly
+type expansion struct {
+	term   string
+	weight float64
+}
+
+// candidate is a document matching a query
+type candidate struct {
+	doc     *document
+	perWord [maxQueryTerms]float64
+	score   float64
+	mask    uint32
+}
+
+// bookMatch gathers a book's own match and those of its chapters
+type bookMatch struct {
+	doc       *document
+	own       *candidate
+	chapters  []*candidate
+	score     float64
+	words     int
+	updatedAt time.Time
+}
+
+// Search runs a query
+func (ix *Index) Search(q Query) Results {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if q.Limit <= 0 {
+		q.Limit = 20
+	}
+	results := Results{Books: []BookHit{}, Authors: []AuthorHit{}}
+
+	words := termsOf(tokenize(q.Text))
+	if len(words) > maxQueryTerms {
+		words = words[:maxQueryTerms]
+	}
+	if strings.TrimSpace(q.Text) != "" && len(words) == 0 {
+		return results
+	}
+
+	// Expand each word to the indexed terms it could mean
+	expansions := make([][]expansion, len(words))
+	matched := map[string]bool{}
+	corrected := make([]string, len(words))
+	changed := false
+	for i, word := range words {
+		// The last word may be unfinished while the reader is typing
+		prefix := i == len(words)-1 && !strings.HasSuffix(q.Text, " ")
+		expansions[i] = ix.expand(word, prefix)
+		corrected[i] = word
+		if _, exact := ix.postings[word]; !exact && len(expansions[i]) > 0 {
+			if best := expansions[i][0].term; !strings.HasPrefix(best, word) {
+				corrected[i] = best
+				changed = true
+			}
+		}
+		for _, e := range expansions[i] {
+			matched[e.term] = true
+		}
+	}
+	if changed {
+		results.Suggestion = strings.Join(corrected, " ")
+	}
+
+	// Score every document matching a word
+	candidates := map[key]*candidate{}
+	total := float64(len(ix.docs))
+	for i, exps := range expansions {
+		for _, e := range exps {
+			postings := ix.postings[e.term]
+			idf := math.Log(1 + (total-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+			for k, freq := range postings {
+				c := candidates[k]
+				if c == nil {
+					c = &candidate{doc: ix.docs[k]}
+					candidates[k] = c
+				}
+				if s := e.weight * idf * ix.bm25(c.doc, freq); s > c.perWord[i] {
+					c.perWord[i] = s
+				}
+			}
+		}
+	}
+	for _, c := range candidates {
+		for i := range words {
+			if c.perWord[i] > 0 {
+				c.score += c.perWord[i]
+				c.mask |= 1 << i
+			}
+		}
+	}
+
+	// Gather the matches by book, or every book when browsing
+	books := map[uint]*bookMatch{}
+	bookOf := func(id uint) *bookMatch {
+		if m, ok := books[id]; ok {
+			return m
+		}
+		doc := ix.docs[key{kindBook, id}]
+		if doc == nil {
+			return nil
+		}
+		m := &bookMatch{doc: doc}
+		books[id] = m
+		return m
+	}
+	var authors []*candidate
+	if len(words) == 0 {
+		for k := range ix.docs {
+			if k.kind == kindBook {
+				bookOf(k.id)
+			}
+		}
+	}
+	for _, c := range candidates {
+		switch c.doc.key.kind {
+		case kindBook:
+			if m := bookOf(c.doc.key.id); m != nil {
+				m.own = c
+			}
+		case kindChapter:
+			if m := bookOf(c.doc.bookID); m != nil {
+				m.chapters = append(m.chapters, c)
+			}
+		case kindAuthor:
+			authors = append(authors, c)
+		}
+	}
+
+	var ranked []*bookMatch
+	for _, m := range books {
+		ix.summarize(m)
+		if !q.matches(m) {
+			continue
+		}
+		m.score = score(m, len(words))
+		ranked = append(ranked, m)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		if !ranked[i].updatedAt.Equal(ranked[j].updatedAt) {
+			return ranked[i].updatedAt.After(ranked[j].updatedAt)
+		}
+		return ranked[i].doc.key.id > ranked[j].doc.key.id
+	})
+
+	results.Total = len(ranked)
+	if q.Offset < len(ranked) {
+		page := ranked[q.Offset:]
+		if len(page) > q.Limit {
+			page = page[:q.Limit]
+		}
+		for _, m := range page {
+			results.Books = append(results.Books, m.hit(matched))
+		}
+	}
+
+	if q.Offset == 0 {
+		sort.Slice(authors, func(i, j int) bool { return rank(authors[i], len(words)) > rank(authors[j], len(words)) })
+		for _, c := range authors {
+			if len(results.Authors) == 5 {
+				break
+			}
+			results.Authors = append(results.Authors, AuthorHit{
+				UserID:  c.doc.key.id,
+				Name:    highlight(c.doc.fields[0], matched),
+				Snippet: snippet(c.doc.fields[1], matched, 30),
+			})
+		}
+	}
+	return results
+}
+
+// expand returns the indexed terms a query word matches: itself, words a
+// few typos away and, for the word being typed, words it begins. Better
+// matches come first.
+func (ix *Index) expand(word string, prefix bool) []expansion {
+	var out []expansion
+	if _, ok := ix.postings[word]; ok {
+		out = append(out, expansion{word, 1})
+	}
+
+	edits := maxEdits(word)
+	prefix = prefix && len([]rune(word)) >= 3
+	if edits == 0 && !prefix {
+		return out
+	}
+	for term := range ix.postings {
+		if term == word {
+			continue
+		}
+		if prefix && strings.HasPrefix(term, word) {
+			out = append(out, expansion{term, 0.8})
+			continue
+		}
+		if edits > 0 {
+			if d := editDistance(word, term, edits); d <= edits {
+				out = append(out, expansion{term, 1 - 0.3*float64(d)})
+			}
+		}
+	}
+
+	// Keep the closest and most common terms
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].weight != out[j].weight {
+			return out[i].weight > out[j].weight
+		}
+		if a, b := len(ix.postings[out[i].term]), len(ix.postings[out[j].term]); a != b {
+			return a > b
+		}
+		return out[i].term < out[j].term
+	})
+	if len(out) > 20 {
+		out = out[:20]
+	}
+	return out
+}
+
+// bm25 scores a term's frequencies in a document against the average
+// length of each field
+func (ix *Index) bm25(doc *document, freq *frequencies) float64 {
+	k := doc.key.kind
+	weighted := 0.0
+	for f, tf := range freq {
+		if tf == 0 || weights[k][f] == 0 {
+			continue
+		}
+		avg := float64(ix.totalLen[k][f]) / float64(max(ix.counts[k], 1))
+		norm := 1 - b
+		if avg > 0 {
+			norm += b * float64(doc.lengths[f]) / avg
+		}
+		weighted += weights[k][f] * float64(tf) / norm
+	}
+	return weighted * (k1 + 1) / (k1 + weighted)
+}
+
+// summarize totals the words of a book's chapters and finds when it last
+// changed
+func (ix *Index) summarize(m *bookMatch) {
+	m.updatedAt = m.doc.updatedAt
+	for id := range ix.chapters[m.doc.key.id] {
+		chapter := ix.docs[key{kindChapter, id}]
+		m.words += chapter.words
+		if chapter.updatedAt.After(m.updatedAt) {
+			m.updatedAt = chapter.updatedAt
+		}
+	}
+}
+
+func (q Query) matches(m *bookMatch) bool {
+	if len(q.Genres) > 0 && !containsAny(m.doc.genres, q.Genres) {
+		return false
+	}
+	if m.words < q.MinWords || (q.MaxWords > 0 && m.words > q.MaxWords) {
+		return false
+	}
+	switch q.Status {
+	case StatusCompleted:
+		if !m.doc.completed {
+			return false
+		}
+	case StatusOngoing:
+		if m.doc.completed {
+			return false
+		}
+	}
+	if !q.UpdatedAfter.IsZero() && !m.updatedAt.After(q.UpdatedAfter) {
+		return false
+	}
+	return true
+}
+
+// score ranks a book by its own match and its best chapters. Books that
+// match only some of the query words are ranked down sharply.
+func score(m *bookMatch, words int) float64 {
+	if words == 0 {
+		return 0
+	}
+	sort.Slice(m.chapters, func(i, j int) bool { return m.chapters[i].score > m.chapters[j].score })
+
+	var s float64
+	var mask uint32
+	if m.own != nil {
+		s += m.own.score
+		mask |= m.own.mask
+	}
+	for i, c := range m.chapters {
+		switch {
+		case i == 0:
+			s += c.score
+		case i < 3:
+			s += 0.3 * c.score
+		}
+		mask |= c.mask
+	}
+	return s * coverage(mask, words)
+}
+
+// rank orders authors the way score orders books
+func rank(c *candidate, words int) float64 {
+	return c.score * coverage(c.mask, words)
+}
+
+// coverage is the squared share of the query words matched
+func coverage(mask uint32, words int) float64 {
+	n := 0
+	for ; mask != 0; mask &= mask - 1 {
+		n++
+	}
+	share := float64(n) / float64(words)
+	return share * share
+}
+
+// hit describes a ranked book for the results
+func (m *bookMatch) hit(matched map[string]bool) BookHit {
+	hit := BookHit{
+		BookID:    m.doc.key.id,
+		Score:     math.Round(m.score*1000) / 1000,
+		Title:     highlight(m.doc.fields[0], matched),
+		Snippet:   snippet(m.doc.fields[2], matched, 30),
+		WordCount: m.words,
+		UpdatedAt: m.updatedAt,
+		Chapters:  []ChapterHit{},
+	}
+	for i, c := range m.chapters {
+		if i == 3 {
+			break
+		}
+		hit.Chapters = append(hit.Chapters, ChapterHit{
+			ChapterID:     c.doc.key.id,
+			ChapterNumber: c.doc.number,
+			Title:         highlight(c.doc.fields[0], matched),
+			Snippet:       snippet(c.doc.fields[1], matched, 30),
+		})
+	}
+	// A book matched only in its chapters is best described by them
+	if m.own == nil && len(hit.Chapters) > 0 {
+		hit.Snippet = hit.Chapters[0].Snippet
+	}
+	return hit
+}
+
+func containsAny(have, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if strings.EqualFold(h, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package search
+
+import (
+	"testing"
+	"time"
+)
+
+var day = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestIndex returns an index of three books, their chapters and an
+// author. Book 1 is the most relevant to "dragon"; book 3 mentions dragons
+// only in a chapter; book 2 not at all.
+func newTestIndex() *Index {
+	ix := NewIndex()
+	docs := []*document{
+		{key: key{kindBook, 1}, fields: [numFields]string{"The Dragon Keeper", "Ann Smith", "A girl raises a dragon."}, genres: []string{"Fantasy"}, completed: true, updatedAt: day.AddDate(0, 0, 1)},
+		{key: key{kindBook, 2}, fields: [numFields]string{"Sea of Stars", "Bob Jones", "A voyage across the galaxy."}, genres: []string{"Science Fiction"}, updatedAt: day.AddDate(0, 0, 3)},
+		{key: key{kindBook, 3}, fields: [numFields]string{"Winter Tales", "Cy Young", "Short stories for cold nights."}, genres: []string{"Fantasy", "Horror"}, updatedAt: day.AddDate(0, 0, 2)},
+		{key: key{kindChapter, 11}, fields: [numFields]string{"Hatching", "The egg cracked open at dawn."}, bookID: 1, number: 1, words: 5000, updatedAt: day},
+		{key: key{kindChapter, 21}, fields: [numFields]string{"Launch", "The ship left orbit."}, bookID: 2, number: 1, words: 20000, updatedAt: day},
+		{key: key{kindChapter, 31}, fields: [numFields]string{"The Dragon of Winter", "Snow fell on the dragon's back."}, bookID: 3, number: 4, words: 1000, updatedAt: day},
+		{key: key{kindAuthor, 100}, fields: [numFields]string{"Dragon Lady", "Writes about dragons and winter.", "dragonlady"}},
+	}
+	for _, doc := range docs {
+		ix.put(doc)
+	}
+	ix.ready = true
+	return ix
+}
+
+func bookIDs(results Results) []uint {
+	ids := make([]uint, len(results.Books))
+	for i, hit := range results.Books {
+		ids[i] = hit.BookID
+	}
+	return ids
+}
+
+func equalIDs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearchRanking(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		want       []uint
+		suggestion string
+	}{
+		{name: "title beats chapter", text: "dragon", want: []uint{1, 3}},
+		{name: "every word beats some words", text: "dragon winter", want: []uint{3, 1}},
+		{name: "stop words are ignored", text: "the dragon of", want: []uint{1, 3}},
+		{name: "accents and case", text: "DRÁGON", want: []uint{1, 3}},
+		{name: "typo", text: "dragn ", want: []uint{1, 3}, suggestion: "dragon"},
+		{name: "short words must be exact", text: "sae ", want: []uint{}},
+		{name: "unfinished last word", text: "gala", want: []uint{2}},
+		{name: "only stop words", text: "the of", want: []uint{}},
+		{name: "no match", text: "submarine", want: []uint{}},
+	}
+
+	ix := newTestIndex()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := ix.Search(Query{Text: tt.text})
+			if got := bookIDs(results); !equalIDs(got, tt.want) {
+				t.Errorf("got books %v, want %v", got, tt.want)
+			}
+			if results.Total != len(tt.want) {
+				t.Errorf("got total %d, want %d", results.Total, len(tt.want))
+			}
+			if results.Suggestion != tt.suggestion {
+				t.Errorf("got suggestion %q, want %q", results.Suggestion, tt.suggestion)
+			}
+		})
+	}
+}
+
+func TestSearchHits(t *testing.T) {
+	results := newTestIndex().Search(Query{Text: "dragon"})
+	if len(results.Books) != 2 {
+		t.Fatalf("got %d books, want 2", len(results.Books))
+	}
+
+	own := results.Books[0]
+	if own.Title != "The <mark>Dragon</mark> Keeper" || own.Snippet != "A girl raises a <mark>dragon</mark>." {
+		t.Errorf("book 1: got title %q and snippet %q", own.Title, own.Snippet)
+	}
+	if own.WordCount != 5000 || !own.UpdatedAt.Equal(day.AddDate(0, 0, 1)) {
+		t.Errorf("book 1: got %d words updated %s", own.WordCount, own.UpdatedAt)
+	}
+
+	// A book matched only in a chapter is described by the chapter
+	byChapter := results.Books[1]
+	if len(byChapter.Chapters) != 1 || byChapter.Chapters[0].ChapterNumber != 4 {
+		t.Fatalf("book 3: got chapters %+v, want chapter 4", byChapter.Chapters)
+	}
+	if byChapter.Snippet != "Snow fell on the <mark>dragon&#39;s</mark> back." {
+		t.Errorf("book 3: got snippet %q", byChapter.Snippet)
+	}
+
+	if len(results.Authors) != 1 || results.Authors[0].UserID != 100 || results.Authors[0].Name != "<mark>Dragon</mark> Lady" {
+		t.Errorf("got authors %+v, want Dragon Lady", results.Authors)
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		want  []uint
+	}{
+		{name: "browse, most recently updated first", want: []uint{2, 3, 1}},
+		{name: "genre", query: Query{Genres: []string{"fantasy"}}, want: []uint{3, 1}},
+		{name: "any of several genres", query: Query{Genres: []string{"Horror", "Science Fiction"}}, want: []uint{2, 3}},
+		{name: "completed", query: Query{Status: StatusCompleted}, want: []uint{1}},
+		{name: "ongoing", query: Query{Status: StatusOngoing}, want: []uint{2, 3}},
+		{name: "minimum words", query: Query{MinWords: 5000}, want: []uint{2, 1}},
+		{name: "maximum words", query: Query{MaxWords: 5000}, want: []uint{3, 1}},
+		{name: "updated after", query: Query{UpdatedAfter: day.AddDate(0, 0, 2)}, want: []uint{2}},
+		{name: "filters and text", query: Query{Text: "dragon", Status: StatusOngoing}, want: []uint{3}},
+		{name: "page", query: Query{Offset: 1, Limit: 1}, want: []uint{3}},
+		{name: "past the last page", query: Query{Offset: 5}, want: []uint{}},
+	}
+
+	ix := newTestIndex()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bookIDs(ix.Search(tt.query)); !equalIDs(got, tt.want) {
+				t.Errorf("got books %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	ix := newTestIndex()
+
+	ix.remove(key{kindChapter, 31})
+	if got := bookIDs(ix.Search(Query{Text: "dragon"})); !equalIDs(got, []uint{1}) {
+		t.Errorf("after removing the chapter: got books %v, want [1]", got)
+	}
+
+	// Replacing a document drops the terms it no longer has
+	ix.put(&document{key: key{kindBook, 1}, fields: [numFields]string{"The Keeper", "Ann Smith", "A girl raises a lizard."}})
+	if got := bookIDs(ix.Search(Query{Text: "dragon"})); len(got) != 0 {
+		t.Errorf("after replacing the book: got books %v, want none", got)
+	}
+	if _, ok := ix.postings["dragon"][key{kindBook, 1}]; ok {
+		t.Error("replaced book is still posted under its old terms")
+	}
+}
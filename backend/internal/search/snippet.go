@@ -0,0 +1,85 @@
+package search
+
+import (
+	"html"
+	"strings"
+)
+
+// highlight escapes text for HTML and wraps the matched words in <mark>
+func highlight(text string, matched map[string]bool) string {
+	return mark(text, tokenize(text), 0, len(text), matched)
+}
+
+// snippet returns an excerpt of text of about size words around its best
+// cluster of matches, escaped and highlighted like highlight. Text with no
+// matches gives its opening words.
+func snippet(text string, matched map[string]bool, size int) string {
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	// Slide a window of size words over the text and keep the one with the
+	// most distinct matched words, then the most matches
+	best, bestDistinct, bestCount := 0, 0, 0
+	for start := 0; start < len(tokens); start++ {
+		if start > 0 && !matched[tokens[start].Term] {
+			continue // Windows worth having start on a match
+		}
+		end := min(start+size, len(tokens))
+		distinct := map[string]bool{}
+		count := 0
+		for _, t := range tokens[start:end] {
+			if matched[t.Term] {
+				distinct[t.Term] = true
+				count++
+			}
+		}
+		if len(distinct) > bestDistinct || (len(distinct) == bestDistinct && count > bestCount) {
+			best, bestDistinct, bestCount = start, len(distinct), count
+		}
+	}
+
+	// Lead in with a few words of context before the first match
+	start := max(0, best-5)
+	end := min(start+size, len(tokens))
+	window := tokens[start:end]
+
+	from, to := window[0].Start, window[len(window)-1].End
+	if start == 0 {
+		from = 0
+	}
+	// Keep the punctuation after the last word
+	if end == len(tokens) {
+		to = len(text)
+	} else if i := strings.IndexAny(text[to:], " \t\n"); i >= 0 {
+		to += i
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	b.WriteString(mark(text, tokens, from, to, matched))
+	if end < len(tokens) {
+		b.WriteString("…")
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// mark escapes text[from:to], wrapping matched tokens in <mark>
+func mark(text string, tokens []token, from, to int, matched map[string]bool) string {
+	var b strings.Builder
+	pos := from
+	for _, t := range tokens {
+		if t.Start < from || t.End > to || !matched[t.Term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:t.Start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[t.Start:t.End]))
+		b.WriteString("</mark>")
+		pos = t.End
+	}
+	b.WriteString(html.EscapeString(text[pos:to]))
+	return b.String()
+}
@@ -0,0 +1,250 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"fdip/internal/content"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// Default is the index the handlers search. It is filled by Start.
+var Default = NewIndex()
+
+// SyncInterval is how often the index checks the database for changes
+const SyncInterval = 30 * time.Second
+
+// loadBatch is how many changed rows are loaded per query
+const loadBatch = 100
+
+// Start fills Default from the database and keeps it in step until ctx is
+// cancelled. Unlike the jobs package, which runs each job on one server,
+// this runs on every server: each has its own index.
+func Start(ctx context.Context, db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(SyncInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := Default.Sync(ctx, db); err != nil {
+				log.Printf("[SEARCH] Failed to sync index: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stampRow is the id and version of a row the index may hold
+type stampRow struct {
+	ID        uint
+	UpdatedAt time.Time
+	Other     time.Time // Author's updated_at for books
+	Version   uint      // Render version for chapters
+	Locked    bool      // Whether a chapter is closed to some readers
+}
+
+func (r stampRow) stamp() string {
+	return fmt.Sprintf("%d/%d/%d/%t", r.UpdatedAt.UnixNano(), r.Other.UnixNano(), r.Version, r.Locked)
+}
+
+// Sync brings the index in step with the database. It compares the
+// version of every searchable row with the indexed one, loads the rows that
+// changed and drops those that are no longer searchable: deleted,
+// unpublished or made private.
+func (ix *Index) Sync(ctx context.Context, db *gorm.DB) error {
+	db = db.WithContext(ctx)
+
+	var books, chapters, authors []stampRow
+	var chapterRows []models.Chapter
+	if err := db.Table("books").
+		Select("books.id, books.updated_at, users.updated_at AS other").
+		Joins("JOIN users ON users.id = books.author_id").
+		Where("books.is_published = ?", true).
+		Scan(&books).Error; err != nil {
+		return err
+	}
+	if err := db.Table("chapters").
+		Select("chapters.id, chapters.created_at, chapters.updated_at, chapters.render_version, chapters.is_premium, chapters.price_tokens, chapters.free_after_days, chapters.published_at, chapters.subscribers_only, chapters.early_access_until").
+		Joins("JOIN books ON books.id = chapters.book_id").
+		Where("books.is_published = ? AND chapters.is_published = ? AND chapters.is_private = ?", true, true, false).
+		Scan(&chapterRows).Error; err != nil {
+		return err
+	}
+	// Chapters not open to every reader are indexed by title only, so a
+	// chapter is reloaded when it opens
+	now := time.Now()
+	for i := range chapterRows {
+		chapter := &chapterRows[i]
+		chapters = append(chapters, stampRow{
+			ID:        chapter.ID,
+			UpdatedAt: chapter.UpdatedAt,
+			Version:   chapter.RenderVersion,
+			Locked:    !chapter.IsOpen(now),
+		})
+	}
+	if err := db.Table("users").
+		Select("id, updated_at").
+		Where("role IN (?, ?)", models.RoleAuthor, models.RoleAdmin).
+		Scan(&authors).Error; err != nil {
+		return err
+	}
+
+	changedBooks, stamps, removed := ix.diff(kindBook, books, nil, nil)
+	changedChapters, stamps, removed := ix.diff(kindChapter, chapters, stamps, removed)
+	changedAuthors, stamps, removed := ix.diff(kindAuthor, authors, stamps, removed)
+
+	var docs []*document
+	for _, ids := range batches(changedBooks) {
+		loaded, err := loadBooks(db, ids)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, loaded...)
+	}
+	for _, ids := range batches(changedChapters) {
+		loaded, err := loadChapters(db, ids)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, loaded...)
+	}
+	for _, ids := range batches(changedAuthors) {
+		loaded, err := loadAuthors(db, ids)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, loaded...)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, k := range removed {
+		ix.remove(k)
+	}
+	for _, doc := range docs {
+		doc.stamp = stamps[doc.key]
+		ix.put(doc)
+	}
+	ix.ready = true
+	return nil
+}
+
+// diff compares the rows of a kind with the index. It returns the IDs to
+// load, adds their versions to stamps and adds the documents to drop to
+// removed.
+func (ix *Index) diff(k kind, rows []stampRow, stamps map[key]string, removed []key) ([]uint, map[key]string, []key) {
+	if stamps == nil {
+		stamps = map[key]string{}
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var changed []uint
+	present := make(map[uint]bool, len(rows))
+	for _, row := range rows {
+		present[row.ID] = true
+		stamp := row.stamp()
+		if doc := ix.docs[key{k, row.ID}]; doc == nil || doc.stamp != stamp {
+			changed = append(changed, row.ID)
+			stamps[key{k, row.ID}] = stamp
+		}
+	}
+	for dk := range ix.docs {
+		if dk.kind == k && !present[dk.id] {
+			removed = append(removed, dk)
+		}
+	}
+	return changed, stamps, removed
+}
+
+// batches splits ids into slices of at most loadBatch
+func batches(ids []uint) [][]uint {
+	var out [][]uint
+	for i := 0; i < len(ids); i += loadBatch {
+		out = append(out, ids[i:min(i+loadBatch, len(ids))])
+	}
+	return out
+}
+
+func loadBooks(db *gorm.DB, ids []uint) ([]*document, error) {
+	var books []models.Book
+	if err := db.Preload("Author").Where("id IN ?", ids).Find(&books).Error; err != nil {
+		return nil, err
+	}
+	docs := make([]*document, 0, len(books))
+	for _, book := range books {
+		description := ""
+		if book.Description != nil {
+			description = *book.Description
+		}
+		docs = append(docs, &document{
+			key:       key{kindBook, book.ID},
+			fields:    [numFields]string{book.Title, book.Author.DisplayName, description},
+			genres:    book.GetGenres(),
+			completed: book.IsCompleted,
+			updatedAt: book.UpdatedAt,
+		})
+	}
+	return docs, nil
+}
+
+func loadChapters(db *gorm.DB, ids []uint) ([]*document, error) {
+	var chapters []models.Chapter
+	if err := db.Where("id IN ?", ids).Find(&chapters).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	docs := make([]*document, 0, len(chapters))
+	for i := range chapters {
+		chapter := &chapters[i]
+		// Chapters waiting for the render job are rendered here, unsaved
+		if chapter.RenderVersion != content.Version {
+			if err := chapter.Render(); err != nil {
+				log.Printf("[SEARCH] Failed to render chapter %d: %v", chapter.ID, err)
+				continue
+			}
+		}
+		text := content.PlainText(chapter.RenderedHTML)
+		if !chapter.IsOpen(now) {
+			text = ""
+		}
+		docs = append(docs, &document{
+			key:       key{kindChapter, chapter.ID},
+			fields:    [numFields]string{chapter.Title, text},
+			bookID:    chapter.BookID,
+			number:    chapter.ChapterNumber,
+			words:     int(chapter.WordCount),
+			updatedAt: chapter.UpdatedAt,
+		})
+	}
+	return docs, nil
+}
+
+func loadAuthors(db *gorm.DB, ids []uint) ([]*document, error) {
+	var users []models.User
+	if err := db.Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	docs := make([]*document, 0, len(users))
+	for _, user := range users {
+		bio := ""
+		if user.Bio != nil {
+			bio = *user.Bio
+		}
+		docs = append(docs, &document{
+			key:       key{kindAuthor, user.ID},
+			fields:    [numFields]string{user.DisplayName, bio, user.Username},
+			updatedAt: user.UpdatedAt,
+		})
+	}
+	return docs, nil
+}
@@ -0,0 +1,83 @@
+package search
+
+import "testing"
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "Hello, world!", want: []string{"hello", "world"}},
+		{text: "Don't stop", want: []string{"dont", "stop"}},
+		{text: "the authors' books", want: []string{"the", "authors", "books"}},
+		{text: "Café crème", want: []string{"cafe", "creme"}},
+		{text: "route 66", want: []string{"route", "66"}},
+		{text: "日本語", want: []string{"日", "本", "語"}},
+	}
+
+	for _, tt := range tests {
+		tokens := tokenize(tt.text)
+		if len(tokens) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.text, tokens, tt.want)
+			continue
+		}
+		for i, token := range tokens {
+			if token.Term != tt.want[i] {
+				t.Errorf("%q: got %v, want %v", tt.text, tokens, tt.want)
+				break
+			}
+		}
+	}
+
+	// Offsets point into the original text
+	text := "Ünïcode words"
+	for _, token := range tokenize(text) {
+		if normalize(text[token.Start:token.End]) != token.Term {
+			t.Errorf("token %q spans %q", token.Term, text[token.Start:token.End])
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		limit int
+		want  int
+	}{
+		{a: "dragon", b: "dragon", limit: 2, want: 0},
+		{a: "dragn", b: "dragon", limit: 2, want: 1},
+		{a: "drgaon", b: "dragon", limit: 2, want: 1},
+		{a: "dargon", b: "dragon", limit: 2, want: 1},
+		{a: "wagon", b: "dragon", limit: 2, want: 2},
+		{a: "dog", b: "dragon", limit: 2, want: 3},
+		{a: "salamander", b: "dragon", limit: 2, want: 3},
+	}
+
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b, tt.limit); got != tt.want {
+			t.Errorf("%s to %s: got %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	matched := map[string]bool{"dragon": true}
+	text := "One two three four five six seven eight nine ten eleven twelve <dragon> thirteen fourteen fifteen"
+
+	// Five words lead in to the match
+	got := snippet(text, matched, 6)
+	want := "…eight nine ten eleven twelve &lt;<mark>dragon</mark>&gt;…"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got = snippet(text, matched, 10)
+	want = "…eight nine ten eleven twelve &lt;<mark>dragon</mark>&gt; thirteen fourteen fifteen"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := snippet("no match here", matched, 2); got != "no match…" {
+		t.Errorf("without a match: got %q, want the opening words", got)
+	}
+}
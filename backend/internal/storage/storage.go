@@ -0,0 +1,84 @@
+// Package storage keeps uploaded files. Production uses an S3-compatible
+// object store; local development uses a directory on disk, or an
+// in-process fake S3 server to exercise the S3 client offline.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Default is the storage used by the handlers. It is set by Init.
+var Default Storage
+
+// ErrNotFound is returned when no object has the key
+var ErrNotFound = errors.New("object not found")
+
+// ErrInvalidKey is returned for keys that are empty or escape the store
+var ErrInvalidKey = errors.New("invalid object key")
+
+// Storage stores objects by key. Keys are slash-separated paths such as
+// "media/12/small.jpg".
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Init selects the storage from the STORAGE_DRIVER environment variable
+// ("local" by default, "s3" or "fake-s3") and stores it in Default
+func Init() error {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		Default = NewLocalStorage(dir)
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		s3 := &S3Storage{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    region,
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		}
+		if s3.Endpoint == "" || s3.Bucket == "" {
+			return errors.New("S3_ENDPOINT and S3_BUCKET are required for the s3 storage driver")
+		}
+		Default = s3
+	case "fake-s3":
+		// Objects live in memory and are lost on restart
+		s3, err := StartFakeS3()
+		if err != nil {
+			return fmt.Errorf("failed to start fake S3 server: %w", err)
+		}
+		log.Printf("[STORAGE] Fake S3 server listening on %s", s3.Endpoint)
+		Default = s3
+	default:
+		return fmt.Errorf("unknown storage driver %q", driver)
+	}
+	return nil
+}
+
+// cleanKey checks that a key is a relative path that stays inside the store
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	cleaned := path.Clean(key)
+	if cleaned != key || cleaned == "." || strings.HasPrefix(cleaned, "../") || cleaned == ".." {
+		return "", ErrInvalidKey
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{key: "media/12/small.jpg", ok: true},
+		{key: "file.txt", ok: true},
+		{key: "media/..hidden/x.jpg", ok: true},
+		{key: ""},
+		{key: "."},
+		{key: ".."},
+		{key: "../secret"},
+		{key: "media/../../secret"},
+		{key: "media/../other/x.jpg"},
+		{key: "/etc/passwd"},
+		{key: "media\\..\\..\\secret"},
+		{key: "media//12/small.jpg"},
+		{key: "media/./12/small.jpg"},
+		{key: "media/12/"},
+	}
+
+	for _, tt := range tests {
+		got, err := cleanKey(tt.key)
+		if tt.ok {
+			if err != nil || got != tt.key {
+				t.Errorf("cleanKey(%q) = %q, %v; want the key back", tt.key, got, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("cleanKey(%q) = %q, %v; want %v", tt.key, got, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestLocalStorageStaysInsideItsDirectory(t *testing.T) {
+	root := t.TempDir()
+	s := NewLocalStorage(filepath.Join(root, "store"))
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "../escaped.txt", []byte("x"), "text/plain"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Put: got error %v, want %v", err, ErrInvalidKey)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the store: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := s.Open(ctx, "../secret.txt"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Open: got error %v, want %v", err, ErrInvalidKey)
+	}
+	if err := s.Delete(ctx, "../secret.txt"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Delete: got error %v, want %v", err, ErrInvalidKey)
+	}
+
+	if err := s.Put(ctx, "media/1/small.jpg", []byte("image"), "image/jpeg"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, err := s.Open(ctx, "media/1/small.jpg")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer rc.Close()
+	if data, _ := io.ReadAll(rc); string(data) != "image" {
+		t.Errorf("got %q, want %q", data, "image")
+	}
+}
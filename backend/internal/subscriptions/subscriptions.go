@@ -0,0 +1,343 @@
+// Package subscriptions manages readers' paid subscriptions to authors.
+// Subscribing charges the tier's monthly price up front; the renewal job
+// charges that same price again at the end of each period, so a tier's new
+// price only applies to subscriptions started after the change. A renewal
+// the reader cannot afford leaves the subscription past due, with access,
+// for a grace period while the job retries, after which it lapses.
+package subscriptions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"fdip/internal/ledger"
+	"fdip/internal/mailer"
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxPriceTokens is the most a tier may charge a month
+const MaxPriceTokens = 10000
+
+// RetryInterval is how often a past due renewal is tried again
+const RetryInterval = 6 * time.Hour
+
+// renewBatch is how many due subscriptions the renewal job handles per run
+const renewBatch = 100
+
+var (
+	ErrTierNotFound      = errors.New("subscription tier not found")
+	ErrInvalidPrice      = errors.New("tiers must cost between 1 and 10000 tokens a month")
+	ErrOwnTier           = errors.New("you cannot subscribe to yourself")
+	ErrAlreadySubscribed = errors.New("you already subscribe to this author; cancel before changing tier")
+	ErrNotFound          = errors.New("subscription not found")
+	ErrNotActive         = errors.New("subscription is not active")
+)
+
+// ValidatePrice checks the monthly price of a tier
+func ValidatePrice(priceTokens int) error {
+	if priceTokens < 1 || priceTokens > MaxPriceTokens {
+		return ErrInvalidPrice
+	}
+	return nil
+}
+
+// nextPeriodEnd returns the end of the period that starts at start
+func nextPeriodEnd(start time.Time) time.Time {
+	return start.AddDate(0, 1, 0)
+}
+
+// Active returns userID's subscription to authorID, with its tier, if it
+// gives access at now, or nil
+func Active(db *gorm.DB, userID, authorID uint, now time.Time) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := db.Preload("Tier").Where("user_id = ? AND author_id = ?", userID, authorID).First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !subscription.HasAccess(now) {
+		return nil, nil
+	}
+	return &subscription, nil
+}
+
+// Opens reports whether a subscription, which may be nil, lets its reader
+// past a chapter's subscriber-only and early access limits at now
+func Opens(subscription *models.Subscription, chapter *models.Chapter, now time.Time) bool {
+	if !chapter.SubscribersOnly && !chapter.IsEarlyAccess(now) {
+		return true
+	}
+	if subscription == nil || !subscription.HasAccess(now) {
+		return false
+	}
+	return !chapter.IsEarlyAccess(now) || subscription.Tier.EarlyAccess
+}
+
+// Subscribe subscribes userID to a tier, charging its first month. It also
+// resumes a subscription cancelled at its period end without charging, and
+// settles a past due one. Subscribing again to the same tier while
+// subscribed changes nothing; charged reports whether tokens moved. It
+// returns ledger.ErrInsufficientFunds when the reader cannot afford the tier.
+func Subscribe(db *gorm.DB, userID, tierID uint, now time.Time) (subscription *models.Subscription, charged bool, err error) {
+	var tier models.SubscriptionTier
+	if err := db.Where("id = ? AND is_active = ?", tierID, true).First(&tier).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, ErrTierNotFound
+		}
+		return nil, false, err
+	}
+	if tier.AuthorID == userID {
+		return nil, false, ErrOwnTier
+	}
+
+	subscription = &models.Subscription{}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Make sure the row exists, then lock it, so concurrent requests and
+		// the renewal job take turns
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Subscription{
+			UserID:           userID,
+			AuthorID:         tier.AuthorID,
+			TierID:           tier.ID,
+			Status:           models.SubscriptionStatusLapsed,
+			CurrentPeriodEnd: now,
+			RenewAt:          now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND author_id = ?", userID, tier.AuthorID).
+			First(subscription).Error; err != nil {
+			return err
+		}
+
+		if subscription.HasAccess(now) {
+			if subscription.TierID != tier.ID {
+				return ErrAlreadySubscribed
+			}
+			if subscription.Status == models.SubscriptionStatusActive {
+				subscription.CancelAtPeriodEnd = false
+				return tx.Save(subscription).Error
+			}
+			// Past due: pay for the period that failed to renew
+			if err := charge(tx, subscription); err != nil {
+				return err
+			}
+			charged = true
+			advance(subscription, now)
+			subscription.CancelAtPeriodEnd = false
+			return tx.Save(subscription).Error
+		}
+
+		// A new subscription, or one that lapsed or was cancelled
+		subscription.TierID = tier.ID
+		subscription.PriceTokens = tier.PriceTokens
+		if err := charge(tx, subscription); err != nil {
+			return err
+		}
+		charged = true
+		subscription.Status = models.SubscriptionStatusActive
+		subscription.CurrentPeriodEnd = nextPeriodEnd(now)
+		subscription.RenewAt = subscription.CurrentPeriodEnd
+		subscription.GraceUntil = nil
+		subscription.CancelAtPeriodEnd = false
+		return tx.Save(subscription).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	subscription.Tier = tier
+	return subscription, charged, nil
+}
+
+// Cancel stops a subscription from renewing. An active subscription keeps
+// access until the end of its paid period; a past due one ends at once.
+func Cancel(db *gorm.DB, userID, subscriptionID uint) (*models.Subscription, error) {
+	var subscription models.Subscription
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ?", subscriptionID, userID).
+			First(&subscription).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		switch subscription.Status {
+		case models.SubscriptionStatusActive:
+			subscription.CancelAtPeriodEnd = true
+		case models.SubscriptionStatusPastDue:
+			subscription.Status = models.SubscriptionStatusCancelled
+			subscription.GraceUntil = nil
+		default:
+			return ErrNotActive
+		}
+		return tx.Save(&subscription).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// RenewDue renews the subscriptions whose period has ended, a batch at a
+// time. Subscriptions set to cancel, or on a retired tier, end instead.
+func RenewDue(ctx context.Context, db *gorm.DB) error {
+	now := time.Now()
+
+	var ids []uint
+	if err := db.Model(&models.Subscription{}).
+		Where("status IN ? AND renew_at <= ?", []models.SubscriptionStatus{models.SubscriptionStatusActive, models.SubscriptionStatusPastDue}, now).
+		Order("renew_at").Limit(renewBatch).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		notice, err := renew(db, id, now)
+		if err != nil {
+			log.Printf("[SUBSCRIPTIONS] Failed to renew subscription %d: %v", id, err)
+			continue
+		}
+		if notice != nil {
+			if err := mailer.Default.Send(*notice); err != nil {
+				log.Printf("[SUBSCRIPTIONS] Failed to email subscriber of subscription %d: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// renew settles one due subscription and returns the email to send its
+// reader, if any
+func renew(db *gorm.DB, id uint, now time.Time) (*mailer.Message, error) {
+	var notice *mailer.Message
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var subscription models.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Preload("Tier").Preload("Author").
+			First(&subscription, id).Error; err != nil {
+			return err
+		}
+		// Subscribe or Cancel may have settled it in the meantime
+		if subscription.RenewAt.After(now) ||
+			(subscription.Status != models.SubscriptionStatusActive && subscription.Status != models.SubscriptionStatusPastDue) {
+			return nil
+		}
+
+		if subscription.CancelAtPeriodEnd || !subscription.Tier.IsActive {
+			subscription.Status = models.SubscriptionStatusCancelled
+			subscription.GraceUntil = nil
+			return tx.Save(&subscription).Error
+		}
+
+		// Roll back a failed charge on its own, keeping the changes below
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			return charge(tx, &subscription)
+		})
+		switch {
+		case err == nil:
+			advance(&subscription, now)
+		case !errors.Is(err, ledger.ErrInsufficientFunds):
+			return err
+		case subscription.Status == models.SubscriptionStatusActive:
+			graceUntil := subscription.CurrentPeriodEnd.Add(models.SubscriptionGracePeriod)
+			subscription.Status = models.SubscriptionStatusPastDue
+			subscription.GraceUntil = &graceUntil
+			subscription.RenewAt = earliest(now.Add(RetryInterval), graceUntil)
+			notice = &mailer.Message{
+				Subject: fmt.Sprintf("Your subscription to %s could not be renewed", subscription.Author.DisplayName),
+				Body: fmt.Sprintf("Your %s subscription to %s costs %d tokens a month and your balance is too low to renew it. "+
+					"Add tokens by %s to keep your access.\n",
+					subscription.Tier.Name, subscription.Author.DisplayName, subscription.PriceTokens, graceUntil.Format("January 2, 2006")),
+			}
+		case subscription.GraceUntil == nil || !now.Before(*subscription.GraceUntil):
+			subscription.Status = models.SubscriptionStatusLapsed
+			subscription.GraceUntil = nil
+			notice = &mailer.Message{
+				Subject: fmt.Sprintf("Your subscription to %s has ended", subscription.Author.DisplayName),
+				Body: fmt.Sprintf("Your %s subscription to %s could not be renewed and has ended. You can subscribe again at any time.\n",
+					subscription.Tier.Name, subscription.Author.DisplayName),
+			}
+		default:
+			subscription.RenewAt = earliest(now.Add(RetryInterval), *subscription.GraceUntil)
+		}
+		if err := tx.Save(&subscription).Error; err != nil {
+			return err
+		}
+
+		if notice != nil {
+			var reader models.User
+			if err := tx.Select("email").First(&reader, subscription.UserID).Error; err != nil {
+				return err
+			}
+			notice.To = reader.Email
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notice, nil
+}
+
+// advance starts the next period of a subscription that has just been paid
+// for. Periods follow on from each other unless the subscription fell far
+// behind.
+func advance(subscription *models.Subscription, now time.Time) {
+	start := subscription.CurrentPeriodEnd
+	if end := nextPeriodEnd(start); !end.After(now) {
+		start = now
+	}
+	subscription.Status = models.SubscriptionStatusActive
+	subscription.CurrentPeriodEnd = nextPeriodEnd(start)
+	subscription.RenewAt = subscription.CurrentPeriodEnd
+	subscription.GraceUntil = nil
+}
+
+// charge moves a month's price from the reader to the author
+func charge(tx *gorm.DB, subscription *models.Subscription) error {
+	readerTransaction := models.TokenTransaction{
+		UserID:          subscription.UserID,
+		TransactionType: models.TransactionTypeSubscription,
+		Amount:          -subscription.PriceTokens, // Negative for debit
+		RecipientID:     &subscription.AuthorID,
+		SubscriptionID:  &subscription.ID,
+		Status:          models.TransactionStatusCompleted,
+	}
+	if err := tx.Create(&readerTransaction).Error; err != nil {
+		return err
+	}
+	authorTransaction := models.TokenTransaction{
+		UserID:          subscription.AuthorID,
+		TransactionType: models.TransactionTypeSubscription,
+		Amount:          subscription.PriceTokens, // Positive for credit
+		RecipientID:     &subscription.UserID,
+		SubscriptionID:  &subscription.ID,
+		Status:          models.TransactionStatusCompleted,
+	}
+	if err := tx.Create(&authorTransaction).Error; err != nil {
+		return err
+	}
+
+	entry := ledger.Transfer(models.JournalKindSubscription, ledger.User(subscription.UserID), ledger.User(subscription.AuthorID), subscription.PriceTokens, &readerTransaction.ID)
+	_, err := ledger.Post(tx, entry)
+	return err
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
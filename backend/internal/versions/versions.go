@@ -0,0 +1,110 @@
+// Package versions keeps the version history of published chapters and the
+// autosaved drafts of their editors.
+package versions
+
+import (
+	"errors"
+
+	"fdip/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrNoVersions = errors.New("chapter has no versions")
+
+// Record writes a version of the chapter's current title and content. It
+// does nothing when they match the latest version. It must be called inside
+// a database transaction: the chapter row is locked so concurrent saves get
+// distinct version numbers. authorID is empty for versions the system
+// writes, such as scheduled publishes.
+func Record(tx *gorm.DB, chapter *models.Chapter, authorID *uint, source models.VersionSource, restoredFrom *uint) (*models.ChapterVersion, error) {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		First(&models.Chapter{}, chapter.ID).Error; err != nil {
+		return nil, err
+	}
+
+	latest, err := Latest(tx, chapter.ID)
+	if err != nil && !errors.Is(err, ErrNoVersions) {
+		return nil, err
+	}
+	if latest != nil && source != models.VersionSourceRestore &&
+		latest.Title == chapter.Title && latest.Content == chapter.Content && latest.ContentType == chapter.ContentType {
+		return latest, nil
+	}
+
+	version := models.ChapterVersion{
+		ChapterID:     chapter.ID,
+		Title:         chapter.Title,
+		Content:       chapter.Content,
+		ContentType:   chapter.ContentType,
+		VersionNumber: 1,
+		WordCount:     chapter.WordCount,
+		Source:        source,
+		AuthorID:      authorID,
+		RestoredFrom:  restoredFrom,
+	}
+	if latest != nil {
+		version.VersionNumber = latest.VersionNumber + 1
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// Latest returns the newest version of a chapter
+func Latest(db *gorm.DB, chapterID uint) (*models.ChapterVersion, error) {
+	var version models.ChapterVersion
+	if err := db.Where("chapter_id = ?", chapterID).Order("version_number DESC").First(&version).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoVersions
+		}
+		return nil, err
+	}
+	return &version, nil
+}
+
+// Restore copies a version back into its chapter. A published chapter gets
+// a new version recording the restore, so history is never rewritten.
+// Versions written before titles were kept leave the title unchanged.
+func Restore(db *gorm.DB, chapter *models.Chapter, version *models.ChapterVersion, authorID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if version.Title != "" {
+			chapter.Title = version.Title
+		}
+		chapter.Content = version.Content
+		chapter.ContentType = version.ContentType
+		if err := chapter.Render(); err != nil {
+			return err
+		}
+
+		updates := chapter.RenderedColumns()
+		updates["title"] = chapter.Title
+		updates["content"] = chapter.Content
+		updates["content_type"] = chapter.ContentType
+		if err := tx.Model(chapter).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		if !chapter.IsPublished {
+			return nil
+		}
+		_, err := Record(tx, chapter, &authorID, models.VersionSourceRestore, &version.VersionNumber)
+		return err
+	})
+}
+
+// SaveDraft stores a user's autosaved edit of a chapter, replacing their
+// previous draft
+func SaveDraft(db *gorm.DB, draft *models.ChapterDraft) error {
+	return db.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"title", "content", "content_type", "updated_at"}),
+	}).Create(draft).Error
+}
+
+// DiscardDraft deletes a user's draft of a chapter
+func DiscardDraft(db *gorm.DB, chapterID, userID uint) error {
+	return db.Where("chapter_id = ? AND user_id = ?", chapterID, userID).Delete(&models.ChapterDraft{}).Error
+}
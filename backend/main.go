@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"time"
 
 	"fdip/internal/auth"
 	"fdip/internal/database"
 	"fdip/internal/handlers"
+	"fdip/internal/jobs"
+	"fdip/internal/ledger"
+	"fdip/internal/mailer"
+	"fdip/internal/manuscript"
+	"fdip/internal/media"
+	"fdip/internal/membership"
 	"fdip/internal/middleware"
 	"fdip/internal/models"
+	"fdip/internal/oidc"
+	"fdip/internal/payments"
+	"fdip/internal/payout"
+	"fdip/internal/permissions"
+	"fdip/internal/publishing"
+	"fdip/internal/search"
+	"fdip/internal/storage"
+	"fdip/internal/subscriptions"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"github.com/stripe/stripe-go/v76"
 )
 
 func main() {
@@ -21,8 +36,28 @@ func main() {
 		log.Println("No .env file found, using environment variables")
 	}
 
-	// Set Stripe API key
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	// Initialize payment provider
+	if err := payments.Init(); err != nil {
+		log.Fatal("Failed to initialize payment provider:", err)
+	}
+
+	// Initialize mailer
+	if err := mailer.Init(); err != nil {
+		log.Fatal("Failed to initialize mailer:", err)
+	}
+
+	// Initialize file storage and media URLs
+	if err := storage.Init(); err != nil {
+		log.Fatal("Failed to initialize storage:", err)
+	}
+	if err := media.Init(); err != nil {
+		log.Fatal("Failed to initialize media:", err)
+	}
+
+	// Initialize external sign-in providers
+	if err := oidc.Init(); err != nil {
+		log.Fatal("Failed to initialize sign-in providers:", err)
+	}
 
 	// Initialize JWT
 	if err := auth.InitJWT(); err != nil {
@@ -41,11 +76,46 @@ func main() {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
+	// Backfill the token ledger for databases that predate it
+	if err := ledger.Bootstrap(database.DB); err != nil {
+		log.Fatal("Failed to bootstrap token ledger:", err)
+	}
+	if err := ledger.BackfillBuckets(database.DB); err != nil {
+		log.Fatal("Failed to backfill token buckets:", err)
+	}
+
+	// Publish the initial payout tiers on first start
+	if err := payout.EnsureDefault(database.DB); err != nil {
+		log.Fatal("Failed to create default payout rules:", err)
+	}
+
+	// Create the system roles and their default permissions
+	if err := permissions.EnsureDefaults(database.DB); err != nil {
+		log.Fatal("Failed to create default roles:", err)
+	}
+
+	// Give books created before collaborators their owner
+	if err := membership.EnsureOwners(database.DB); err != nil {
+		log.Fatal("Failed to add book owners:", err)
+	}
+
 	// Seed initial data
 	if err := database.SeedData(); err != nil {
 		log.Fatal("Failed to seed data:", err)
 	}
 
+	// Run background jobs
+	jobs.Start(context.Background(), database.DB,
+		jobs.Job{Name: "publish-scheduled", Interval: 30 * time.Second, Run: publishing.PublishDue},
+		jobs.Job{Name: "render-chapters", Interval: time.Minute, Run: models.RenderStaleChapters},
+		jobs.Job{Name: "expire-imports", Interval: time.Hour, Run: manuscript.DeleteExpired},
+		jobs.Job{Name: "renew-subscriptions", Interval: 5 * time.Minute, Run: subscriptions.RenewDue},
+		jobs.Job{Name: "expire-tokens", Interval: 10 * time.Minute, Run: ledger.ExpireDue},
+	)
+
+	// Build the search index and keep it in step with the database
+	search.Start(context.Background(), database.DB)
+
 	// Set Gin mode
 	if os.Getenv("ENV") == "production" {
 		gin.SetMode(gin.ReleaseMode)
@@ -54,6 +124,12 @@ func main() {
 	// Create router
 	r := gin.Default()
 
+	// Only trust forwarded client IPs from known proxies, as rate limits,
+	// login lockouts and fraud checks are keyed on the client IP
+	if err := r.SetTrustedProxies(middleware.TrustedProxiesFromEnv()); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
@@ -71,50 +147,129 @@ func main() {
 		c.Next()
 	})
 
+	// Rate limiting. Limits can be overridden per policy, e.g.
+	// RATE_LIMIT_AUTH=20/1m
+	limits := middleware.NewMemoryRateLimitStore()
+	middleware.Logins = middleware.NewLoginGuard(limits)
+	uploads := rateLimit(limits, "upload", 60, time.Hour, middleware.RateLimitByUser)
+
 	// API routes
 	api := r.Group("/api")
 	{
 		// Authentication routes (public)
 		auth := api.Group("/auth")
+		auth.Use(rateLimit(limits, "auth", 20, time.Minute, middleware.RateLimitByIP))
 		{
 			auth.POST("/register", handlers.Register)
 			auth.POST("/login", handlers.Login)
+			auth.POST("/refresh", handlers.RefreshSession)
+			auth.POST("/logout", middleware.AuthMiddleware(), handlers.Logout)
+			auth.POST("/logout-all", middleware.AuthMiddleware(), handlers.LogoutAll)
+			auth.POST("/verify-email", handlers.VerifyEmail)
+			auth.POST("/resend-verification", middleware.AuthMiddleware(), handlers.ResendVerification)
+			auth.POST("/forgot-password", handlers.ForgotPassword)
+			auth.POST("/reset-password", handlers.ResetPassword)
+			auth.POST("/login/2fa", handlers.LoginTwoFactor)
+			auth.GET("/oidc/providers", handlers.GetOIDCProviders)
+			auth.POST("/oidc/:provider/start", handlers.StartOIDCLogin)
+			auth.POST("/oidc/callback", middleware.OptionalAuthMiddleware(), handlers.CompleteOIDCLogin)
 		}
 
 		// Protected routes
 		protected := api.Group("")
-		protected.Use(middleware.AuthMiddleware())
+		protected.Use(middleware.AuthMiddleware(), rateLimit(limits, "user", 300, time.Minute, middleware.RateLimitByUser))
 		{
 			// User profile
 			protected.GET("/profile", handlers.GetProfile)
 			protected.PUT("/profile", handlers.UpdateProfile)
+			protected.PUT("/profile/avatar", uploads, handlers.UploadAvatar)
 			protected.POST("/profile/promote", handlers.SelfPromoteToAuthor)
 
+			// Two-factor authentication
+			protected.POST("/profile/2fa/setup", handlers.SetupTwoFactor)
+			protected.POST("/profile/2fa/enable", handlers.EnableTwoFactor)
+			protected.POST("/profile/2fa/disable", handlers.DisableTwoFactor)
+			protected.POST("/profile/2fa/recovery-codes", handlers.RegenerateRecoveryCodes)
+
+			// Linked sign-in providers
+			protected.GET("/profile/identities", handlers.GetIdentities)
+			protected.POST("/profile/identities/:provider", handlers.StartOIDCLink)
+			protected.DELETE("/profile/identities/:id", handlers.UnlinkIdentity)
+
 			// User's own books routes (protected)
 			protected.GET("/my-books", handlers.GetBooks)
 			protected.GET("/my-books/:id", handlers.GetBook)
-			protected.PUT("/my-books/:id", middleware.RequireAuthorOrAdmin(), handlers.UpdateBook)
+			protected.PUT("/my-books/:id", handlers.UpdateBook)
 
-			// Books routes (protected - for authors/admins)
+			// Render content as readers will see it
+			protected.POST("/content/preview", handlers.PreviewContent)
+
+			// Upcoming scheduled releases of the user's books
+			protected.GET("/calendar", handlers.GetReleaseCalendar)
+
+			// Manuscript imports: upload, review the chapters found, then
+			// commit to create a draft book
+			imports := protected.Group("/imports")
+			{
+				imports.POST("", middleware.RequirePermission(models.PermBooksWrite), rateLimit(limits, "import", 20, time.Hour, middleware.RateLimitByUser), handlers.ImportManuscript)
+				imports.GET("/:id", handlers.GetManuscriptImport)
+				imports.POST("/:id/commit", middleware.RequirePermission(models.PermBooksWrite), handlers.CommitManuscriptImport)
+				imports.DELETE("/:id", handlers.DiscardManuscriptImport)
+			}
+
+			// Invitations to work on other users' books
+			protected.GET("/invitations", handlers.GetMyInvitations)
+			protected.POST("/invitations/:id/accept", handlers.AcceptBookInvitation)
+			protected.POST("/invitations/:id/decline", handlers.DeclineBookInvitation)
+
+			// Books routes (protected). Editing is checked against the user's
+			// role on the book.
 			books := protected.Group("/books")
 			{
-				books.POST("", middleware.RequireAuthorOrAdmin(), handlers.CreateBook)
-				books.PUT("/:id", middleware.RequireAuthorOrAdmin(), handlers.UpdateBook)
-				books.DELETE("/:id", middleware.RequireAuthorOrAdmin(), handlers.DeleteBook)
+				books.POST("", middleware.RequirePermission(models.PermBooksWrite), handlers.CreateBook)
+				books.PUT("/:id", handlers.UpdateBook)
+				books.PUT("/:id/cover", uploads, handlers.UploadBookCover)
+				books.DELETE("/:id", handlers.DeleteBook)
+				books.PUT("/:id/schedule", handlers.ScheduleBook)
+				books.DELETE("/:id/schedule", handlers.UnscheduleBook)
+
+				// Collaborators
+				books.GET("/:id/members", handlers.GetBookMembers)
+				books.PUT("/:id/members/:userId", handlers.UpdateBookMember)
+				books.DELETE("/:id/members/:userId", handlers.RemoveBookMember)
+				books.POST("/:id/invitations", handlers.InviteBookMember)
+				books.DELETE("/:id/invitations/:invitationId", handlers.RevokeBookInvitation)
+				books.PUT("/:id/revenue-shares", handlers.UpdateRevenueShares)
 
 				// Chapters routes
 				chapters := books.Group("/:id/chapters")
 				{
 					chapters.GET("", handlers.GetChapters)
-					chapters.POST("", middleware.RequireAuthorOrAdmin(), handlers.CreateChapter)
+					chapters.POST("", handlers.CreateChapter)
 				}
 			}
 
-			// Chapter management routes (protected - for authors/admins)
+			// Chapter management routes (protected - for book members and moderators)
 			chapters := protected.Group("/chapters")
 			{
-				chapters.PUT("/:id", middleware.RequireAuthorOrAdmin(), handlers.UpdateChapter)
-				chapters.DELETE("/:id", middleware.RequireAuthorOrAdmin(), handlers.DeleteChapter)
+				chapters.GET("/:id", handlers.GetChapter)
+				chapters.PUT("/:id", handlers.UpdateChapter)
+				chapters.PUT("/:id/image", uploads, handlers.UploadChapterImage)
+				chapters.DELETE("/:id", handlers.DeleteChapter)
+				chapters.PUT("/:id/schedule", handlers.ScheduleChapter)
+				chapters.DELETE("/:id/schedule", handlers.UnscheduleChapter)
+
+				// Version history and autosaved drafts
+				chapters.GET("/:id/versions", handlers.GetChapterVersions)
+				chapters.GET("/:id/versions/diff", handlers.DiffChapterVersions)
+				chapters.GET("/:id/versions/:version", handlers.GetChapterVersion)
+				chapters.POST("/:id/versions/:version/restore", handlers.RestoreChapterVersion)
+				chapters.GET("/:id/draft", handlers.GetChapterDraft)
+				chapters.PUT("/:id/draft", handlers.SaveChapterDraft)
+				chapters.DELETE("/:id/draft", handlers.DeleteChapterDraft)
+
+				// Premium chapters
+				chapters.POST("/:id/unlock", rateLimit(limits, "unlock", 30, time.Minute, middleware.RateLimitByUser), handlers.UnlockChapter)
 			}
 
 			// Token routes
@@ -122,9 +277,35 @@ func main() {
 			{
 				tokens.GET("/balance", handlers.GetTokenBalance)
 				tokens.GET("/transactions", handlers.GetTokenTransactions)
-				tokens.POST("/purchase", handlers.PurchaseTokens)
-				tokens.POST("/tip", handlers.TipAuthor)
-				tokens.POST("/cashout", middleware.RequireAuthorOrAdmin(), handlers.CashoutTokens)
+				tokens.GET("/bundles", handlers.GetTokenBundles)
+				tokens.POST("/quote", rateLimit(limits, "quote", 30, time.Minute, middleware.RateLimitByUser), handlers.QuotePurchase)
+				tokens.POST("/purchase", rateLimit(limits, "purchase", 10, time.Hour, middleware.RateLimitByUser), handlers.PurchaseTokens)
+				tokens.POST("/tip", rateLimit(limits, "tip", 10, time.Minute, middleware.RateLimitByUser), handlers.TipAuthor)
+				tokens.POST("/cashout", middleware.RequirePermission(models.PermPayoutsReceive), twoFactorIf("REQUIRE_2FA_CASHOUT"), rateLimit(limits, "cashout", 5, time.Hour, middleware.RateLimitByUser), handlers.CashoutTokens)
+			}
+
+			// Payout account routes (protected - for authors)
+			payouts := protected.Group("/payouts")
+			payouts.Use(middleware.RequirePermission(models.PermPayoutsReceive))
+			{
+				payouts.GET("/account", handlers.GetPayoutAccount)
+				payouts.POST("/onboarding", handlers.StartPayoutOnboarding)
+				payouts.GET("/tier", handlers.GetPayoutTier)
+			}
+
+			// Subscriptions to authors
+			protected.GET("/subscriptions", handlers.GetMySubscriptions)
+			protected.POST("/subscriptions", rateLimit(limits, "subscribe", 10, time.Minute, middleware.RateLimitByUser), handlers.Subscribe)
+			protected.DELETE("/subscriptions/:id", handlers.CancelSubscription)
+
+			// Authors' subscription tiers
+			tiers := protected.Group("/subscription-tiers")
+			tiers.Use(middleware.RequirePermission(models.PermBooksWrite))
+			{
+				tiers.GET("", handlers.GetMySubscriptionTiers)
+				tiers.POST("", handlers.CreateSubscriptionTier)
+				tiers.PUT("/:id", handlers.UpdateSubscriptionTier)
+				tiers.DELETE("/:id", handlers.RetireSubscriptionTier)
 			}
 
 			// Following routes
@@ -135,25 +316,70 @@ func main() {
 				following.DELETE("/:authorId", handlers.UnfollowAuthor)
 			}
 
-			// Admin routes
+			// Staff routes, each guarded by its own permission
 			admin := protected.Group("/admin")
-			admin.Use(middleware.RequireRole(models.RoleAdmin))
+			admin.Use(twoFactorIf("REQUIRE_2FA_ADMIN"))
 			{
-				admin.POST("/users/:id/promote", handlers.PromoteToAuthor)
+				admin.POST("/users/:id/promote", middleware.RequirePermission(models.PermUsersPromote), handlers.PromoteToAuthor)
+				admin.POST("/ledger/rebuild", middleware.RequirePermission(models.PermLedgerRebuild), handlers.RebuildTokenBalances)
+				admin.GET("/webhooks", middleware.RequirePermission(models.PermWebhooksManage), handlers.GetWebhookEvents)
+				admin.POST("/webhooks/:id/replay", middleware.RequirePermission(models.PermWebhooksManage), handlers.ReplayWebhookEvent)
+				admin.POST("/payouts/:id/retry", middleware.RequirePermission(models.PermPayoutsApprove), handlers.RetryPayout)
+				admin.GET("/cashout-reviews", middleware.RequirePermission(models.PermPayoutsApprove), handlers.GetCashoutReviews)
+				admin.POST("/cashout-reviews/:id/approve", middleware.RequirePermission(models.PermPayoutsApprove), handlers.ApproveCashoutReview)
+				admin.POST("/cashout-reviews/:id/reject", middleware.RequirePermission(models.PermPayoutsApprove), handlers.RejectCashoutReview)
+				admin.GET("/users/:id/risk", middleware.RequirePermission(models.PermUsersReview), handlers.GetRiskAssessments)
+				admin.POST("/transactions/:id/refund", middleware.RequirePermission(models.PermRefundsIssue), handlers.RefundPurchase)
+				admin.GET("/disputes", middleware.RequirePermission(models.PermDisputesView), handlers.GetDisputes)
+				admin.POST("/users/:id/unflag", middleware.RequirePermission(models.PermUsersReview), handlers.UnflagUser)
+				admin.GET("/payout-rules", middleware.RequirePermission(models.PermPayoutsManage), handlers.GetPayoutRules)
+				admin.POST("/payout-rules", middleware.RequirePermission(models.PermPayoutsManage), handlers.CreatePayoutRules)
+				admin.POST("/payout-rules/:version/activate", middleware.RequirePermission(models.PermPayoutsManage), handlers.ActivatePayoutRules)
+				admin.GET("/users/:id/payout-overrides", middleware.RequirePermission(models.PermPayoutsManage), handlers.GetPayoutOverrides)
+				admin.PUT("/users/:id/payout-override", middleware.RequirePermission(models.PermPayoutsManage), handlers.SetPayoutOverride)
+				admin.DELETE("/users/:id/payout-override", middleware.RequirePermission(models.PermPayoutsManage), handlers.RemovePayoutOverride)
+
+				// Token pricing
+				admin.GET("/token-bundles", middleware.RequirePermission(models.PermPricingManage), handlers.GetAdminTokenBundles)
+				admin.POST("/token-bundles", middleware.RequirePermission(models.PermPricingManage), handlers.CreateTokenBundle)
+				admin.PUT("/token-bundles/:id", middleware.RequirePermission(models.PermPricingManage), handlers.UpdateTokenBundle)
+				admin.GET("/promotions", middleware.RequirePermission(models.PermPricingManage), handlers.GetPromotions)
+				admin.POST("/promotions", middleware.RequirePermission(models.PermPricingManage), handlers.CreatePromotion)
+				admin.PUT("/promotions/:id", middleware.RequirePermission(models.PermPricingManage), handlers.UpdatePromotion)
+				admin.GET("/promo-codes", middleware.RequirePermission(models.PermPricingManage), handlers.GetPromoCodes)
+				admin.POST("/promo-codes", middleware.RequirePermission(models.PermPricingManage), handlers.CreatePromoCode)
+				admin.PUT("/promo-codes/:id", middleware.RequirePermission(models.PermPricingManage), handlers.UpdatePromoCode)
+
+				// Roles and permissions
+				admin.GET("/permissions", middleware.RequirePermission(models.PermRolesManage), handlers.GetPermissions)
+				admin.GET("/roles", middleware.RequirePermission(models.PermRolesManage), handlers.GetRoles)
+				admin.POST("/roles", middleware.RequirePermission(models.PermRolesManage), handlers.CreateRole)
+				admin.DELETE("/roles/:name", middleware.RequirePermission(models.PermRolesManage), handlers.DeleteRole)
+				admin.POST("/roles/:name/permissions", middleware.RequirePermission(models.PermRolesManage), handlers.GrantRolePermission)
+				admin.DELETE("/roles/:name/permissions/:permission", middleware.RequirePermission(models.PermRolesManage), handlers.RevokeRolePermission)
+				admin.PUT("/users/:id/role", middleware.RequirePermission(models.PermRolesManage), handlers.AssignUserRole)
+				admin.GET("/permission-audit", middleware.RequirePermission(models.PermAuditView), handlers.GetPermissionAudit)
 			}
 		}
 
 		// Public routes (with optional auth)
 		public := api.Group("")
-		public.Use(middleware.OptionalAuthMiddleware())
+		public.Use(middleware.OptionalAuthMiddleware(), rateLimit(limits, "public", 120, time.Minute, middleware.RateLimitByIP))
 		{
 			public.GET("/books", handlers.GetPublicBooks)
 			public.GET("/books/:id", handlers.GetPublicBook)
+			public.GET("/books/:id/epub", rateLimit(limits, "download", 30, time.Hour, middleware.RateLimitByIP), handlers.DownloadBookEPUB)
 			public.GET("/chapters/:id", handlers.GetPublicChapter)
 			public.GET("/authors", handlers.GetAuthors)
+			public.GET("/search", handlers.Search)
 			public.GET("/authors/:id", handlers.GetAuthor)
+			public.GET("/authors/:id/tiers", handlers.GetAuthorTiers)
 		}
 
+		// Uploaded images, fetched by browsers without credentials. Private
+		// images are checked against their URL signature.
+		api.GET("/media/:id/:variant", handlers.ServeMedia)
+
 		// Stripe webhook (no auth)
 		api.POST("/stripe/webhook", handlers.HandleStripeWebhook)
 	}
@@ -174,3 +400,23 @@ func main() {
 		log.Fatal("Failed to start server:", err)
 	}
 }
+
+// twoFactorIf returns the two-factor middleware when the given environment
+// variable is "true" and a pass-through handler otherwise
+func twoFactorIf(envVar string) gin.HandlerFunc {
+	if os.Getenv(envVar) == "true" {
+		return middleware.RequireTwoFactor()
+	}
+	return func(c *gin.Context) { c.Next() }
+}
+
+// rateLimit returns the rate limiting middleware for the named policy, with
+// the given default of limit requests per window
+func rateLimit(store middleware.RateLimitStore, name string, limit int, window time.Duration, key middleware.RateLimitKey) gin.HandlerFunc {
+	return middleware.RateLimit(store, middleware.RateLimitPolicyFromEnv(middleware.RateLimitPolicy{
+		Name:   name,
+		Limit:  limit,
+		Window: window,
+		Key:    key,
+	}))
+}